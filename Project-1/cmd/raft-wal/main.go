@@ -0,0 +1,89 @@
+// Command raft-wal checks and repairs a node's write-ahead log offline, with
+// the node stopped.
+//
+// Usage:
+//
+//	raft-wal verify DIR
+//	raft-wal repair [-discard] DIR
+//
+// DIR is the wal directory inside a raftd data_dir. verify lists every segment
+// and exits with status 1 if the log is corrupt somewhere other than a torn
+// final record (which raftd truncates by itself on startup). repair truncates
+// a torn tail; with -discard it also cuts the log at the first corrupt record,
+// throwing away everything after it. Only do that if the rest of the cluster
+// still has those entries.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	raft "RaftLogReplication"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: raft-wal verify DIR\n       raft-wal repair [-discard] DIR")
+	os.Exit(2)
+}
+
+func printReport(report *raft.WALReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tFIRST INDEX\tRECORDS\tSIZE\tSTATUS")
+	for _, segment := range report.Segments {
+		status := "ok"
+		if segment.Stale {
+			status = "left by an interrupted truncation"
+		} else if segment.Torn {
+			status = fmt.Sprintf("torn tail at offset %d: %v", segment.ValidSize, segment.Err)
+		} else if segment.Err != nil {
+			status = fmt.Sprintf("CORRUPT at offset %d: %v", segment.ValidSize, segment.Err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", segment.Name, segment.FirstIndex, segment.Records, segment.Size, status)
+	}
+	w.Flush()
+	fmt.Printf("%d readable entries\n", report.Entries)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	discard := flags.Bool("discard", false, "repair: cut the log at the first corrupt record, losing the entries after it")
+	flags.Usage = usage
+	flags.Parse(os.Args[2:])
+	if flags.NArg() != 1 {
+		usage()
+	}
+	dir := flags.Arg(0)
+
+	var report *raft.WALReport
+	var err error
+	switch os.Args[1] {
+	case "verify":
+		report, err = raft.VerifyWAL(dir)
+		if err == nil {
+			err = report.Err
+		}
+	case "repair":
+		report, err = raft.RepairWAL(dir, *discard)
+		if err != nil && report != nil && report.Err == err {
+			err = fmt.Errorf("%v\nrefusing to drop the entries after it without -discard", err)
+		}
+	default:
+		usage()
+	}
+
+	if report != nil {
+		printReport(report)
+	}
+	if err == nil && os.Args[1] == "repair" {
+		fmt.Println("repaired")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "raft-wal:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,395 @@
+// Command raftctl administers a cluster of raftd nodes through their
+// "RaftAdmin" RPC service.
+//
+// Usage:
+//
+//	raftctl [-config raftd.json] status
+//	raftctl [-config raftd.json] submit get|put|append|delete KEY [VALUE]
+//	raftctl [-config raftd.json] watch [-prefix] KEY [REVISION]
+//	raftctl [-config raftd.json] transfer-leader ID
+//	raftctl [-config raftd.json] add-member ID ADDR
+//	raftctl [-config raftd.json] remove-member ID
+//	raftctl [-config raftd.json] snapshot ID
+//
+// The config is any node's raftd config file; raftctl only reads the node
+// addresses from it (its listen address and its peers). submit,
+// transfer-leader, add-member and remove-member go to the current leader,
+// and snapshot to node ID; watch asks any node, and carries on with another
+// if it goes away. They are about the default Raft group unless -group names
+// another one the nodes host.
+//
+// Each request to a node fails after -timeout, so that a node that accepts
+// connections but never answers doesn't hang raftctl; status reports it as
+// that node's error. The default leaves room for the nodes' own
+// raft.AdminTimeout, and the long poll of watch.
+//
+// add-member makes node ID, started with "join" in its config and listening
+// at ADDR, a member. remove-member takes node ID out, first handing
+// leadership to another member if ID is the leader; ID can be stopped once it
+// returns. Both wait until the change is committed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	raft "RaftLogReplication"
+)
+
+const dialTimeout = 2 * time.Second
+
+// defaultTimeout bounds each request to a node, unless -timeout says otherwise.
+const defaultTimeout = raft.AdminTimeout + 5*time.Second
+
+type config struct {
+	Id     int               `json:"id"`
+	Listen string            `json:"listen"`
+	Peers  map[string]string `json:"peers"` // Keyed by node id
+}
+
+// loadAddrs returns the address of every node in the cluster, keyed by id.
+func loadAddrs(path string) map[int]string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatalf("%s: %v", path, err)
+	}
+
+	addrs := map[int]string{cfg.Id: cfg.Listen}
+	for idStr, addr := range cfg.Peers {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			log.Fatalf("%s: bad peer id %q", path, idStr)
+		}
+		addrs[id] = addr
+	}
+	return addrs
+}
+
+type admin struct {
+	addrs   map[int]string
+	group   int
+	timeout time.Duration // Per request, from dialling to the reply
+}
+
+func (this *admin) ids() []int {
+	ids := make([]int, 0, len(this.addrs))
+	for id := range this.addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (this *admin) call(id int, method string, args interface{}, reply interface{}) error {
+	addr, ok := this.addrs[id]
+	if !ok {
+		return fmt.Errorf("no node %d in the config", id)
+	}
+	deadline := time.Now().Add(this.timeout)
+	conn, err := net.DialTimeout("tcp", addr, min(dialTimeout, this.timeout))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	err = client.Call("RaftAdmin."+method, args, reply)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("no reply from node %d within %v", id, this.timeout)
+	}
+	return err
+}
+
+// statuses asks every node for its status; unreachable nodes map to an error.
+func (this *admin) statuses() (map[int]raft.NodeStatus, map[int]error) {
+	statuses := make(map[int]raft.NodeStatus)
+	errs := make(map[int]error)
+	for _, id := range this.ids() {
+		var status raft.NodeStatus
+		if err := this.call(id, "Status", raft.AdminStatusArgs{Group: this.group}, &status); err != nil {
+			errs[id] = err
+		} else {
+			statuses[id] = status
+		}
+	}
+	return statuses, errs
+}
+
+// leader returns the leader of the highest term any node knows of.
+func (this *admin) leader() int {
+	leader, _ := this.findLeader()
+	if leader < 0 {
+		log.Fatal("no leader found")
+	}
+	return leader
+}
+
+// findLeader returns the leader, and its status; -1 if there's none.
+func (this *admin) findLeader() (int, raft.NodeStatus) {
+	statuses, _ := this.statuses()
+	leader := raft.NodeStatus{Id: -1, Term: -1}
+	for _, status := range statuses {
+		if status.State == "Leader" && status.Term > leader.Term {
+			leader = status
+		}
+	}
+	return leader.Id, leader
+}
+
+// removeMember takes id out of the members. The leader can't remove itself,
+// so if that's id, it first hands leadership to another member.
+func (this *admin) removeMember(id int) error {
+	leader, status := this.findLeader()
+	if leader < 0 {
+		return fmt.Errorf("no leader found")
+	}
+	if leader == id {
+		target := -1
+		for _, member := range status.Members {
+			if member != id {
+				target = member
+				break
+			}
+		}
+		if target < 0 {
+			return fmt.Errorf("node %d is the only member", id)
+		}
+		if err := this.call(leader, "TransferLeadership", raft.AdminTransferArgs{Group: this.group, Target: target}, &raft.AdminReply{}); err != nil {
+			return err
+		}
+		for deadline := time.Now().Add(raft.AdminTimeout); leader == id || leader < 0; leader, _ = this.findLeader() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("no leader found after handing over leadership")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return this.call(leader, "RemoveMember", raft.AdminMemberArgs{Group: this.group, Id: id}, &raft.AdminReply{})
+}
+
+func (this *admin) status() {
+	statuses, errs := this.statuses()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTERM\tSTATE\tVOTED\tLEADER\tCOMMIT\tAPPLIED\tLOG\tHEARTBEAT\tPEERS (next/match, last contact)")
+	for _, id := range this.ids() {
+		if err, failed := errs[id]; failed {
+			fmt.Fprintf(w, "%d\t-\tunreachable (%v)\t\t\t\t\t\t\t\n", id, err)
+			continue
+		}
+		status := statuses[id]
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", id, status.Term, status.State,
+			optionalId(status.VotedFor), optionalId(status.Leader), status.CommitIndex, status.LastApplied,
+			formatLog(status), formatAgo(status.SinceHeartbeat), formatPeers(status.Peers))
+	}
+	w.Flush()
+}
+
+func optionalId(id int) string {
+	if id < 0 {
+		return "-"
+	}
+	return strconv.Itoa(id)
+}
+
+// formatLog shows the range of log indexes and the last entry's term, and
+// the last index the snapshot covers.
+func formatLog(status raft.NodeStatus) string {
+	var log string
+	switch {
+	case status.FirstLogIndex >= 0:
+		log = fmt.Sprintf("%d..%d (term %d)", status.FirstLogIndex, status.LastLogIndex, status.LastLogTerm)
+	case status.LastLogIndex >= 0:
+		log = fmt.Sprintf("empty (term %d)", status.LastLogTerm)
+	default:
+		return "empty"
+	}
+	if status.Snapshot.LastIncludedIndex >= 0 {
+		log += fmt.Sprintf(", snapshot ..%d", status.Snapshot.LastIncludedIndex)
+	}
+	return log
+}
+
+func formatAgo(d time.Duration) string {
+	if d == 0 {
+		return "never"
+	}
+	return d.Round(time.Millisecond).String() + " ago"
+}
+
+func formatPeers(peers map[int]raft.PeerStatus) string {
+	if peers == nil {
+		return "-"
+	}
+	peerIds := make([]int, 0, len(peers))
+	for peerId := range peers {
+		peerIds = append(peerIds, peerId)
+	}
+	sort.Ints(peerIds)
+	parts := make([]string, len(peerIds))
+	for i, peerId := range peerIds {
+		peer := peers[peerId]
+		contact := "never"
+		if !peer.LastContact.IsZero() {
+			contact = time.Since(peer.LastContact).Round(time.Millisecond).String()
+		}
+		parts[i] = fmt.Sprintf("%d:%d/%d,%s", peerId, peer.NextIndex, peer.MatchIndex, contact)
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseKVCommand(args []string) raft.KVCommand {
+	if len(args) < 2 {
+		usage()
+	}
+	var cmd raft.KVCommand
+	switch strings.ToLower(args[0]) {
+	case "get":
+		cmd = raft.KVCommand{Op: raft.KVGet, Key: args[1]}
+	case "delete":
+		cmd = raft.KVCommand{Op: raft.KVDelete, Key: args[1]}
+	case "put", "append":
+		if len(args) != 3 {
+			usage()
+		}
+		cmd = raft.KVCommand{Op: raft.KVPut, Key: args[1], Value: args[2]}
+		if strings.ToLower(args[0]) == "append" {
+			cmd.Op = raft.KVAppend
+		}
+	default:
+		usage()
+	}
+	return cmd
+}
+
+// watch prints the changes to key, or to the keys under it if prefix, from
+// revision from on, as they're applied. It asks the nodes in turn, moving on
+// to the next one, from where it got to, whenever one can't be reached.
+func (this *admin) watch(key string, prefix bool, from int) error {
+	ids := this.ids()
+	for i := 0; ; {
+		var reply raft.AdminWatchReply
+		err := this.call(ids[i%len(ids)], "Watch", raft.AdminWatchArgs{Group: this.group, Key: key, Prefix: prefix, From: from}, &reply)
+		if err != nil {
+			log.Printf("node %d: %v", ids[i%len(ids)], err)
+			i++
+			time.Sleep(time.Second)
+			continue
+		}
+		if reply.Compacted {
+			return fmt.Errorf("revision %d: %w", from, raft.ErrCompacted)
+		}
+		for _, event := range reply.Events {
+			fmt.Printf("%d\t%s\t%s\t%s\n", event.Revision, event.Type, event.Key, event.Value)
+		}
+		from = reply.Next
+	}
+}
+
+func parseId(arg string) int {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		log.Fatalf("bad node id %q", arg)
+	}
+	return id
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: raftctl [-config raftd.json] [-group ID] [-timeout DURATION] COMMAND
+commands:
+  status
+  submit get|put|append|delete KEY [VALUE]
+  watch [-prefix] KEY [REVISION]
+  transfer-leader ID
+  add-member ID ADDR
+  remove-member ID
+  snapshot ID`)
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("raftctl: ")
+	configPath := flag.String("config", "raftd.json", "any node's raftd config file")
+	group := flag.Int("group", raft.DefaultGroup, "Raft group to address")
+	timeout := flag.Duration("timeout", defaultTimeout, "how long to wait for each node's reply")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+
+	ctl := &admin{addrs: loadAddrs(*configPath), group: *group, timeout: *timeout}
+	var err error
+	switch args[0] {
+	case "status":
+		ctl.status()
+	case "submit":
+		var command []byte
+		if command, err = raft.EncodeCommand(raft.JSONCodec, parseKVCommand(args[1:])); err != nil {
+			break
+		}
+		var reply raft.AdminSubmitReply
+		if err = ctl.call(ctl.leader(), "Submit", raft.AdminSubmitArgs{Group: ctl.group, Command: command}, &reply); err == nil {
+			fmt.Printf("%+v\n", reply.Result)
+		}
+	case "watch":
+		flags := flag.NewFlagSet("watch", flag.ExitOnError)
+		prefix := flags.Bool("prefix", false, "watch every key starting with KEY")
+		flags.Usage = usage
+		flags.Parse(args[1:])
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			usage()
+		}
+		from := -1
+		if flags.NArg() == 2 {
+			if from, err = strconv.Atoi(flags.Arg(1)); err != nil {
+				log.Fatalf("bad revision %q", flags.Arg(1))
+			}
+		}
+		err = ctl.watch(flags.Arg(0), *prefix, from)
+	case "transfer-leader":
+		if len(args) != 2 {
+			usage()
+		}
+		err = ctl.call(ctl.leader(), "TransferLeadership", raft.AdminTransferArgs{Group: ctl.group, Target: parseId(args[1])}, &raft.AdminReply{})
+	case "add-member":
+		if len(args) != 3 {
+			usage()
+		}
+		err = ctl.call(ctl.leader(), "AddMember", raft.AdminMemberArgs{Group: ctl.group, Id: parseId(args[1]), Addr: args[2]}, &raft.AdminReply{})
+	case "remove-member":
+		if len(args) != 2 {
+			usage()
+		}
+		err = ctl.removeMember(parseId(args[1]))
+	case "snapshot":
+		if len(args) != 2 {
+			usage()
+		}
+		var meta raft.SnapshotMeta
+		if err = ctl.call(parseId(args[1]), "Snapshot", raft.AdminSnapshotArgs{Group: ctl.group}, &meta); err == nil {
+			fmt.Printf("snapshot up to index %d (term %d)\n", meta.LastIncludedIndex, meta.LastIncludedTerm)
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
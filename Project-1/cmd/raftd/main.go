@@ -0,0 +1,202 @@
+// Command raftd runs a single Raft node as its own process, replicating a
+// KVStore, until it receives SIGINT or SIGTERM. Its term, vote, log and
+// snapshot are kept in data_dir, so a node that is stopped and started again
+// rejoins the cluster where it left off.
+//
+// Usage:
+//
+//	raftd -config node0.json
+//
+// where the config file looks like
+//
+//	{
+//		"id": 0,
+//		"listen": "127.0.0.1:7000",
+//		"data_dir": "data/0",
+//		"fsync": "always",
+//		"snapshot_threshold": 10000,
+//		"metrics": "127.0.0.1:9000",
+//		"journal": "data/0/journal.jsonl",
+//		"peers": {"1": "127.0.0.1:7001", "2": "127.0.0.1:7002"},
+//		"groups": [1, 2]
+//	}
+//
+// fsync is always (the default), batched or none; see raft.SyncPolicy. Every
+// snapshot_threshold applied entries, the node snapshots its KVStore and
+// compacts its log; without it, only when told to by raftctl snapshot.
+// metrics and journal are optional. groups lists Raft groups to host besides
+// the default one, each with a KVStore of its own kept in data_dir/group<ID>;
+// every node should list the same groups.
+//
+// A node to be added to a running cluster, with raftctl add-member, is
+// started with "join": true, and the cluster's nodes as its peers; it waits
+// to be sent the log, and to hear that it's a member, before it takes any
+// part. Once it has, "join" makes no difference.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	raft "RaftLogReplication"
+)
+
+type config struct {
+	Id      int               `json:"id"`
+	Listen  string            `json:"listen"`
+	DataDir string            `json:"data_dir"`
+	Fsync   string            `json:"fsync"`
+	Metrics string            `json:"metrics"`
+	Journal string            `json:"journal"`
+	Peers   map[string]string `json:"peers"` // Keyed by node id
+	Groups  []int             `json:"groups"`
+	Join    bool              `json:"join"` // Start as a member to be added to running groups; see raftctl add-member
+
+	SnapshotThreshold int `json:"snapshot_threshold"` // 0 for none
+}
+
+func loadConfig(path string) (*config, raft.SyncPolicy, map[int]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, 0, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Listen == "" || cfg.DataDir == "" {
+		return nil, 0, nil, fmt.Errorf("%s: listen and data_dir are required", path)
+	}
+	policy := raft.SyncAlways
+	if cfg.Fsync != "" {
+		if policy, err = raft.ParseSyncPolicy(cfg.Fsync); err != nil {
+			return nil, 0, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	peers := make(map[int]string)
+	for _, group := range cfg.Groups {
+		if group == raft.DefaultGroup {
+			return nil, 0, nil, fmt.Errorf("%s: group %d is always hosted", path, group)
+		}
+	}
+
+	for idStr, addr := range cfg.Peers {
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id == cfg.Id {
+			return nil, 0, nil, fmt.Errorf("%s: bad peer id %q", path, idStr)
+		}
+		peers[id] = addr
+	}
+	return &cfg, policy, peers, nil
+}
+
+func main() {
+	configPath := flag.String("config", "raftd.json", "node configuration file")
+	flag.Parse()
+
+	cfg, policy, peers, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	peerIds := make([]int, 0, len(peers))
+	for id := range peers {
+		peerIds = append(peerIds, id)
+	}
+	sort.Ints(peerIds)
+
+	storage, err := raft.NewFileStorage(cfg.DataDir, policy)
+	if err != nil {
+		log.Fatalf("opening %s: %v", cfg.DataDir, err)
+	}
+
+	ready := make(chan interface{})
+	server := raft.NewServer(cfg.Id, peerIds, ready, 0)
+	server.SetListenAddress(cfg.Listen)
+	server.SetSimulatedLatency(false)
+	server.SetStorage(storage)
+	server.SetTracePath(filepath.Join(cfg.DataDir, "applied"))
+	server.SetJoining(cfg.Join)
+	server.SetSnapshotDir(filepath.Join(cfg.DataDir, "incoming"))
+	server.SetSnapshotThreshold(cfg.SnapshotThreshold)
+	server.SetStateMachine(raft.NewSessions(raft.NewKVStore(), raft.DefaultSessionTTL))
+
+	var journal *raft.Journal
+	if cfg.Journal != "" {
+		f, err := os.OpenFile(cfg.Journal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		journal = raft.NewJournal(f)
+		server.SetJournal(journal)
+	}
+
+	server.Serve()
+
+	storages := []raft.Storage{storage}
+	for _, group := range cfg.Groups {
+		dir := filepath.Join(cfg.DataDir, fmt.Sprintf("group%d", group))
+		groupStorage, err := raft.NewFileStorage(dir, policy)
+		if err != nil {
+			log.Fatalf("opening %s: %v", dir, err)
+		}
+		storages = append(storages, groupStorage)
+		if _, err := server.AddGroup(group, raft.GroupConfig{
+			StateMachine: raft.NewSessions(raft.NewKVStore(), raft.DefaultSessionTTL),
+			Storage:      groupStorage,
+			TracePath:    filepath.Join(dir, "applied"),
+			Joining:      cfg.Join,
+			SnapshotDir:  filepath.Join(dir, "incoming"),
+
+			SnapshotThreshold: cfg.SnapshotThreshold,
+		}); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.Metrics != "" {
+		if _, err := server.ServeMetrics(cfg.Metrics); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Peers that aren't up yet are redialled in the background, looking up
+	// their names again each time in case they have moved.
+	server.SetPeerResolver(func(id int) (net.Addr, error) { return net.ResolveTCPAddr("tcp", peers[id]) })
+	for _, id := range peerIds {
+		addr, err := net.ResolveTCPAddr("tcp", peers[id])
+		if err != nil {
+			log.Fatalf("peer %d: %v", id, err)
+		}
+		server.ConnectToPeer(id, addr)
+	}
+	close(ready)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("node %d: received %v, shutting down", cfg.Id, sig)
+
+	server.Shutdown()
+	if journal != nil {
+		if err := journal.Close(); err != nil {
+			log.Printf("node %d: %v", cfg.Id, err)
+		}
+	}
+	for _, storage := range storages {
+		if err := storage.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	raft "RaftLogReplication"
+)
+
+// Set in the environment of the copies of the test binary that run as nodes.
+const runAsNode = "RAFTD_TEST_RUN_AS_NODE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsNode) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func writeConfig(t *testing.T, cfg interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "raftd.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, config{Id: 1, Listen: "127.0.0.1:7001", DataDir: "data/1", Fsync: "batched",
+		Peers: map[string]string{"0": "127.0.0.1:7000", "2": "127.0.0.1:7002"}, Groups: []int{3}})
+	cfg, policy, peers, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Id != 1 || policy != raft.SyncBatched || len(peers) != 2 || peers[2] != "127.0.0.1:7002" {
+		t.Fatalf("got %+v, %v, %v", cfg, policy, peers)
+	}
+	if _, policy, _, _ := loadConfig(writeConfig(t, config{Listen: ":7000", DataDir: "d"})); policy != raft.SyncAlways {
+		t.Fatalf("default fsync policy: got %v", policy)
+	}
+
+	bad := []struct {
+		cfg  interface{}
+		want string
+	}{
+		{config{DataDir: "d"}, "listen and data_dir are required"},
+		{config{Listen: ":7000"}, "listen and data_dir are required"},
+		{config{Listen: ":7000", DataDir: "d", Fsync: "sometimes"}, "sometimes"},
+		{config{Listen: ":7000", DataDir: "d", Groups: []int{raft.DefaultGroup}}, "always hosted"},
+		{config{Listen: ":7000", DataDir: "d", Peers: map[string]string{"one": ":7001"}}, `bad peer id "one"`},
+		{config{Id: 1, Listen: ":7000", DataDir: "d", Peers: map[string]string{"1": ":7001"}}, `bad peer id "1"`},
+		{"not an object", "cannot unmarshal"},
+	}
+	for _, test := range bad {
+		if _, _, _, err := loadConfig(writeConfig(t, test.cfg)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%+v: got %v, want an error about %q", test.cfg, err, test.want)
+		}
+	}
+	if _, _, _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+// node is a raftd process started from the test binary.
+type node struct {
+	id     int
+	config string
+	cmd    *exec.Cmd
+}
+
+func (this *node) start(t *testing.T) {
+	t.Helper()
+	out, err := os.OpenFile(this.config+".log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	this.cmd = exec.Command(os.Args[0], "-config", this.config)
+	this.cmd.Env = append(os.Environ(), runAsNode+"=1")
+	this.cmd.Stdout, this.cmd.Stderr = out, out
+	if err := this.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stop sends the node SIGTERM and waits for it to shut down cleanly.
+func (this *node) stop(t *testing.T) {
+	t.Helper()
+	this.cmd.Process.Signal(syscall.SIGTERM)
+	if err := this.cmd.Wait(); err != nil {
+		log, _ := os.ReadFile(this.config + ".log")
+		t.Fatalf("node %d: %v\n%s", this.id, err, log)
+	}
+	this.cmd = nil
+}
+
+func call(addr string, method string, args interface{}, reply interface{}) error {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call("RaftAdmin."+method, args, reply)
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// A node stopped and started again comes back with its term, vote, log and
+// snapshot.
+func TestRestartedNodeKeepsItsState(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster of processes")
+	}
+	dir := t.TempDir()
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	nodes := make([]*node, len(addrs))
+	for id := range addrs {
+		peers := make(map[string]string)
+		for peer, addr := range addrs {
+			if peer != id {
+				peers[fmt.Sprint(peer)] = addr
+			}
+		}
+		cfg := config{Id: id, Listen: addrs[id], DataDir: filepath.Join(dir, fmt.Sprint(id)), Peers: peers}
+		data, _ := json.Marshal(cfg)
+		path := filepath.Join(dir, fmt.Sprintf("node%d.json", id))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		nodes[id] = &node{id: id, config: path}
+		nodes[id].start(t)
+	}
+	defer func() {
+		for _, node := range nodes {
+			if node.cmd != nil {
+				node.cmd.Process.Kill()
+				node.cmd.Wait()
+			}
+		}
+	}()
+
+	status := func(id int) (raft.NodeStatus, error) {
+		var status raft.NodeStatus
+		err := call(addrs[id], "Status", raft.AdminStatusArgs{}, &status)
+		return status, err
+	}
+	awaitLeader := func() int {
+		for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+			for id := range nodes {
+				if s, err := status(id); err == nil && s.State == "Leader" {
+					return id
+				}
+			}
+		}
+		t.Fatal("no leader elected")
+		return -1
+	}
+
+	leader := awaitLeader()
+	command, err := raft.EncodeCommand(raft.JSONCodec, raft.KVCommand{Op: raft.KVPut, Key: "x", Value: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply raft.AdminSubmitReply
+	if err := call(addrs[leader], "Submit", raft.AdminSubmitArgs{Command: command}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := reply.Result.(raft.KVResult); !ok || result.Err != "" {
+		t.Fatalf("put: got %+v", reply.Result)
+	}
+
+	// Stop a follower that has the entry, and start it again
+	follower := (leader + 1) % len(nodes)
+	var before raft.NodeStatus
+	for deadline := time.Now().Add(10 * time.Second); before.LastApplied < 1; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d hasn't applied the put: %+v", follower, before)
+		}
+		before, _ = status(follower)
+	}
+	// With the put in a snapshot rather than the log
+	var snapshot raft.SnapshotMeta
+	if err := call(addrs[follower], "Snapshot", raft.AdminSnapshotArgs{}, &snapshot); err != nil || snapshot.LastIncludedIndex < 1 {
+		t.Fatalf("snapshot of node %d: %+v, %v", follower, snapshot, err)
+	}
+	nodes[follower].stop(t)
+	nodes[follower].start(t)
+
+	var after raft.NodeStatus
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if after, err = status(follower); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d didn't come back: %v", follower, err)
+		}
+	}
+	if after.Term < before.Term || after.LastLogIndex < before.LastLogIndex || after.LastLogTerm < before.LastLogTerm ||
+		!reflect.DeepEqual(after.Snapshot, snapshot) || after.LastApplied < snapshot.LastIncludedIndex {
+		t.Fatalf("node %d lost state over a restart: had %+v, now %+v", follower, before, after)
+	}
+
+	// It rejoins the cluster and catches up
+	for deadline := time.Now().Add(20 * time.Second); after.LastApplied < before.LastApplied; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d hasn't caught up after restarting: %+v", follower, after)
+		}
+		after, _ = status(follower)
+	}
+	for _, node := range nodes {
+		node.stop(t)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLine is one parsed line of a verbose log.
+type logLine struct {
+	at    time.Time
+	node  int // -1 for lines not about a node, e.g. test harness actions
+	msg   string
+	attrs map[string]string
+}
+
+var legacyLine = regexp.MustCompile(`^(\d\d:\d\d:\d\d\.\d+) (?:AT NODE (\d+): )?(.*)$`)
+
+// parseLogLine understands the slog text format nodes log in, as well as the
+// "15:04:05.000000 AT NODE n: ..." lines of older runs.
+func parseLogLine(text string) (logLine, bool) {
+	if strings.HasPrefix(text, "time=") {
+		attrs := parseLogfmt(text)
+		at, err := time.Parse(time.RFC3339Nano, attrs["time"])
+		if err != nil {
+			return logLine{}, false
+		}
+		node := -1
+		if n, err := strconv.Atoi(attrs["node"]); err == nil {
+			node = n
+		}
+		return logLine{at: at, node: node, msg: attrs["msg"], attrs: attrs}, true
+	}
+
+	m := legacyLine.FindStringSubmatch(text)
+	if m == nil {
+		return logLine{}, false
+	}
+	at, err := time.Parse("15:04:05.999999", m[1])
+	if err != nil {
+		return logLine{}, false
+	}
+	node := -1
+	if m[2] != "" {
+		node, _ = strconv.Atoi(m[2])
+	}
+	return logLine{at: at, node: node, msg: m[3]}, true
+}
+
+// parseLogfmt splits key=value pairs, where values may be Go-quoted strings.
+func parseLogfmt(text string) map[string]string {
+	attrs := make(map[string]string)
+	for len(text) > 0 {
+		text = strings.TrimLeft(text, " ")
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			break
+		}
+		key := text[:eq]
+		text = text[eq+1:]
+
+		var value string
+		if strings.HasPrefix(text, `"`) {
+			quoted, err := strconv.QuotedPrefix(text)
+			if err != nil {
+				break
+			}
+			value, _ = strconv.Unquote(quoted)
+			text = text[len(quoted):]
+		} else if sp := strings.IndexByte(text, ' '); sp >= 0 {
+			value, text = text[:sp], text[sp:]
+		} else {
+			value, text = text, ""
+		}
+		attrs[key] = value
+	}
+	return attrs
+}
+
+var (
+	legacyBecame    = regexp.MustCompile(`^became (Candidate|Leader|Follower)\b.*?term=(\d+)`)
+	legacySend      = regexp.MustCompile(`^sending (RequestVote|AppendEntries|Heartbeat) to (\d+)`)
+	legacyVoteRecv  = regexp.MustCompile(`^Received Vote Request from NODE (\d+)`)
+	legacyAERecv    = regexp.MustCompile(`^Received (AppendEntries|Heartbeat) from NODE (\d+)`)
+	legacyCommit    = regexp.MustCompile(`^leader sets commitIndex := (\d+)`)
+	legacyAction    = regexp.MustCompile(`^\[ACTION\] (.*)$`)
+	replyToAERegexp = regexp.MustCompile(`^(AppendEntries|Heartbeat) reply (success|was failure)`)
+)
+
+// action is what a line says happened, in terms of the diagram.
+type action struct {
+	kind  string // "state", "send", "recv", "respond", "done", "commit", "note"
+	state string
+	term  int
+	peer  int
+	rpc   string // "RequestVote", "AppendEntries" or "Heartbeat"
+	index int
+	text  string
+}
+
+func classify(line logLine) (action, bool) {
+	if line.attrs == nil {
+		return classifyLegacy(line.msg)
+	}
+
+	a := line.attrs
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(a[key])
+		return n
+	}
+	msg := line.msg
+	switch {
+	case strings.HasPrefix(msg, "[ACTION] "):
+		return action{kind: "note", text: strings.TrimPrefix(msg, "[ACTION] ")}, true
+	case msg == "became Candidate" || msg == "became Leader" || msg == "became Follower":
+		return action{kind: "state", state: strings.TrimPrefix(msg, "became "), term: atoi("term")}, true
+	case msg == "KILLED":
+		return action{kind: "state", state: "Dead", term: atoi("term")}, true
+	case msg == "sending RequestVote":
+		return action{kind: "send", rpc: "RequestVote", peer: atoi("peer")}, true
+	case msg == "sending AppendEntries" || msg == "sending Heartbeat":
+		return action{kind: "send", rpc: strings.TrimPrefix(msg, "sending "), peer: atoi("peer")}, true
+	case msg == "Received Vote Request":
+		return action{kind: "recv", rpc: "RequestVote", peer: atoi("peer")}, true
+	case msg == "Received AppendEntries" || msg == "Received Heartbeat":
+		return action{kind: "recv", rpc: strings.TrimPrefix(msg, "Received "), peer: atoi("peer")}, true
+	case msg == "Sending Request Vote Reply":
+		return action{kind: "respond", rpc: "RequestVote", peer: atoi("peer")}, true
+	case msg == "Sending AppendEntries reply" || msg == "Sending Heartbeat reply":
+		return action{kind: "respond", rpc: strings.TrimSuffix(strings.TrimPrefix(msg, "Sending "), " reply"), peer: atoi("peer")}, true
+	case msg == "received RequestVote reply":
+		return action{kind: "done", rpc: "RequestVote", peer: atoi("peer")}, true
+	case msg == "leader sets commitIndex":
+		return action{kind: "commit", index: atoi("commitIndex")}, true
+	}
+	if m := replyToAERegexp.FindStringSubmatch(msg); m != nil {
+		return action{kind: "done", rpc: m[1], peer: atoi("peer")}, true
+	}
+	return action{}, false
+}
+
+func classifyLegacy(msg string) (action, bool) {
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	if m := legacyAction.FindStringSubmatch(msg); m != nil {
+		return action{kind: "note", text: m[1]}, true
+	}
+	if msg == "KILLED" {
+		return action{kind: "state", state: "Dead"}, true
+	}
+	if m := legacyBecame.FindStringSubmatch(msg); m != nil {
+		return action{kind: "state", state: m[1], term: atoi(m[2])}, true
+	}
+	if m := legacySend.FindStringSubmatch(msg); m != nil {
+		return action{kind: "send", rpc: m[1], peer: atoi(m[2])}, true
+	}
+	if m := legacyVoteRecv.FindStringSubmatch(msg); m != nil {
+		return action{kind: "recv", rpc: "RequestVote", peer: atoi(m[1])}, true
+	}
+	if m := legacyAERecv.FindStringSubmatch(msg); m != nil {
+		return action{kind: "recv", rpc: m[1], peer: atoi(m[2])}, true
+	}
+	if m := legacyCommit.FindStringSubmatch(msg); m != nil {
+		return action{kind: "commit", index: atoi(m[1])}, true
+	}
+	return action{}, false
+}
+
+// fromLogs adds what the log lines describe to tl. Logs carry no message ids,
+// so a receive is matched with the oldest unmatched send between the same
+// two nodes for the same RPC, and likewise for replies.
+func fromLogs(tl *timeline, lines []logLine) {
+	if len(lines) == 0 {
+		return
+	}
+	start := lines[0].at
+	for _, line := range lines {
+		if line.at.Before(start) {
+			start = line.at
+		}
+	}
+
+	type link struct {
+		from, to int
+		rpc      string
+	}
+	pendingSends := make(map[link][]time.Duration)
+	pendingReplies := make(map[link][]time.Duration)
+	started := make(map[int]bool)
+
+	for _, line := range lines {
+		a, ok := classify(line)
+		if !ok {
+			continue
+		}
+		at := line.at.Sub(start)
+		if a.kind == "note" {
+			tl.notes = append(tl.notes, note{at: at, text: a.text})
+			continue
+		}
+		if line.node < 0 {
+			continue
+		}
+		tl.see(line.node, at)
+		if !started[line.node] {
+			started[line.node] = true
+			tl.states = append(tl.states, stateChange{node: line.node, at: 0, state: "Follower"})
+		}
+
+		switch a.kind {
+		case "state":
+			tl.states = append(tl.states, stateChange{node: line.node, at: at, state: a.state, term: a.term})
+		case "commit":
+			tl.commits = append(tl.commits, commitMark{node: line.node, at: at, index: a.index})
+		case "send":
+			l := link{line.node, a.peer, a.rpc}
+			pendingSends[l] = append(pendingSends[l], at)
+		case "recv":
+			l := link{a.peer, line.node, a.rpc}
+			if queue := pendingSends[l]; len(queue) > 0 {
+				pendingSends[l] = queue[1:]
+				tl.messages = append(tl.messages, message{from: l.from, to: l.to, sent: queue[0], received: at,
+					rpc: rpcName(a.rpc), heartbeat: a.rpc == "Heartbeat", label: a.rpc})
+			}
+		case "respond":
+			l := link{line.node, a.peer, a.rpc}
+			pendingReplies[l] = append(pendingReplies[l], at)
+		case "done":
+			l := link{a.peer, line.node, a.rpc}
+			if queue := pendingReplies[l]; len(queue) > 0 {
+				pendingReplies[l] = queue[1:]
+				tl.messages = append(tl.messages, message{from: l.from, to: l.to, sent: queue[0], received: at,
+					rpc: rpcName(a.rpc), reply: true, heartbeat: a.rpc == "Heartbeat", label: a.rpc + " reply"})
+			}
+		}
+	}
+}
+
+func rpcName(kind string) string {
+	if kind == "Heartbeat" {
+		return "AppendEntries"
+	}
+	return kind
+}
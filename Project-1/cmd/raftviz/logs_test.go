@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	got := parseLogfmt(`time=2026-10-19T10:00:00.5Z level=INFO msg="became Leader" node=2 term=3 log="[{x 1} {y 2}]"`)
+	want := map[string]string{
+		"time": "2026-10-19T10:00:00.5Z", "level": "INFO", "msg": "became Leader",
+		"node": "2", "term": "3", "log": "[{x 1} {y 2}]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		text string
+		ok   bool
+		node int
+		msg  string
+	}{
+		{`time=2026-10-19T10:00:00.5Z level=INFO msg="sending RequestVote" node=1 peer=2`, true, 1, "sending RequestVote"},
+		{`time=2026-10-19T10:00:00.5Z level=INFO msg="[ACTION] Disconnecting 2"`, true, -1, "[ACTION] Disconnecting 2"},
+		{`time=yesterday msg=x`, false, 0, ""},
+		{`10:00:00.500000 AT NODE 3: became Leader at term=4`, true, 3, "became Leader at term=4"},
+		{`10:00:00.500000 [ACTION] Disconnecting 2`, true, -1, "[ACTION] Disconnecting 2"},
+		{`=== RUN   Test2`, false, 0, ""},
+	}
+	for _, test := range tests {
+		line, ok := parseLogLine(test.text)
+		if ok != test.ok {
+			t.Errorf("%q: parsed %v, want %v", test.text, ok, test.ok)
+			continue
+		}
+		if ok && (line.node != test.node || line.msg != test.msg) {
+			t.Errorf("%q: got node %d msg %q, want node %d msg %q", test.text, line.node, line.msg, test.node, test.msg)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		text string
+		want action
+	}{
+		{`time=2026-10-19T10:00:00Z msg="became Candidate" node=0 term=5`, action{kind: "state", state: "Candidate", term: 5}},
+		{`time=2026-10-19T10:00:00Z msg=KILLED node=0 term=5`, action{kind: "state", state: "Dead", term: 5}},
+		{`time=2026-10-19T10:00:00Z msg="sending Heartbeat" node=0 peer=2`, action{kind: "send", rpc: "Heartbeat", peer: 2}},
+		{`time=2026-10-19T10:00:00Z msg="Received Vote Request" node=2 peer=0`, action{kind: "recv", rpc: "RequestVote", peer: 0}},
+		{`time=2026-10-19T10:00:00Z msg="Sending AppendEntries reply" node=2 peer=0`, action{kind: "respond", rpc: "AppendEntries", peer: 0}},
+		{`time=2026-10-19T10:00:00Z msg="AppendEntries reply success" node=0 peer=2`, action{kind: "done", rpc: "AppendEntries", peer: 2}},
+		{`time=2026-10-19T10:00:00Z msg="leader sets commitIndex" node=0 commitIndex=7`, action{kind: "commit", index: 7}},
+		{`time=2026-10-19T10:00:00Z msg="[ACTION] Crashing 1"`, action{kind: "note", text: "Crashing 1"}},
+		{`10:00:00.000001 AT NODE 1: became Follower at term=6`, action{kind: "state", state: "Follower", term: 6}},
+		{`10:00:00.000001 AT NODE 1: sending AppendEntries to 2: ni=3`, action{kind: "send", rpc: "AppendEntries", peer: 2}},
+		{`10:00:00.000001 AT NODE 2: Received Heartbeat from NODE 1`, action{kind: "recv", rpc: "Heartbeat", peer: 1}},
+		{`10:00:00.000001 AT NODE 1: leader sets commitIndex := 4`, action{kind: "commit", index: 4}},
+	}
+	for _, test := range tests {
+		line, ok := parseLogLine(test.text)
+		if !ok {
+			t.Fatalf("%q didn't parse", test.text)
+		}
+		got, ok := classify(line)
+		if !ok || got != test.want {
+			t.Errorf("%q: got %+v (%v), want %+v", test.text, got, ok, test.want)
+		}
+	}
+
+	line, _ := parseLogLine(`time=2026-10-19T10:00:00Z msg="Election timer started" node=0`)
+	if a, ok := classify(line); ok {
+		t.Errorf("unrelated line classified as %+v", a)
+	}
+}
+
+// Sends and receives between the same nodes are matched up in order, from
+// lines as a node's slog logger writes them.
+func TestFromLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	node := func(id int) *slog.Logger { return logger.With("node", id) }
+	step := func() { time.Sleep(2 * time.Millisecond) }
+
+	node(0).Info("became Leader", "term", 1)
+	step()
+	node(0).Info("sending AppendEntries", "peer", 1)
+	step()
+	node(0).Info("sending AppendEntries", "peer", 1)
+	step()
+	node(1).Info("Received AppendEntries", "peer", 0)
+	step()
+	node(1).Info("Sending AppendEntries reply", "peer", 0)
+	step()
+	node(0).Info("AppendEntries reply success", "peer", 1)
+	step()
+	node(1).Info("Received AppendEntries", "peer", 0)
+	step()
+	logger.Info("[ACTION] Disconnecting 1")
+	node(0).Info("leader sets commitIndex", "commitIndex", 0)
+
+	var lines []logLine
+	for _, text := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		line, ok := parseLogLine(text)
+		if !ok {
+			t.Fatalf("%q didn't parse", text)
+		}
+		lines = append(lines, line)
+	}
+	tl := &timeline{nodes: make(map[int]bool)}
+	fromLogs(tl, lines)
+
+	if len(tl.nodes) != 2 || len(tl.notes) != 1 || tl.notes[0].text != "Disconnecting 1" {
+		t.Fatalf("nodes %v, notes %+v", tl.nodes, tl.notes)
+	}
+	if len(tl.commits) != 1 || tl.commits[0].node != 0 || tl.commits[0].index != 0 {
+		t.Fatalf("commits: %+v", tl.commits)
+	}
+	// Both nodes start out followers; node 0 then leads
+	if len(tl.states) != 3 || tl.states[1].state != "Leader" || tl.states[1].term != 1 {
+		t.Fatalf("states: %+v", tl.states)
+	}
+
+	if len(tl.messages) != 3 {
+		t.Fatalf("messages: %+v", tl.messages)
+	}
+	first, reply, second := tl.messages[0], tl.messages[1], tl.messages[2]
+	if first.from != 0 || first.to != 1 || first.reply || second.sent <= first.sent || second.received <= first.received {
+		t.Fatalf("requests not matched in order: %+v, %+v", first, second)
+	}
+	if !reply.reply || reply.from != 1 || reply.to != 0 || reply.sent < first.received || reply.label != "AppendEntries reply" {
+		t.Fatalf("reply: %+v", reply)
+	}
+}
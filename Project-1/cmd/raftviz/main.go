@@ -0,0 +1,257 @@
+// Command raftviz renders a run of the cluster as a standalone HTML
+// space-time diagram: one lane per node showing its state and term over time,
+// arrows for the messages between nodes, and markers where commitIndex advanced.
+//
+// Usage:
+//
+//	raftviz [-o out.html] [-heartbeats] [-wall] [-group ID] FILE...
+//
+// Each FILE is either a node's event journal (JSON lines, see SetJournal) or
+// a verbose log as written by go test -v (slog text, or the older
+// "AT NODE n:" format). Journals give exact message arrows; logs are matched
+// up in order per pair of nodes. Journals of servers hosting several Raft
+// groups are drawn one group at a time.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	raft "RaftLogReplication"
+)
+
+// State of a node from At onwards.
+type stateChange struct {
+	node  int
+	at    time.Duration
+	state string
+	term  int
+}
+
+// A message arrow; reply arrows go from the callee back to the caller.
+type message struct {
+	from, to  int
+	sent      time.Duration
+	received  time.Duration
+	rpc       string
+	reply     bool
+	heartbeat bool
+	label     string
+}
+
+type commitMark struct {
+	node  int
+	at    time.Duration
+	index int
+}
+
+// A test harness action such as "Disconnecting 2"; only found in logs.
+type note struct {
+	at   time.Duration
+	text string
+}
+
+type timeline struct {
+	nodes    map[int]bool
+	states   []stateChange
+	messages []message
+	commits  []commitMark
+	notes    []note
+	end      time.Duration
+}
+
+func (this *timeline) see(node int, at time.Duration) {
+	this.nodes[node] = true
+	if at > this.end {
+		this.end = at
+	}
+}
+
+func main() {
+	out := flag.String("o", "raftviz.html", "where to write the diagram")
+	heartbeats := flag.Bool("heartbeats", false, "also draw heartbeats (AppendEntries without entries)")
+	wall := flag.Bool("wall", false, "order journal events by wall clock instead of the monotonic clock; needed for journals of separate processes")
+	pxPerSec := flag.Float64("px-per-sec", 120, "horizontal scale")
+	group := flag.Int("group", raft.DefaultGroup, "Raft group whose journal events to draw")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: raftviz [-o out.html] [-heartbeats] [-wall] [-group ID] FILE...")
+		os.Exit(2)
+	}
+
+	var events []raft.Event
+	var logLines []logLine
+	for _, path := range flag.Args() {
+		journal, lines, err := readFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "raftviz: %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		for _, event := range journal {
+			if event.Group == *group {
+				events = append(events, event)
+			}
+		}
+		logLines = append(logLines, lines...)
+	}
+
+	tl := &timeline{nodes: make(map[int]bool)}
+	fromJournal(tl, events, *wall)
+	fromLogs(tl, logLines)
+
+	if !*heartbeats {
+		kept := tl.messages[:0]
+		for _, msg := range tl.messages {
+			if !msg.heartbeat {
+				kept = append(kept, msg)
+			}
+		}
+		tl.messages = kept
+	}
+	sort.SliceStable(tl.states, func(i, j int) bool { return tl.states[i].at < tl.states[j].at })
+
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftviz: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	render(w, tl, *pxPerSec)
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "raftviz: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("wrote %s: %d nodes, %d state changes, %d messages, %d commits\n", *out, len(tl.nodes), len(tl.states), len(tl.messages), len(tl.commits))
+}
+
+// readFile returns the file's journal events if it is a journal, or its lines otherwise.
+func readFile(path string) ([]raft.Event, []logLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var events []raft.Event
+	var lines []logLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.HasPrefix(text, "{") {
+			var event raft.Event
+			if err := json.Unmarshal([]byte(text), &event); err == nil {
+				events = append(events, event)
+				continue
+			}
+		}
+		if line, ok := parseLogLine(text); ok {
+			lines = append(lines, line)
+		}
+	}
+	return events, lines, scanner.Err()
+}
+
+func fromJournal(tl *timeline, events []raft.Event, wall bool) {
+	if len(events) == 0 {
+		return
+	}
+
+	at := func(e raft.Event) time.Duration { return time.Duration(e.Mono) }
+	if wall {
+		var first time.Time
+		for _, e := range events {
+			if first.IsZero() || e.Wall.Before(first) {
+				first = e.Wall
+			}
+		}
+		at = func(e raft.Event) time.Duration { return e.Wall.Sub(first) }
+	} else {
+		first := events[0].Mono
+		for _, e := range events {
+			if e.Mono < first {
+				first = e.Mono
+			}
+		}
+		at = func(e raft.Event) time.Duration { return time.Duration(e.Mono - first) }
+	}
+
+	// Every node starts out a follower in term 0.
+	started := make(map[int]bool)
+	for _, e := range events {
+		if !started[e.Node] {
+			started[e.Node] = true
+			tl.states = append(tl.states, stateChange{node: e.Node, at: 0, state: "Follower"})
+		}
+	}
+
+	type key struct {
+		msg  uint64
+		kind string
+	}
+	byMsg := make(map[key]raft.Event)
+	for _, e := range events {
+		tl.see(e.Node, at(e))
+		switch e.Type {
+		case raft.EventStateChange:
+			tl.states = append(tl.states, stateChange{node: e.Node, at: at(e), state: e.State, term: e.Term})
+		case raft.EventCommit:
+			if e.Index != nil {
+				tl.commits = append(tl.commits, commitMark{node: e.Node, at: at(e), index: *e.Index})
+			}
+		case raft.EventRPCSend, raft.EventRPCReceive, raft.EventRPCRespond, raft.EventRPCDone:
+			if e.MsgId != 0 {
+				byMsg[key{e.MsgId, e.Type}] = e
+			}
+		}
+	}
+
+	for k, send := range byMsg {
+		if k.kind != raft.EventRPCSend {
+			continue
+		}
+		rpc := strings.TrimPrefix(send.RPC, "RaftNode.")
+		heartbeat := rpc == "AppendEntries" && !hasEntries(send.Args)
+		if recv, ok := byMsg[key{k.msg, raft.EventRPCReceive}]; ok {
+			tl.messages = append(tl.messages, message{
+				from: send.Node, to: recv.Node, sent: at(send), received: at(recv),
+				rpc: rpc, heartbeat: heartbeat, label: describe(rpc, send.Args),
+			})
+		}
+		respond, okRespond := byMsg[key{k.msg, raft.EventRPCRespond}]
+		done, okDone := byMsg[key{k.msg, raft.EventRPCDone}]
+		if okRespond && okDone && done.Error == "" {
+			tl.messages = append(tl.messages, message{
+				from: respond.Node, to: done.Node, sent: at(respond), received: at(done),
+				rpc: rpc, reply: true, heartbeat: heartbeat, label: describe(rpc+" reply", done.Reply),
+			})
+		}
+	}
+	sort.Slice(tl.messages, func(i, j int) bool { return tl.messages[i].sent < tl.messages[j].sent })
+}
+
+func hasEntries(args interface{}) bool {
+	m, ok := args.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	entries, ok := m["Entries"].([]interface{})
+	return ok && len(entries) > 0
+}
+
+func describe(what string, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return what
+	}
+	return what + " " + string(b)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	raft "RaftLogReplication"
+)
+
+// writeJournal journals the four events of an AppendEntries from node 0 to
+// node 1, and a commit, the way the nodes would, followed by a log line.
+func writeJournal(t *testing.T, entries []raft.LogEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	journal := raft.NewJournal(f)
+	peer := func(id int) *int { return &id }
+	args := raft.AppendEntriesArgs{Term: 2, LeaderId: 0, PrevLogIndex: -1, Entries: entries, MsgId: 42}
+	reply := raft.AppendEntriesReply{Term: 2, Success: true}
+	journal.Emit(raft.Event{Node: 0, Type: raft.EventStateChange, Term: 2, State: "Leader", From: "Candidate"})
+	journal.Emit(raft.Event{Node: 0, Type: raft.EventRPCSend, Term: 2, Peer: peer(1), RPC: "RaftNode.AppendEntries", MsgId: 42, Args: args})
+	journal.Emit(raft.Event{Node: 1, Type: raft.EventRPCReceive, Term: 2, Peer: peer(0), RPC: "RaftNode.AppendEntries", MsgId: 42, Args: args})
+	journal.Emit(raft.Event{Node: 1, Type: raft.EventRPCRespond, Term: 2, Peer: peer(0), RPC: "RaftNode.AppendEntries", MsgId: 42, Args: args, Reply: reply})
+	journal.Emit(raft.Event{Node: 0, Type: raft.EventRPCDone, Term: 2, Peer: peer(1), RPC: "RaftNode.AppendEntries", MsgId: 42, Args: args, Reply: reply})
+	index := 0
+	journal.Emit(raft.Event{Node: 0, Type: raft.EventCommit, Term: 2, State: "Leader", Index: &index, Entries: entries})
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`time=2026-10-19T10:00:00Z level=INFO msg="[ACTION] Disconnecting 1"` + "\n")
+	return path
+}
+
+func TestReadFile(t *testing.T) {
+	command, err := raft.EncodeCommand(raft.GobCodec, raft.KVCommand{Op: raft.KVPut, Key: "x", Value: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, lines, err := readFile(writeJournal(t, []raft.LogEntry{{Command: command, Term: 2}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 || len(lines) != 1 || lines[0].msg != "[ACTION] Disconnecting 1" {
+		t.Fatalf("got %d events and lines %+v", len(events), lines)
+	}
+	for i, event := range events {
+		if event.Seq != uint64(i+1) {
+			t.Fatalf("event %d: %+v", i, event)
+		}
+	}
+	if commit := events[5]; commit.Type != raft.EventCommit || len(commit.Entries) != 1 || commit.Entries[0].Term != 2 {
+		t.Fatalf("commit event: %+v", commit)
+	}
+}
+
+func TestFromJournal(t *testing.T) {
+	for _, heartbeat := range []bool{false, true} {
+		var entries []raft.LogEntry
+		if !heartbeat {
+			entries = []raft.LogEntry{{Term: 2, Type: raft.EntryNoop}}
+		}
+		events, _, err := readFile(writeJournal(t, entries))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, wall := range []bool{false, true} {
+			tl := &timeline{nodes: make(map[int]bool)}
+			fromJournal(tl, events, wall)
+
+			if len(tl.nodes) != 2 || len(tl.commits) != 1 || tl.commits[0].index != 0 {
+				t.Fatalf("nodes %v, commits %+v", tl.nodes, tl.commits)
+			}
+			// Both nodes start out followers; node 0 then leads
+			if len(tl.states) != 3 || tl.states[2].state != "Leader" || tl.states[2].term != 2 {
+				t.Fatalf("states: %+v", tl.states)
+			}
+			if len(tl.messages) != 2 {
+				t.Fatalf("messages: %+v", tl.messages)
+			}
+			request, reply := tl.messages[0], tl.messages[1]
+			if request.from != 0 || request.to != 1 || request.reply || request.rpc != "AppendEntries" || request.received < request.sent {
+				t.Fatalf("request: %+v", request)
+			}
+			if !reply.reply || reply.from != 1 || reply.to != 0 || reply.sent < request.received || !strings.Contains(reply.label, `"Success":true`) {
+				t.Fatalf("reply: %+v", reply)
+			}
+			if request.heartbeat != heartbeat || reply.heartbeat != heartbeat {
+				t.Fatalf("heartbeat %v: got %+v, %+v", heartbeat, request, reply)
+			}
+		}
+	}
+}
+
+// RPCs besides RequestVote and AppendEntries, such as the chunks of a snapshot
+// transfer, are drawn too, each arrow with a colour and a marker that exists.
+func TestRenderSnapshotTransfer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := raft.NewJournal(f)
+	peer := func(id int) *int { return &id }
+	exchange := func(rpc string, msgId uint64, args interface{}, reply interface{}) {
+		journal.Emit(raft.Event{Node: 0, Type: raft.EventRPCSend, Term: 2, Peer: peer(1), RPC: rpc, MsgId: msgId, Args: args})
+		journal.Emit(raft.Event{Node: 1, Type: raft.EventRPCReceive, Term: 2, Peer: peer(0), RPC: rpc, MsgId: msgId, Args: args})
+		journal.Emit(raft.Event{Node: 1, Type: raft.EventRPCRespond, Term: 2, Peer: peer(0), RPC: rpc, MsgId: msgId, Args: args, Reply: reply})
+		journal.Emit(raft.Event{Node: 0, Type: raft.EventRPCDone, Term: 2, Peer: peer(1), RPC: rpc, MsgId: msgId, Args: args, Reply: reply})
+	}
+	meta := raft.SnapshotMeta{LastIncludedIndex: 9, LastIncludedTerm: 2}
+	exchange("RaftNode.InstallSnapshot", 1, raft.InstallSnapshotArgs{Term: 2, Meta: meta, Data: make([]byte, 10), MsgId: 1}, raft.InstallSnapshotReply{Term: 2, Offset: 10})
+	exchange("RaftNode.InstallSnapshot", 2, raft.InstallSnapshotArgs{Term: 2, Meta: meta, Offset: 10, Data: make([]byte, 5), Done: true, MsgId: 2}, raft.InstallSnapshotReply{Term: 2, Offset: 15, Installed: true})
+	exchange("RaftNode.TimeoutNow", 3, raft.TimeoutNowArgs{Term: 2, MsgId: 3}, raft.TimeoutNowReply{Term: 2})
+	exchange("RaftNode.SomethingNew", 4, struct{ MsgId uint64 }{4}, struct{}{})
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	events, _, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &timeline{nodes: make(map[int]bool)}
+	fromJournal(tl, events, false)
+	if len(tl.messages) != 8 {
+		t.Fatalf("messages: %+v", tl.messages)
+	}
+	var out strings.Builder
+	render(&out, tl, 100)
+	svg := out.String()
+
+	if strings.Contains(svg, `stroke=""`) {
+		t.Errorf("an arrow has no colour:\n%s", svg)
+	}
+	arrows := 0
+	for _, part := range strings.Split(svg, `marker-end="url(#`)[1:] {
+		marker := part[:strings.Index(part, ")")]
+		if !strings.Contains(svg, `<marker id="`+marker+`"`) {
+			t.Errorf("no marker %q", marker)
+		}
+		arrows++
+	}
+	if arrows != 8 {
+		t.Errorf("%d arrows, want 8", arrows)
+	}
+	for _, marker := range []string{"arrow-InstallSnapshot", "arrow-TimeoutNow", "arrow-other"} {
+		if !strings.Contains(svg, `url(#`+marker+`)`) {
+			t.Errorf("no arrow with marker %s", marker)
+		}
+	}
+}
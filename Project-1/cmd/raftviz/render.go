@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	laneHeight = 70
+	laneGap    = 30
+	leftMargin = 90
+	topMargin  = 80 // Room for harness notes
+)
+
+var stateColors = map[string]string{
+	"Follower":  "#d9d9d9",
+	"Candidate": "#f6c26b",
+	"Leader":    "#7cc47f",
+	"Dead":      "#555555",
+}
+
+var rpcColors = map[string]string{
+	"RequestVote":     "#8e44ad",
+	"AppendEntries":   "#2e6fd8",
+	"InstallSnapshot": "#d35400",
+	"TimeoutNow":      "#16a085",
+}
+
+// In the order of the legend; any other RPC is drawn in otherRPCColor.
+var rpcNames = []string{"RequestVote", "AppendEntries", "InstallSnapshot", "TimeoutNow"}
+
+const otherRPCColor = "#7f8c8d"
+
+// rpcArrow returns the colour of rpc's arrows, and the id of their marker.
+func rpcArrow(rpc string) (color string, marker string) {
+	if color, ok := rpcColors[rpc]; ok {
+		return color, "arrow-" + rpc
+	}
+	return otherRPCColor, "arrow-other"
+}
+
+func render(w io.Writer, tl *timeline, pxPerSec float64) {
+	var nodes []int
+	for node := range tl.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	lane := make(map[int]int)
+	for i, node := range nodes {
+		lane[node] = i
+	}
+
+	x := func(at time.Duration) float64 { return leftMargin + at.Seconds()*pxPerSec }
+	laneTop := func(node int) float64 { return float64(topMargin + lane[node]*(laneHeight+laneGap)) }
+	laneMid := func(node int) float64 { return laneTop(node) + laneHeight/2 }
+
+	width := x(tl.end) + 40
+	height := float64(topMargin+len(nodes)*(laneHeight+laneGap)) + 30
+
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>raftviz</title>
+<style>
+body { font-family: sans-serif; margin: 12px; }
+text { font-size: 11px; }
+.legend span { display: inline-block; padding: 2px 8px; margin-right: 6px; }
+</style></head><body>
+<div class="legend">`)
+	for _, state := range []string{"Follower", "Candidate", "Leader", "Dead"} {
+		fmt.Fprintf(w, `<span style="background:%s">%s</span>`, stateColors[state], state)
+	}
+	for _, rpc := range rpcNames {
+		fmt.Fprintf(w, `<span style="color:%s">&rarr; %s</span>`, rpcColors[rpc], rpc)
+	}
+	fmt.Fprintf(w, `<span style="color:%s">&rarr; other</span><span>dashed: reply</span><span>&#9670; commitIndex</span></div>
+<svg width="%.0f" height="%.0f" xmlns="http://www.w3.org/2000/svg">
+<defs>`, otherRPCColor, width, height)
+	for _, rpc := range append(rpcNames, "other") {
+		color, marker := rpcArrow(rpc)
+		fmt.Fprintf(w, `<marker id="%s" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="%s"/></marker>`, marker, color)
+	}
+	fmt.Fprintf(w, "</defs>\n")
+
+	// Time axis
+	axisY := height - 20
+	for s := 0; time.Duration(s)*time.Second <= tl.end; s++ {
+		tx := x(time.Duration(s) * time.Second)
+		fmt.Fprintf(w, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#eee"/><text x="%.1f" y="%.1f" fill="#888">%ds</text>`+"\n", tx, topMargin-10, tx, axisY-10, tx+2, axisY, s)
+	}
+
+	// State spans, one lane per node
+	for _, node := range nodes {
+		fmt.Fprintf(w, `<text x="8" y="%.1f" font-weight="bold">node %d</text>`+"\n", laneMid(node)+4, node)
+
+		var changes []stateChange
+		for _, change := range tl.states {
+			if change.node == node {
+				changes = append(changes, change)
+			}
+		}
+		for i, change := range changes {
+			end := tl.end
+			if i+1 < len(changes) {
+				end = changes[i+1].at
+			}
+			fmt.Fprintf(w, `<g><title>node %d: %s, term %d, from %v</title><rect x="%.1f" y="%.1f" width="%.1f" height="%d" fill="%s"/>`,
+				node, change.state, change.term, change.at.Round(time.Millisecond), x(change.at), laneTop(node), x(end)-x(change.at), laneHeight, stateColors[change.state])
+			fmt.Fprintf(w, `<text x="%.1f" y="%.1f">T%d</text></g>`+"\n", x(change.at)+3, laneTop(node)+12, change.term)
+		}
+	}
+
+	// Commit points
+	for _, commit := range tl.commits {
+		cx, cy := x(commit.at), laneTop(commit.node)+laneHeight-8
+		fmt.Fprintf(w, `<g><title>node %d: commitIndex=%d at %v</title><path d="M %.1f %.1f l 5 5 l -5 5 l -5 -5 z" fill="#c0392b"/><text x="%.1f" y="%.1f" fill="#c0392b">%d</text></g>`+"\n",
+			commit.node, commit.index, commit.at.Round(time.Millisecond), cx, cy-5, cx+6, cy+4, commit.index)
+	}
+
+	// Messages, drawn lane centre to lane centre
+	for _, msg := range tl.messages {
+		if _, ok := lane[msg.to]; !ok {
+			continue
+		}
+		color, marker := rpcArrow(msg.rpc)
+		dash, opacity := "", "0.9"
+		if msg.reply {
+			dash = ` stroke-dasharray="4 3"`
+		}
+		if msg.heartbeat {
+			opacity = "0.35"
+		}
+		fmt.Fprintf(w, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-opacity="%s"%s marker-end="url(#%s)"><title>%d &rarr; %d: %s (%v)</title></line>`+"\n",
+			x(msg.sent), laneMid(msg.from), x(msg.received), laneMid(msg.to), color, opacity, dash, marker,
+			msg.from, msg.to, html.EscapeString(msg.label), (msg.received - msg.sent).Round(time.Millisecond))
+	}
+
+	// Harness actions
+	for i, n := range tl.notes {
+		nx := x(n.at)
+		fmt.Fprintf(w, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#c0392b" stroke-dasharray="2 4"/><text x="%.1f" y="%d" fill="#c0392b">%s</text>`+"\n",
+			nx, 12+(i%4)*16, nx, axisY-10, nx+3, 22+(i%4)*16, html.EscapeString(n.text))
+	}
+
+	fmt.Fprintf(w, "</svg>\n</body></html>\n")
+}
@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Commands live in the log as opaque bytes: a header naming the codec, the
+// command's type and the version of that type, then the command as encoded by
+// the codec:
+//
+//	byte    format of the header, commandFormatVersion
+//	string  codec name, e.g. "gob"
+//	string  command type name, e.g. "kv"
+//	uvarint command type version
+//	...     body
+//
+// where strings are a uvarint length followed by the bytes. Entries written by
+// an older release keep decoding as long as the Go type it used for that type
+// name and version stays registered, so the state machine can still apply them.
+const commandFormatVersion = 1
+
+// Codec turns a command into bytes and back.
+type Codec interface {
+	Name() string
+	Marshal(command interface{}) ([]byte, error)
+	// Unmarshal decodes data into command, a pointer to a new value of the
+	// command's registered type.
+	Unmarshal(data []byte, command interface{}) error
+}
+
+// ProtoMessage is what ProtoCodec needs of a command: the methods that
+// gogoproto generates, or a thin wrapper around proto.Marshal/Unmarshal.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+var (
+	GobCodec   Codec = gobCodec{}
+	JSONCodec  Codec = jsonCodec{}
+	ProtoCodec Codec = protoCodec{}
+)
+
+// Command is a command decoded from a log entry.
+type Command struct {
+	Type    string
+	Version int
+	Value   interface{} // Of the Go type registered for Type and Version
+}
+
+type commandType struct {
+	name    string
+	version int
+}
+
+var commandRegistry = struct {
+	sync.RWMutex
+	codecs   map[string]Codec
+	types    map[commandType]reflect.Type
+	byGoType map[reflect.Type]commandType
+}{
+	codecs:   make(map[string]Codec),
+	types:    make(map[commandType]reflect.Type),
+	byGoType: make(map[reflect.Type]commandType),
+}
+
+func init() {
+	for _, codec := range []Codec{GobCodec, JSONCodec, ProtoCodec} {
+		RegisterCodec(codec)
+	}
+	RegisterCommand("string", 1, "") // What the tests submit
+}
+
+// RegisterCodec makes entries encoded with codec decodable.
+func RegisterCodec(codec Codec) {
+	commandRegistry.Lock()
+	defer commandRegistry.Unlock()
+	commandRegistry.codecs[codec.Name()] = codec
+}
+
+// RegisterCommand declares prototype's Go type to be version version of the
+// command type name. Each Go type has one name and version, which new
+// commands of that type are encoded with; to change a command's layout,
+// register the new Go type as the next version and keep the old one
+// registered so entries already in logs still decode.
+func RegisterCommand(name string, version int, prototype interface{}) {
+	goType := reflect.TypeOf(prototype)
+	key := commandType{name: name, version: version}
+
+	commandRegistry.Lock()
+	defer commandRegistry.Unlock()
+	if existing, ok := commandRegistry.types[key]; ok && existing != goType {
+		panic(fmt.Sprintf("raft: command %s v%d registered as both %v and %v", name, version, existing, goType))
+	}
+	if existing, ok := commandRegistry.byGoType[goType]; ok && existing != key {
+		panic(fmt.Sprintf("raft: %v registered as both command %s v%d and %s v%d", goType, existing.name, existing.version, name, version))
+	}
+	commandRegistry.types[key] = goType
+	commandRegistry.byGoType[goType] = key
+}
+
+// EncodeCommand encodes command with codec, behind the header DecodeCommand needs.
+func EncodeCommand(codec Codec, command interface{}) ([]byte, error) {
+	commandRegistry.RLock()
+	key, ok := commandRegistry.byGoType[reflect.TypeOf(command)]
+	commandRegistry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("raft: %T is not a registered command type; see RegisterCommand", command)
+	}
+
+	body, err := codec.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("raft: encoding %T with %s: %v", command, codec.Name(), err)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)+32))
+	buf.WriteByte(commandFormatVersion)
+	writeHeaderString(buf, codec.Name())
+	writeHeaderString(buf, key.name)
+	buf.Write(binary.AppendUvarint(nil, uint64(key.version)))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func writeHeaderString(buf *bytes.Buffer, s string) {
+	buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	buf.WriteString(s)
+}
+
+// DecodeCommand decodes what EncodeCommand encoded.
+func DecodeCommand(data []byte) (Command, error) {
+	var command Command
+	r := bytes.NewReader(data)
+	format, err := r.ReadByte()
+	if err != nil {
+		return command, errors.New("raft: empty command")
+	}
+	if format != commandFormatVersion {
+		return command, fmt.Errorf("raft: unknown command format %d", format)
+	}
+	codecName, err := readHeaderString(r)
+	if err != nil {
+		return command, err
+	}
+	if command.Type, err = readHeaderString(r); err != nil {
+		return command, err
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return command, fmt.Errorf("raft: bad command header: %v", err)
+	}
+	command.Version = int(version)
+
+	commandRegistry.RLock()
+	codec, codecOk := commandRegistry.codecs[codecName]
+	goType, typeOk := commandRegistry.types[commandType{name: command.Type, version: command.Version}]
+	commandRegistry.RUnlock()
+	if !codecOk {
+		return command, fmt.Errorf("raft: command encoded with unknown codec %q", codecName)
+	}
+	if !typeOk {
+		return command, fmt.Errorf("raft: unknown command type %s v%d", command.Type, command.Version)
+	}
+
+	value := reflect.New(goType)
+	if err := codec.Unmarshal(data[len(data)-r.Len():], value.Interface()); err != nil {
+		return command, fmt.Errorf("raft: decoding %s v%d with %s: %v", command.Type, command.Version, codecName, err)
+	}
+	command.Value = value.Elem().Interface()
+	return command, nil
+}
+
+func readHeaderString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", errors.New("raft: bad command header")
+	}
+	s := make([]byte, n)
+	r.Read(s)
+	return string(s), nil
+}
+
+// describeCommand renders an encoded command for logs and traces.
+func describeCommand(data []byte) string {
+	command, err := DecodeCommand(data)
+	if err != nil {
+		return fmt.Sprintf("<undecodable command: %v>", err)
+	}
+	if s, ok := command.Value.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%+v", command.Value)
+}
+
+func (this LogEntry) String() string {
+	if this.Type == EntryNoop {
+		return fmt.Sprintf("{<no-op> %d}", this.Term)
+	}
+	return fmt.Sprintf("{%s %d}", describeCommand(this.Command), this.Term)
+}
+
+// MarshalJSON shows the decoded command, for journals.
+func (this LogEntry) MarshalJSON() ([]byte, error) {
+	entry := struct {
+		Command interface{}
+		Type    string `json:",omitempty"`
+		Term    int
+	}{Term: this.Term}
+	if this.Type == EntryNoop {
+		entry.Type = "noop"
+	} else if command, err := DecodeCommand(this.Command); err == nil {
+		entry.Command, entry.Type = command.Value, fmt.Sprintf("%s/v%d", command.Type, command.Version)
+	} else {
+		entry.Command = this.Command
+	}
+	return json.Marshal(entry)
+}
+
+// UnmarshalJSON reads an entry back from a journal. The command is journalled
+// decoded, and can't be encoded again without its Go type, so it is left out.
+func (this *LogEntry) UnmarshalJSON(data []byte) error {
+	var entry struct {
+		Type string
+		Term int
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	*this = LogEntry{Term: entry.Term}
+	if entry.Type == "noop" {
+		this.Type = EntryNoop
+	}
+	return nil
+}
+
+/* Codecs */
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(command interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(command)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, command interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(command)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (jsonCodec) Unmarshal(data []byte, command interface{}) error {
+	return json.Unmarshal(data, command)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(command interface{}) ([]byte, error) {
+	message, ok := command.(ProtoMessage)
+	if !ok {
+		// Generated messages implement ProtoMessage on their pointer type
+		pointer := reflect.New(reflect.TypeOf(command))
+		pointer.Elem().Set(reflect.ValueOf(command))
+		if message, ok = pointer.Interface().(ProtoMessage); !ok {
+			return nil, fmt.Errorf("%T is not a ProtoMessage", command)
+		}
+	}
+	return message.Marshal()
+}
+
+func (protoCodec) Unmarshal(data []byte, command interface{}) error {
+	message, ok := command.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a ProtoMessage", command)
+	}
+	return message.Unmarshal(data)
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// protoTestCommand stands in for a generated protobuf message.
+type protoTestCommand struct {
+	Id uint64
+}
+
+func (this *protoTestCommand) Marshal() ([]byte, error) {
+	return binary.AppendUvarint(nil, this.Id), nil
+}
+
+func (this *protoTestCommand) Unmarshal(data []byte) error {
+	id, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errors.New("bad varint")
+	}
+	this.Id = id
+	return nil
+}
+
+// Two versions of the same command, as two releases would have them.
+type renameTestCommandV1 struct{ Name string }
+type renameTestCommandV2 struct{ First, Last string }
+
+func init() {
+	RegisterCommand("codec-test/proto", 1, protoTestCommand{})
+	RegisterCommand("codec-test/rename", 1, renameTestCommandV1{})
+	RegisterCommand("codec-test/rename", 2, renameTestCommandV2{})
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		codec   Codec
+		command interface{}
+		typ     string
+		version int
+	}{
+		{GobCodec, KVCommand{Op: KVPut, Key: "x", Value: "1"}, "kv", 1},
+		{JSONCodec, KVCommand{Op: KVAppend, Key: "y", Value: "2"}, "kv", 1},
+		{GobCodec, "Set X = 5", "string", 1},
+		{ProtoCodec, protoTestCommand{Id: 300}, "codec-test/proto", 1},
+		{JSONCodec, renameTestCommandV1{Name: "Ada Lovelace"}, "codec-test/rename", 1},
+		{GobCodec, renameTestCommandV2{First: "Ada", Last: "Lovelace"}, "codec-test/rename", 2},
+	} {
+		data, err := EncodeCommand(tc.codec, tc.command)
+		if err != nil {
+			t.Fatalf("encoding %v with %s: %v", tc.command, tc.codec.Name(), err)
+		}
+		command, err := DecodeCommand(data)
+		if err != nil {
+			t.Fatalf("decoding %v with %s: %v", tc.command, tc.codec.Name(), err)
+		}
+		if command.Type != tc.typ || command.Version != tc.version || !reflect.DeepEqual(command.Value, tc.command) {
+			t.Fatalf("%s round trip of %v gave %+v", tc.codec.Name(), tc.command, command)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	type unregistered struct{}
+	if _, err := EncodeCommand(GobCodec, unregistered{}); err == nil || !strings.Contains(err.Error(), "not a registered command type") {
+		t.Fatalf("encoding an unregistered type should fail, got %v", err)
+	}
+
+	data, err := EncodeCommand(GobCodec, KVCommand{Op: KVGet, Key: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The header is 1, 3 "gob", 2 "kv", 1 (the version), then the body
+	withByte := func(i int, b byte) []byte {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] = b
+		return corrupt
+	}
+	for name, corrupt := range map[string][]byte{
+		"empty":           nil,
+		"unknown format":  withByte(0, 9),
+		"truncated":       data[:3],
+		"unknown codec":   withByte(2, 'x'),
+		"unknown version": withByte(8, 2),
+	} {
+		if _, err := DecodeCommand(corrupt); err == nil {
+			t.Errorf("%s: decoding should fail", name)
+		}
+	}
+}
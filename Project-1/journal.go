@@ -0,0 +1,246 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types written to a Journal.
+const (
+	EventRPCSend         = "rpc_send"    // Caller sent a request
+	EventRPCReceive      = "rpc_recv"    // Callee received it
+	EventRPCRespond      = "rpc_respond" // Callee replied
+	EventRPCDone         = "rpc_done"    // Caller got the reply, or gave up (Error is set)
+	EventElectionTimeout = "election_timeout"
+	EventStateChange     = "state_change"
+	EventLogAppend       = "log_append"   // Entries appended starting at Index
+	EventLogTruncate     = "log_truncate" // Entries from Index onwards dropped
+	EventCommit          = "commit"       // commitIndex advanced to Index
+	EventApply           = "apply"        // Entry at Index applied to the state machine
+)
+
+// Journals of all nodes in a process share one epoch, so Mono orders their events.
+var journalEpoch = time.Now()
+
+// Event is one line of a Journal. Fields that don't apply to a type are omitted.
+type Event struct {
+	Seq   uint64    `json:"seq"`
+	Mono  int64     `json:"mono"` // Nanoseconds since journalEpoch, from the monotonic clock
+	Wall  time.Time `json:"wall"`
+	Node  int       `json:"node"`
+	Group int       `json:"group,omitempty"` // Raft group; omitted for DefaultGroup
+	Type  string    `json:"type"`
+	Term  int       `json:"term"`
+	State string    `json:"state,omitempty"`
+
+	Peer  *int        `json:"peer,omitempty"`
+	RPC   string      `json:"rpc,omitempty"`
+	MsgId uint64      `json:"msg,omitempty"` // Same on all four events of one RPC
+	Args  interface{} `json:"args,omitempty"`
+	Reply interface{} `json:"reply,omitempty"`
+	Error string      `json:"error,omitempty"`
+
+	From    string     `json:"from,omitempty"` // Previous state, for state_change
+	Index   *int       `json:"index,omitempty"`
+	Entries []LogEntry `json:"entries,omitempty"`
+}
+
+// Journal writes a node's events to w as JSON lines. Safe for concurrent use.
+// Events are encoded as they are emitted, but written to w by a goroutine of
+// the journal's own, so that nodes never wait on w with their lock held; Close
+// writes out whatever is still buffered.
+type Journal struct {
+	mu      sync.Mutex
+	w       io.Writer
+	seq     uint64
+	pending []byte // Encoded events not yet handed to w
+	spare   []byte // Buffer last written out, reused for pending
+	closed  bool
+
+	// Events that could not be encoded or written, and the first reason why
+	failed   uint64
+	firstErr error
+
+	wake chan interface{}
+	done chan interface{}
+}
+
+func NewJournal(w io.Writer) *Journal {
+	this := &Journal{
+		w:    w,
+		wake: make(chan interface{}, 1),
+		done: make(chan interface{}),
+	}
+	go this.run()
+	return this
+}
+
+// Emit stamps event with the next sequence number and the time, and queues
+// it to be written. Events emitted after Close are dropped.
+func (this *Journal) Emit(event Event) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return
+	}
+
+	this.seq++
+	event.Seq = this.seq
+	event.Mono = int64(time.Since(journalEpoch))
+	event.Wall = time.Now()
+	line, err := json.Marshal(event)
+	if err != nil {
+		this.fail(1, fmt.Errorf("encoding %s event %d: %w", event.Type, event.Seq, err))
+		return
+	}
+	this.pending = append(append(this.pending, line...), '\n')
+	select {
+	case this.wake <- nil:
+	default:
+	}
+}
+
+// This function runs as a go routine
+func (this *Journal) run() {
+	defer close(this.done)
+	for range this.wake {
+		this.mu.Lock()
+		buf := this.pending
+		this.pending = this.spare[:0]
+		this.mu.Unlock()
+
+		if len(buf) == 0 {
+			continue
+		}
+		_, err := this.w.Write(buf)
+
+		this.mu.Lock()
+		if err != nil {
+			this.fail(uint64(bytes.Count(buf, []byte{'\n'})), fmt.Errorf("writing journal: %w", err))
+		}
+		this.spare = buf
+		this.mu.Unlock()
+	}
+}
+
+// fail records that n events were lost. Expects this.mu to be held.
+func (this *Journal) fail(n uint64, err error) {
+	this.failed += n
+	if this.firstErr == nil {
+		this.firstErr = err
+	}
+}
+
+// Err reports how many events could not be journalled so far, and why the
+// first of them couldn't.
+func (this *Journal) Err() (failed uint64, first error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.failed, this.firstErr
+}
+
+// Close writes out all events emitted so far and stops the journal. It does
+// not close w. Returns an error if any event was lost.
+func (this *Journal) Close() error {
+	this.mu.Lock()
+	if !this.closed {
+		this.closed = true
+		close(this.wake)
+	}
+	this.mu.Unlock()
+	<-this.done
+
+	if failed, err := this.Err(); err != nil {
+		return fmt.Errorf("%d events not journalled: %w", failed, err)
+	}
+	return nil
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// msgIdentified is implemented by RPC args carrying a MsgId.
+type msgIdentified interface {
+	GetMsgId() uint64
+}
+
+// Message ids are unique per process: the sending server's id, then a counter.
+var msgCounter uint64
+
+func (this *Server) newMsgId() uint64 {
+	return uint64(this.serverId)<<40 | atomic.AddUint64(&msgCounter, 1)
+}
+
+// SetJournal makes this server and its node record events to journal; nil turns it off.
+func (this *Server) SetJournal(journal *Journal) {
+	this.journal.Store(journal)
+}
+
+// emitRPC journals an RPC event; term is taken from the args.
+func (this *Server) emitRPC(eventType string, peerId int, serviceMethod string, args interface{}, reply interface{}, err error) {
+	journal := this.journal.Load()
+	if journal == nil {
+		return
+	}
+
+	event := Event{Node: this.serverId, Type: eventType, Peer: intPtr(peerId), RPC: serviceMethod, Args: args, Reply: reply}
+	if msg, ok := args.(msgIdentified); ok {
+		event.MsgId = msg.GetMsgId()
+	}
+	switch a := args.(type) {
+	case RequestVoteArgs:
+		event.Group, event.Term = a.GroupId, a.Term
+	case AppendEntriesArgs:
+		event.Group, event.Term = a.GroupId, a.Term
+	case TimeoutNowArgs:
+		event.Group, event.Term = a.GroupId, a.Term
+	case InstallSnapshotArgs:
+		event.Group, event.Term = a.GroupId, a.Term
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	journal.Emit(event)
+}
+
+// SetEventObserver has the events of this server's nodes handed to observe as
+// well as journalled, as they happen, with the node's lock held; nil turns it
+// off. Not RPC events, which happen outside of any node.
+func (this *Server) SetEventObserver(observe func(event Event)) {
+	this.observer.Store(&observe)
+}
+
+// emit journals an event about this node, stamped with its current term and
+// state, and hands it to the event observer. Expects this.mu to be held.
+func (this *RaftNode) emit(event Event) {
+	journal := this.server.journal.Load()
+	observe := this.server.observer.Load()
+	if journal == nil && (observe == nil || *observe == nil) {
+		return
+	}
+	event.Node = this.id
+	event.Group = this.groupId
+	event.Term = this.currentTerm
+	event.State = this.state
+	if observe != nil && *observe != nil {
+		(*observe)(event)
+	}
+	if journal != nil {
+		journal.Emit(event)
+	}
+}
+
+// setState changes state, journalling the transition. Expects this.mu to be held.
+func (this *RaftNode) setState(state string) {
+	from := this.state
+	this.state = state
+	if from != state {
+		this.emit(Event{Type: EventStateChange, From: from})
+	}
+}
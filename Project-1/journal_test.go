@@ -0,0 +1,112 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalOfClusterRun(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RAFT_JOURNAL_DIR", dir)
+	cluster := NewCluster(t, 3)
+	leader := cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	awaitApplied(t, cluster, cluster.getServers()[leader].raftLogic.Status().LastApplied)
+	cluster.Shutdown()
+
+	sent := make(map[uint64]bool)
+	var received []uint64
+	for id := 0; id < 3; id++ {
+		events := readJournal(t, filepath.Join(dir, fmt.Sprintf("%d.jsonl", id)))
+		counts := make(map[string]int)
+		for i, event := range events {
+			if event.Seq != uint64(i+1) {
+				t.Fatalf("node %d: event %d has seq %d", id, i, event.Seq)
+			}
+			if i > 0 && event.Mono < events[i-1].Mono {
+				t.Fatalf("node %d: event %d goes back in time: %+v after %+v", id, i, event, events[i-1])
+			}
+			if event.Node != id {
+				t.Fatalf("node %d journalled an event of node %d: %+v", id, event.Node, event)
+			}
+			counts[event.Type]++
+			switch event.Type {
+			case EventRPCSend:
+				sent[event.MsgId] = true
+			case EventRPCReceive:
+				received = append(received, event.MsgId)
+			}
+		}
+		for _, eventType := range []string{EventStateChange, EventLogAppend, EventCommit, EventApply} {
+			if counts[eventType] == 0 {
+				t.Errorf("node %d journalled no %s events: %v", id, eventType, counts)
+			}
+		}
+	}
+	if len(sent) == 0 || len(received) == 0 {
+		t.Fatalf("%d RPCs sent and %d received", len(sent), len(received))
+	}
+	for _, msgId := range received {
+		if !sent[msgId] {
+			t.Errorf("message %x received but never sent", msgId)
+		}
+	}
+}
+
+// readJournal parses a journal file, one Event per line.
+func readJournal(t *testing.T, path string) []Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []Event
+	dec := json.NewDecoder(f)
+	for {
+		var event Event
+		if err := dec.Decode(&event); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("%s: event %d: %v", path, len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestJournalCountsLostEvents(t *testing.T) {
+	journal := NewJournal(failingWriter{})
+	journal.Emit(Event{Type: EventApply, Args: func() {}}) // Can't be encoded
+	journal.Emit(Event{Type: EventCommit, Index: intPtr(1)})
+	journal.Emit(Event{Type: EventApply, Index: intPtr(1)})
+
+	err := journal.Close()
+	if err == nil {
+		t.Fatal("Close reported no lost events")
+	}
+	if failed, _ := journal.Err(); failed != 3 {
+		t.Fatalf("lost events: got %d, want 3 (%v)", failed, err)
+	}
+	if !strings.Contains(err.Error(), "encoding apply event 1") {
+		t.Fatalf("Close: got %v, want the encoding error first", err)
+	}
+
+	journal.Emit(Event{Type: EventCommit}) // Dropped quietly once closed
+	if failed, _ := journal.Err(); failed != 3 {
+		t.Fatalf("lost events after Close: got %d, want 3", failed)
+	}
+}
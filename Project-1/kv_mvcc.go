@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+)
+
+// KVResult.Err, and KVRangeResult.Err, of a read as of a revision that has
+// been compacted away.
+const KVErrCompacted = "revision compacted"
+
+// KVLatestRevision, as KVRange.Revision, reads the latest versions.
+const KVLatestRevision = -1
+
+// KVNoEnd, as KVRange.End, reads every key from KVRange.Key on.
+const KVNoEnd = "\x00"
+
+// KVRange reads the keys from Key up to End, End excluded, in order, as of
+// Revision. An End of "" reads Key alone. With a Limit, it reads that many
+// keys at most; the next page starts after the last key read, and to read the
+// same data it asks for the revision the first page was read as of.
+type KVRange struct {
+	Key      string
+	End      string
+	Revision int
+	Limit    int // 0 for no limit
+}
+
+// KVRangeResult is what KVStore.Apply returns for a KVRange.
+type KVRangeResult struct {
+	KVs      []KVPair
+	More     bool // There are more keys in the range than Limit
+	Revision int  // The revision read as of; the latest one for KVLatestRevision
+	Err      string
+}
+
+type KVPair struct {
+	Key            string
+	Value          string
+	Version        int
+	CreateRevision int
+	ModRevision    int // Of the key's last change as of the revision read
+}
+
+// KVCompact drops the versions of keys that are not needed to read as of
+// Revision or later; reads as of earlier revisions fail with KVErrCompacted,
+// and so do watches from them. Its result is a KVResult.
+type KVCompact struct {
+	Revision int
+}
+
+func init() {
+	RegisterCommand("kv/range", 1, KVRange{})
+	RegisterCommand("kv/compact", 1, KVCompact{})
+	gob.Register(KVRangeResult{})
+}
+
+// KVPrefixEnd returns the End of the KVRange of the keys starting with prefix.
+func KVPrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return KVNoEnd // Every byte is 0xff, or there are none
+}
+
+func (this *KVStore) readRange(query KVRange) KVRangeResult {
+	revision := query.Revision
+	if revision == KVLatestRevision {
+		revision = this.revision
+	}
+	switch {
+	case revision < this.compacted:
+		return KVRangeResult{Err: KVErrCompacted}
+	case revision > this.revision || revision < 0:
+		return KVRangeResult{Err: fmt.Sprintf("no revision %d yet", revision)}
+	}
+
+	result := KVRangeResult{Revision: revision}
+	for i := sort.SearchStrings(this.keys, query.Key); i < len(this.keys); i++ {
+		key := this.keys[i]
+		if query.End == "" && key != query.Key || query.End != "" && query.End != KVNoEnd && key >= query.End {
+			break
+		}
+		version, found := this.at(key, revision)
+		if !found {
+			continue
+		}
+		if query.Limit > 0 && len(result.KVs) == query.Limit {
+			result.More = true
+			break
+		}
+		result.KVs = append(result.KVs, KVPair{Key: key, Value: version.Value, Version: version.Version,
+			CreateRevision: version.CreateRevision, ModRevision: version.Revision})
+	}
+	return result
+}
+
+func (this *KVStore) compact(revision int) KVResult {
+	switch {
+	case revision > this.revision:
+		return KVResult{Err: fmt.Sprintf("no revision %d yet", revision)}
+	case revision <= this.compacted:
+		return KVResult{}
+	}
+
+	keys := this.keys[:0]
+	for _, key := range this.keys {
+		versions := this.history[key]
+		// Keep the version that's current as of revision, unless it's a
+		// deletion, and every later one
+		kept := sort.Search(len(versions), func(i int) bool { return versions[i].Revision > revision }) - 1
+		if kept < 0 || versions[kept].Deleted {
+			kept++
+		}
+		if kept == len(versions) {
+			delete(this.history, key)
+			continue
+		}
+		this.history[key] = append([]KVVersion(nil), versions[kept:]...)
+		keys = append(keys, key)
+	}
+	this.keys = keys
+	this.compacted = revision
+	if this.watches != nil {
+		this.watches.Compact(revision - 1)
+	}
+	return KVResult{}
+}
+
+// load sets the keys of values as of revision index, and compacts the store
+// there: how they came to have those values is history it doesn't have, so
+// reads and watches as of earlier revisions fail with KVErrCompacted.
+func (this *KVStore) load(index int, values map[string]string) {
+	this.revision = index
+	for key, value := range values {
+		this.set(index, key, value)
+	}
+	this.compact(index)
+}
+
+// kvSnapshot is the whole of a KVStore, history and all.
+type kvSnapshot struct {
+	Revision  int
+	Compacted int
+	History   map[string][]KVVersion
+}
+
+func (this *KVStore) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(kvSnapshot{Revision: this.revision, Compacted: this.compacted, History: this.history})
+	return buf.Bytes(), err
+}
+
+// Restore replaces the store with the one in data; the node compacts its
+// watchers' history up to the snapshot.
+func (this *KVStore) Restore(data []byte) error {
+	var snapshot kvSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return err
+	}
+	this.revision, this.compacted, this.history = snapshot.Revision, snapshot.Compacted, snapshot.History
+	if this.history == nil {
+		this.history = make(map[string][]KVVersion)
+	}
+	this.keys = make([]string, 0, len(this.history))
+	for key := range this.history {
+		this.keys = append(this.keys, key)
+	}
+	sort.Strings(this.keys)
+	return nil
+}
@@ -0,0 +1,210 @@
+package raft
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func rangeKeys(result KVRangeResult) []string {
+	var keys []string
+	for _, kv := range result.KVs {
+		keys = append(keys, kv.Key+"="+kv.Value)
+	}
+	return keys
+}
+
+func TestKVHistory(t *testing.T) {
+	store := NewKVStore()
+	applyKV(t, store, 1, KVCommand{Op: KVPut, Key: "a", Value: "1"})
+	applyKV(t, store, 2, KVCommand{Op: KVPut, Key: "b", Value: "1"})
+	applyKV(t, store, 3, KVCommand{Op: KVAppend, Key: "a", Value: "2"})
+	applyKV(t, store, 4, KVCommand{Op: KVDelete, Key: "b"})
+	applyKV(t, store, 5, KVCommand{Op: KVPut, Key: "b", Value: "2"})
+
+	for _, test := range []struct {
+		revision int
+		want     []KVPair
+	}{
+		{0, nil},
+		{1, []KVPair{{Key: "a", Value: "1", Version: 1, CreateRevision: 1, ModRevision: 1}}},
+		{3, []KVPair{{Key: "a", Value: "12", Version: 2, CreateRevision: 1, ModRevision: 3}, {Key: "b", Value: "1", Version: 1, CreateRevision: 2, ModRevision: 2}}},
+		{4, []KVPair{{Key: "a", Value: "12", Version: 2, CreateRevision: 1, ModRevision: 3}}},
+		{KVLatestRevision, []KVPair{{Key: "a", Value: "12", Version: 2, CreateRevision: 1, ModRevision: 3}, {Key: "b", Value: "2", Version: 1, CreateRevision: 5, ModRevision: 5}}},
+	} {
+		result := applyKV(t, store, 6, KVRange{Key: "", End: KVNoEnd, Revision: test.revision}).(KVRangeResult)
+		if result.Err != "" || !reflect.DeepEqual(result.KVs, test.want) {
+			t.Errorf("as of revision %d: got %+v, want %+v", test.revision, result, test.want)
+		}
+	}
+	if result := applyKV(t, store, 7, KVRange{Key: "b", Revision: 2}).(KVRangeResult); !reflect.DeepEqual(rangeKeys(result), []string{"b=1"}) {
+		t.Errorf("b as of revision 2: got %+v", result)
+	}
+	if result := applyKV(t, store, 8, KVRange{Key: "a", Revision: 9}).(KVRangeResult); result.Err == "" {
+		t.Errorf("read as of a future revision: got %+v", result)
+	}
+}
+
+func TestKVRangePagination(t *testing.T) {
+	store := NewKVStore()
+	index := 0
+	apply := func(command interface{}) interface{} {
+		index++
+		return applyKV(t, store, index, command)
+	}
+	for _, key := range []string{"user/3", "user/1", "users", "user/2", "group/1", "user/4"} {
+		apply(KVCommand{Op: KVPut, Key: key, Value: "x"})
+	}
+
+	// Page through user/ two at a time, while the keys keep changing
+	var pages [][]string
+	query := KVRange{Key: "user/", End: KVPrefixEnd("user/"), Revision: KVLatestRevision, Limit: 2}
+	for {
+		result := apply(query).(KVRangeResult)
+		if result.Err != "" {
+			t.Fatal(result.Err)
+		}
+		pages = append(pages, rangeKeys(result))
+		apply(KVCommand{Op: KVDelete, Key: "user/3"})
+		apply(KVCommand{Op: KVPut, Key: "user/0", Value: "y"})
+		if !result.More {
+			break
+		}
+		query.Key, query.Revision = result.KVs[len(result.KVs)-1].Key+"\x00", result.Revision
+	}
+	if want := [][]string{{"user/1=x", "user/2=x"}, {"user/3=x", "user/4=x"}}; !reflect.DeepEqual(pages, want) {
+		t.Fatalf("pages: got %v, want %v", pages, want)
+	}
+	if end := KVPrefixEnd("a\xff\xff"); end != "b" {
+		t.Fatalf("end of prefix a\\xff\\xff: got %q", end)
+	}
+}
+
+func TestKVCompact(t *testing.T) {
+	store := NewKVStore()
+	hub := NewWatchHub()
+	store.SetWatchHub(hub)
+	for index, cmd := range []KVCommand{
+		{Op: KVPut, Key: "a", Value: "1"},
+		{Op: KVPut, Key: "b", Value: "1"},
+		{Op: KVPut, Key: "a", Value: "2"},
+		{Op: KVDelete, Key: "b"},
+		{Op: KVPut, Key: "a", Value: "3"},
+	} {
+		applyKV(t, store, index, cmd)
+		hub.applied(index)
+	}
+
+	if result := applyKV(t, store, 5, KVCompact{Revision: 3}); result != (KVResult{}) {
+		t.Fatalf("compact: %+v", result)
+	}
+	if result := applyKV(t, store, 6, KVRange{Key: "a", Revision: 2}).(KVRangeResult); result.Err != KVErrCompacted {
+		t.Fatalf("read as of a compacted revision: got %+v", result)
+	}
+	if result := applyKV(t, store, 7, KVRange{Key: "", End: KVNoEnd, Revision: 3}).(KVRangeResult); !reflect.DeepEqual(rangeKeys(result), []string{"a=2"}) {
+		t.Fatalf("read as of the compaction: got %+v", result)
+	}
+	if versions := len(store.history["a"]); versions != 2 || store.history["b"] != nil {
+		t.Fatalf("history kept: a has %d versions, b %v", versions, store.history["b"])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := hub.Events(ctx, "a", false, 2, 0); err != ErrCompacted {
+		t.Fatalf("watch from a compacted revision: got %v", err)
+	}
+}
+
+func TestKVSnapshot(t *testing.T) {
+	sessions := NewSessions(NewKVStore(), DefaultSessionTTL)
+	register, _ := EncodeCommand(GobCodec, SessionRegister{})
+	client := &ClientSession{ClientId: sessions.Apply(0, LogEntry{Command: register, Time: 1}).(uint64)}
+	put, _ := client.Next(GobCodec, KVCommand{Op: KVPut, Key: "a", Value: "1"})
+	appendA, _ := client.Next(GobCodec, KVCommand{Op: KVAppend, Key: "a", Value: "2"})
+	for index, request := range []SessionRequest{put, appendA} {
+		data, _ := EncodeCommand(GobCodec, request)
+		sessions.Apply(index+1, LogEntry{Command: data, Time: 2})
+	}
+	compact, _ := EncodeCommand(GobCodec, KVCompact{Revision: 2})
+	sessions.Apply(3, LogEntry{Command: compact, Time: 3})
+
+	data, err := sessions.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewSessions(NewKVStore(), DefaultSessionTTL)
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history, the compaction and the sessions all survive
+	retry, _ := EncodeCommand(GobCodec, appendA)
+	restored.Apply(4, LogEntry{Command: retry, Time: 4})
+	read, _ := EncodeCommand(GobCodec, KVRange{Key: "a", Revision: KVLatestRevision})
+	if result := restored.Apply(5, LogEntry{Command: read, Time: 5}).(KVRangeResult); !reflect.DeepEqual(rangeKeys(result), []string{"a=12"}) || result.KVs[0].ModRevision != 2 {
+		t.Fatalf("after restoring: got %+v", result)
+	}
+	readOld, _ := EncodeCommand(GobCodec, KVRange{Key: "a", Revision: 1})
+	if result := restored.Apply(6, LogEntry{Command: readOld, Time: 6}).(KVRangeResult); result.Err != KVErrCompacted {
+		t.Fatalf("read as of a compacted revision after restoring: got %+v", result)
+	}
+}
+
+// A follower sent a snapshot gets the store's history, its compaction point
+// and the client sessions along with the latest values.
+func TestKVSnapshotInstalled(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	lagging := (leader + 1) % 3
+	cluster.DisconnectPeer(lagging)
+	submit := func(id int, command interface{}) interface{} {
+		t.Helper()
+		result, err := cluster.ExecuteClientCommand(id, command, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	client := &ClientSession{ClientId: submit(leader, SessionRegister{}).(uint64)}
+	put, _ := client.Next(GobCodec, KVCommand{Op: KVPut, Key: "a", Value: "1"})
+	appendA, _ := client.Next(GobCodec, KVCommand{Op: KVAppend, Key: "a", Value: "2"})
+	submit(leader, put)
+	appended := submit(leader, appendA)
+	submit(leader, KVCommand{Op: KVPut, Key: "b", Value: "1"})
+	latest := submit(leader, KVRange{Key: "", End: KVNoEnd, Revision: KVLatestRevision}).(KVRangeResult)
+	compactAt := latest.KVs[0].ModRevision // Of the append
+	submit(leader, KVCompact{Revision: compactAt})
+
+	snapshotAllBut(t, cluster, leader, lagging)
+	cluster.ReconnectPeer(lagging)
+	awaitSnapshot(t, cluster.getServers()[lagging].raftLogic, compactAt)
+
+	// Read it all back from the follower, as the leader
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := cluster.getServers()[cluster.getClusterLeader()].raftLogic.TransferLeadership(ctx, lagging); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := cluster.getClusterLeader(); newLeader != lagging {
+		t.Fatalf("leader after the transfer: got %d, want %d", newLeader, lagging)
+	}
+	if result := submit(lagging, KVRange{Key: "", End: KVNoEnd, Revision: latest.Revision}).(KVRangeResult); !reflect.DeepEqual(result.KVs, latest.KVs) {
+		t.Fatalf("as of revision %d: got %+v, want %+v", latest.Revision, result.KVs, latest.KVs)
+	}
+	if result := submit(lagging, KVRange{Key: "a", Revision: compactAt - 1}).(KVRangeResult); result.Err != KVErrCompacted {
+		t.Fatalf("read as of a compacted revision: got %+v", result)
+	}
+	// Its watchers can't be told about the changes the snapshot covers
+	if _, _, err := cluster.getServers()[lagging].raftLogic.WatchEvents("a", false, compactAt, 0, time.Second); err != ErrCompacted {
+		t.Fatalf("watch from before the snapshot: got %v", err)
+	}
+	// A retry of a request applied before the snapshot isn't applied again
+	if result := submit(lagging, appendA); result != appended {
+		t.Fatalf("retried append: got %+v, first time %+v", result, appended)
+	}
+	if result := submit(lagging, KVRange{Key: "a", Revision: KVLatestRevision}).(KVRangeResult); !reflect.DeepEqual(rangeKeys(result), []string{"a=12"}) {
+		t.Fatalf("a after the retry: got %+v", result)
+	}
+}
@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+)
+
+// Operations understood by KVStore.
+const (
+	KVGet    = "Get"
+	KVPut    = "Put"
+	KVAppend = "Append"
+	KVDelete = "Delete"
+)
+
+// KVCommand is a client command for KVStore. Reads go through the log as
+// well, which makes them linearizable at the cost of a round of replication.
+type KVCommand struct {
+	Op    string
+	Key   string
+	Value string
+}
+
+// KVResult is what KVStore.Apply returns for a KVCommand.
+type KVResult struct {
+	Value string
+	Found bool
+	Err   string
+}
+
+func init() {
+	RegisterCommand("kv", 1, KVCommand{})
+	gob.Register(KVResult{}) // Returned to raftctl inside an interface{}
+}
+
+// KVStore is an in-memory key/value StateMachine that keeps every version of
+// every key, back to the last KVCompact, keyed by the index of the log entry
+// that made it: its revision. Besides KVCommands, which act on the latest
+// versions, it takes KVTxns, and KVRanges that read the keys in order as of
+// any revision since the last compaction. It's Watchable, and a Snapshotter.
+type KVStore struct {
+	history   map[string][]KVVersion // Each key's versions, oldest first
+	keys      []string               // Of history, sorted
+	revision  int                    // Of the last entry applied
+	compacted int                    // Reads as of an earlier revision fail with KVErrCompacted
+	watches   *WatchHub
+}
+
+// KVVersion is a key as of the change at Revision.
+type KVVersion struct {
+	Revision       int
+	Value          string
+	Deleted        bool // The change deleted the key; the other fields are unset
+	Version        int  // Changes since the key was created, that one included
+	CreateRevision int
+}
+
+func NewKVStore() *KVStore {
+	return &KVStore{history: make(map[string][]KVVersion), revision: -1, compacted: -1}
+}
+
+func (this *KVStore) SetWatchHub(hub *WatchHub) {
+	this.watches = hub
+}
+
+func (this *KVStore) Apply(index int, entry LogEntry) interface{} {
+	this.revision = index
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return KVResult{Err: err.Error()}
+	}
+	switch cmd := command.Value.(type) {
+	case KVCommand:
+		return this.apply(index, cmd)
+	case KVTxn:
+		return this.applyTxn(index, cmd)
+	case KVRange:
+		return this.readRange(cmd)
+	case KVCompact:
+		return this.compact(cmd.Revision)
+	}
+	return KVResult{Err: fmt.Sprintf("not a KVCommand: %s v%d", command.Type, command.Version)}
+}
+
+func (this *KVStore) apply(index int, cmd KVCommand) KVResult {
+	switch cmd.Op {
+	case KVGet:
+		latest, found := this.latest(cmd.Key)
+		return KVResult{Value: latest.Value, Found: found}
+	case KVPut:
+		this.set(index, cmd.Key, cmd.Value)
+		return KVResult{}
+	case KVAppend:
+		latest, _ := this.latest(cmd.Key)
+		this.set(index, cmd.Key, latest.Value+cmd.Value)
+		return KVResult{}
+	case KVDelete:
+		_, found := this.latest(cmd.Key)
+		if found {
+			this.change(cmd.Key, KVVersion{Revision: index, Deleted: true})
+			this.watches.publish(WatchEvent{Revision: index, Type: WatchDelete, Key: cmd.Key})
+		}
+		return KVResult{Found: found}
+	}
+	return KVResult{Err: "unknown op " + cmd.Op}
+}
+
+func (this *KVStore) set(index int, key string, value string) {
+	version := KVVersion{Revision: index, Value: value, Version: 1, CreateRevision: index}
+	if latest, found := this.latest(key); found {
+		version.Version, version.CreateRevision = latest.Version+1, latest.CreateRevision
+	}
+	this.change(key, version)
+	this.watches.publish(WatchEvent{Revision: index, Type: WatchPut, Key: key, Value: value})
+}
+
+// change adds version to the history of key; a later change by the same
+// entry, in a Txn, replaces an earlier one.
+func (this *KVStore) change(key string, version KVVersion) {
+	versions, ok := this.history[key]
+	if !ok {
+		at := sort.SearchStrings(this.keys, key)
+		this.keys = append(this.keys, "")
+		copy(this.keys[at+1:], this.keys[at:])
+		this.keys[at] = key
+	}
+	if n := len(versions); n > 0 && versions[n-1].Revision == version.Revision {
+		versions = versions[:n-1]
+	}
+	this.history[key] = append(versions, version)
+}
+
+// at returns key as of revision, and whether it existed then.
+func (this *KVStore) at(key string, revision int) (KVVersion, bool) {
+	versions := this.history[key]
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].Revision > revision }) - 1
+	if i < 0 || versions[i].Deleted {
+		return KVVersion{}, false
+	}
+	return versions[i], true
+}
+
+func (this *KVStore) latest(key string) (KVVersion, bool) {
+	return this.at(key, this.revision)
+}
+
+// values returns the latest value of every key.
+func (this *KVStore) values() map[string]string {
+	values := make(map[string]string, len(this.keys))
+	for _, key := range this.keys {
+		if latest, found := this.latest(key); found {
+			values[key] = latest.Value
+		}
+	}
+	return values
+}
@@ -0,0 +1,144 @@
+package raft
+
+import (
+	"cmp"
+	"encoding/gob"
+	"fmt"
+)
+
+// What a KVCompare compares.
+const (
+	KVCompareValue    = "Value"
+	KVCompareVersion  = "Version"  // How many times the key has changed since it was created; 0 if it doesn't exist
+	KVCompareRevision = "Revision" // Log index of the key's last change; -1 if it doesn't exist
+)
+
+// KVCompare is a condition on a key: that its Target, compared with Op
+// ("=", "!=", "<" or ">"), matches the field of the same name.
+type KVCompare struct {
+	Key      string
+	Target   string
+	Op       string
+	Value    string
+	Version  int
+	Revision int
+}
+
+func CompareValue(key string, op string, value string) KVCompare {
+	return KVCompare{Key: key, Target: KVCompareValue, Op: op, Value: value}
+}
+
+func CompareVersion(key string, op string, version int) KVCompare {
+	return KVCompare{Key: key, Target: KVCompareVersion, Op: op, Version: version}
+}
+
+func CompareRevision(key string, op string, revision int) KVCompare {
+	return KVCompare{Key: key, Target: KVCompareRevision, Op: op, Revision: revision}
+}
+
+// KVTxn runs Then if every one of Compare holds, and Else otherwise, as a
+// single log entry: no other command sees, or changes, the keys in between.
+// A Txn with a malformed compare or command does nothing at all.
+type KVTxn struct {
+	Compare []KVCompare
+	Then    []KVCommand
+	Else    []KVCommand
+}
+
+// KVTxnResult is what KVStore.Apply returns for a KVTxn: which branch ran,
+// and the result of each of its commands, in order.
+type KVTxnResult struct {
+	Succeeded bool // Then ran
+	Results   []KVTxnOpResult
+	Err       string
+}
+
+// KVTxnOpResult is the result of a command in a KVTxn; those of Gets have
+// the key's Version and Revision as well, to compare with in a later Txn.
+type KVTxnOpResult struct {
+	KVResult
+	Version  int
+	Revision int
+}
+
+func init() {
+	RegisterCommand("kv/txn", 1, KVTxn{})
+	gob.Register(KVTxnResult{})
+}
+
+func (this *KVStore) applyTxn(index int, txn KVTxn) KVTxnResult {
+	if err := txn.check(); err != nil {
+		return KVTxnResult{Err: err.Error()}
+	}
+
+	succeeded := true
+	for _, compare := range txn.Compare {
+		succeeded = succeeded && this.holds(compare)
+	}
+	ops := txn.Else
+	if succeeded {
+		ops = txn.Then
+	}
+
+	result := KVTxnResult{Succeeded: succeeded, Results: make([]KVTxnOpResult, len(ops))}
+	for i, op := range ops {
+		result.Results[i].KVResult = this.apply(index, op)
+		if op.Op == KVGet {
+			result.Results[i].Version, result.Results[i].Revision = this.version(op.Key)
+		}
+	}
+	return result
+}
+
+// check returns why txn can't be applied, if it can't.
+func (this KVTxn) check() error {
+	for _, compare := range this.Compare {
+		switch {
+		case compare.Target != KVCompareValue && compare.Target != KVCompareVersion && compare.Target != KVCompareRevision:
+			return fmt.Errorf("unknown compare target %q", compare.Target)
+		case compare.Op != "=" && compare.Op != "!=" && compare.Op != "<" && compare.Op != ">":
+			return fmt.Errorf("unknown compare op %q", compare.Op)
+		}
+	}
+	for _, ops := range [][]KVCommand{this.Then, this.Else} {
+		for _, op := range ops {
+			if op.Op != KVGet && op.Op != KVPut && op.Op != KVAppend && op.Op != KVDelete {
+				return fmt.Errorf("unknown op %q", op.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// version returns the Version and Revision of key.
+func (this *KVStore) version(key string) (int, int) {
+	latest, found := this.latest(key)
+	if !found {
+		return 0, -1
+	}
+	return latest.Version, latest.Revision
+}
+
+func (this *KVStore) holds(compare KVCompare) bool {
+	version, revision := this.version(compare.Key)
+	var order int
+	switch compare.Target {
+	case KVCompareValue:
+		latest, _ := this.latest(compare.Key)
+		order = cmp.Compare(latest.Value, compare.Value)
+	case KVCompareVersion:
+		order = cmp.Compare(version, compare.Version)
+	case KVCompareRevision:
+		order = cmp.Compare(revision, compare.Revision)
+	}
+
+	switch compare.Op {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	}
+	return order > 0
+}
@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// applyKV applies command to store as the entry at index.
+func applyKV(t *testing.T, store *KVStore, index int, command interface{}) interface{} {
+	t.Helper()
+	data, err := EncodeCommand(GobCodec, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Apply(index, LogEntry{Command: data})
+}
+
+func TestKVTxn(t *testing.T) {
+	store := NewKVStore()
+	hub := NewWatchHub()
+	store.SetWatchHub(hub)
+	applyKV(t, store, 1, KVCommand{Op: KVPut, Key: "x", Value: "2"})
+	applyKV(t, store, 2, KVCommand{Op: KVPut, Key: "y", Value: "3"})
+
+	// Set y = x + y: read both, then write y only if neither changed since
+	read := applyKV(t, store, 3, KVTxn{Then: []KVCommand{{Op: KVGet, Key: "x"}, {Op: KVGet, Key: "y"}, {Op: KVGet, Key: "z"}}}).(KVTxnResult)
+	want := KVTxnResult{Succeeded: true, Results: []KVTxnOpResult{
+		{KVResult: KVResult{Value: "2", Found: true}, Version: 1, Revision: 1},
+		{KVResult: KVResult{Value: "3", Found: true}, Version: 1, Revision: 2},
+		{Version: 0, Revision: -1},
+	}}
+	if !reflect.DeepEqual(read, want) {
+		t.Fatalf("reads: got %+v, want %+v", read, want)
+	}
+	setY := func(x, y KVTxnOpResult) KVTxn {
+		a, _ := strconv.Atoi(x.Value)
+		b, _ := strconv.Atoi(y.Value)
+		return KVTxn{
+			Compare: []KVCompare{CompareRevision("x", "=", x.Revision), CompareRevision("y", "=", y.Revision)},
+			Then:    []KVCommand{{Op: KVPut, Key: "y", Value: strconv.Itoa(a + b)}},
+			Else:    []KVCommand{{Op: KVGet, Key: "x"}, {Op: KVGet, Key: "y"}},
+		}
+	}
+	stale := setY(read.Results[0], read.Results[1])
+
+	applyKV(t, store, 4, KVCommand{Op: KVAppend, Key: "x", Value: "0"}) // x = 20, meanwhile
+	lost := applyKV(t, store, 5, stale).(KVTxnResult)
+	if lost.Succeeded || len(lost.Results) != 2 || lost.Results[0].Value != "20" || lost.Results[0].Version != 2 || lost.Results[0].Revision != 4 {
+		t.Fatalf("txn after a concurrent change: got %+v", lost)
+	}
+	won := applyKV(t, store, 6, setY(lost.Results[0], lost.Results[1])).(KVTxnResult)
+	if !won.Succeeded || len(won.Results) != 1 {
+		t.Fatalf("retried txn: got %+v", won)
+	}
+	if result := applyKV(t, store, 7, KVCommand{Op: KVGet, Key: "y"}); result != (KVResult{Value: "23", Found: true}) {
+		t.Fatalf("y: got %+v", result)
+	}
+
+	// Comparisons on values and versions, one of them false
+	swap := KVTxn{
+		Compare: []KVCompare{CompareValue("x", ">", "1"), CompareVersion("y", "=", 2), CompareVersion("z", "!=", 0)},
+		Then:    []KVCommand{{Op: KVDelete, Key: "x"}},
+		Else:    []KVCommand{{Op: KVDelete, Key: "x"}, {Op: KVPut, Key: "z", Value: "x was 20"}},
+	}
+	if result := applyKV(t, store, 8, swap).(KVTxnResult); result.Succeeded || len(result.Results) != 2 || !result.Results[0].Found {
+		t.Fatalf("swap: got %+v", result)
+	}
+
+	// A malformed Txn changes nothing, not even what comes before the bad part
+	bad := KVTxn{Then: []KVCommand{{Op: KVPut, Key: "y", Value: "0"}, {Op: "Increment", Key: "y"}}}
+	if result := applyKV(t, store, 9, bad).(KVTxnResult); result.Err == "" {
+		t.Fatalf("malformed txn: got %+v", result)
+	}
+	if result := applyKV(t, store, 10, KVCommand{Op: KVGet, Key: "y"}); result != (KVResult{Value: "23", Found: true}) {
+		t.Fatalf("y after a malformed txn: got %+v", result)
+	}
+
+	// Watchers get every change a Txn made, at the Txn's revision
+	hub.applied(10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	events, _, err := hub.Events(ctx, "", true, 8, 0)
+	if err != nil || !reflect.DeepEqual(events, []WatchEvent{{Revision: 8, Type: WatchDelete, Key: "x"}, {Revision: 8, Type: WatchPut, Key: "z", Value: "x was 20"}}) {
+		t.Fatalf("events of the swap: got %+v, %v", events, err)
+	}
+}
@@ -0,0 +1,450 @@
+package raft
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Operation is one client operation in a history. Call and Return are
+// timestamps in nanoseconds since the history started; Return is
+// math.MaxInt64 if the client never learned the outcome, in which case the
+// operation may or may not have taken effect.
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Output   interface{}
+	Call     int64
+	Return   int64
+}
+
+// Model is a sequential specification that histories are checked against.
+type Model struct {
+	// Optional. Splits a history into independent parts, e.g. one per key.
+	Partition func(history []Operation) [][]Operation
+	Init      func() interface{}
+	// Step reports whether output is a valid result for input in state, and the resulting state.
+	Step  func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	Equal func(state1, state2 interface{}) bool
+	// Optional, used when visualising histories.
+	DescribeOperation func(input interface{}, output interface{}) string
+	DescribeState     func(state interface{}) string
+}
+
+type CheckResult string
+
+const (
+	CheckOk      CheckResult = "Ok"
+	CheckIllegal CheckResult = "Illegal"
+	CheckUnknown CheckResult = "Unknown" // Ran out of time
+)
+
+// LinearizationInfo describes how far the checker got with each partition of
+// a history; it is what Visualize draws.
+type LinearizationInfo struct {
+	Partitions []PartitionInfo
+}
+
+type PartitionInfo struct {
+	Result     CheckResult
+	History    []Operation
+	Longest    []int // Indexes into History of the longest linearizable prefix found, in order
+	StatesText []string
+}
+
+// CheckOperations checks whether history is linearizable with respect to model,
+// using the Wing & Gong algorithm with Lowe's memoization, as Porcupine does.
+// A timeout of zero means no limit.
+func CheckOperations(model Model, history []Operation, timeout time.Duration) (CheckResult, LinearizationInfo) {
+	fillDefaults(&model)
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	var info LinearizationInfo
+	result := CheckOk
+	for _, partition := range model.Partition(history) {
+		partitionResult, longest := checkPartition(model, partition, deadline)
+		info.Partitions = append(info.Partitions, PartitionInfo{
+			Result:     partitionResult,
+			History:    partition,
+			Longest:    longest,
+			StatesText: describeStates(model, partition, longest),
+		})
+
+		if partitionResult == CheckIllegal {
+			result = CheckIllegal
+		} else if partitionResult == CheckUnknown && result == CheckOk {
+			result = CheckUnknown
+		}
+	}
+	return result, info
+}
+
+func fillDefaults(model *Model) {
+	if model.Partition == nil {
+		model.Partition = func(history []Operation) [][]Operation { return [][]Operation{history} }
+	}
+	if model.Equal == nil {
+		model.Equal = func(state1, state2 interface{}) bool { return state1 == state2 }
+	}
+	if model.DescribeOperation == nil {
+		model.DescribeOperation = func(input, output interface{}) string { return fmt.Sprintf("%v -> %v", input, output) }
+	}
+	if model.DescribeState == nil {
+		model.DescribeState = func(state interface{}) string { return fmt.Sprintf("%v", state) }
+	}
+}
+
+// The history is turned into a doubly linked list of call and return events
+// sorted by time. A call node points at its matching return node.
+type lzNode struct {
+	id    int
+	value interface{} // Input for calls, output for returns
+	match *lzNode     // Set for calls only
+	prev  *lzNode
+	next  *lzNode
+}
+
+type lzEvent struct {
+	id     int
+	isCall bool
+	time   int64
+}
+
+// sortedEvents orders call and return events by time; on ties calls come
+// first, so that operations touching at an instant count as concurrent.
+func sortedEvents(history []Operation) []lzEvent {
+	events := make([]lzEvent, 0, 2*len(history))
+	for id, op := range history {
+		events = append(events, lzEvent{id: id, isCall: true, time: op.Call})
+		events = append(events, lzEvent{id: id, isCall: false, time: op.Return})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].isCall && !events[j].isCall
+	})
+	return events
+}
+
+// makeList builds the event list and returns a sentinel node in front of it.
+func makeList(history []Operation) *lzNode {
+	head := new(lzNode)
+	tail := head
+	returns := make(map[int]*lzNode)
+
+	events := sortedEvents(history)
+	nodes := make([]*lzNode, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.isCall {
+			nodes[i] = &lzNode{id: event.id, value: history[event.id].Input, match: returns[event.id]}
+		} else {
+			nodes[i] = &lzNode{id: event.id, value: history[event.id].Output}
+			returns[event.id] = nodes[i]
+		}
+	}
+	for _, node := range nodes {
+		tail.next = node
+		node.prev = tail
+		tail = node
+	}
+	return head
+}
+
+// lift takes a call and its return out of the list; unlift puts them back.
+func lift(call *lzNode) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+func unlift(call *lzNode) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+type lzBitset []uint64
+
+func newBitset(n int) lzBitset { return make(lzBitset, (n+63)/64) }
+
+func (this lzBitset) clone() lzBitset { return append(lzBitset(nil), this...) }
+func (this lzBitset) set(i int)       { this[i/64] |= 1 << uint(i%64) }
+func (this lzBitset) clear(i int)     { this[i/64] &^= 1 << uint(i%64) }
+
+func (this lzBitset) equals(other lzBitset) bool {
+	for i := range this {
+		if this[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (this lzBitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, word := range this {
+		h = (h ^ word) * 1099511628211
+	}
+	return h
+}
+
+type lzCacheEntry struct {
+	linearized lzBitset
+	state      interface{}
+}
+
+type lzFrame struct {
+	call  *lzNode
+	state interface{}
+}
+
+// checkPartition returns whether history is linearizable, along with the
+// longest linearizable prefix it found (as operation ids, in order).
+func checkPartition(model Model, history []Operation, deadline time.Time) (CheckResult, []int) {
+	head := makeList(history)
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]lzCacheEntry)
+	var calls []lzFrame
+	var longest []int
+
+	state := model.Init()
+	entry := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%1024 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return CheckUnknown, longest
+		}
+
+		if entry.match != nil {
+			ok, newState := model.Step(state, entry.value, entry.match.value)
+			if ok {
+				newLinearized := linearized.clone()
+				newLinearized.set(entry.id)
+				if !cacheContains(model, cache, newLinearized, newState) {
+					h := newLinearized.hash()
+					cache[h] = append(cache[h], lzCacheEntry{newLinearized, newState})
+					calls = append(calls, lzFrame{entry, state})
+					if len(calls) > len(longest) {
+						longest = longest[:0]
+						for _, frame := range calls {
+							longest = append(longest, frame.call.id)
+						}
+					}
+
+					state = newState
+					linearized.set(entry.id)
+					lift(entry)
+					entry = head.next
+					continue
+				}
+			}
+			entry = entry.next
+			continue
+		}
+
+		// Reached a return whose call we couldn't linearize: backtrack.
+		if len(calls) == 0 {
+			return CheckIllegal, longest
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		entry, state = top.call, top.state
+		linearized.clear(entry.id)
+		unlift(entry)
+		entry = entry.next
+	}
+	return CheckOk, longest
+}
+
+func cacheContains(model Model, cache map[uint64][]lzCacheEntry, linearized lzBitset, state interface{}) bool {
+	for _, cached := range cache[linearized.hash()] {
+		if linearized.equals(cached.linearized) && model.Equal(state, cached.state) {
+			return true
+		}
+	}
+	return false
+}
+
+func describeStates(model Model, history []Operation, order []int) []string {
+	states := make([]string, 0, len(order))
+	state := model.Init()
+	for _, id := range order {
+		_, state = model.Step(state, history[id].Input, history[id].Output)
+		states = append(states, model.DescribeState(state))
+	}
+	return states
+}
+
+/* VISUALISATION */
+
+const (
+	vizRowHeight   = 36
+	vizEventWidth  = 28
+	vizLeftMargin  = 90
+	vizTopMargin   = 10
+	vizLegendSpace = 20
+)
+
+// Visualize writes a standalone HTML page drawing every partition of a checked
+// history: one row per client, one bar per operation spanning its call and
+// return. Operations in the longest linearizable prefix are green and numbered
+// in linearization order; the rest, which no valid order could place, are red.
+func Visualize(model Model, info LinearizationInfo, w io.Writer) error {
+	fillDefaults(&model)
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Linearizability check</title>\n")
+	fmt.Fprintf(w, "<style>body{font-family:sans-serif} text{font-size:11px} .ok{fill:#b7e1b0} .bad{fill:#f4b3b3} .unknown{stroke-dasharray:4}</style></head><body>\n")
+
+	for p, partition := range info.Partitions {
+		fmt.Fprintf(w, "<h3>Partition %d: %s</h3>\n", p, partition.Result)
+		visualizePartition(model, partition, w)
+	}
+
+	_, err := fmt.Fprintf(w, "</body></html>\n")
+	return err
+}
+
+func visualizePartition(model Model, partition PartitionInfo, w io.Writer) {
+	history := partition.History
+
+	// X positions are event ranks rather than real time, so that short
+	// operations stay readable next to long ones.
+	rank := make(map[int][2]int)
+	for r, event := range sortedEvents(history) {
+		pos := rank[event.id]
+		if event.isCall {
+			pos[0] = r
+		} else {
+			pos[1] = r
+		}
+		rank[event.id] = pos
+	}
+
+	rows := make(map[int]int)
+	var clients []int
+	for _, op := range history {
+		if _, ok := rows[op.ClientId]; !ok {
+			rows[op.ClientId] = 0
+			clients = append(clients, op.ClientId)
+		}
+	}
+	sort.Ints(clients)
+	for row, client := range clients {
+		rows[client] = row
+	}
+
+	order := make(map[int]int)
+	for i, id := range partition.Longest {
+		order[id] = i + 1
+	}
+
+	width := vizLeftMargin + vizEventWidth*(2*len(history)+1)
+	height := vizTopMargin + vizRowHeight*len(clients) + vizLegendSpace
+	fmt.Fprintf(w, "<svg width=\"%d\" height=\"%d\">\n", width, height)
+	for _, client := range clients {
+		y := vizTopMargin + vizRowHeight*rows[client]
+		fmt.Fprintf(w, "<text x=\"4\" y=\"%d\">client %d</text>\n", y+vizRowHeight/2, client)
+	}
+
+	for id, op := range history {
+		x1 := vizLeftMargin + vizEventWidth*rank[id][0]
+		x2 := vizLeftMargin + vizEventWidth*rank[id][1] + vizEventWidth/2
+		y := vizTopMargin + vizRowHeight*rows[op.ClientId] + 4
+
+		class := "bad"
+		label := model.DescribeOperation(op.Input, op.Output)
+		if n, ok := order[id]; ok {
+			class = "ok"
+			label = fmt.Sprintf("%d. %s", n, label)
+		}
+		if op.Return == math.MaxInt64 {
+			class += " unknown"
+		}
+		fmt.Fprintf(w, "<g><title>%s</title><rect class=\"%s\" x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" stroke=\"#555\"/>", html.EscapeString(label), class, x1, y, x2-x1, vizRowHeight-8)
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">%s</text></g>\n", x1+3, y+vizRowHeight/2, html.EscapeString(label))
+	}
+	fmt.Fprintf(w, "</svg>\n")
+
+	fmt.Fprintf(w, "<ol>\n")
+	for i, id := range partition.Longest {
+		op := history[id]
+		fmt.Fprintf(w, "<li>client %d: %s &rarr; state %s</li>\n", op.ClientId, html.EscapeString(model.DescribeOperation(op.Input, op.Output)), html.EscapeString(partition.StatesText[i]))
+	}
+	fmt.Fprintf(w, "</ol>\n")
+	if partition.Result == CheckIllegal {
+		fmt.Fprintf(w, "<p>No valid order extends the prefix above to any of the red operations.</p>\n")
+	}
+}
+
+/* MODELS */
+
+// KVModel specifies KVStore: a map of independent string registers, each
+// partitioned into its own history. Operations with unknown output (nil)
+// are accepted with any result.
+var KVModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		byKey := make(map[string][]Operation)
+		var keys []string
+		for _, op := range history {
+			key := op.Input.(KVCommand).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		sort.Strings(keys)
+
+		partitions := make([][]Operation, 0, len(keys))
+		for _, key := range keys {
+			partitions = append(partitions, byKey[key])
+		}
+		return partitions
+	},
+	Init: func() interface{} { return "" },
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		value := state.(string)
+		cmd := input.(KVCommand)
+		switch cmd.Op {
+		case KVGet:
+			result, known := output.(KVResult)
+			return !known || result.Value == value, value
+		case KVPut:
+			return true, cmd.Value
+		case KVAppend:
+			return true, value + cmd.Value
+		case KVDelete:
+			return true, ""
+		}
+		return false, value
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		cmd := input.(KVCommand)
+		switch cmd.Op {
+		case KVGet:
+			if result, known := output.(KVResult); known {
+				return fmt.Sprintf("get(%q) -> %q", cmd.Key, result.Value)
+			}
+			return fmt.Sprintf("get(%q) -> ?", cmd.Key)
+		case KVPut:
+			return fmt.Sprintf("put(%q, %q)", cmd.Key, cmd.Value)
+		}
+		return fmt.Sprintf("%s(%q, %q)", cmd.Op, cmd.Key, cmd.Value)
+	},
+	DescribeState: func(state interface{}) string { return fmt.Sprintf("%q", state) },
+}
@@ -0,0 +1,50 @@
+package raft
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func kvOp(client int, cmd KVCommand, output interface{}, call int64, ret int64) Operation {
+	return Operation{ClientId: client, Input: cmd, Output: output, Call: call, Return: ret}
+}
+
+func TestLinearizableKVHistory(t *testing.T) {
+	history := []Operation{
+		kvOp(0, KVCommand{Op: KVPut, Key: "x", Value: "1"}, KVResult{}, 0, 10),
+		kvOp(1, KVCommand{Op: KVPut, Key: "x", Value: "2"}, KVResult{}, 5, 15),
+		kvOp(2, KVCommand{Op: KVGet, Key: "x"}, KVResult{Value: "2"}, 12, 20),
+		kvOp(2, KVCommand{Op: KVGet, Key: "x"}, KVResult{Value: "2"}, 21, 30),
+		kvOp(0, KVCommand{Op: KVAppend, Key: "y", Value: "a"}, nil, 0, math.MaxInt64),
+		kvOp(1, KVCommand{Op: KVGet, Key: "y"}, KVResult{Value: "a"}, 40, 50),
+	}
+
+	if result, _ := CheckOperations(KVModel, history, 0); result != CheckOk {
+		t.Fatalf("expected linearizable history, got %s", result)
+	}
+}
+
+func TestNonLinearizableKVHistory(t *testing.T) {
+	// The second read comes strictly after the first, yet observes an older value.
+	history := []Operation{
+		kvOp(0, KVCommand{Op: KVPut, Key: "x", Value: "1"}, KVResult{}, 0, 10),
+		kvOp(1, KVCommand{Op: KVPut, Key: "x", Value: "2"}, KVResult{}, 5, 15),
+		kvOp(2, KVCommand{Op: KVGet, Key: "x"}, KVResult{Value: "1"}, 20, 25),
+		kvOp(2, KVCommand{Op: KVGet, Key: "x"}, KVResult{Value: "2"}, 30, 35),
+	}
+
+	result, info := CheckOperations(KVModel, history, 0)
+	if result != CheckIllegal {
+		t.Fatalf("expected illegal history, got %s", result)
+	}
+
+	var page bytes.Buffer
+	if err := Visualize(KVModel, info, &page); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), `class="bad"`) {
+		t.Fatalf("visualisation doesn't mark any operation as unlinearizable")
+	}
+}
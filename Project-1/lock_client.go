@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLockSessionExpired is returned by a LockClerk whose session expired: the
+// locks it held may have been granted to others since. The clerk opens a new
+// session on its next request.
+var ErrLockSessionExpired = errors.New("raft: " + LockErrSessionExpired)
+
+// LockClerk is a client of the lock service run by group groupId on servers,
+// with a session of its own. Its methods may be called concurrently; they
+// are run one at a time.
+type LockClerk struct {
+	mu      sync.Mutex
+	exec    GroupExecutor
+	groupId int
+	servers []int
+	leader  int    // Index into servers of the last known leader
+	session uint64 // Opened on first use; 0 until then
+
+	TTL     time.Duration // Of the clerk's session; it must call Renew, or Acquire, more often than that
+	Timeout time.Duration // How long each request is retried for, or Acquire waits; ShardClerkTimeout unless set
+}
+
+func NewLockClerk(exec GroupExecutor, groupId int, servers []int) *LockClerk {
+	return &LockClerk{exec: exec, groupId: groupId, servers: servers, TTL: DefaultLockTTL, Timeout: ShardClerkTimeout}
+}
+
+// Acquire waits until the clerk's session holds lock name, and returns the
+// lock's fencing token, or gives up on it after Timeout.
+func (this *LockClerk) Acquire(name string) (int, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	deadline := time.Now().Add(this.Timeout)
+	for {
+		result, err := this.do(func(session uint64) interface{} { return LockAcquire{Session: session, Name: name} }, deadline)
+		if err != nil {
+			return 0, err
+		}
+		if result.Held {
+			return result.Token, nil
+		}
+		if time.Now().After(deadline) {
+			// Leave the queue, so the lock isn't granted to a session that
+			// isn't waiting for it any more
+			this.do(func(session uint64) interface{} { return LockRelease{Session: session, Name: name} }, time.Now().Add(this.Timeout))
+			return 0, context.DeadlineExceeded
+		}
+		sleepMs(100)
+	}
+}
+
+// Release releases lock name, held with token.
+func (this *LockClerk) Release(name string, token int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err := this.do(func(session uint64) interface{} { return LockRelease{Session: session, Name: name, Token: token} }, time.Now().Add(this.Timeout))
+	return err
+}
+
+// Renew keeps the clerk's session, and so the locks it holds, alive for
+// another TTL.
+func (this *LockClerk) Renew() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err := this.do(func(session uint64) interface{} { return LockRenew{Session: session} }, time.Now().Add(this.Timeout))
+	return err
+}
+
+// do runs the command command returns for the clerk's session, opening the
+// session first if need be. Expects this.mu to be held.
+func (this *LockClerk) do(command func(session uint64) interface{}, deadline time.Time) (LockResult, error) {
+	if this.session == 0 {
+		result, err := executeOnGroup(this.exec, this.groupId, this.servers, &this.leader, LockSessionOpen{TTL: this.TTL}, deadline)
+		if err != nil {
+			return LockResult{}, err
+		}
+		session, ok := result.(uint64)
+		if !ok {
+			return LockResult{}, fmt.Errorf("raft: unexpected lock session %v", result)
+		}
+		this.session = session
+	}
+
+	result, err := executeOnGroup(this.exec, this.groupId, this.servers, &this.leader, command(this.session), deadline)
+	if err != nil {
+		return LockResult{}, err
+	}
+	lockResult, ok := result.(LockResult)
+	switch {
+	case !ok:
+		return LockResult{}, fmt.Errorf("raft: unexpected lock service result %v", result)
+	case lockResult.Err == LockErrSessionExpired:
+		this.session = 0
+		return LockResult{}, ErrLockSessionExpired
+	case lockResult.Err != "":
+		return LockResult{}, errors.New(lockResult.Err)
+	}
+	return lockResult, nil
+}
@@ -0,0 +1,346 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"time"
+)
+
+// How often the leader of a lock service group puts the time in its log, so
+// that sessions expire even when no client is submitting anything.
+const LockTickInterval = 1 * time.Second
+
+// DefaultLockTTL is the TTL of lock sessions opened without one.
+const DefaultLockTTL = 10 * time.Second
+
+// LockResult.Err of a command in a session that expired or never existed. Any
+// locks the session held have been released, or handed to their next waiters.
+const LockErrSessionExpired = "lock session expired"
+
+// LockSessionOpen starts a lock session that expires after TTL without being
+// renewed (DefaultLockTTL if 0). Its result is the new session's id (a
+// uint64): one more than the log index of the entry, so that 0 is never one.
+type LockSessionOpen struct {
+	TTL time.Duration
+}
+
+// LockRenew keeps Session alive for another TTL. Acquires renew it as well.
+type LockRenew struct {
+	Session uint64
+}
+
+// LockAcquire grants Name to Session if nobody holds it, and otherwise queues
+// Session behind the lock's other waiters; the lock is granted to them in the
+// order they first asked for it. Asking again, e.g. to find out whether the
+// lock has been granted meanwhile, keeps Session's place in the queue.
+type LockAcquire struct {
+	Session uint64
+	Name    string
+}
+
+// LockRelease releases Name if Session holds it with Token, handing it to
+// its next waiter. With Token 0 it gives up on Name whatever the state of
+// the request: withdraws Session from the waiters, or releases the lock if
+// it was granted meanwhile. Releasing a lock that isn't held is a no-op.
+type LockRelease struct {
+	Session uint64
+	Name    string
+	Token   int
+}
+
+// LockStatus returns who holds Name and who waits for it, as a LockInfo.
+type LockStatus struct {
+	Name string
+}
+
+// LockTick carries nothing but its entry's timestamp.
+type LockTick struct{}
+
+// LockResult is what the lock service returns for a LockRenew, LockAcquire
+// or LockRelease. Token is the fencing token of a held lock: the log index
+// of the entry it was granted at, so a later grant always has a higher
+// token, and whatever the lock protects can turn away holders that are out
+// of date.
+type LockResult struct {
+	Held     bool
+	Token    int
+	Position int // Place in the queue of waiters, from 1, if not Held
+	Err      string
+}
+
+type LockInfo struct {
+	Holder  uint64 // 0 if the lock is free
+	Token   int
+	Waiters []uint64
+}
+
+func init() {
+	RegisterCommand("lock/open", 1, LockSessionOpen{})
+	RegisterCommand("lock/renew", 1, LockRenew{})
+	RegisterCommand("lock/acquire", 1, LockAcquire{})
+	RegisterCommand("lock/release", 1, LockRelease{})
+	RegisterCommand("lock/status", 1, LockStatus{})
+	RegisterCommand("lock/tick", 1, LockTick{})
+	gob.Register(LockResult{})
+	gob.Register(LockInfo{})
+}
+
+// LockService is a StateMachine of named locks held by sessions. Sessions
+// expire as measured by the leader timestamps on the log entries, like those
+// of Sessions, so every replica expires them, and hands their locks on, at
+// the same point in the log. StartLockService has the leader add a LockTick
+// every LockTickInterval for when nothing else is being submitted. It's a
+// Snapshotter.
+type LockService struct {
+	now      int64 // Latest entry timestamp seen
+	sessions map[uint64]*lockSession
+	locks    map[string]*lockState
+}
+
+type lockSession struct {
+	ttl        time.Duration
+	lastActive int64
+	locks      map[string]bool // Held or waited for
+}
+
+type lockState struct {
+	holder  uint64
+	token   int
+	waiters []uint64
+}
+
+func NewLockService() *LockService {
+	return &LockService{sessions: make(map[uint64]*lockSession), locks: make(map[string]*lockState)}
+}
+
+// lockSnapshot is a LockService as gob encodes it. Fencing tokens are log
+// indexes, so a restored service carries on handing out higher ones with no
+// counter of its own to restore.
+type lockSnapshot struct {
+	Now      int64
+	Sessions map[uint64]lockSessionSnapshot
+	Locks    map[string]LockInfo
+}
+
+type lockSessionSnapshot struct {
+	TTL        time.Duration
+	LastActive int64
+	Locks      []string
+}
+
+func (this *LockService) Snapshot() ([]byte, error) {
+	snapshot := lockSnapshot{Now: this.now, Sessions: make(map[uint64]lockSessionSnapshot), Locks: make(map[string]LockInfo)}
+	for id, session := range this.sessions {
+		names := make([]string, 0, len(session.locks))
+		for name := range session.locks {
+			names = append(names, name)
+		}
+		snapshot.Sessions[id] = lockSessionSnapshot{TTL: session.ttl, LastActive: session.lastActive, Locks: names}
+	}
+	for name, lock := range this.locks {
+		snapshot.Locks[name] = LockInfo{Holder: lock.holder, Token: lock.token, Waiters: lock.waiters}
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(snapshot)
+	return buf.Bytes(), err
+}
+
+// Restore replaces the lock table and sessions with those in data.
+func (this *LockService) Restore(data []byte) error {
+	var snapshot lockSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return err
+	}
+	this.now = snapshot.Now
+	this.sessions = make(map[uint64]*lockSession, len(snapshot.Sessions))
+	for id, session := range snapshot.Sessions {
+		locks := make(map[string]bool, len(session.Locks))
+		for _, name := range session.Locks {
+			locks[name] = true
+		}
+		this.sessions[id] = &lockSession{ttl: session.TTL, lastActive: session.LastActive, locks: locks}
+	}
+	this.locks = make(map[string]*lockState, len(snapshot.Locks))
+	for name, lock := range snapshot.Locks {
+		this.locks[name] = &lockState{holder: lock.Holder, token: lock.Token, waiters: append([]uint64(nil), lock.Waiters...)}
+	}
+	return nil
+}
+
+func (this *LockService) Apply(index int, entry LogEntry) interface{} {
+	if entry.Time > this.now {
+		this.now = entry.Time
+		this.expire(index)
+	}
+
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return LockResult{Err: err.Error()}
+	}
+	switch cmd := command.Value.(type) {
+	case LockSessionOpen:
+		ttl := cmd.TTL
+		if ttl <= 0 {
+			ttl = DefaultLockTTL
+		}
+		id := uint64(index) + 1
+		this.sessions[id] = &lockSession{ttl: ttl, lastActive: this.now, locks: make(map[string]bool)}
+		return id
+
+	case LockTick:
+		return nil
+
+	case LockStatus:
+		info := LockInfo{}
+		if lock := this.locks[cmd.Name]; lock != nil {
+			info = LockInfo{Holder: lock.holder, Token: lock.token, Waiters: append([]uint64(nil), lock.waiters...)}
+		}
+		return info
+
+	case LockRenew:
+		if this.session(cmd.Session) == nil {
+			return LockResult{Err: LockErrSessionExpired}
+		}
+		return LockResult{}
+
+	case LockAcquire:
+		session := this.session(cmd.Session)
+		if session == nil {
+			return LockResult{Err: LockErrSessionExpired}
+		}
+		return this.acquire(index, cmd.Session, session, cmd.Name)
+
+	case LockRelease:
+		session := this.session(cmd.Session)
+		if session == nil {
+			return LockResult{Err: LockErrSessionExpired}
+		}
+		this.release(index, cmd.Session, session, cmd.Name, cmd.Token)
+		return LockResult{}
+	}
+	return LockResult{Err: "not a lock command: " + command.Type}
+}
+
+// session returns the session with id, renewed, or nil if there's none.
+func (this *LockService) session(id uint64) *lockSession {
+	session := this.sessions[id]
+	if session != nil {
+		session.lastActive = this.now
+	}
+	return session
+}
+
+func (this *LockService) acquire(index int, id uint64, session *lockSession, name string) LockResult {
+	lock := this.locks[name]
+	if lock == nil {
+		lock = &lockState{}
+		this.locks[name] = lock
+	}
+	session.locks[name] = true
+
+	switch {
+	case lock.holder == 0:
+		lock.holder, lock.token = id, index
+	case lock.holder != id:
+		for i, waiter := range lock.waiters {
+			if waiter == id {
+				return LockResult{Position: i + 1}
+			}
+		}
+		lock.waiters = append(lock.waiters, id)
+		return LockResult{Position: len(lock.waiters)}
+	}
+	return LockResult{Held: true, Token: lock.token}
+}
+
+func (this *LockService) release(index int, id uint64, session *lockSession, name string, token int) {
+	lock := this.locks[name]
+	if lock == nil {
+		return
+	}
+	if lock.holder == id {
+		if token != 0 && token != lock.token {
+			return // A retry of an earlier release; the session holds it again since
+		}
+		this.handOn(index, lock)
+	} else {
+		for i, waiter := range lock.waiters {
+			if waiter == id {
+				lock.waiters = append(lock.waiters[:i:i], lock.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(session.locks, name)
+	if lock.holder == 0 {
+		delete(this.locks, name)
+	}
+}
+
+// handOn grants lock to its first waiter, at index, or frees it if there's none.
+func (this *LockService) handOn(index int, lock *lockState) {
+	lock.holder, lock.token = 0, 0
+	if len(lock.waiters) > 0 {
+		lock.holder, lock.token = lock.waiters[0], index
+		lock.waiters = lock.waiters[1:]
+	}
+}
+
+// expire drops the sessions that haven't been used for their TTL, at index,
+// in order of id so that locks are handed on the same way everywhere.
+func (this *LockService) expire(index int) {
+	var expired []uint64
+	for id, session := range this.sessions {
+		if this.now-session.lastActive > int64(session.ttl) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+
+	for _, id := range expired {
+		session := this.sessions[id]
+		names := make([]string, 0, len(session.locks))
+		for name := range session.locks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			this.release(index, id, session, name, 0)
+		}
+		delete(this.sessions, id)
+	}
+}
+
+// StartLockService starts server's member of Raft group groupId, whose state
+// machine is a LockService.
+func StartLockService(server *Server, groupId int, config GroupConfig) (*LockService, error) {
+	locks := NewLockService()
+	config.StateMachine = locks
+	node, err := server.AddGroup(groupId, config)
+	if err != nil {
+		return nil, err
+	}
+	go tickLocks(node)
+	return locks, nil
+}
+
+// tickLocks has node, while it leads its group, submit a LockTick every
+// LockTickInterval.
+// This function runs as a go routine until the node is killed.
+func tickLocks(node *RaftNode) {
+	for {
+		select {
+		case <-node.ctx.Done():
+			return
+		case <-time.After(LockTickInterval):
+		}
+		if _, _, isLeader := node.GetNodeState(); !isLeader {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(node.ctx, 2*ClientAttemptTimeout)
+		node.SubmitCommand(ctx, LockTick{})
+		cancel()
+	}
+}
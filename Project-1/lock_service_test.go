@@ -0,0 +1,186 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// lockLog applies commands to a LockService as consecutive log entries,
+// stamped with a clock the test moves along.
+type lockLog struct {
+	t     *testing.T
+	locks *LockService
+	index int
+	now   time.Time
+}
+
+func (this *lockLog) apply(command interface{}) interface{} {
+	this.t.Helper()
+	data, err := EncodeCommand(GobCodec, command)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	this.index++
+	return this.locks.Apply(this.index, LogEntry{Command: data, Time: this.now.UnixNano()})
+}
+
+func TestLockServiceFIFO(t *testing.T) {
+	log := &lockLog{t: t, locks: NewLockService(), now: time.Now()}
+	a, b, c := log.apply(LockSessionOpen{}).(uint64), log.apply(LockSessionOpen{}).(uint64), log.apply(LockSessionOpen{}).(uint64)
+
+	granted := log.apply(LockAcquire{Session: a, Name: "x"}).(LockResult)
+	if !granted.Held || granted.Token != log.index {
+		t.Fatalf("acquire of a free lock: got %+v at index %d", granted, log.index)
+	}
+	if again := log.apply(LockAcquire{Session: a, Name: "x"}).(LockResult); again != granted {
+		t.Fatalf("acquire by the holder: got %+v, want %+v", again, granted)
+	}
+	if result := log.apply(LockAcquire{Session: c, Name: "x"}).(LockResult); result != (LockResult{Position: 1}) {
+		t.Fatalf("first waiter: got %+v", result)
+	}
+	if result := log.apply(LockAcquire{Session: b, Name: "x"}).(LockResult); result != (LockResult{Position: 2}) {
+		t.Fatalf("second waiter: got %+v", result)
+	}
+	if result := log.apply(LockAcquire{Session: c, Name: "x"}).(LockResult); result != (LockResult{Position: 1}) {
+		t.Fatalf("first waiter asking again: got %+v", result)
+	}
+
+	// A stale token releases nothing
+	log.apply(LockRelease{Session: a, Name: "x", Token: granted.Token + 1})
+	if info := log.apply(LockStatus{Name: "x"}).(LockInfo); info.Holder != a {
+		t.Fatalf("released with a stale token: %+v", info)
+	}
+
+	log.apply(LockRelease{Session: a, Name: "x", Token: granted.Token})
+	info := log.apply(LockStatus{Name: "x"}).(LockInfo)
+	if info.Holder != c || info.Token != log.index-1 || len(info.Waiters) != 1 || info.Waiters[0] != b {
+		t.Fatalf("after release: got %+v, want c=%d holding from index %d, b=%d waiting", info, c, log.index-1, b)
+	}
+	if result := log.apply(LockAcquire{Session: c, Name: "x"}).(LockResult); !result.Held || result.Token <= granted.Token {
+		t.Fatalf("next waiter: got %+v, want a token above %d", result, granted.Token)
+	}
+
+	// b gives up waiting, so the lock is free once c releases it
+	log.apply(LockRelease{Session: b, Name: "x"})
+	log.apply(LockRelease{Session: c, Name: "x", Token: info.Token})
+	if info := log.apply(LockStatus{Name: "x"}).(LockInfo); info.Holder != 0 || len(info.Waiters) != 0 {
+		t.Fatalf("after everyone left: %+v", info)
+	}
+}
+
+func TestLockServiceExpiry(t *testing.T) {
+	log := &lockLog{t: t, locks: NewLockService(), now: time.Now()}
+	a := log.apply(LockSessionOpen{TTL: 5 * time.Second}).(uint64)
+	b := log.apply(LockSessionOpen{TTL: 20 * time.Second}).(uint64)
+	token := log.apply(LockAcquire{Session: a, Name: "x"}).(LockResult).Token
+	log.apply(LockAcquire{Session: b, Name: "x"})
+
+	log.now = log.now.Add(4 * time.Second)
+	if result := log.apply(LockRenew{Session: a}).(LockResult); result.Err != "" {
+		t.Fatalf("renew: %+v", result)
+	}
+	log.now = log.now.Add(4 * time.Second)
+	log.apply(LockTick{})
+	if info := log.apply(LockStatus{Name: "x"}).(LockInfo); info.Holder != a {
+		t.Fatalf("renewed session lost its lock: %+v", info)
+	}
+
+	// a's session runs out; the tick that notices hands the lock on
+	log.now = log.now.Add(2 * time.Second)
+	log.apply(LockTick{})
+	info := log.apply(LockStatus{Name: "x"}).(LockInfo)
+	if info.Holder != b || info.Token != log.index-1 || info.Token <= token {
+		t.Fatalf("after a expired: got %+v, want b=%d holding from index %d", info, b, log.index-1)
+	}
+	if result := log.apply(LockAcquire{Session: a, Name: "x"}).(LockResult); result.Err != LockErrSessionExpired {
+		t.Fatalf("acquire in an expired session: got %+v", result)
+	}
+}
+
+func TestLockClerk(t *testing.T) {
+	const locksGroup = 1
+	cluster := NewClusterTracedTo(t, 3, t.TempDir())
+	defer cluster.Shutdown()
+	cluster.StartLockService(locksGroup, []int{0, 1, 2})
+
+	a, b := cluster.NewLockClerk(locksGroup), cluster.NewLockClerk(locksGroup)
+	b.TTL = 6 * time.Second
+	tokenA, err := a.Acquire("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan int, 1)
+	go func() {
+		token, err := b.Acquire("x")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- token
+	}()
+	sleepMs(3000)
+	select {
+	case <-acquired:
+		t.Fatal("b acquired x while a held it")
+	default:
+	}
+	if err := a.Release("x", tokenA); err != nil {
+		t.Fatal(err)
+	}
+	tokenB := <-acquired
+	if tokenB <= tokenA {
+		t.Fatalf("b's token %d is not above a's %d", tokenB, tokenA)
+	}
+
+	// b stops renewing; its lock goes to a once its session expires, with
+	// nothing but the leader's ticks going into the log meanwhile
+	tokenA, err = a.Acquire("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenA <= tokenB {
+		t.Fatalf("a's token %d is not above b's %d", tokenA, tokenB)
+	}
+	if err := b.Renew(); err != ErrLockSessionExpired {
+		t.Fatalf("renewing b's expired session: got %v", err)
+	}
+}
+
+// A member that missed the lock table's changes gets it, sessions and fencing
+// tokens included, from a snapshot, and carries on from there as leader.
+func TestLockServiceSnapshotInstalled(t *testing.T) {
+	const locksGroup = 1
+	cluster := NewClusterTracedTo(t, 3, t.TempDir())
+	defer cluster.Shutdown()
+	cluster.StartLockService(locksGroup, []int{0, 1, 2})
+	leader := cluster.awaitGroupLeader(locksGroup)
+	lagging := (leader + 1) % 3
+	cluster.DisconnectPeer(lagging)
+	submit := func(id int, command interface{}) interface{} {
+		t.Helper()
+		result, err := cluster.ExecuteGroupCommand(id, locksGroup, command, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	a := submit(leader, LockSessionOpen{TTL: time.Minute}).(uint64)
+	b := submit(leader, LockSessionOpen{TTL: time.Minute}).(uint64)
+	granted := submit(leader, LockAcquire{Session: a, Name: "x"}).(LockResult)
+	submit(leader, LockAcquire{Session: b, Name: "x"})
+
+	index := snapshotGroupAllBut(t, cluster, locksGroup, leader, lagging)
+	cluster.ReconnectPeer(lagging)
+	node := cluster.getServers()[lagging].Group(locksGroup)
+	awaitSnapshot(t, node, index)
+
+	transferGroupLeader(t, cluster, locksGroup, lagging)
+	if info := submit(lagging, LockStatus{Name: "x"}).(LockInfo); info.Holder != a || info.Token != granted.Token || len(info.Waiters) != 1 || info.Waiters[0] != b {
+		t.Fatalf("restored lock: got %+v, want a=%d holding with token %d, b=%d waiting", info, a, granted.Token, b)
+	}
+	submit(lagging, LockRelease{Session: a, Name: "x", Token: granted.Token})
+	if result := submit(lagging, LockAcquire{Session: b, Name: "x"}).(LockResult); !result.Held || result.Token <= granted.Token {
+		t.Fatalf("next waiter after the snapshot: got %+v, want a token above %d", result, granted.Token)
+	}
+}
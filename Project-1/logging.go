@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Subsystems whose log level can be adjusted independently.
+const (
+	LogAll         = "*" // Wildcard; the level for subsystems without one of their own
+	LogElection    = "election"
+	LogVote        = "vote"
+	LogReplication = "replication" // AppendEntries at Info, heartbeats at Debug
+	LogApply       = "apply"
+	LogClient      = "client"
+	LogNetwork     = "network"
+	LogStorage     = "storage"
+	LogCluster     = "cluster" // The test harness
+)
+
+// LevelOff silences a subsystem entirely.
+const LevelOff = slog.Level(1 << 20)
+
+// Logging holds the log levels and the sink (a slog.Handler) for a Server and
+// the RaftNode it hosts. Anything not set on it falls back to the process-wide
+// settings, changed with SetLogLevel and SetLogHandler.
+type Logging struct {
+	mu       sync.RWMutex
+	levels   map[string]slog.Level
+	handler  slog.Handler
+	silenced bool
+
+	parent *Logging
+}
+
+// sinkGeneration goes up whenever any Logging's sink changes, so that
+// subsystemHandlers know to wrap the sink again.
+var sinkGeneration atomic.Uint64
+
+var defaultLogging = &Logging{
+	levels:  map[string]slog.Level{LogAll: slog.LevelInfo},
+	handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+}
+
+// SetLogLevel sets the process-wide level of a subsystem, or of all of them with LogAll.
+func SetLogLevel(subsystem string, level slog.Level) {
+	defaultLogging.SetLevel(subsystem, level)
+}
+
+// SetLogHandler sets the process-wide sink; it should accept every level,
+// since filtering happens before records reach it.
+func SetLogHandler(handler slog.Handler) {
+	defaultLogging.SetHandler(handler)
+}
+
+func newLogging() *Logging {
+	return &Logging{levels: make(map[string]slog.Level), parent: defaultLogging}
+}
+
+func (this *Logging) SetLevel(subsystem string, level slog.Level) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.levels[subsystem] = level
+}
+
+// ResetLevel drops the level set for subsystem, falling back to the process-wide one.
+func (this *Logging) ResetLevel(subsystem string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.levels, subsystem)
+}
+
+func (this *Logging) SetHandler(handler slog.Handler) {
+	this.mu.Lock()
+	this.handler = handler
+	this.mu.Unlock()
+	sinkGeneration.Add(1)
+}
+
+// SetSilenced turns off every subsystem, whatever the levels set for them,
+// until it's called with false, e.g. while a node is cut off in a test.
+func (this *Logging) SetSilenced(silenced bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.silenced = silenced
+}
+
+// level resolves the level of subsystem: its own level here, then LogAll here,
+// then the same two in the parent.
+func (this *Logging) level(subsystem string) slog.Level {
+	this.mu.RLock()
+	level, ok := this.levels[subsystem]
+	if !ok {
+		level, ok = this.levels[LogAll]
+	}
+	if this.silenced {
+		level, ok = LevelOff, true
+	}
+	this.mu.RUnlock()
+
+	if ok {
+		return level
+	}
+	if this.parent != nil {
+		return this.parent.level(subsystem)
+	}
+	return slog.LevelInfo
+}
+
+func (this *Logging) sink() slog.Handler {
+	this.mu.RLock()
+	handler := this.handler
+	this.mu.RUnlock()
+
+	if handler == nil && this.parent != nil {
+		return this.parent.sink()
+	}
+	return handler
+}
+
+// Logger returns a logger for subsystem that tags every record with it and attrs.
+func (this *Logging) Logger(subsystem string, attrs ...any) *slog.Logger {
+	handler := &subsystemHandler{logging: this, subsystem: subsystem}
+	return slog.New(handler).With("subsystem", subsystem).With(attrs...)
+}
+
+// subsystemHandler filters records by the current level of its subsystem and
+// forwards the rest to the current sink, so both can change at runtime.
+type subsystemHandler struct {
+	logging   *Logging
+	subsystem string
+	wrap      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, in order
+	wrapped   atomic.Pointer[wrappedSink]
+}
+
+// wrappedSink is the sink with wrap applied, as of a sinkGeneration.
+type wrappedSink struct {
+	generation uint64
+	handler    slog.Handler
+}
+
+func (this *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= this.logging.level(this.subsystem)
+}
+
+func (this *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	generation := sinkGeneration.Load()
+	if wrapped := this.wrapped.Load(); wrapped != nil && wrapped.generation == generation {
+		return wrapped.handler.Handle(ctx, record)
+	}
+	handler := this.logging.sink()
+	for _, wrap := range this.wrap {
+		handler = wrap(handler)
+	}
+	this.wrapped.Store(&wrappedSink{generation: generation, handler: handler})
+	return handler.Handle(ctx, record)
+}
+
+func (this *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return this.with(func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })
+}
+
+func (this *subsystemHandler) WithGroup(name string) slog.Handler {
+	return this.with(func(h slog.Handler) slog.Handler { return h.WithGroup(name) })
+}
+
+func (this *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	return &subsystemHandler{
+		logging:   this.logging,
+		subsystem: this.subsystem,
+		wrap:      append(append([]func(slog.Handler) slog.Handler(nil), this.wrap...), wrap),
+	}
+}
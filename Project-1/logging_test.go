@@ -0,0 +1,90 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// countingHandler counts the WithAttrs and WithGroup calls made on it.
+type countingHandler struct {
+	slog.Handler
+	wraps *int
+}
+
+func (this countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	*this.wraps++
+	return countingHandler{this.Handler.WithAttrs(attrs), this.wraps}
+}
+
+func (this countingHandler) WithGroup(name string) slog.Handler {
+	*this.wraps++
+	return countingHandler{this.Handler.WithGroup(name), this.wraps}
+}
+
+func textSink(buf *bytes.Buffer) slog.Handler {
+	return slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	})
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logging := newLogging()
+	logging.SetHandler(textSink(&buf))
+	logger := logging.Logger(LogVote, "node", 1).With("term", 3)
+	expect := func(want string) {
+		t.Helper()
+		if got := buf.String(); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		buf.Reset()
+	}
+
+	logger.Info("info")
+	logger.Debug("debug")
+	expect("level=INFO msg=info subsystem=vote node=1 term=3\n")
+
+	logging.SetLevel(LogVote, slog.LevelDebug)
+	logging.SetLevel(LogAll, LevelOff) // Subsystems with a level of their own keep it
+	logger.Debug("debug")
+	logging.Logger(LogElection).Info("off")
+	expect("level=DEBUG msg=debug subsystem=vote node=1 term=3\n")
+
+	logging.SetSilenced(true)
+	logger.Error("silenced")
+	expect("")
+	logging.SetSilenced(false)
+	logger.Info("back")
+	expect("level=INFO msg=back subsystem=vote node=1 term=3\n")
+}
+
+func TestSubsystemHandlerWrapsSinkOnce(t *testing.T) {
+	var buf bytes.Buffer
+	wraps := 0
+	logging := newLogging()
+	logging.SetHandler(countingHandler{textSink(&buf), &wraps})
+	logger := logging.Logger(LogReplication, "node", 1).WithGroup("rpc")
+	for i := 0; i < 10; i++ {
+		logger.Info("sent", "peer", i)
+	}
+	if wraps != 3 { // subsystem, node and the group, once
+		t.Fatalf("sink wrapped %d times for 10 records", wraps)
+	}
+
+	// A new sink is wrapped again
+	var other bytes.Buffer
+	logging.SetHandler(textSink(&other))
+	logger.InfoContext(context.Background(), "sent", "peer", 10)
+	if !strings.Contains(other.String(), "subsystem=replication node=1 rpc.peer=10") || strings.Contains(buf.String(), "peer=10") {
+		t.Fatalf("after changing the sink: old %q, new %q", buf.String(), other.String())
+	}
+}
@@ -1,8 +1,14 @@
 package raft
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -22,13 +28,41 @@ type Cluster struct {
 	// Maintains whether server is partioned or not
 	connected []bool
 
+	// Maintains whether server has crashed, and what it keeps on stable storage
+	crashed      []bool
+	storages     []*MemoryStorage
+	snapshotDirs []string // Where each server receives snapshots; kept over restarts
+	traceDir     string   // Where each server traces applied commands, to <id>, and its groups', to <id>.group<N>
+
+	// Raft groups besides the default one, by group id; see raft_cluster_groups.go
+	groups      map[int]*clusterGroup
+	controllers []int // Servers hosting the shard controller, if started
+
 	n int
 
 	t *testing.T
+
+	// Samples every node in the background, failing t on any safety violation.
+	checker *invariantChecker
+
+	// Per node event journals, if RAFT_JOURNAL_DIR is set
+	journals     []*Journal
+	journalFiles []*os.File
 }
 
+// NewCluster starts n connected servers, which trace applied commands to
+// NodeLogs, like a Server does by default.
 func NewCluster(t *testing.T, n int) *Cluster {
+	return NewClusterTracedTo(t, n, "NodeLogs")
+}
+
+// NewClusterTracedTo is NewCluster with the servers tracing applied commands
+// to traceDir instead, e.g. t.TempDir() for tests of many groups that would
+// otherwise leave a file for each of them in NodeLogs.
+func NewClusterTracedTo(t *testing.T, n int, traceDir string) *Cluster {
 	ns := make([]*Server, n)
+	storages := make([]*MemoryStorage, n)
+	snapshotDirs := make([]string, n)
 	connected := make([]bool, n)
 	ready := make(chan interface{})
 
@@ -48,6 +82,12 @@ func NewCluster(t *testing.T, n int) *Cluster {
 		// }
 
 		ns[i] = NewServer(i, peersIds, ready, 20)
+		storages[i] = NewMemoryStorage()
+		snapshotDirs[i] = t.TempDir()
+		ns[i].SetStateMachine(NewSessions(NewKVStore(), DefaultSessionTTL))
+		ns[i].SetStorage(storages[i])
+		ns[i].SetSnapshotDir(snapshotDirs[i])
+		ns[i].SetTracePath(filepath.Join(traceDir, strconv.Itoa(i)))
 		ns[i].Serve()
 	}
 
@@ -65,22 +105,78 @@ func NewCluster(t *testing.T, n int) *Cluster {
 	this := &Cluster{
 		nodes:     ns,
 		connected: connected,
+		crashed:   make([]bool, n),
+		storages:  storages,
+		groups:    make(map[int]*clusterGroup),
 		n:         n,
 		t:         t,
+
+		snapshotDirs: snapshotDirs,
+		traceDir:     traceDir,
+	}
+	for _, server := range ns {
+		server.SetPeerResolver(this.peerAddr)
 	}
+	this.openJournals(os.Getenv("RAFT_JOURNAL_DIR"))
+	this.checker = newInvariantChecker(this)
 	return this
 }
 
+// peerAddr is the peer resolver of every server in the cluster: servers
+// restarted by RestartPeer listen at a new address.
+func (this *Cluster) peerAddr(id int) (net.Addr, error) {
+	this.mu.Lock()
+	server := this.nodes[id]
+	this.mu.Unlock()
+	return server.GetCurrentAddress(), nil
+}
+
 func (this *Cluster) Shutdown() {
+	this.checker.stop()
 	for i := 0; i < this.n; i++ {
 		this.nodes[i].DisconnectAll()
 		this.connected[i] = false
 	}
 	for i := 0; i < this.n; i++ {
-		this.nodes[i].Shutdown()
+		if !this.crashed[i] {
+			this.nodes[i].Shutdown()
+		}
+	}
+	for i, journal := range this.journals {
+		if err := journal.Close(); err != nil {
+			this.t.Errorf("journal of node %d: %v", i, err)
+		}
+		this.journalFiles[i].Close()
 	}
 }
 
+// openJournals has every node write its event journal to dir/<id>.jsonl,
+// e.g. RAFT_JOURNAL_DIR=journals go test -run Test2. Does nothing if dir is empty.
+func (this *Cluster) openJournals(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		this.t.Fatal(err)
+	}
+	for i := 0; i < this.n; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d.jsonl", i)))
+		if err != nil {
+			this.t.Fatal(err)
+		}
+		this.journalFiles = append(this.journalFiles, f)
+		this.journals = append(this.journals, NewJournal(f))
+		this.nodes[i].SetJournal(this.journals[i])
+	}
+}
+
+// getServers returns the servers currently making up the cluster.
+func (this *Cluster) getServers() []*Server {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]*Server(nil), this.nodes...)
+}
+
 // DisconnectPeer disconnects a server from all other servers in the nodes.
 func (this *Cluster) DisconnectPeer(id int) {
 	testing_log("Disconnecting %d", id)
@@ -92,9 +188,7 @@ func (this *Cluster) DisconnectPeer(id int) {
 	}
 	this.connected[id] = false
 
-	this.nodes[id].raftLogic.mu.Lock()
-	this.nodes[id].raftLogic.LOG_ENTRIES = false
-	this.nodes[id].raftLogic.mu.Unlock()
+	this.nodes[id].Logging().SetSilenced(true) // Silence partitioned nodes
 }
 
 // ReconnectPeer connects a server to all other servers in the nodes.
@@ -113,9 +207,96 @@ func (this *Cluster) ReconnectPeer(id int) {
 	}
 	this.connected[id] = true
 
-	this.nodes[id].raftLogic.mu.Lock()
-	this.nodes[id].raftLogic.LOG_ENTRIES = true
-	this.nodes[id].raftLogic.mu.Unlock()
+	this.nodes[id].Logging().SetSilenced(false)
+}
+
+// CrashPeer stops a server as if its process died; only its storage survives.
+// The others' connections to it break, and they redial it until it's back.
+func (this *Cluster) CrashPeer(id int) {
+	testing_log("Crashing %d", id)
+	this.nodes[id].DisconnectAll()
+	this.connected[id] = false
+	this.nodes[id].Logging().SetSilenced(true)
+	this.nodes[id].Shutdown()
+	this.crashed[id] = true
+}
+
+// RestartPeer brings a crashed server back up from the state it had persisted,
+// on a fresh address, and connects it to every server that's connected or
+// will be back. The servers whose connections to it broke when it crashed
+// find it at its new address by themselves (see peerAddr); those that had
+// disconnected from it on purpose stay that way until HealAll.
+func (this *Cluster) RestartPeer(id int) {
+	testing_log("Restarting %d", id)
+	ready := make(chan interface{})
+
+	server := NewServer(id, this.nodes[id].peersIds, ready, this.nodes[id].getMinRPCLatency())
+	server.SetStateMachine(NewSessions(NewKVStore(), DefaultSessionTTL))
+	server.SetStorage(this.storages[id])
+	server.SetSnapshotDir(this.snapshotDirs[id])
+	server.SetTracePath(filepath.Join(this.traceDir, strconv.Itoa(id)))
+	server.SetPeerResolver(this.peerAddr)
+	server.SetEventObserver(this.checker.observe)
+	if this.journals != nil {
+		server.SetJournal(this.journals[id])
+	}
+	server.Serve()
+	this.startGroups(server)
+
+	this.mu.Lock()
+	this.nodes[id] = server
+	this.mu.Unlock()
+	this.crashed[id] = false
+
+	for j := 0; j < this.n; j++ {
+		if j == id || !this.connected[j] && !this.crashed[j] {
+			continue
+		}
+		// One that's down is redialled in the background until it's back
+		if err := server.ConnectToPeer(j, this.nodes[j].GetCurrentAddress()); err != nil && !this.crashed[j] {
+			this.t.Fatal(err)
+		}
+	}
+	this.connected[id] = true
+	close(ready)
+}
+
+// PartitionPeers cuts every link between a server in group and one outside it.
+// Unlike DisconnectPeer, servers on either side keep talking amongst themselves.
+func (this *Cluster) PartitionPeers(group []int) {
+	testing_log("Partitioning %v from the rest", group)
+	inGroup := make(map[int]bool)
+	for _, id := range group {
+		inGroup[id] = true
+	}
+	for i := 0; i < this.n; i++ {
+		for j := 0; j < this.n; j++ {
+			if inGroup[i] && !inGroup[j] {
+				this.nodes[i].DisconnectPeer(j)
+				this.nodes[j].DisconnectPeer(i)
+			}
+		}
+	}
+}
+
+// HealAll undoes every disconnection and partition between servers that are up.
+func (this *Cluster) HealAll() {
+	testing_log("Healing all links")
+	for i := 0; i < this.n; i++ {
+		if this.crashed[i] {
+			continue
+		}
+		if !this.connected[i] {
+			this.ReconnectPeer(i)
+		}
+		for j := 0; j < this.n; j++ {
+			if j != i && !this.crashed[j] {
+				if err := this.nodes[i].ConnectToPeer(j, this.nodes[j].GetCurrentAddress()); err != nil {
+					this.t.Fatal(err)
+				}
+			}
+		}
+	}
 }
 
 /* getClusterLeader checks that only a single server thinks it's the leader.
@@ -151,9 +332,18 @@ func (this *Cluster) SubmitClientCommand(serverId int, cmd interface{}) bool {
 	return this.nodes[serverId].raftLogic.ReceiveClientCommand(cmd)
 }
 
+// ExecuteClientCommand submits cmd to serverId and waits up to timeout for it
+// to be applied, returning the state machine's result.
+func (this *Cluster) ExecuteClientCommand(serverId int, cmd interface{}, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return this.getServers()[serverId].raftLogic.SubmitCommand(ctx, cmd)
+}
+
+var clusterLogger = defaultLogging.Logger(LogCluster)
+
 func testing_log(format string, a ...interface{}) {
-	format = "[ACTION] " + format
-	log.Printf(format, a...)
+	clusterLogger.Info("[ACTION] " + fmt.Sprintf(format, a...))
 }
 
 func sleepMs(n int) {
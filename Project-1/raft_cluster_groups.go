@@ -0,0 +1,172 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// GroupStarter starts server's member of Raft group groupId. config has the
+// member's peers, storage and snapshot directory filled in; the starter supplies the rest, e.g.
+// the state machine, and calls server.AddGroup.
+type GroupStarter func(server *Server, groupId int, config GroupConfig) error
+
+// clusterGroup is a Raft group the Cluster runs besides the default one.
+type clusterGroup struct {
+	members  []int
+	start    GroupStarter
+	storages map[int]*MemoryStorage // By member; survive crashes like the default group's
+}
+
+// AddGroup starts Raft group groupId on members, with start, and keeps it
+// running on them: a member that's crashed and restarted starts its member of
+// the group again from its storage.
+func (this *Cluster) AddGroup(groupId int, members []int, start GroupStarter) {
+	testing_log("Starting group %d on %v", groupId, members)
+	group := &clusterGroup{members: append([]int(nil), members...), start: start, storages: make(map[int]*MemoryStorage)}
+	for _, id := range members {
+		group.storages[id] = NewMemoryStorage()
+	}
+
+	this.mu.Lock()
+	this.groups[groupId] = group
+	this.mu.Unlock()
+
+	for _, id := range members {
+		if !this.crashed[id] {
+			this.startGroupMember(this.nodes[id], groupId, group)
+		}
+	}
+}
+
+func (this *Cluster) startGroupMember(server *Server, groupId int, group *clusterGroup) {
+	var peers []int
+	for _, id := range group.members {
+		if id != server.serverId {
+			peers = append(peers, id)
+		}
+	}
+	config := GroupConfig{
+		Peers:       peers,
+		Storage:     group.storages[server.serverId],
+		SnapshotDir: filepath.Join(this.snapshotDirs[server.serverId], fmt.Sprintf("group-%d", groupId)),
+	}
+	if err := group.start(server, groupId, config); err != nil {
+		this.t.Fatalf("starting group %d on %d: %v", groupId, server.serverId, err)
+	}
+}
+
+// startGroups starts server's members of the added groups; used when it restarts.
+func (this *Cluster) startGroups(server *Server) {
+	this.mu.Lock()
+	groups := make(map[int]*clusterGroup, len(this.groups))
+	groupIds := make([]int, 0, len(this.groups))
+	for groupId, group := range this.groups {
+		groups[groupId] = group
+		groupIds = append(groupIds, groupId)
+	}
+	this.mu.Unlock()
+	sort.Ints(groupIds)
+
+	for _, groupId := range groupIds {
+		group := groups[groupId]
+		for _, id := range group.members {
+			if id == server.serverId {
+				this.startGroupMember(server, groupId, group)
+			}
+		}
+	}
+}
+
+// ExecuteGroupCommand implements GroupExecutor for clients of the cluster,
+// which, like those of ExecuteClientCommand, aren't cut off by partitions.
+func (this *Cluster) ExecuteGroupCommand(serverId int, groupId int, command interface{}, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	node, err := this.getServers()[serverId].group(groupId)
+	if err != nil {
+		return nil, err
+	}
+	return node.SubmitCommand(ctx, command)
+}
+
+// GroupLeader returns the member of groupId that is leader of the highest
+// term, among connected servers, or -1 if none is.
+func (this *Cluster) GroupLeader(groupId int) int {
+	leader, leaderTerm := -1, -1
+	for id, server := range this.getServers() {
+		if !this.connected[id] || this.crashed[id] {
+			continue
+		}
+		if node := server.Group(groupId); node != nil {
+			if _, term, isLeader := node.GetNodeState(); isLeader && term > leaderTerm {
+				leader, leaderTerm = id, term
+			}
+		}
+	}
+	return leader
+}
+
+// awaitGroupLeader waits up to 10s for groupId to have a leader, and returns it.
+func (this *Cluster) awaitGroupLeader(groupId int) int {
+	this.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if leader := this.GroupLeader(groupId); leader >= 0 {
+			return leader
+		}
+		if time.Now().After(deadline) {
+			this.t.Fatalf("group %d has no leader", groupId)
+		}
+		sleepMs(100)
+	}
+}
+
+/* Sharded key/value service */
+
+// StartShardController runs the shard controller on members.
+func (this *Cluster) StartShardController(members []int) {
+	this.controllers = append([]int(nil), members...)
+	this.AddGroup(ShardControllerGroup, members, func(server *Server, groupId int, config GroupConfig) error {
+		config.StateMachine = NewSessions(NewShardController(), DefaultSessionTTL)
+		_, err := server.AddGroup(groupId, config)
+		return err
+	})
+}
+
+// StartShardGroup runs replica group gid on members; call StartShardController
+// first, and have the group Join through a ControllerClerk to give it shards.
+func (this *Cluster) StartShardGroup(gid int, members []int) {
+	controllers := this.controllers
+	this.AddGroup(gid, members, func(server *Server, groupId int, config GroupConfig) error {
+		_, err := StartShardKV(server, groupId, config, controllers)
+		return err
+	})
+}
+
+func (this *Cluster) NewControllerClerk() *ControllerClerk {
+	return NewControllerClerk(this, this.controllers)
+}
+
+func (this *Cluster) NewShardClerk() *ShardClerk {
+	return NewShardClerk(this, this.controllers)
+}
+
+/* Lock service */
+
+// StartLockService runs the lock service as group groupId on members.
+func (this *Cluster) StartLockService(groupId int, members []int) {
+	this.AddGroup(groupId, members, func(server *Server, groupId int, config GroupConfig) error {
+		_, err := StartLockService(server, groupId, config)
+		return err
+	})
+}
+
+// NewLockClerk returns a clerk of the lock service started as groupId.
+func (this *Cluster) NewLockClerk(groupId int) *LockClerk {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return NewLockClerk(this, groupId, this.groups[groupId].members)
+}
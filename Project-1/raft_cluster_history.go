@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long a single attempt at one server may take before the outcome of an
+// operation is considered unknown.
+const ClientAttemptTimeout = 2 * time.Second
+
+// HistoryRecorder runs client operations against a Cluster and records when
+// each was invoked and when it completed, for CheckLinearizable.
+type HistoryRecorder struct {
+	mu      sync.Mutex
+	cluster *Cluster
+	start   time.Time
+	ops     []Operation
+
+	leaderHint int
+	sessions   map[int]*ClientSession // Keyed by the recorder's client ids
+}
+
+func (this *Cluster) NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{cluster: this, start: time.Now(), sessions: make(map[int]*ClientSession)}
+}
+
+func (this *HistoryRecorder) Get(clientId int, key string) (string, error) {
+	result, err := this.Do(clientId, KVCommand{Op: KVGet, Key: key}, 10*time.Second)
+	return result.Value, err
+}
+
+func (this *HistoryRecorder) Put(clientId int, key string, value string) error {
+	_, err := this.Do(clientId, KVCommand{Op: KVPut, Key: key, Value: value}, 10*time.Second)
+	return err
+}
+
+func (this *HistoryRecorder) Append(clientId int, key string, value string) error {
+	_, err := this.Do(clientId, KVCommand{Op: KVAppend, Key: key, Value: value}, 10*time.Second)
+	return err
+}
+
+// Do submits cmd the way a client would, within a session of its own so that
+// retries are harmless: it tries servers until one accepts it as leader and
+// applies it, resubmitting the same request after errors whose outcome is
+// unknown. If timeout runs out first, the operation is recorded as never
+// returning (unless it was a read, which has no effect) and an error is passed back.
+func (this *HistoryRecorder) Do(clientId int, cmd KVCommand, timeout time.Duration) (KVResult, error) {
+	call := this.now()
+	deadline := time.Now().Add(timeout)
+
+	session, err := this.session(clientId, deadline)
+	if err != nil {
+		return KVResult{}, err // Nothing was submitted yet
+	}
+	request, err := session.Next(GobCodec, cmd)
+	if err != nil {
+		return KVResult{}, err
+	}
+
+	result, err := this.execute(request, deadline)
+	if err == nil {
+		if sessionErr, ok := result.(SessionError); ok {
+			err = sessionErr
+		}
+	}
+	if err != nil {
+		if cmd.Op != KVGet {
+			this.record(Operation{ClientId: clientId, Input: cmd, Call: call, Return: math.MaxInt64})
+		}
+		return KVResult{}, err
+	}
+	this.record(Operation{ClientId: clientId, Input: cmd, Output: result, Call: call, Return: this.now()})
+	return result.(KVResult), nil
+}
+
+// session returns clientId's session, registering it first if need be.
+func (this *HistoryRecorder) session(clientId int, deadline time.Time) (*ClientSession, error) {
+	this.mu.Lock()
+	session := this.sessions[clientId]
+	this.mu.Unlock()
+	if session != nil {
+		return session, nil
+	}
+
+	result, err := this.execute(SessionRegister{}, deadline)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := result.(uint64)
+	if !ok {
+		return nil, fmt.Errorf("raft: unexpected client id %v", result)
+	}
+	session = &ClientSession{ClientId: id}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.sessions[clientId] = session
+	return session, nil
+}
+
+// execute submits command until it's applied, trying each server in turn, and
+// returns the state machine's result. Only use it for commands that are safe
+// to apply more than once.
+func (this *HistoryRecorder) execute(command interface{}, deadline time.Time) (interface{}, error) {
+	this.mu.Lock()
+	server := this.leaderHint
+	this.mu.Unlock()
+
+	for tried := 0; ; tried++ {
+		if tried > 0 && tried%this.cluster.n == 0 {
+			sleepMs(100) // Went round every server; give an election time to finish
+		}
+		if time.Now().After(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+
+		attempt := ClientAttemptTimeout
+		if remaining := time.Until(deadline); remaining < attempt {
+			attempt = remaining
+		}
+		result, err := this.cluster.ExecuteClientCommand(server, command, attempt)
+		if err == nil {
+			this.mu.Lock()
+			this.leaderHint = server
+			this.mu.Unlock()
+			return result, nil
+		}
+		server = (server + 1) % this.cluster.n
+	}
+}
+
+func (this *HistoryRecorder) now() int64 {
+	return int64(time.Since(this.start))
+}
+
+func (this *HistoryRecorder) record(op Operation) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.ops = append(this.ops, op)
+}
+
+// Operations returns a copy of the history recorded so far.
+func (this *HistoryRecorder) Operations() []Operation {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]Operation(nil), this.ops...)
+}
+
+// CheckLinearizable fails the test if the recorded history isn't linearizable
+// with respect to model, and saves a visualisation of the counterexample.
+func (this *HistoryRecorder) CheckLinearizable(model Model, timeout time.Duration) {
+	t := this.cluster.t
+	result, info := CheckOperations(model, this.Operations(), timeout)
+
+	switch result {
+	case CheckOk:
+		testing_log("history of %d operations is linearizable", len(this.Operations()))
+	case CheckUnknown:
+		testing_log("linearizability check timed out after %v; inconclusive", timeout)
+	case CheckIllegal:
+		f, err := os.CreateTemp("", "linearizability-*.html")
+		if err != nil {
+			t.Errorf("history is not linearizable (could not save visualisation: %v)", err)
+			return
+		}
+		defer f.Close()
+		Visualize(model, info, f)
+		t.Errorf("history is not linearizable; see %s", f.Name())
+	}
+}
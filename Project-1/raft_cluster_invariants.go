@@ -0,0 +1,283 @@
+package raft
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// How often the invariant checker samples every node of a Cluster.
+const InvariantCheckIntervalMs = 50
+
+// nodeSample is a consistent copy of the parts of a RaftNode the checker looks at.
+type nodeSample struct {
+	id          int
+	group       int
+	state       string
+	term        int
+	first       int // Index of log[0]; entries before it are in the node's snapshot
+	log         []LogEntry
+	commitIndex int
+	lastApplied int
+}
+
+// invariantChecker continuously samples all nodes of a Cluster and fails the
+// test on any violation of the Raft safety properties (Figure 3 of the paper):
+// Election Safety, Log Matching, Leader Completeness and State Machine Safety.
+// Every sample is taken under the node's own lock, so it is a state the node
+// really was in; the properties must hold for each of them. Every Raft group
+// the servers host is checked, each on its own.
+//
+// Which term an entry was committed in can't be told from samples, as the
+// leader that committed it may be gone by the next one, so the checker
+// watches the commit events of the nodes as well: an entry is committed in
+// the term of the first leader to advance its commitIndex past it.
+type invariantChecker struct {
+	mu       sync.Mutex
+	cluster  *Cluster
+	report   func(msg string)
+	reported map[string]bool
+
+	groupsMu sync.Mutex
+	groups   map[int]*groupInvariants
+
+	// Taken with a node's lock held, so never while sampling; guards the
+	// commitTerms and leaderCommit of every group
+	termsMu sync.Mutex
+
+	quit chan interface{}
+	done chan interface{}
+}
+
+// groupInvariants is what the checker has seen of one Raft group.
+type groupInvariants struct {
+	id        int
+	leaders   map[int]int      // term -> id of the node seen leading it
+	committed map[int]LogEntry // index -> entry seen committed there
+	applied   map[int]LogEntry // index -> entry seen applied there
+
+	commitTerms  map[int]int // index -> term it was committed in
+	leaderCommit int         // Highest index in commitTerms
+}
+
+func newInvariantChecker(cluster *Cluster) *invariantChecker {
+	this := newInvariantState(func(msg string) { cluster.t.Errorf("invariant violated: %s", msg) })
+	this.cluster = cluster
+	for _, server := range cluster.getServers() {
+		server.SetEventObserver(this.observe)
+	}
+	go this.run()
+	return this
+}
+
+// newInvariantState returns a checker that isn't attached to a cluster, and
+// reports violations to report.
+func newInvariantState(report func(msg string)) *invariantChecker {
+	return &invariantChecker{
+		report:   report,
+		groups:   make(map[int]*groupInvariants),
+		reported: make(map[string]bool),
+		quit:     make(chan interface{}),
+		done:     make(chan interface{}),
+	}
+}
+
+// group returns what has been seen of group groupId, starting afresh the first
+// time it's asked for.
+func (this *invariantChecker) group(groupId int) *groupInvariants {
+	this.groupsMu.Lock()
+	defer this.groupsMu.Unlock()
+	group, ok := this.groups[groupId]
+	if !ok {
+		group = &groupInvariants{
+			id:           groupId,
+			leaders:      make(map[int]int),
+			committed:    make(map[int]LogEntry),
+			applied:      make(map[int]LogEntry),
+			commitTerms:  make(map[int]int),
+			leaderCommit: -1,
+		}
+		this.groups[groupId] = group
+	}
+	return group
+}
+
+// observe is the event observer of every server in the cluster.
+func (this *invariantChecker) observe(event Event) {
+	if event.Type != EventCommit || event.State != "Leader" {
+		return
+	}
+	group := this.group(event.Group)
+	this.termsMu.Lock()
+	defer this.termsMu.Unlock()
+	for ; group.leaderCommit < *event.Index; group.leaderCommit++ {
+		group.commitTerms[group.leaderCommit+1] = event.Term
+	}
+}
+
+// This function runs as a go routine
+func (this *invariantChecker) run() {
+	defer close(this.done)
+
+	ticker := time.NewTicker(InvariantCheckIntervalMs * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.quit:
+			return
+		case <-ticker.C:
+			this.checkOnce()
+		}
+	}
+}
+
+// stop halts background sampling and runs one final round of checks.
+func (this *invariantChecker) stop() {
+	close(this.quit)
+	<-this.done
+	this.checkOnce()
+}
+
+func (this *invariantChecker) checkOnce() {
+	var samples []nodeSample
+	for _, server := range this.cluster.getServers() {
+		for _, node := range server.allGroups() {
+			samples = append(samples, sampleNode(node))
+		}
+	}
+	this.check(samples)
+}
+
+// check checks one round of samples, taken at about the same time, each
+// against the others of its group.
+func (this *invariantChecker) check(samples []nodeSample) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	byGroup := make(map[int][]nodeSample)
+	for _, s := range samples {
+		byGroup[s.group] = append(byGroup[s.group], s)
+	}
+	for groupId, samples := range byGroup {
+		group := this.group(groupId)
+		for _, s := range samples {
+			this.checkElectionSafety(group, s)
+			this.checkStateMachineSafety(group, s)
+		}
+		for _, s := range samples {
+			this.checkLeaderCompleteness(group, s)
+		}
+		for i := 0; i < len(samples); i++ {
+			for j := i + 1; j < len(samples); j++ {
+				this.checkLogMatching(group, samples[i], samples[j])
+			}
+		}
+	}
+}
+
+func sampleNode(node *RaftNode) nodeSample {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	s := nodeSample{
+		id:          node.id,
+		group:       node.groupId,
+		state:       node.state,
+		term:        node.currentTerm,
+		first:       node.firstIndex(),
+		log:         make([]LogEntry, len(node.log)),
+		commitIndex: node.commitIndex,
+		lastApplied: node.lastApplied,
+	}
+	copy(s.log, node.log)
+	return s
+}
+
+// end is one past the index of the last entry in the sample's log.
+func (this nodeSample) end() int {
+	return this.first + len(this.log)
+}
+
+func (this nodeSample) entry(index int) LogEntry {
+	return this.log[index-this.first]
+}
+
+// Election Safety: at most one leader can be elected in a given term.
+func (this *invariantChecker) checkElectionSafety(group *groupInvariants, s nodeSample) {
+	if s.state != "Leader" {
+		return
+	}
+	if leader, ok := group.leaders[s.term]; ok && leader != s.id {
+		this.violation("Election Safety in group %d: nodes %d and %d were both leader in term %d", group.id, leader, s.id, s.term)
+		return
+	}
+	group.leaders[s.term] = s.id
+}
+
+// State Machine Safety: no two nodes commit or apply different entries at the same index.
+func (this *invariantChecker) checkStateMachineSafety(group *groupInvariants, s nodeSample) {
+	for i := s.first; i <= s.commitIndex && i < s.end(); i++ {
+		if entry, ok := group.committed[i]; ok && !reflect.DeepEqual(entry, s.entry(i)) {
+			this.violation("State Machine Safety in group %d: node %d committed %v at index %d, but %v was committed there before", group.id, s.id, s.entry(i), i, entry)
+			continue
+		}
+		group.committed[i] = s.entry(i)
+	}
+	for i := s.first; i <= s.lastApplied && i < s.end(); i++ {
+		if entry, ok := group.applied[i]; ok && !reflect.DeepEqual(entry, s.entry(i)) {
+			this.violation("State Machine Safety in group %d: node %d applied %v at index %d, but %v was applied there before", group.id, s.id, s.entry(i), i, entry)
+			continue
+		}
+		group.applied[i] = s.entry(i)
+	}
+}
+
+// Leader Completeness: an entry committed in some term is present in the logs
+// of the leaders of all higher terms, or in their snapshots, which can't be
+// looked into.
+func (this *invariantChecker) checkLeaderCompleteness(group *groupInvariants, s nodeSample) {
+	if s.state != "Leader" {
+		return
+	}
+	this.termsMu.Lock()
+	defer this.termsMu.Unlock()
+	for i, entry := range group.committed {
+		if term, ok := group.commitTerms[i]; !ok || term >= s.term || i < s.first {
+			continue
+		}
+		if i >= s.end() || !reflect.DeepEqual(s.entry(i), entry) {
+			this.violation("Leader Completeness in group %d: leader %d of term %d is missing %v committed at index %d", group.id, s.id, s.term, entry, i)
+		}
+	}
+}
+
+// Log Matching: if two logs contain an entry with the same index and term,
+// the logs are identical in all entries up through that index. Only the
+// indexes both logs still have, after their snapshots, are compared.
+func (this *invariantChecker) checkLogMatching(group *groupInvariants, a nodeSample, b nodeSample) {
+	first, end := max(a.first, b.first), min(a.end(), b.end())
+	for i := end - 1; i >= first; i-- {
+		if a.entry(i).Term != b.entry(i).Term {
+			continue
+		}
+		for j := first; j <= i; j++ {
+			if !reflect.DeepEqual(a.entry(j), b.entry(j)) {
+				this.violation("Log Matching in group %d: nodes %d and %d agree on term %d at index %d, but differ at index %d (%v vs %v)", group.id, a.id, b.id, a.entry(i).Term, i, j, a.entry(j), b.entry(j))
+				return
+			}
+		}
+		return
+	}
+}
+
+// violation fails the test, reporting each distinct problem only once.
+// Expects this.mu to be held.
+func (this *invariantChecker) violation(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if this.reported[msg] {
+		return
+	}
+	this.reported[msg] = true
+	this.report(msg)
+}
@@ -0,0 +1,52 @@
+package raft
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInvariantCheckerCatchesViolations(t *testing.T) {
+	x := LogEntry{Term: 1, Command: []byte("x")}
+	y := LogEntry{Term: 1, Command: []byte("y")}
+	z := LogEntry{Term: 2, Command: []byte("z")}
+	sample := func(id int, state string, term int, commitIndex int, log ...LogEntry) nodeSample {
+		return nodeSample{id: id, state: state, term: term, log: log, commitIndex: commitIndex, lastApplied: commitIndex}
+	}
+	inGroup := func(group int, s nodeSample) nodeSample {
+		s.group = group
+		return s
+	}
+	// Node 0 leads term 1 and commits x at index 0
+	committedX := []nodeSample{sample(0, "Leader", 1, 0, x), sample(1, "Follower", 1, 0, x)}
+
+	for _, test := range []struct {
+		name   string
+		rounds [][]nodeSample
+		want   string
+	}{
+		{"two leaders", [][]nodeSample{{sample(0, "Leader", 2, -1), sample(1, "Leader", 2, -1)}}, "Election Safety"},
+		{"different entries committed", [][]nodeSample{committedX, {sample(2, "Follower", 2, 0, y)}}, "State Machine Safety"},
+		{"logs that fork", [][]nodeSample{{sample(0, "Follower", 2, -1, x, z), sample(1, "Follower", 2, -1, y, z)}}, "Log Matching"},
+		{"leader without a committed entry", [][]nodeSample{committedX, {sample(2, "Leader", 2, -1, y)}}, "Leader Completeness"},
+		// Node 3 only hears of the commit in term 4; the leader of term 2 still needs x
+		{"committed entry first seen in a later term", [][]nodeSample{{sample(3, "Follower", 4, 0, x)}, {sample(2, "Leader", 2, -1)}}, "Leader Completeness"},
+		{"no violation", [][]nodeSample{committedX, {sample(2, "Leader", 2, 1, x, z), sample(0, "Follower", 2, 1, x, z)}}, ""},
+		// Groups are independent: each may have its own leader of a term, and its own log
+		{"two groups", [][]nodeSample{committedX, {inGroup(1, sample(1, "Leader", 1, 0, y)), inGroup(1, sample(2, "Follower", 1, 0, y))}}, ""},
+		{"two leaders in another group", [][]nodeSample{committedX, {inGroup(1, sample(1, "Leader", 1, -1)), inGroup(1, sample(2, "Leader", 1, -1))}}, "Election Safety"},
+	} {
+		var reports []string
+		checker := newInvariantState(func(msg string) { reports = append(reports, msg) })
+		checker.observe(Event{Type: EventCommit, State: "Leader", Term: 1, Index: intPtr(0)})
+		for _, round := range test.rounds {
+			checker.check(round)
+		}
+		caught := len(reports) > 0
+		for _, report := range reports {
+			caught = caught && strings.HasPrefix(report, test.want)
+		}
+		if caught != (test.want != "") {
+			t.Errorf("%s: got %q, want %q violations", test.name, reports, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Nemesis injects randomized faults into a Cluster: disconnections, crashes,
+// partitions and latency spikes. It runs one fault at a time, each followed
+// by a full heal, so that the cluster keeps making progress in between.
+type Nemesis struct {
+	cluster *Cluster
+	rng     *rand.Rand
+}
+
+func (this *Cluster) NewNemesis(rng *rand.Rand) *Nemesis {
+	return &Nemesis{cluster: this, rng: rng}
+}
+
+// Run keeps injecting faults until stop is closed, then heals the cluster.
+// It calls t.Fatal on harness errors, so it must run on the test's goroutine.
+func (this *Nemesis) Run(stop <-chan interface{}) {
+	for {
+		undo := this.injectFault()
+
+		if !this.sleep(500+this.rng.Intn(3500), stop) {
+			undo()
+			this.cluster.HealAll()
+			return
+		}
+		undo()
+		this.cluster.HealAll()
+
+		if !this.sleep(500+this.rng.Intn(2500), stop) {
+			return
+		}
+	}
+}
+
+// injectFault applies one randomly chosen fault and returns a function undoing
+// whatever HealAll can't undo by itself.
+func (this *Nemesis) injectFault() (undo func()) {
+	n := this.cluster.n
+	minority := (n - 1) / 2
+
+	fault := this.rng.Intn(4)
+	if minority == 0 {
+		fault = 3 // With fewer than 3 servers, losing any of them loses the majority
+	}
+	switch fault {
+	case 0:
+		for _, id := range this.rng.Perm(n)[:1+this.rng.Intn(minority)] {
+			this.cluster.DisconnectPeer(id)
+		}
+		return func() {}
+
+	case 1:
+		crashed := this.rng.Perm(n)[:1+this.rng.Intn(minority)]
+		for _, id := range crashed {
+			this.cluster.CrashPeer(id)
+		}
+		return func() {
+			for _, id := range crashed {
+				this.cluster.RestartPeer(id)
+			}
+		}
+
+	case 2:
+		// Sometimes the leader ends up on the minority side, sometimes not.
+		this.cluster.PartitionPeers(this.rng.Perm(n)[:1+this.rng.Intn(n/2)])
+		return func() {}
+
+	default:
+		slow := this.rng.Intn(n)
+		server := this.cluster.getServers()[slow]
+		latency := server.getMinRPCLatency()
+		spike := 200 + this.rng.Intn(1300)
+		testing_log("Adding %dms latency to %d", spike, slow)
+		server.SetMinRPCLatency(latency + spike)
+		return func() {
+			server.SetMinRPCLatency(latency)
+		}
+	}
+}
+
+// sleep waits ms milliseconds, returning false early if stop is closed.
+func (this *Nemesis) sleep(ms int, stop <-chan interface{}) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return true
+	}
+}
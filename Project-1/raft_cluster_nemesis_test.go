@@ -0,0 +1,24 @@
+package raft
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNemesisOnSmallClusters(t *testing.T) {
+	for n := 1; n <= 2; n++ {
+		cluster := NewCluster(t, n)
+		nemesis := cluster.NewNemesis(rand.New(rand.NewSource(1)))
+		for i := 0; i < 20; i++ {
+			undo := nemesis.injectFault()
+			undo()
+			cluster.HealAll()
+		}
+		for id := 0; id < n; id++ {
+			if !cluster.connected[id] || cluster.crashed[id] {
+				t.Errorf("%d-server cluster: server %d was taken down", n, id)
+			}
+		}
+		cluster.Shutdown()
+	}
+}
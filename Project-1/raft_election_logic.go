@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
@@ -13,7 +14,7 @@ func (this *RaftNode) startElectionTimer() {
 	this.mu.Lock()
 	termStarted := this.currentTerm
 	this.mu.Unlock()
-	this.write_log("Election timer started: %v, with term=%d", timeoutDuration, termStarted)
+	this.logger(LogElection).Info("Election timer started", "timeout", timeoutDuration, "term", termStarted)
 
 	// Keep checking for a resolution
 	ticker := time.NewTicker(200 * time.Millisecond)
@@ -37,6 +38,13 @@ func (this *RaftNode) startElectionTimer() {
 
 		// Start an election if we haven't heard from a leader or haven't voted for someone for the duration of the timeout.
 		if elapsed := time.Since(this.lastElectionTimerStartedTime); elapsed >= timeoutDuration {
+			if !this.isMember(this.id) {
+				// Not one of the group's members yet, or any more; see raft_membership.go
+				this.lastElectionTimerStartedTime = time.Now()
+				this.mu.Unlock()
+				continue
+			}
+			this.emit(Event{Type: EventElectionTimeout})
 			this.startElection()
 			this.mu.Unlock()
 			return
@@ -47,67 +55,64 @@ func (this *RaftNode) startElectionTimer() {
 
 // startElection starts a new election with this RN as a candidate.
 func (this *RaftNode) startElection() {
-	this.state = "Candidate"
 	this.currentTerm += 1
+	this.setState("Candidate")
+	this.leaderId = -1
+	this.metrics.electionsStarted++
 	termWhenVoteRequested := this.currentTerm
+	ctx := this.currentTermContext()
 	this.lastElectionTimerStartedTime = time.Now()
 	this.votedFor = this.id
-	this.write_log("became Candidate with term=%d;", termWhenVoteRequested)
+	this.persistHardState()
+	this.logger(LogElection).Info("became Candidate", "state", this.state, "term", termWhenVoteRequested)
 
 	votesReceived := 1
 
 	// Send RequestVote RPCs to all other servers concurrently.
 	for _, peerId := range this.peersIds {
-		go func(peerId int) {
+		go func(ctx context.Context, peerId int) {
 			this.mu.Lock()
-			var LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested int
-
-			if len(this.log) > 0 {
-				lastIndex := len(this.log) - 1
-				LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested = lastIndex, this.log[lastIndex].Term
-			} else {
-				LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested = -1, -1
-			}
+			LastLogIndexWhenVoteRequested, LastLogTermWhenVoteRequested := this.lastIndex(), this.lastTerm()
 			this.mu.Unlock()
 
 			args := RequestVoteArgs{
+				GroupId:      this.groupId,
 				Term:         termWhenVoteRequested,
 				CandidateId:  this.id,
 				LastLogIndex: LastLogIndexWhenVoteRequested,
 				LastLogTerm:  LastLogTermWhenVoteRequested,
 
 				Latency: rand.Intn(500), // Ignore Latency.
+				MsgId:   this.server.newMsgId(),
 			}
 
-			if LogVoteRequestMessages {
-				this.write_log("sending RequestVote to %d: %+v", peerId, args)
-			}
+			this.logger(LogVote).Info("sending RequestVote", "rpc", "RequestVote", "peer", peerId, "term", args.Term, "args", args)
 
 			var reply RequestVoteReply
-			if err := this.server.SendRPCCallTo(peerId, "RaftNode.RequestVote", args, &reply); err == nil {
+			if err := this.server.SendRPCCallTo(ctx, peerId, "RaftNode.RequestVote", args, &reply); err == nil {
 				this.mu.Lock()
 				defer this.mu.Unlock()
-				if LogVoteRequestMessages {
-					this.write_log("received RequestVoteReply from %d: %+v", peerId, reply)
-				}
+				this.logger(LogVote).Info("received RequestVote reply", "rpc", "RequestVote", "peer", peerId, "term", this.currentTerm, "reply", reply)
 				if this.state != "Candidate" {
-					this.write_log("State changed from Candidate to %s", this.state)
+					this.logger(LogElection).Info("State changed from Candidate", "state", this.state, "term", this.currentTerm)
 					return
 				}
-
-				// IMPLEMENT HANDLING THE VOTEREQUEST's REPLY;
-				// You probably need to have implemented becomeFollower before this.
-
-				//-------------------------------------------------------------------------------------------/
-				if reply.Term > {
-					// TODO
-				} else if reply.Term ==  {
-					// TODO
+				if this.currentTerm != termWhenVoteRequested {
+					return // A reply to an election we've since given up on
 				}
-				//-------------------------------------------------------------------------------------------/
 
+				if reply.Term > this.currentTerm {
+					this.becomeFollower(reply.Term)
+					return
+				} else if reply.Term == this.currentTerm && reply.VoteGranted {
+					votesReceived++
+					if votesReceived*2 > len(this.peersIds)+1 {
+						this.startLeader()
+						return
+					}
+				}
 			}
-		}(peerId)
+		}(ctx, peerId)
 	}
 
 	// Run another election timer, in case this election is not successful.
@@ -116,10 +121,25 @@ func (this *RaftNode) startElection() {
 
 // becomeFollower sets a node to be a follower and resets its state.
 func (this *RaftNode) becomeFollower(term int) {
-	this.write_log("became Follower with term=%d; log=%v", term, this.log)
+	this.logger(LogElection).Info("became Follower", "state", "Follower", "term", term, "log", this.log)
+	previousState, previousTerm := this.state, this.currentTerm
 
 	// IMPLEMENT becomeFollower; do you need to start a goroutine here, maybe?
 	//-------------------------------------------------------------------------------------------/
-	// TODO
+	this.state = "Follower"
+	this.currentTerm = term
+	this.votedFor = -1
+	this.lastElectionTimerStartedTime = time.Now()
+	go this.startElectionTimer()
 	//-------------------------------------------------------------------------------------------/
+
+	if this.currentTerm != previousTerm {
+		this.leaderId = -1
+	}
+	this.transferTarget = -1
+	this.persistHardState()
+	this.rotateTermContext() // Abandon any RPCs still in flight for the old term
+	if this.state != previousState || this.currentTerm != previousTerm {
+		this.emit(Event{Type: EventStateChange, From: previousState})
+	}
 }
@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A candidate whose log is behind gets no vote, and doesn't put off the
+// election timer of the node it asked, so it can't hold back the election of
+// one that's up to date.
+func TestLaggingCandidateDoesntDelayElection(t *testing.T) {
+	server := NewServer(0, []int{1, 2}, make(chan interface{}), 0)
+	node := NewRaftNode(0, DefaultGroup, []int{1, 2}, server, GroupConfig{TracePath: filepath.Join(t.TempDir(), "applied")}, make(chan interface{}))
+	defer node.KillNode()
+
+	started := time.Now().Add(-time.Second)
+	node.mu.Lock()
+	node.currentTerm = 2
+	node.log = []LogEntry{{Term: 1}, {Term: 2}}
+	node.lastElectionTimerStartedTime = started
+	node.mu.Unlock()
+	timerStarted := func() time.Time {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.lastElectionTimerStartedTime
+	}
+
+	var reply RequestVoteReply
+	node.HandleRequestVote(RequestVoteArgs{Term: 3, CandidateId: 1, LastLogIndex: 1, LastLogTerm: 1}, &reply)
+	if reply.VoteGranted || reply.Term != 3 {
+		t.Fatalf("lagging candidate: got %+v", reply)
+	}
+	if !timerStarted().Equal(started) {
+		t.Fatal("a vote request that wasn't granted restarted the election timer")
+	}
+
+	// One that's up to date gets the vote, which does restart it
+	node.HandleRequestVote(RequestVoteArgs{Term: 3, CandidateId: 2, LastLogIndex: 1, LastLogTerm: 2}, &reply)
+	if !reply.VoteGranted {
+		t.Fatalf("up-to-date candidate: got %+v", reply)
+	}
+	if !timerStarted().After(started) {
+		t.Fatal("a granted vote didn't restart the election timer")
+	}
+
+	// A leader or candidate that steps down starts the timer afresh
+	for _, state := range []string{"Leader", "Candidate"} {
+		node.mu.Lock()
+		node.state = state
+		node.lastElectionTimerStartedTime = started
+		term := node.currentTerm
+		node.mu.Unlock()
+		node.HandleRequestVote(RequestVoteArgs{Term: term + 1, CandidateId: 1, LastLogIndex: 1, LastLogTerm: 1}, &reply)
+		if status := node.Status(); status.State != "Follower" || !timerStarted().After(started) {
+			t.Fatalf("%s stepping down: state %s, election timer started %v", state, status.State, timerStarted())
+		}
+	}
+}
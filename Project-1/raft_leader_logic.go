@@ -1,19 +1,29 @@
 package raft
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
 
 // startLeader switches this into a leader state and begins process of heartbeats.
 func (this *RaftNode) startLeader() {
-	this.state = "Leader"
+	this.setState("Leader")
+	this.leaderId = this.id
+	this.transferTarget = -1
+	this.metrics.electionsWon++
+	this.metrics.proposedAt = make(map[int]time.Time) // Entries proposed in earlier terms are not ours to time
+	this.nextIndex = make(map[int]int)                // Members removed under an earlier leader aren't replicated to
+	this.matchIndex = make(map[int]int)
+	this.lastContact = make(map[int]time.Time)
+	this.snapshotsDisabled = make(map[int]bool) // It may have been given a snapshot directory since
 
 	for _, peerId := range this.peersIds {
-		this.nextIndex[peerId] = len(this.log)
+		this.nextIndex[peerId] = this.lastIndex() + 1
 		this.matchIndex[peerId] = -1
 	}
-	this.write_log("became Leader; term=%d, nextIndex=%v, matchIndex=%v; log=%v", this.currentTerm, this.nextIndex, this.matchIndex, this.log)
+	this.appendNoop()
+	this.logger(LogElection).Info("became Leader", "state", this.state, "term", this.currentTerm, "nextIndex", this.nextIndex, "matchIndex", this.matchIndex, "log", this.log)
 
 	go func() {
 		ticker := time.NewTicker(1000 * time.Millisecond)
@@ -45,22 +55,28 @@ func (this *RaftNode) broadcastHeartbeats() {
 		return
 	}
 	termWhenHeartbeatSent := this.currentTerm
+	ctx := this.currentTermContext()
+	replicas := this.replicas()
+	this.lastHeartbeat = time.Now()
 
 	this.mu.Unlock()
 
 	// Send a Heartbeat PER PEER.
-	for _, peerId := range this.peersIds { // Peers are other nodes.
+	for _, peerId := range replicas { // Peers are other nodes.
 
-		go func(peerId int) {
+		go func(ctx context.Context, peerId int) {
 			this.mu.Lock()
 
 			currentPeer_nextIndex := this.nextIndex[peerId]
-			prevLogIndex := currentPeer_nextIndex - 1
-			prevLogTerm := -1
-			if prevLogIndex >= 0 {
-				prevLogTerm = this.log[prevLogIndex].Term
+			if currentPeer_nextIndex < this.firstIndex() {
+				// The entries it needs are gone from our log; it gets our snapshot instead
+				this.startSnapshotSend(ctx, peerId, termWhenHeartbeatSent)
+				this.mu.Unlock()
+				return
 			}
-			entries := this.log[currentPeer_nextIndex:] // Which entries on the leader are not there on peer?
+			prevLogIndex := currentPeer_nextIndex - 1
+			prevLogTerm, _ := this.termAt(prevLogIndex)
+			entries := this.entries(currentPeer_nextIndex, this.lastIndex()+1) // Which entries on the leader are not there on peer?
 
 			var aeType string
 			if len(entries) > 0 {
@@ -70,6 +86,7 @@ func (this *RaftNode) broadcastHeartbeats() {
 			}
 
 			args := AppendEntriesArgs{
+				GroupId:      this.groupId,
 				Term:         termWhenHeartbeatSent,
 				LeaderId:     this.id,
 				PrevLogIndex: prevLogIndex,
@@ -77,21 +94,22 @@ func (this *RaftNode) broadcastHeartbeats() {
 				Entries:      entries,
 				LeaderCommit: this.commitIndex,
 				Latency:      rand.Intn(500), // Ignore Latency
+				MsgId:        this.server.newMsgId(),
 			}
+			this.metrics.appendEntriesSent[peerId]++
 
 			this.mu.Unlock()
-			if (aeType == "Heartbeat" && LogHeartbeatMessages) || aeType == "AppendEntries" {
-				this.write_log("sending %s to %v: currentPeer_nextIndex=%d, args=%+v", aeType, peerId, currentPeer_nextIndex, args)
-			}
+			this.logger(LogReplication).Log(ctx, appendEntriesLevel(aeType), "sending "+aeType, "rpc", "AppendEntries", "peer", peerId, "term", args.Term, "nextIndex", currentPeer_nextIndex, "args", args)
 
 			var reply AppendEntriesReply
 
 			// Don't worry about this; this is how the RPC itself is sent.
 			// Just presume that the AppendEntries went to this follower id,
 			// And you now need to handle the reply.
-			if err := this.server.SendRPCCallTo(peerId, "RaftNode.AppendEntries", args, &reply); err == nil {
+			if err := this.server.SendRPCCallTo(ctx, peerId, "RaftNode.AppendEntries", args, &reply); err == nil {
 				this.mu.Lock()
 				defer this.mu.Unlock()
+				this.lastContact[peerId] = time.Now()
 
 				if reply.Term > this.currentTerm {
 					this.becomeFollower(reply.Term)
@@ -106,12 +124,11 @@ func (this *RaftNode) broadcastHeartbeats() {
 						// So does this.matchIndex[peerId].
 						// IMPLEMENT THE UPDATE LOGIC FOR THIS.
 						//-------------------------------------------------------------------------------------------/
-						// TODO
+						this.nextIndex[peerId] = currentPeer_nextIndex + len(entries)
+						this.matchIndex[peerId] = this.nextIndex[peerId] - 1
 						//-------------------------------------------------------------------------------------------/
 
-						if (aeType == "Heartbeat" && LogHeartbeatMessages) || aeType == "AppendEntries" {
-							this.write_log("%s reply from NODE %d success: nextIndex := %v, matchIndex := %v", aeType, peerId, this.nextIndex, this.matchIndex)
-						}
+						this.logger(LogReplication).Log(ctx, appendEntriesLevel(aeType), aeType+" reply success", "rpc", "AppendEntries", "peer", peerId, "term", this.currentTerm, "nextIndex", this.nextIndex, "matchIndex", this.matchIndex)
 						oldCommitIndex := this.commitIndex
 
 						// AppendEntries success on majority, now commit on leader (IF NOT HEARTBEAT)
@@ -120,17 +137,17 @@ func (this *RaftNode) broadcastHeartbeats() {
 						// Figure out how and where; HINT: look for a majority of matchCounts.
 
 						//-------------------------------------------------------------------------------------------/
-						for i := this.commitIndex + 1; i < len(this.log); i++ {
-							if this.log[i].Term == this.currentTerm {
+						for i := this.commitIndex + 1; i <= this.lastIndex(); i++ {
+							if this.entryAt(i).Term == this.currentTerm {
 								matchCount := 1 // Leader itself
 
 								for _, peerId := range this.peersIds {
-									if { // TODO  // When should you update matchCount?
+									if this.matchIndex[peerId] >= i {
 										matchCount++
 									}
 								}
 
-								if { // TODO  // When should you update commitIndex to i?
+								if matchCount*2 > len(this.peersIds)+1 {
 									this.commitIndex = i
 								}
 							}
@@ -140,25 +157,27 @@ func (this *RaftNode) broadcastHeartbeats() {
 						// This actually applies commits. Your logic above for deciding whether or not
 						// To commit needs to work succesfully in order for this to occur.
 						if this.commitIndex != oldCommitIndex {
-							this.write_log("leader sets commitIndex := %d", this.commitIndex)
+							this.observeCommits(oldCommitIndex)
+							this.emit(Event{Type: EventCommit, Index: intPtr(this.commitIndex)})
+							this.logger(LogReplication).Info("leader sets commitIndex", "term", this.currentTerm, "commitIndex", this.commitIndex)
 							this.notifyToApplyCommit <- 1
+							this.forgetRemoved()
 						}
 
 					} else {
+						this.metrics.appendEntriesRejected[peerId]++
 
 						// There's changes you need to make here.
 						// this.nextIndex for the received PEER (this.nextIndex[peerId]) needs to be updated.
 
 						//-------------------------------------------------------------------------------------------/
-						// TODO
+						this.nextIndex[peerId] = currentPeer_nextIndex - 1
 						//-------------------------------------------------------------------------------------------/
 
-						if (aeType == "Heartbeat" && LogHeartbeatMessages) || aeType == "AppendEntries" {
-							this.write_log("%s reply from NODE %d was failure; Hence, decrementing its nextIndex", aeType, peerId)
-						}
+						this.logger(LogReplication).Log(ctx, appendEntriesLevel(aeType), aeType+" reply was failure; Hence, decrementing its nextIndex", "rpc", "AppendEntries", "peer", peerId, "term", this.currentTerm)
 					}
 				}
 			}
-		}(peerId)
+		}(ctx, peerId)
 	}
 }
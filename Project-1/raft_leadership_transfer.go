@@ -0,0 +1,118 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrTransferInProgress = errors.New("raft: a leadership transfer is already in progress")
+
+// TimeoutNow asks a follower to start an election right away instead of
+// waiting for its election timer; see section 3.10 of the Raft thesis.
+type TimeoutNowArgs struct {
+	GroupId  int // Raft group the RPC is addressed to; see Server.AddGroup
+	Term     int
+	LeaderId int
+
+	Latency int
+	MsgId   uint64 // Only used to match up journal events
+}
+
+func (this TimeoutNowArgs) GetMsgId() uint64 { return this.MsgId }
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+func (this *RaftNode) HandleTimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.state == "Dead" {
+		return nil
+	}
+
+	this.logger(LogElection).Info("Received TimeoutNow", "rpc", "TimeoutNow", "peer", args.LeaderId, "term", this.currentTerm, "args", args)
+
+	if args.Term > this.currentTerm {
+		this.becomeFollower(args.Term)
+	}
+	if args.Term == this.currentTerm && this.state == "Follower" && this.isMember(this.id) {
+		this.emit(Event{Type: EventElectionTimeout})
+		this.startElection()
+	}
+
+	reply.Term = this.currentTerm
+	return nil
+}
+
+// TransferLeadership hands leadership over to target: it stops accepting new
+// commands, brings target's log up to date and then tells it to start an
+// election, which it wins unless another node times out at the same moment.
+// Returns nil once this node is no longer the leader; if ctx ends first the
+// transfer is abandoned and this node carries on as leader.
+func (this *RaftNode) TransferLeadership(ctx context.Context, target int) error {
+	this.mu.Lock()
+	if this.state != "Leader" {
+		this.mu.Unlock()
+		return ErrNotLeader
+	}
+	if target == this.id {
+		this.mu.Unlock()
+		return nil
+	}
+	if _, ok := this.matchIndex[target]; !ok {
+		this.mu.Unlock()
+		return fmt.Errorf("raft: %d is not a peer", target)
+	}
+	if this.transferTarget >= 0 {
+		this.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	this.transferTarget = target
+	term := this.currentTerm
+	this.logger(LogElection).Info("transferring leadership", "peer", target, "term", term)
+	this.mu.Unlock()
+
+	defer func() {
+		this.mu.Lock()
+		if this.state == "Leader" && this.currentTerm == term {
+			this.transferTarget = -1
+		}
+		this.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeoutNowSent := false
+	for {
+		this.mu.Lock()
+		if this.state != "Leader" || this.currentTerm != term {
+			this.mu.Unlock()
+			return nil
+		}
+		caughtUp := this.matchIndex[target] == this.lastIndex()
+		sendCtx := this.currentTermContext()
+		this.mu.Unlock()
+
+		if !caughtUp {
+			this.broadcastHeartbeats() // Don't wait for the next heartbeat to replicate
+		} else if !timeoutNowSent {
+			timeoutNowSent = true
+			go func() {
+				args := TimeoutNowArgs{GroupId: this.groupId, Term: term, LeaderId: this.id, MsgId: this.server.newMsgId()}
+				var reply TimeoutNowReply
+				if err := this.server.SendRPCCallTo(sendCtx, target, "RaftNode.TimeoutNow", args, &reply); err != nil {
+					this.logger(LogElection).Info("TimeoutNow failed", "rpc", "TimeoutNow", "peer", target, "term", term, "err", err)
+				}
+			}()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
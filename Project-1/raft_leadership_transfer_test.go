@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTransferLeadership(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	node := cluster.getServers()[leader].raftLogic
+	_, term, _ := node.GetNodeState()
+	target := (leader + 1) % 3
+	follower := (leader + 2) % 3
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cluster.getServers()[follower].raftLogic.TransferLeadership(ctx, target); err != ErrNotLeader {
+		t.Fatalf("transfer from a follower: got %v", err)
+	}
+	if err := node.TransferLeadership(ctx, 7); err == nil {
+		t.Fatal("transfer to a node that isn't a peer succeeded")
+	}
+	if err := node.TransferLeadership(ctx, leader); err != nil {
+		t.Fatalf("transfer to itself: got %v", err)
+	}
+
+	if err := node.TransferLeadership(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+	if newLeader := cluster.getClusterLeader(); newLeader != target {
+		t.Fatalf("leader after the transfer: got %d, want %d", newLeader, target)
+	}
+	if _, newTerm, _ := cluster.getServers()[target].raftLogic.GetNodeState(); newTerm <= term {
+		t.Fatalf("new leader's term %d isn't past %d", newTerm, term)
+	}
+	if result, err := cluster.ExecuteClientCommand(target, KVCommand{Op: KVGet, Key: "x"}, 10*time.Second); err != nil || result.(KVResult).Value != "1" {
+		t.Fatalf("get x from the new leader: %v, %v", result, err)
+	}
+}
+
+// A transfer to a peer that can't catch up holds off new commands until it is
+// abandoned, after which the leader carries on.
+func TestTransferLeadershipAbandoned(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	node := cluster.getServers()[leader].raftLogic
+	_, term, _ := node.GetNodeState()
+	target := (leader + 1) % 3
+	cluster.DisconnectPeer(target)
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- node.TransferLeadership(ctx, target) }()
+	sleepMs(200)
+	if node.ReceiveClientCommand(KVCommand{Op: KVPut, Key: "y", Value: "2"}) {
+		t.Fatal("command accepted during a transfer")
+	}
+	if err := node.TransferLeadership(context.Background(), (leader+2)%3); err != ErrTransferInProgress {
+		t.Fatalf("second transfer: got %v", err)
+	}
+
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Fatalf("transfer to a disconnected peer: got %v", err)
+	}
+	if _, newTerm, isLeader := node.GetNodeState(); !isLeader || newTerm != term {
+		t.Fatalf("after an abandoned transfer: leader %v in term %d, was leader in term %d", isLeader, newTerm, term)
+	}
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "y", Value: "2"}, 10*time.Second); err != nil {
+		t.Fatalf("command after an abandoned transfer: %v", err)
+	}
+}
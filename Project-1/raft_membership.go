@@ -0,0 +1,258 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// A group's members change one server at a time (section 4.2 of the Raft
+// thesis): any majority of the old members and any majority of the new ones
+// then have a member in common, so the two can't elect leaders of their own.
+// The leader puts the new members in its log as an EntryConfig, and every
+// node goes by the latest one in its log from when it's appended, committed
+// or not; one that's dropped with the rest of a conflicting log takes the
+// members back to those of the one before. The next change waits until the
+// last is committed, and until the leader has committed an entry of its own
+// term, so that a leader that hasn't seen an uncommitted change of its
+// predecessor's can't make one that overlaps it.
+//
+// A new member starts with GroupConfig.Joining, as one of no group, and is
+// sent the log, or the snapshot, from the start. A removed one goes on being
+// sent entries until its removal is committed, so that it learns of it:
+// nodes that aren't members don't start elections, and nobody votes for one
+// that isn't a member of its own config, or even takes notice of its term.
+// The leader can't remove itself; it has to hand over leadership first.
+
+var (
+	ErrMembershipChangePending = errors.New("raft: the last membership change isn't committed yet")
+	ErrRemoveLeader            = errors.New("raft: the leader can't remove itself; transfer leadership first")
+)
+
+// GroupMembers is the command of an EntryConfig.
+type GroupMembers struct {
+	Members []int          // Sorted
+	Addrs   map[int]string // Where to reach members servers mightn't know of yet; see Server.connectMembers
+}
+
+func init() {
+	RegisterCommand("raft/members", 1, GroupMembers{})
+}
+
+// configOf decodes the members an EntryConfig sets.
+func configOf(entry LogEntry) (GroupMembers, bool) {
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return GroupMembers{}, false
+	}
+	members, ok := command.Value.(GroupMembers)
+	return members, ok
+}
+
+// latestConfig returns the latest EntryConfig in the log at or before index,
+// and its index; -1 if there's none.
+func (this *RaftNode) latestConfig(index int) (GroupMembers, int) {
+	for i := min(index, this.lastIndex()); i >= this.firstIndex(); i-- {
+		if entry := this.entryAt(i); entry.Type == EntryConfig {
+			if config, ok := configOf(entry); ok {
+				return config, i
+			}
+			this.logger(LogReplication).Error("undecodable config entry", "term", this.currentTerm, "index", i)
+		}
+	}
+	return GroupMembers{}, -1
+}
+
+// membersAt returns the members as of index, which mustn't be before the
+// snapshot. Expects this.mu to be held.
+func (this *RaftNode) membersAt(index int) []int {
+	if config, at := this.latestConfig(index); at >= 0 {
+		return config.Members
+	}
+	if this.snapshot.Members != nil {
+		return this.snapshot.Members
+	}
+	return this.initialMembers
+}
+
+// updateMembership takes the members from the latest config, after the log
+// or snapshot changed. A leader starts sending new members everything from
+// the start. Expects this.mu to be held.
+func (this *RaftNode) updateMembership() {
+	config, at := this.latestConfig(this.lastIndex())
+	switch {
+	case at >= 0:
+	case this.snapshot.Members != nil:
+		config.Members, at = this.snapshot.Members, this.snapshot.LastIncludedIndex
+	default:
+		config.Members = this.initialMembers
+	}
+	changed := at != this.configIndex
+	this.members, this.configIndex = config.Members, at
+
+	this.peersIds = make([]int, 0, len(this.members))
+	for _, id := range this.members {
+		if id != this.id {
+			this.peersIds = append(this.peersIds, id)
+		}
+	}
+	if this.state == "Leader" {
+		for _, peerId := range this.peersIds {
+			if _, ok := this.nextIndex[peerId]; !ok {
+				this.nextIndex[peerId], this.matchIndex[peerId] = 0, -1
+			}
+		}
+	}
+	if changed {
+		this.logger(LogReplication).Info("members changed", "term", this.currentTerm, "members", this.members, "index", at)
+		if len(config.Addrs) > 0 {
+			go this.server.connectMembers(config.Addrs)
+		}
+	}
+}
+
+// logChanged updates the members if the log, changed from index on by
+// appending entries, lost or gained an EntryConfig. Expects this.mu to be held.
+func (this *RaftNode) logChanged(index int, entries []LogEntry) {
+	changed := index <= this.configIndex
+	for _, entry := range entries {
+		changed = changed || entry.Type == EntryConfig
+	}
+	if changed {
+		this.updateMembership()
+	}
+}
+
+// isMember reports whether id is one of the members. Expects this.mu to be held.
+func (this *RaftNode) isMember(id int) bool {
+	i := sort.SearchInts(this.members, id)
+	return i < len(this.members) && this.members[i] == id
+}
+
+// replicas returns the peers the leader sends entries to: its peers, and
+// removed members until their removal is committed. Expects this.mu to be held.
+func (this *RaftNode) replicas() []int {
+	replicas := make([]int, 0, len(this.nextIndex))
+	for peerId := range this.nextIndex {
+		replicas = append(replicas, peerId)
+	}
+	sort.Ints(replicas)
+	return replicas
+}
+
+// forgetRemoved stops the leader sending entries to removed members once
+// their removal is committed. Expects this.mu to be held.
+func (this *RaftNode) forgetRemoved() {
+	if this.configIndex > this.commitIndex {
+		return
+	}
+	for peerId := range this.nextIndex {
+		if !this.isMember(peerId) {
+			delete(this.nextIndex, peerId)
+			delete(this.matchIndex, peerId)
+			delete(this.lastContact, peerId)
+		}
+	}
+}
+
+// Members returns the group's members, as of the latest config this node has.
+func (this *RaftNode) Members() []int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]int(nil), this.members...)
+}
+
+// AddMember makes server id, on which the group must have been started with
+// GroupConfig.Joining, a member, and waits until that's committed. addr, if
+// not "", is where servers that don't know id yet can reach it. Fails with
+// ErrNotLeader on anything but the leader, and with
+// ErrMembershipChangePending while another change is under way.
+func (this *RaftNode) AddMember(ctx context.Context, id int, addr string) error {
+	var addrs map[int]string
+	if addr != "" {
+		addrs = map[int]string{id: addr}
+	}
+	return this.changeMembers(ctx, addrs, func(members []int) []int {
+		if this.isMember(id) {
+			return nil
+		}
+		members = append(members, id)
+		sort.Ints(members)
+		return members
+	})
+}
+
+// RemoveMember takes server id out of the group, and waits until that's
+// committed; it fails like AddMember, and with ErrRemoveLeader if id is this
+// node. Once it returns, the removed member can be stopped.
+func (this *RaftNode) RemoveMember(ctx context.Context, id int) error {
+	if id == this.id {
+		return ErrRemoveLeader
+	}
+	return this.changeMembers(ctx, nil, func(members []int) []int {
+		if !this.isMember(id) {
+			return nil
+		}
+		for i, member := range members {
+			if member == id {
+				return append(members[:i], members[i+1:]...)
+			}
+		}
+		return nil
+	})
+}
+
+// changeMembers appends the members change returns, given a copy of the
+// current ones, unless it returns nil for no change, and waits until they're
+// committed. A leader that hasn't committed an entry of its own term yet,
+// which it does with its no-op, is waited for until ctx ends.
+func (this *RaftNode) changeMembers(ctx context.Context, addrs map[int]string, change func(members []int) []int) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	this.mu.Lock()
+	for {
+		if this.state != "Leader" || this.transferTarget >= 0 {
+			this.mu.Unlock()
+			return ErrNotLeader
+		}
+		if this.configIndex > this.commitIndex {
+			this.mu.Unlock()
+			return ErrMembershipChangePending
+		}
+		if term, _ := this.termAt(this.commitIndex); term == this.currentTerm {
+			break
+		}
+		this.mu.Unlock()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		this.mu.Lock()
+	}
+
+	members := change(append([]int(nil), this.members...))
+	if members == nil {
+		this.mu.Unlock()
+		return nil
+	}
+	command, err := EncodeCommand(this.codec, GroupMembers{Members: members, Addrs: addrs})
+	if err != nil {
+		this.mu.Unlock()
+		return err
+	}
+	this.log = append(this.log, LogEntry{Command: command, Term: this.currentTerm, Time: time.Now().UnixNano(), Type: EntryConfig})
+	index, term := this.lastIndex(), this.currentTerm
+	this.persistEntries(index)
+	this.emit(Event{Type: EventLogAppend, Index: intPtr(index), Entries: this.log[len(this.log)-1:]})
+	this.updateMembership()
+
+	ch := make(chan ApplyResult, 1)
+	this.applyWaiters[index] = append(this.applyWaiters[index], applyWaiter{term: term, ch: ch})
+	this.mu.Unlock()
+
+	this.broadcastHeartbeats() // Don't wait for the next heartbeat to replicate
+	_, err = this.awaitApplied(ctx, term, ch)
+	return err
+}
@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A removed member stops taking part, without disturbing the rest, and can
+// be added back.
+func TestRemoveAndAddMember(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	node := cluster.getServers()[leader].raftLogic
+	removed := (leader + 1) % 3
+	// A leader changes members only once it has committed an entry of its
+	// term, which its no-op is
+	awaitApplied(t, cluster, node.Status().LastLogIndex)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cluster.getServers()[removed].raftLogic.RemoveMember(ctx, leader); err != ErrNotLeader {
+		t.Fatalf("removal by a follower: got %v", err)
+	}
+	if err := node.RemoveMember(ctx, leader); err != ErrRemoveLeader {
+		t.Fatalf("removal of the leader: got %v", err)
+	}
+	if err := node.RemoveMember(ctx, removed); err != nil {
+		t.Fatal(err)
+	}
+	if members := node.Members(); len(members) != 2 || members[0] == removed || members[1] == removed {
+		t.Fatalf("members after removing %d: %v", removed, members)
+	}
+
+	// The two left make a majority of their own
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "y", Value: "2"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// and the removed member, no longer sent entries, doesn't start elections
+	_, term, _ := cluster.getServers()[removed].raftLogic.GetNodeState()
+	sleepMs(1500)
+	if _, newTerm, _ := cluster.getServers()[removed].raftLogic.GetNodeState(); newTerm != term {
+		t.Fatalf("removed member went from term %d to %d", term, newTerm)
+	}
+	if newLeader := cluster.getClusterLeader(); newLeader != leader {
+		t.Fatalf("leader changed from %d to %d", leader, newLeader)
+	}
+
+	if err := node.AddMember(ctx, removed, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "z", Value: "3"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	awaitCaughtUp(t, cluster.getServers()[removed].raftLogic, node)
+	if members := cluster.getServers()[removed].raftLogic.Members(); !reflect.DeepEqual(members, []int{0, 1, 2}) {
+		t.Fatalf("members of %d after adding it back: %v", removed, members)
+	}
+}
+
+// A server started to join a running group is sent the log, and becomes one
+// of its members.
+func TestJoinRunningGroup(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan interface{})
+	server := NewServer(3, []int{0, 1, 2}, ready, 20)
+	server.SetJoining(true)
+	server.SetTracePath(filepath.Join(t.TempDir(), "applied"))
+	server.SetStateMachine(NewSessions(NewKVStore(), DefaultSessionTTL))
+	server.Serve()
+	defer server.Shutdown()
+	for id, peer := range cluster.getServers() {
+		server.ConnectToPeer(id, peer.GetCurrentAddress())
+	}
+	close(ready)
+
+	joining := server.raftLogic
+	sleepMs(1500)
+	if _, term, _ := joining.GetNodeState(); term != 0 || len(joining.Members()) != 0 {
+		t.Fatalf("joining server took part before being added: term %d, members %v", term, joining.Members())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	node := cluster.getServers()[leader].raftLogic
+	if err := node.AddMember(ctx, 3, server.GetCurrentAddress().String()); err != nil {
+		t.Fatal(err)
+	}
+	awaitCaughtUp(t, joining, node)
+	if members := joining.Members(); !reflect.DeepEqual(members, []int{0, 1, 2, 3}) {
+		t.Fatalf("members of the joined server: %v", members)
+	}
+
+	// It's a voting member: it can be handed leadership, and serve reads
+	if err := node.TransferLeadership(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; sleepMs(50) {
+		if _, _, isLeader := joining.GetNodeState(); isLeader {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("joined server didn't take over leadership")
+		}
+	}
+	if result, err := joining.SubmitCommand(ctx, KVCommand{Op: KVGet, Key: "x"}); err != nil || result.(KVResult).Value != "1" {
+		t.Fatalf("get x from the joined server: %v, %v", result, err)
+	}
+}
+
+// awaitCaughtUp waits for node to apply everything leader has.
+func awaitCaughtUp(t *testing.T, node *RaftNode, leader *RaftNode) {
+	t.Helper()
+	leader.mu.Lock()
+	index := leader.lastApplied
+	leader.mu.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; sleepMs(50) {
+		node.mu.Lock()
+		lastApplied := node.lastApplied
+		node.mu.Unlock()
+		if lastApplied >= index {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("node %d has applied up to %d, not %d", node.id, lastApplied, index)
+		}
+	}
+}
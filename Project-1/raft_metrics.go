@@ -0,0 +1,321 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Upper bounds, in seconds, of the buckets of every latency histogram.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a Prometheus-style cumulative histogram; not safe for concurrent use.
+type histogram struct {
+	counts []int // counts[i] observations fell in (latencyBuckets[i-1], latencyBuckets[i]]
+	count  int
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int, len(latencyBuckets))}
+}
+
+func (this *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	this.count++
+	this.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			this.counts[i]++
+			return
+		}
+	}
+}
+
+func (this *histogram) clone() *histogram {
+	return &histogram{counts: append([]int(nil), this.counts...), count: this.count, sum: this.sum}
+}
+
+// raftMetrics are the counters a RaftNode keeps about itself; guarded by RaftNode.mu.
+type raftMetrics struct {
+	electionsStarted      int
+	electionsWon          int
+	votesGranted          int
+	appendEntriesSent     map[int]int // Per peer, heartbeats included
+	appendEntriesRejected map[int]int // Per peer, replies with Success == false in the same term
+	commitLatency         *histogram  // From a leader appending an entry to committing it
+	proposedAt            map[int]time.Time
+}
+
+func newRaftMetrics() raftMetrics {
+	return raftMetrics{
+		appendEntriesSent:     make(map[int]int),
+		appendEntriesRejected: make(map[int]int),
+		commitLatency:         newHistogram(),
+		proposedAt:            make(map[int]time.Time),
+	}
+}
+
+// observeCommits records the commit latency of every entry this leader
+// proposed between oldCommitIndex and commitIndex. Expects this.mu to be held.
+func (this *RaftNode) observeCommits(oldCommitIndex int) {
+	for i := oldCommitIndex + 1; i <= this.commitIndex; i++ {
+		if proposed, ok := this.metrics.proposedAt[i]; ok {
+			this.metrics.commitLatency.observe(time.Since(proposed))
+			delete(this.metrics.proposedAt, i)
+		}
+	}
+}
+
+/* EXPOSITION */
+
+// metricsWriter renders the Prometheus text exposition format.
+type metricsWriter struct {
+	buf    bytes.Buffer
+	node   int
+	labels []string        // Added to every sample after node, e.g. the group
+	seen   map[string]bool // Metrics whose header is written
+}
+
+func (this *metricsWriter) header(name string, kind string, help string) {
+	if this.seen[name] {
+		return
+	}
+	if this.seen == nil {
+		this.seen = make(map[string]bool)
+	}
+	this.seen[name] = true
+	fmt.Fprintf(&this.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels are alternating names and values.
+func (this *metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(&this.buf, "%s{node=\"%d\"", name, this.node)
+	labels = append(this.labels[:len(this.labels):len(this.labels)], labels...)
+	for i := 0; i+1 < len(labels); i += 2 {
+		fmt.Fprintf(&this.buf, ",%s=%q", labels[i], labels[i+1])
+	}
+	fmt.Fprintf(&this.buf, "} %v\n", value)
+}
+
+func (this *metricsWriter) gauge(name string, help string, value float64) {
+	this.header(name, "gauge", help)
+	this.sample(name, value)
+}
+
+func (this *metricsWriter) counter(name string, help string, value int) {
+	this.header(name, "counter", help)
+	this.sample(name, float64(value))
+}
+
+func (this *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+	cumulative := 0
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		this.sample(name+"_bucket", float64(cumulative), append(labels, "le", fmt.Sprint(bound))...)
+	}
+	this.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	this.sample(name+"_sum", h.sum, labels...)
+	this.sample(name+"_count", float64(h.count), labels...)
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// groupMetrics is a copy of one group's metrics, taken under its node's lock.
+type groupMetrics struct {
+	groupId       int
+	state         string
+	currentTerm   int
+	commitIndex   int
+	lastApplied   int
+	logLength     int
+	metrics       raftMetrics
+	matchIndexLag map[int]int // Per peer; only kept by a leader
+}
+
+func (this *RaftNode) groupMetrics() groupMetrics {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	g := groupMetrics{
+		groupId:     this.groupId,
+		state:       this.state,
+		currentTerm: this.currentTerm,
+		commitIndex: this.commitIndex,
+		lastApplied: this.lastApplied,
+		logLength:   len(this.log),
+		metrics: raftMetrics{
+			electionsStarted:      this.metrics.electionsStarted,
+			electionsWon:          this.metrics.electionsWon,
+			votesGranted:          this.metrics.votesGranted,
+			appendEntriesSent:     make(map[int]int),
+			appendEntriesRejected: make(map[int]int),
+			commitLatency:         this.metrics.commitLatency.clone(),
+		},
+	}
+	for peerId, n := range this.metrics.appendEntriesSent {
+		g.metrics.appendEntriesSent[peerId] = n
+	}
+	for peerId, n := range this.metrics.appendEntriesRejected {
+		g.metrics.appendEntriesRejected[peerId] = n
+	}
+	if this.state == "Leader" {
+		g.matchIndexLag = make(map[int]int)
+		for peerId, matchIndex := range this.matchIndex {
+			g.matchIndexLag[peerId] = this.lastIndex() - matchIndex
+		}
+	}
+	return g
+}
+
+// writeGroupMetrics appends the metrics of nodes, this server's members of
+// its groups, to w. The text format wants all of a metric's samples together,
+// so each metric is written for every group before the next.
+func writeGroupMetrics(w *metricsWriter, nodes []*RaftNode) {
+	groups := make([]groupMetrics, len(nodes))
+	for i, node := range nodes {
+		groups[i] = node.groupMetrics()
+	}
+	// Calls write once per group, with w labelling its samples with the group
+	each := func(write func(g groupMetrics)) {
+		for _, g := range groups {
+			w.labels = []string{"group", fmt.Sprint(g.groupId)}
+			write(g)
+		}
+		w.labels = nil
+	}
+	gauge := func(name string, help string, value func(g groupMetrics) int) {
+		w.header(name, "gauge", help)
+		each(func(g groupMetrics) { w.sample(name, float64(value(g))) })
+	}
+	counter := func(name string, help string, value func(g groupMetrics) int) {
+		w.header(name, "counter", help)
+		each(func(g groupMetrics) { w.sample(name, float64(value(g))) })
+	}
+	perPeer := func(name string, kind string, help string, values func(g groupMetrics) map[int]int) {
+		w.header(name, kind, help)
+		each(func(g groupMetrics) {
+			for _, peerId := range sortedKeys(values(g)) {
+				w.sample(name, float64(values(g)[peerId]), "peer", fmt.Sprint(peerId))
+			}
+		})
+	}
+
+	gauge("raft_current_term", "Current term of the node.", func(g groupMetrics) int { return g.currentTerm })
+	w.header("raft_state", "gauge", "1 for the state the node is in, 0 for the others.")
+	each(func(g groupMetrics) {
+		for _, state := range []string{"Follower", "Candidate", "Leader", "Dead"} {
+			value := 0.0
+			if g.state == state {
+				value = 1
+			}
+			w.sample("raft_state", value, "state", state)
+		}
+	})
+	gauge("raft_commit_index", "Highest log index known to be committed.", func(g groupMetrics) int { return g.commitIndex })
+	gauge("raft_last_applied", "Highest log index applied to the state machine.", func(g groupMetrics) int { return g.lastApplied })
+	gauge("raft_log_length", "Number of entries in the log.", func(g groupMetrics) int { return g.logLength })
+
+	counter("raft_elections_started_total", "Elections started as a candidate.", func(g groupMetrics) int { return g.metrics.electionsStarted })
+	counter("raft_elections_won_total", "Elections won.", func(g groupMetrics) int { return g.metrics.electionsWon })
+	counter("raft_votes_granted_total", "Votes granted to candidates.", func(g groupMetrics) int { return g.metrics.votesGranted })
+
+	perPeer("raft_append_entries_sent_total", "counter", "AppendEntries RPCs sent as leader, heartbeats included.",
+		func(g groupMetrics) map[int]int { return g.metrics.appendEntriesSent })
+	perPeer("raft_append_entries_rejected_total", "counter", "AppendEntries RPCs a peer rejected because of a log mismatch.",
+		func(g groupMetrics) map[int]int { return g.metrics.appendEntriesRejected })
+	perPeer("raft_peer_match_index_lag", "gauge", "How many entries a peer's matchIndex is behind the leader's log.",
+		func(g groupMetrics) map[int]int { return g.matchIndexLag })
+
+	w.header("raft_commit_latency_seconds", "histogram", "Time from a leader appending an entry to committing it.")
+	each(func(g groupMetrics) { w.histogram("raft_commit_latency_seconds", g.metrics.commitLatency) })
+}
+
+// writeMetrics appends this server's RPC metrics to w.
+func (this *Server) writeMetrics(w *metricsWriter) {
+	this.mu.Lock()
+	methods := make([]string, 0, len(this.rpcStats))
+	for method := range this.rpcStats {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	stats := make(map[string]RPCStats)
+	latency := make(map[string]*histogram)
+	for _, method := range methods {
+		stats[method] = *this.rpcStats[method]
+		if h := this.rpcLatency[method]; h != nil {
+			latency[method] = h.clone()
+		}
+	}
+	this.mu.Unlock()
+
+	w.header("raft_rpc_total", "counter", "Outgoing RPCs by outcome.")
+	for _, method := range methods {
+		s := stats[method]
+		w.sample("raft_rpc_total", float64(s.Succeeded), "method", method, "outcome", "succeeded")
+		w.sample("raft_rpc_total", float64(s.Failed), "method", method, "outcome", "failed")
+		w.sample("raft_rpc_total", float64(s.TimedOut), "method", method, "outcome", "timed_out")
+		w.sample("raft_rpc_total", float64(s.Cancelled), "method", method, "outcome", "cancelled")
+	}
+
+	w.header("raft_rpc_duration_seconds", "histogram", "Round trip time of outgoing RPCs that got a reply.")
+	for _, method := range methods {
+		if h := latency[method]; h != nil {
+			w.histogram("raft_rpc_duration_seconds", h, "method", method)
+		}
+	}
+
+	w.header("raft_peer_connected", "gauge", "1 if the connection to a peer is up.")
+	conns := this.GetPeerConnStates()
+	peerIds := make([]int, 0, len(conns))
+	for peerId := range conns {
+		peerIds = append(peerIds, peerId)
+	}
+	sort.Ints(peerIds)
+	for _, peerId := range peerIds {
+		value := 0.0
+		if conns[peerId].State == PeerConnected {
+			value = 1
+		}
+		w.sample("raft_peer_connected", value, "peer", fmt.Sprint(peerId))
+	}
+}
+
+// ServeHTTP serves /metrics in the Prometheus text format.
+func (this *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w := &metricsWriter{node: this.serverId}
+	writeGroupMetrics(w, this.allGroups())
+	this.writeMetrics(w)
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(w.buf.Bytes())
+}
+
+// ServeMetrics starts an HTTP server on addr (e.g. "localhost:0") exposing
+// /metrics, and returns the address it listens at. It is stopped by Shutdown.
+func (this *Server) ServeMetrics(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", this)
+	httpServer := &http.Server{Handler: mux}
+
+	this.mu.Lock()
+	this.metricsServer = httpServer
+	this.mu.Unlock()
+
+	go httpServer.Serve(listener)
+	return listener.Addr(), nil
+}
@@ -0,0 +1,140 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogram()
+	for _, d := range []time.Duration{2 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond, 20 * time.Second} {
+		h.observe(d)
+	}
+	w := &metricsWriter{node: 3, labels: []string{"group", "1"}}
+	w.header("x_seconds", "histogram", "Help text.")
+	w.header("x_seconds", "histogram", "Help text.") // Only written once
+	w.histogram("x_seconds", h, "method", "M")
+
+	want := `# HELP x_seconds Help text.
+# TYPE x_seconds histogram
+x_seconds_bucket{node="3",group="1",method="M",le="0.001"} 0
+x_seconds_bucket{node="3",group="1",method="M",le="0.005"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.01"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.025"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.05"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.1"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.25"} 1
+x_seconds_bucket{node="3",group="1",method="M",le="0.5"} 3
+x_seconds_bucket{node="3",group="1",method="M",le="1"} 3
+x_seconds_bucket{node="3",group="1",method="M",le="2.5"} 3
+x_seconds_bucket{node="3",group="1",method="M",le="5"} 3
+x_seconds_bucket{node="3",group="1",method="M",le="10"} 3
+x_seconds_bucket{node="3",group="1",method="M",le="+Inf"} 4
+x_seconds_sum{node="3",group="1",method="M"} 20.602
+x_seconds_count{node="3",group="1",method="M"} 4
+`
+	if got := w.buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	servers := newMultiGroupServers(t, 3)
+	leader := groupLeader(t, servers, DefaultGroup)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := leader.SubmitCommand(ctx, KVCommand{Op: KVPut, Key: "k", Value: "v"}); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := servers[leader.id].ServeMetrics("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := resp.Header.Get("Content-Type"); !strings.HasPrefix(kind, "text/plain") {
+		t.Errorf("Content-Type %q", kind)
+	}
+
+	lines := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		lines[line]++
+	}
+	node := fmt.Sprintf(`node="%d"`, leader.id)
+	for _, want := range []string{
+		"# TYPE raft_current_term gauge",
+		"# TYPE raft_commit_latency_seconds histogram",
+		"# TYPE raft_rpc_total counter",
+		`raft_state{` + node + `,group="0",state="Leader"} 1`,
+		`raft_state{` + node + `,group="0",state="Follower"} 0`,
+		`raft_commit_latency_seconds_count{` + node + `,group="0"} 1`, // The put; the no-op wasn't proposed by a client
+	} {
+		if lines[want] != 1 {
+			t.Errorf("%q appears %d times in:\n%s", want, lines[want], body)
+		}
+	}
+	for _, group := range []int{0, 1, 2} {
+		if sample := fmt.Sprintf(`raft_last_applied{%s,group="%d"}`, node, group); !strings.Contains(string(body), sample) {
+			t.Errorf("no %s", sample)
+		}
+	}
+	for _, peer := range servers[leader.id].peersIds {
+		if sample := fmt.Sprintf(`raft_peer_connected{%s,peer="%d"} 1`, node, peer); lines[sample] != 1 {
+			t.Errorf("no %s", sample)
+		}
+	}
+}
+
+// Each metric's lines form one block, however many groups the server hosts,
+// as the text format requires.
+func TestMetricsFamiliesContiguous(t *testing.T) {
+	servers := newMultiGroupServers(t, 3)
+	leader := groupLeader(t, servers, DefaultGroup)
+	groupLeader(t, servers, 1)
+	recorder := httptest.NewRecorder()
+	servers[leader.id].ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	written := make(map[string]bool)
+	family := ""
+	groups := make(map[string]map[string]bool) // Groups with samples, by family
+	for _, line := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			name := strings.Fields(line)[2]
+			if written[name] {
+				t.Fatalf("%s is written in more than one block:\n%s", name, recorder.Body)
+			}
+			written[name], family = true, name
+			groups[name] = make(map[string]bool)
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line[:strings.IndexAny(line, "{ ")]
+		if name != family && strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count") != family {
+			t.Fatalf("%q is in the block of %s:\n%s", line, family, recorder.Body)
+		}
+		if i := strings.Index(line, `group="`); i >= 0 {
+			groups[family][line[i:i+len(`group="0"`)]] = true
+		}
+	}
+	for _, name := range []string{"raft_state", "raft_last_applied", "raft_commit_latency_seconds"} {
+		if len(groups[name]) != 3 {
+			t.Errorf("%s has samples for groups %v, want all 3", name, groups[name])
+		}
+	}
+}
@@ -1,77 +1,200 @@
 package raft
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
+	"sort"
 	"sync"
 	"time"
 )
 
-const LogHeartbeatMessages = false
-const LogVoteRequestMessages = true
-
 type LogEntry struct {
-	Command interface{}
+	Command []byte // Encoded with EncodeCommand; see codec.go
 	Term    int
+	Time    int64     // The proposing leader's clock, in Unix nanoseconds
+	Type    EntryType // EntryCommand unless Raft added the entry itself
 }
 
+type EntryType int
+
+const (
+	EntryCommand EntryType = iota
+	// Changes the group's members, from when it's appended; its Command is a
+	// GroupMembers. See raft_membership.go.
+	EntryConfig
+	// Appended by every new leader, so that the entries of earlier terms it
+	// has, which it can't commit by counting replicas, are committed along
+	// with it without waiting for a client. Has no Command, and is never
+	// applied to the state machine.
+	EntryNoop
+)
+
 // Main Raft Data Structure
 type RaftNode struct {
 	mu sync.Mutex
 
 	id       int
-	peersIds []int
+	groupId  int   // Which of its server's Raft groups this node belongs to
+	peersIds []int // The other members, as of the latest config; see raft_membership.go
 
 	// Persistent state on all servers
 	currentTerm int
 	votedFor    int
-	log         []LogEntry
+	log         []LogEntry   // Entries after the snapshot: log[i] is at index snapshot.LastIncludedIndex+1+i
+	snapshot    SnapshotMeta // What the state machine was last saved or restored as of; see raft_snapshot.go
+
+	// The group's members, this node among them unless it's being added or
+	// has been removed, as of the latest EntryConfig in the log, at
+	// configIndex; before any, they're those of the snapshot, or else initialMembers
+	members        []int
+	configIndex    int
+	initialMembers []int
 
 	// Volatile state on all servers
 	commitIndex int
 	lastApplied int
 
 	// Volatile Raft state on leaders
-	nextIndex  map[int]int
-	matchIndex map[int]int
+	nextIndex   map[int]int
+	matchIndex  map[int]int
+	lastContact map[int]time.Time // When each peer last replied to us
 
 	// Utility States
 	state                        string
+	leaderId                     int       // Leader of currentTerm as far as we know, or -1
+	transferTarget               int       // Peer leadership is being handed to, or -1
+	lastHeartbeat                time.Time // Last AppendEntries sent as leader, or received from one
 	lastElectionTimerStartedTime time.Time
 	notifyToApplyCommit          chan int
-	LOG_ENTRIES                  bool
 	filePath                     string
+	snapshotDir                  string // Where InstallSnapshot puts snapshots; "" if disabled
+	snapshotThreshold            int    // Applied entries after which the log is compacted; 0 if never
+	snapshotData                 []byte // The state machine as of snapshot, for sending to lagging peers
+	sendingSnapshot              map[int]bool
+	snapshotsDisabled            map[int]bool // Peers that replied ErrSnapshotsDisabled this term
+	logWrites                    int          // Bumped by persistEntries, for writes made without this.mu to tell
+
+	// Held, before this.mu, while a snapshot is written to storage or a
+	// received one to snapshotDir, so that none of that IO needs this.mu.
+	snapshotMu sync.Mutex
+
+	// One logger per subsystem, tagged with this node's id; see logging.go
+	loggers map[string]*slog.Logger
+
+	// Application committed entries are applied to, and clients waiting for that
+	stateMachine StateMachine
+	watches      *WatchHub // Changes made by stateMachine, if it's Watchable
+	codec        Codec     // Commands submitted to this node are encoded with it
+	applyWaiters map[int][]applyWaiter
+
+	metrics raftMetrics
+
+	// Where the persistent state above is kept, if anywhere
+	storage            Storage
+	persistedHardState HardState
+
+	// ctx is cancelled when the node is killed; termCtx is additionally
+	// cancelled as soon as currentTerm moves past termCtxTerm, so that RPCs
+	// sent on behalf of an old term are abandoned.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	termCtx     context.Context
+	termCancel  context.CancelFunc
+	termCtxTerm int
 
 	// Networking Component, do NOT worry about this whatsoever.
 	server *Server
 }
 
 // Constructor for RaftNodes
-func NewRaftNode(id int, peersIds []int, server *Server, ready <-chan interface{}) *RaftNode {
+func NewRaftNode(id int, groupId int, peersIds []int, server *Server, config GroupConfig, ready <-chan interface{}) *RaftNode {
 	this := new(RaftNode)
 
 	this.server = server
 	this.notifyToApplyCommit = make(chan int, 16)
 
 	this.id = id
+	this.groupId = groupId
 	this.peersIds = peersIds
 
 	this.votedFor = -1
 	this.currentTerm = 0
+	if !config.Joining {
+		this.initialMembers = append([]int{id}, peersIds...)
+		sort.Ints(this.initialMembers)
+	}
 
 	this.commitIndex = -1
 	this.lastApplied = -1
 
+	this.stateMachine = config.StateMachine
+	this.watches = NewWatchHub()
+	if watchable, ok := this.stateMachine.(Watchable); ok {
+		watchable.SetWatchHub(this.watches)
+	}
+
+	this.snapshot = noSnapshot
+	storage := config.Storage
+	this.storage = storage
+	if storage != nil {
+		state, entries, err := storage.Load()
+		if err != nil {
+			log.Fatalf("node %d group %d: loading persistent state: %v", id, groupId, err)
+		}
+		this.currentTerm, this.votedFor, this.log = state.CurrentTerm, state.VotedFor, entries
+		this.persistedHardState = state
+
+		// Everything the snapshot covers was committed, and is applied by
+		// restoring it; the log after it is applied as usual
+		meta, data, err := storage.Snapshot()
+		if err != nil {
+			log.Fatalf("node %d group %d: loading snapshot: %v", id, groupId, err)
+		}
+		if meta.LastIncludedIndex >= 0 {
+			if err := this.restoreStateMachine(data); err != nil {
+				log.Fatalf("node %d group %d: restoring snapshot %+v: %v", id, groupId, meta, err)
+			}
+			this.snapshot, this.snapshotData = meta, data
+			this.commitIndex, this.lastApplied = meta.LastIncludedIndex, meta.LastIncludedIndex
+			this.watches.Compact(meta.LastIncludedIndex)
+			this.watches.applied(meta.LastIncludedIndex)
+		}
+	}
+
 	this.nextIndex = make(map[int]int)
 	this.matchIndex = make(map[int]int)
+	this.lastContact = make(map[int]time.Time)
+	this.sendingSnapshot = make(map[int]bool)
+	this.snapshotsDisabled = make(map[int]bool)
+	this.codec = server.codec
+	this.applyWaiters = make(map[int][]applyWaiter)
+	this.metrics = newRaftMetrics()
 
 	this.state = "Follower"
+	this.leaderId = -1
+	this.transferTarget = -1
 
-	this.LOG_ENTRIES = true
+	this.loggers = make(map[string]*slog.Logger)
+	tags := []any{"node", id}
+	if groupId != DefaultGroup {
+		tags = append(tags, "group", groupId)
+	}
+	for _, subsystem := range []string{LogElection, LogVote, LogReplication, LogApply, LogClient} {
+		this.loggers[subsystem] = server.logging.Logger(subsystem, tags...)
+	}
+
+	this.configIndex = -1
+	this.updateMembership()
 
-	this.filePath = "NodeLogs/" + strconv.Itoa(this.id)
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+	this.rotateTermContext()
+
+	this.filePath = config.TracePath
+	this.snapshotDir = config.SnapshotDir
+	this.snapshotThreshold = config.SnapshotThreshold
 	f, _ := os.Create(this.filePath)
 	f.Close()
 
@@ -96,34 +219,89 @@ func NewRaftNode(id int, peersIds []int, server *Server, ready <-chan interface{
 // This is the function that also writes queries accepted by the leader to files
 // to observe as output
 func (this *RaftNode) applyCommitedLogEntries() {
+	// Opened once, rather than for every batch: this runs until the node is killed
+	f, _ := os.OpenFile(this.filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	defer f.Close()
+
 	for range this.notifyToApplyCommit {
 		this.mu.Lock()
 
 		var entriesToApply []LogEntry
 
 		if this.commitIndex > this.lastApplied {
-			entriesToApply = this.log[this.lastApplied+1 : this.commitIndex+1]
+			entriesToApply = this.entries(this.lastApplied+1, this.commitIndex+1)
 		}
 
-		f, _ := os.OpenFile(this.filePath, os.O_APPEND|os.O_WRONLY, 0644)
-
-		defer f.Close()
-
 		for i, entry := range entriesToApply {
-			strentry := fmt.Sprintf("%s; T:[%d]; I:[%d]", entry.Command, this.currentTerm, this.commitIndex+i)
-			f.WriteString(strentry)
-			f.WriteString("\n")
+			if entry.Type == EntryCommand { // Only commands to write out
+				strentry := fmt.Sprintf("%s; T:[%d]; I:[%d]", describeCommand(entry.Command), this.currentTerm, this.commitIndex+i)
+				f.WriteString(strentry)
+				f.WriteString("\n")
+			}
+
+			this.applyEntry(this.lastApplied+1+i, entry)
 		}
 
 		this.lastApplied = this.commitIndex
+		compact := this.snapshotThreshold > 0 && this.lastApplied-this.snapshot.LastIncludedIndex >= this.snapshotThreshold
 		this.mu.Unlock()
+
+		if compact {
+			if _, err := this.Snapshot(); err != nil {
+				this.logger(LogApply).Error("snapshot failed", "err", err)
+			}
+		}
 	}
 
-	this.write_log("applyCommitedLogEntries done")
+	this.logger(LogApply).Info("applyCommitedLogEntries done")
 }
 
 /* UTILITY FUNCTIONS */
 
+// The log starts after the snapshot; these take absolute log indexes, and
+// expect this.mu to be held.
+
+// firstIndex is the index of this.log[0], whether or not there is one.
+func (this *RaftNode) firstIndex() int {
+	return this.snapshot.LastIncludedIndex + 1
+}
+
+// lastIndex is the index of the last entry in the log, or the last one the
+// snapshot covers if the log is empty; -1 if there's neither.
+func (this *RaftNode) lastIndex() int {
+	return this.firstIndex() + len(this.log) - 1
+}
+
+func (this *RaftNode) lastTerm() int {
+	if len(this.log) == 0 {
+		return this.snapshot.LastIncludedTerm
+	}
+	return this.log[len(this.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, which is known for the log,
+// the snapshot's last entry and index -1 (term -1), but not for the entries
+// before that the snapshot covers.
+func (this *RaftNode) termAt(index int) (term int, ok bool) {
+	if index == this.snapshot.LastIncludedIndex {
+		return this.snapshot.LastIncludedTerm, true
+	}
+	if index < this.firstIndex() || index > this.lastIndex() {
+		return 0, false
+	}
+	return this.log[index-this.firstIndex()].Term, true
+}
+
+func (this *RaftNode) entryAt(index int) LogEntry {
+	return this.log[index-this.firstIndex()]
+}
+
+// entries returns the entries at indexes [from, to), none of which may be
+// covered by the snapshot.
+func (this *RaftNode) entries(from int, to int) []LogEntry {
+	return this.log[from-this.firstIndex() : to-this.firstIndex()]
+}
+
 // GetNodeState reports the state of this RN.
 func (this *RaftNode) GetNodeState() (id int, term int, isLeader bool) {
 	this.mu.Lock()
@@ -135,15 +313,42 @@ func (this *RaftNode) GetNodeState() (id int, term int, isLeader bool) {
 func (this *RaftNode) KillNode() {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	this.state = "Dead"
-	this.write_log("KILLED")
+	this.setState("Dead")
+	this.cancel()
+	this.logger(LogElection).Info("KILLED", "state", this.state, "term", this.currentTerm)
 	close(this.notifyToApplyCommit)
 }
 
-// This function logs all messages to the terminal
-func (this *RaftNode) write_log(format string, args ...interface{}) {
-	if this.LOG_ENTRIES {
-		format = fmt.Sprintf("AT NODE %d: ", this.id) + format
-		log.Printf(format, args...)
+// rotateTermContext cancels the context of the previous term if currentTerm
+// has changed since it was created. Expects this.mu to be held.
+func (this *RaftNode) rotateTermContext() {
+	if this.termCtx != nil && this.termCtxTerm == this.currentTerm {
+		return
+	}
+	if this.termCancel != nil {
+		this.termCancel()
+	}
+	this.termCtx, this.termCancel = context.WithCancel(this.ctx)
+	this.termCtxTerm = this.currentTerm
+}
+
+// currentTermContext returns the context outgoing RPCs for the current term
+// should be sent with. Expects this.mu to be held.
+func (this *RaftNode) currentTermContext() context.Context {
+	this.rotateTermContext()
+	return this.termCtx
+}
+
+// logger returns the logger for one of this node's subsystems.
+func (this *RaftNode) logger(subsystem string) *slog.Logger {
+	return this.loggers[subsystem]
+}
+
+// appendEntriesLevel logs heartbeats only at Debug level, as there's one per
+// peer every second; AppendEntries that carry entries are logged at Info.
+func appendEntriesLevel(aeType string) slog.Level {
+	if aeType == "Heartbeat" {
+		return slog.LevelDebug
 	}
+	return slog.LevelInfo
 }
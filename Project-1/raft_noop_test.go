@@ -0,0 +1,62 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaderNoopCommitsEarlierTerms(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	awaitApplied(t, cluster, cluster.getServers()[leader].raftLogic.Status().LastApplied)
+
+	// Leave servers 0 and 1 with an entry of the last term that they never
+	// heard was committed, and bring the cluster back up with no clients
+	for id := 0; id < 3; id++ {
+		cluster.CrashPeer(id)
+	}
+	state, log, _ := cluster.storages[0].Load()
+	command, _ := EncodeCommand(GobCodec, KVCommand{Op: KVPut, Key: "y", Value: "2"})
+	pending := len(log)
+	for _, id := range []int{0, 1} {
+		_, log, _ := cluster.storages[id].Load()
+		cluster.storages[id].AppendEntries(len(log), []LogEntry{{Command: command, Term: state.CurrentTerm}})
+	}
+	for id := 0; id < 3; id++ {
+		cluster.RestartPeer(id)
+	}
+
+	// The next leader commits it along with its no-op, which follows it
+	awaitApplied(t, cluster, pending+1)
+	node := cluster.getServers()[cluster.getClusterLeader()].raftLogic
+	node.mu.Lock()
+	term, entry, noop := node.currentTerm, node.entryAt(pending), node.entryAt(pending+1)
+	node.mu.Unlock()
+	if entry.Type != EntryCommand || entry.Term != state.CurrentTerm {
+		t.Fatalf("entry %d: got %+v, want the command of term %d", pending, entry, state.CurrentTerm)
+	}
+	if noop.Type != EntryNoop || noop.Term != term {
+		t.Fatalf("entry %d: got %+v, want the no-op of the leader's term %d", pending+1, noop, term)
+	}
+	if events, _, err := cluster.getServers()[0].raftLogic.WatchEvents("y", false, 0, 0, time.Second); err != nil || len(events) != 1 || events[0].Value != "2" {
+		t.Fatalf("changes to y: %v, %v", events, err)
+	}
+}
+
+// awaitApplied waits for every server to apply the entries up to index.
+func awaitApplied(t *testing.T, cluster *Cluster, index int) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for id, server := range cluster.getServers() {
+		for server.raftLogic.Status().LastApplied < index {
+			if time.Now().After(deadline) {
+				t.Fatalf("server %d hasn't applied entry %d: %+v", id, index, server.raftLogic.Status())
+			}
+			sleepMs(100)
+		}
+	}
+}
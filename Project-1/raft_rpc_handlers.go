@@ -1,17 +1,24 @@
 package raft
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Handles an incoming RPC RequestVote request
 type RequestVoteArgs struct {
+	GroupId      int // Raft group the RPC is addressed to; see Server.AddGroup
 	Term         int
 	CandidateId  int
 	LastLogIndex int
 	LastLogTerm  int
 
 	Latency int
+	MsgId   uint64 // Only used to match up journal events
 }
 
+func (this RequestVoteArgs) GetMsgId() uint64 { return this.MsgId }
+
 type RequestVoteReply struct {
 	Term        int
 	VoteGranted bool
@@ -27,46 +34,56 @@ func (this *RaftNode) HandleRequestVote(args RequestVoteArgs, reply *RequestVote
 		return nil
 	}
 
-	var nodeLastLogIndex, nodeLastLogTerm int
+	nodeLastLogIndex, nodeLastLogTerm := this.lastIndex(), this.lastTerm()
 
-	if len(this.log) > 0 {
-		lastIndex := len(this.log) - 1
-		nodeLastLogIndex, nodeLastLogTerm = lastIndex, this.log[lastIndex].Term
-	} else {
-		nodeLastLogIndex, nodeLastLogTerm = -1, -1
-	}
+	this.logger(LogVote).Info("Received Vote Request", "rpc", "RequestVote", "peer", args.CandidateId, "term", this.currentTerm, "args", args, "votedFor", this.votedFor, "lastLogIndex", nodeLastLogIndex, "lastLogTerm", nodeLastLogTerm)
 
-	if LogVoteRequestMessages {
-		this.write_log("Received Vote Request from NODE %d; Args: %+v [currentTerm=%d, votedFor=%d, log index/term=(%d, %d)]", args.CandidateId, args, this.currentTerm, this.votedFor, nodeLastLogIndex, nodeLastLogTerm)
+	if !this.isMember(args.CandidateId) {
+		// Most likely removed, and not told yet; its term, which goes up with
+		// every election it can't win, mustn't depose the leader
+		reply.Term = this.currentTerm
+		this.logger(LogVote).Info("ignoring Vote Request from a non-member", "rpc", "RequestVote", "peer", args.CandidateId, "term", this.currentTerm, "members", this.members)
+		return nil
 	}
 
 	if args.Term > this.currentTerm {
+		// Only a granted vote restarts a follower's timer (§5.2): a candidate
+		// whose log is behind mustn't keep the others from electing one that
+		// can catch it up. A leader or candidate stepping down starts one.
+		started, wasFollower := this.lastElectionTimerStartedTime, this.state == "Follower"
 		this.becomeFollower(args.Term)
+		if wasFollower {
+			this.lastElectionTimerStartedTime = started
+		}
 	}
 
 	// IMPLEMENT THE LOGIC FOR WHETHER THIS NODE VOTES FOR THE CANDIDATE THAT SENT
 	// THIS REQUEST, OR NOT
 	// All the variables that you need for the conditions have been defined above.
 	//-------------------------------------------------------------------------------------------/
-	if  { // TODO: what are the conditions necessary to vote? HINT: there's multiple.
-
-		// TODO: indicate that it has voted.
-
+	if this.currentTerm == args.Term && (this.votedFor == -1 || this.votedFor == args.CandidateId) && (args.LastLogTerm > nodeLastLogTerm || (args.LastLogTerm == nodeLastLogTerm && args.LastLogIndex >= nodeLastLogIndex)) {
+		reply.VoteGranted = true
+		this.votedFor = args.CandidateId
+		this.lastElectionTimerStartedTime = time.Now()
 	} else {
 		reply.VoteGranted = false
 	}
 	//-------------------------------------------------------------------------------------------/
 
-	reply.Term = this.currentTerm
-	if LogVoteRequestMessages {
-		this.write_log("Sending Request Vote Reply: %+v", reply)
+	if reply.VoteGranted {
+		this.metrics.votesGranted++
 	}
+	this.persistHardState() // Before the vote is sent
+
+	reply.Term = this.currentTerm
+	this.logger(LogVote).Info("Sending Request Vote Reply", "rpc", "RequestVote", "peer", args.CandidateId, "term", this.currentTerm, "reply", *reply)
 	return nil
 }
 
 // Handles an incoming RPC AppendEntries request
 
 type AppendEntriesArgs struct {
+	GroupId  int // Raft group the RPC is addressed to; see Server.AddGroup
 	Term     int
 	LeaderId int
 
@@ -76,8 +93,11 @@ type AppendEntriesArgs struct {
 	LeaderCommit int
 
 	Latency int
+	MsgId   uint64 // Only used to match up journal events
 }
 
+func (this AppendEntriesArgs) GetMsgId() uint64 { return this.MsgId }
+
 type AppendEntriesReply struct {
 	Term    int
 	Success bool
@@ -97,9 +117,7 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 		aeType = "Heartbeat"
 	}
 
-	if (aeType == "Heartbeat" && LogHeartbeatMessages) || aeType == "AppendEntries" {
-		this.write_log("Received %s from NODE %d; args: %+v", aeType, args.LeaderId, args)
-	}
+	this.logger(LogReplication).Log(context.Background(), appendEntriesLevel(aeType), "Received "+aeType, "rpc", "AppendEntries", "peer", args.LeaderId, "term", this.currentTerm, "args", args)
 
 	if args.Term > this.currentTerm {
 		this.becomeFollower(args.Term)
@@ -111,10 +129,18 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			this.becomeFollower(args.Term)
 		}
 		this.lastElectionTimerStartedTime = time.Now()
+		this.leaderId = args.LeaderId
+		this.lastHeartbeat = this.lastElectionTimerStartedTime
+
+		// Entries our snapshot covers are committed, so they match the leader's;
+		// only those after it need checking
+		if covered := this.snapshot.LastIncludedIndex - args.PrevLogIndex; covered > 0 {
+			args.Entries = args.Entries[min(covered, len(args.Entries)):]
+			args.PrevLogIndex, args.PrevLogTerm = this.snapshot.LastIncludedIndex, this.snapshot.LastIncludedTerm
+		}
 
 		// Does our log contain an entry at PrevLogIndex whose term matches PrevLogTerm?
-		if args.PrevLogIndex == -1 ||
-			(args.PrevLogIndex < len(this.log) && args.PrevLogTerm == this.log[args.PrevLogIndex].Term) {
+		if prevLogTerm, ok := this.termAt(args.PrevLogIndex); ok && args.PrevLogTerm == prevLogTerm {
 			reply.Success = true
 
 			// Find an insertion point - where there's a term mismatch between
@@ -124,10 +150,10 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			newEntriesIndex := 0
 
 			for {
-				if logInsertIndex >= len(this.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex > this.lastIndex() || newEntriesIndex >= len(args.Entries) {
 					break
 				}
-				if this.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				if this.entryAt(logInsertIndex).Term != args.Entries[newEntriesIndex].Term {
 					break
 				}
 				logInsertIndex++
@@ -140,18 +166,25 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 			// - newEntriesIndex points at the end of Entries, or an index where the
 			//   term mismatches with the corresponding log entry
 			if newEntriesIndex < len(args.Entries) {
-				this.log = append(this.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
-				this.write_log("Log is now: %v", this.log)
+				if logInsertIndex <= this.lastIndex() {
+					this.emit(Event{Type: EventLogTruncate, Index: intPtr(logInsertIndex)})
+				}
+				this.log = append(this.entries(this.firstIndex(), logInsertIndex), args.Entries[newEntriesIndex:]...)
+				this.persistEntries(logInsertIndex)
+				this.logChanged(logInsertIndex, args.Entries[newEntriesIndex:])
+				this.emit(Event{Type: EventLogAppend, Index: intPtr(logInsertIndex), Entries: args.Entries[newEntriesIndex:]})
+				this.logger(LogReplication).Info("Log is now", "term", this.currentTerm, "log", this.log)
 			}
 
 			// Set commit index.
 			if args.LeaderCommit > this.commitIndex {
 
-				if args.LeaderCommit < len(this.log)-1 {
-					this.commitIndex = len(this.log) - 1
+				if args.LeaderCommit > this.lastIndex() {
+					this.commitIndex = this.lastIndex()
 				} else {
 					this.commitIndex = args.LeaderCommit
 				}
+				this.emit(Event{Type: EventCommit, Index: intPtr(this.commitIndex)})
 
 				this.notifyToApplyCommit <- 1
 			}
@@ -159,9 +192,7 @@ func (this *RaftNode) HandleAppendEntries(args AppendEntriesArgs, reply *AppendE
 	}
 
 	reply.Term = this.currentTerm
-	if (aeType == "Heartbeat" && LogHeartbeatMessages) || aeType == "AppendEntries" {
-		this.write_log("Sending %s reply: %+v", aeType, *reply)
-	}
+	this.logger(LogReplication).Log(context.Background(), appendEntriesLevel(aeType), "Sending "+aeType+" reply", "rpc", "AppendEntries", "peer", args.LeaderId, "term", this.currentTerm, "reply", *reply)
 	return nil
 }
 
@@ -170,10 +201,14 @@ func (this *RaftNode) ReceiveClientCommand(command interface{}) bool {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 
-	this.write_log("ReceiveClientCommand received by %s: %v", this.state, command)
-	if this.state == "Leader" {
-		this.log = append(this.log, LogEntry{Command: command, Term: this.currentTerm})
-		this.write_log("Log=%v", this.log)
+	this.logger(LogClient).Info("ReceiveClientCommand", "state", this.state, "term", this.currentTerm, "command", command)
+	data, err := EncodeCommand(this.codec, command)
+	if err != nil {
+		this.logger(LogClient).Error("can't encode command", "term", this.currentTerm, "command", command, "err", err)
+		return false
+	}
+	if _, _, isLeader := this.proposeCommand(data); isLeader {
+		this.logger(LogClient).Info("appended client command", "term", this.currentTerm, "log", this.log)
 		return true
 	}
 	return false
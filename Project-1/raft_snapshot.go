@@ -0,0 +1,487 @@
+package raft
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InstallSnapshot moves a snapshot from the leader to a follower in
+// SnapshotChunkSize pieces, so that no single RPC has to carry the whole
+// state machine image. The follower keeps what it has received in a temporary
+// file named after the snapshot, so a transfer interrupted by a dropped
+// connection, or even a restart of the follower, carries on where it stopped.
+//
+// A node compacts its log by taking a snapshot, with RaftNode.Snapshot or
+// every GroupConfig.SnapshotThreshold applied entries. A leader sends its
+// snapshot to any follower that needs entries it no longer has.
+const SnapshotChunkSize = 1 << 20
+
+var ErrSnapshotsDisabled = errors.New("raft: this node has no snapshot directory")
+
+// Snapshotter is a StateMachine that can be saved in a snapshot and restored
+// from one: Restore(Snapshot()) must leave it as it was, as of the last entry
+// applied. Like Apply, both are called with the node's lock held.
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// SnapshotMeta identifies a snapshot by the last log entry it covers.
+type SnapshotMeta struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Members           []int // Of the group as of that entry; see raft_membership.go
+}
+
+// noSnapshot is the SnapshotMeta of a node that hasn't got a snapshot: its log
+// starts at index 0.
+var noSnapshot = SnapshotMeta{LastIncludedIndex: -1, LastIncludedTerm: -1}
+
+func (this SnapshotMeta) fileName() string {
+	return fmt.Sprintf("snapshot-%016d-%016d", this.LastIncludedIndex, this.LastIncludedTerm)
+}
+
+type InstallSnapshotArgs struct {
+	GroupId  int // Raft group the RPC is addressed to; see Server.AddGroup
+	Term     int
+	LeaderId int
+	Meta     SnapshotMeta
+
+	Offset   int64  // Of Data within the snapshot
+	Data     []byte `json:"-"`
+	Done     bool   // Data is the last chunk
+	Checksum uint32 // CRC-32C of the whole snapshot; only set when Done
+
+	Latency int
+	MsgId   uint64 // Only used to match up journal events
+}
+
+func (this InstallSnapshotArgs) GetMsgId() uint64 { return this.MsgId }
+
+type InstallSnapshotReply struct {
+	Term int
+
+	// How much of the snapshot the follower now has; the leader sends the
+	// next chunk from here. Reset to 0 if the finished snapshot didn't match
+	// its checksum, and the whole snapshot has to be sent again.
+	Offset    int64
+	Installed bool
+	Disabled  bool // The follower has no snapshot directory; see ErrSnapshotsDisabled
+}
+
+// HandleInstallSnapshot stores one chunk of a snapshot, and installs the
+// snapshot once the last chunk is in and the checksum matches. Chunks are
+// written and checked, and the snapshot persisted, without this.mu, which
+// every other RPC needs.
+func (this *RaftNode) HandleInstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	this.mu.Lock()
+	if this.state == "Dead" {
+		this.mu.Unlock()
+		return nil
+	}
+
+	this.logger(LogReplication).Info("Received InstallSnapshot", "rpc", "InstallSnapshot", "peer", args.LeaderId, "term", this.currentTerm,
+		"meta", args.Meta, "offset", args.Offset, "bytes", len(args.Data), "done", args.Done)
+
+	if args.Term > this.currentTerm {
+		this.becomeFollower(args.Term)
+	}
+	reply.Term = this.currentTerm
+	if args.Term < this.currentTerm {
+		this.mu.Unlock()
+		return nil
+	}
+	if this.state != "Follower" {
+		this.becomeFollower(args.Term)
+	}
+	this.lastElectionTimerStartedTime = time.Now()
+	this.leaderId = args.LeaderId
+
+	// Perhaps a retry of a last chunk whose reply was lost
+	if args.Meta.LastIncludedIndex <= this.lastApplied {
+		this.mu.Unlock()
+		reply.Installed = true
+		return nil
+	}
+	dir := this.snapshotDir
+	this.mu.Unlock()
+	if dir == "" {
+		// Not an RPC error, which the leader would retry
+		reply.Disabled = true
+		return nil
+	}
+
+	this.snapshotMu.Lock()
+	defer this.snapshotMu.Unlock()
+	offset, data, done, err := receiveSnapshotChunk(dir, args)
+	if err != nil || !done {
+		reply.Offset = offset
+		return err
+	}
+
+	installed, err := this.installSnapshot(args.Term, args.Meta, data)
+	if err != nil || !installed {
+		// If its leader is gone, the next one will send its own snapshot
+		return err
+	}
+	reply.Offset, reply.Installed = offset, true
+	this.logger(LogReplication).Info("installed snapshot", "term", args.Term, "meta", args.Meta, "bytes", offset)
+	return removeSnapshotFiles(dir, func(name string) bool { return true })
+}
+
+// receiveSnapshotChunk writes a chunk to the snapshot's temporary file in dir
+// and returns how many bytes of it are there now. On the last chunk, the
+// whole snapshot is read back and returned if it matches the checksum.
+func receiveSnapshotChunk(dir string, args InstallSnapshotArgs) (offset int64, data []byte, done bool, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, nil, false, err
+	}
+	tmp := filepath.Join(dir, args.Meta.fileName()+".tmp")
+
+	// Any other snapshot's leftovers are from a transfer that was given up on
+	if err := removeSnapshotFiles(dir, func(name string) bool { return name != filepath.Base(tmp) }); err != nil {
+		return 0, nil, false, err
+	}
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if args.Offset != stat.Size() {
+		return stat.Size(), nil, false, nil // Out of step; tell the leader where to resume
+	}
+	if _, err := f.WriteAt(args.Data, args.Offset); err != nil {
+		return 0, nil, false, err
+	}
+	offset = args.Offset + int64(len(args.Data))
+	if !args.Done {
+		return offset, nil, false, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, false, err
+	}
+	if data, err = io.ReadAll(f); err != nil {
+		return 0, nil, false, err
+	}
+	if crc32.Checksum(data, walCRCTable) != args.Checksum {
+		f.Close()
+		return 0, nil, false, os.Remove(tmp) // Start over
+	}
+	return offset, data, true, nil
+}
+
+// installSnapshot replaces the state machine with the snapshot's, and the log
+// up to its last entry: entries after that are kept if the log has that entry,
+// and otherwise dropped along with the rest. Both changes are persisted first,
+// without this.mu, which is then only held to swap them in; expects
+// this.snapshotMu to be held, and this.mu not. Returns false if the node has
+// moved on from term, that of the leader that sent the snapshot.
+func (this *RaftNode) installSnapshot(term int, meta SnapshotMeta, data []byte) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.currentTerm != term || this.state != "Follower" {
+		return false, nil
+	}
+	for meta.LastIncludedIndex > this.lastApplied {
+		logTerm, ok := this.termAt(meta.LastIncludedIndex)
+		keep := ok && logTerm == meta.LastIncludedTerm
+		logWrites := this.logWrites
+		this.mu.Unlock()
+
+		if this.storage != nil {
+			if err := this.storage.SaveSnapshot(meta, data); err != nil {
+				log.Fatalf("node %d: persisting snapshot %+v: %v", this.id, meta, err)
+			}
+			if !keep {
+				if err := this.storage.AppendEntries(meta.LastIncludedIndex+1, nil); err != nil {
+					log.Fatalf("node %d: dropping log entries after snapshot %+v: %v", this.id, meta, err)
+				}
+			}
+		}
+
+		this.mu.Lock()
+		if this.logWrites == logWrites {
+			return true, this.swapInSnapshot(meta, data, keep)
+		}
+		// Entries were written meanwhile, perhaps after those dropped from
+		// storage; look again
+	}
+	return true, nil
+}
+
+// swapInSnapshot is the in-memory half of installSnapshot. Expects this.mu to
+// be held.
+func (this *RaftNode) swapInSnapshot(meta SnapshotMeta, data []byte, keep bool) error {
+	if err := this.restoreStateMachine(data); err != nil {
+		return err
+	}
+	if keep {
+		this.log = append([]LogEntry(nil), this.entries(meta.LastIncludedIndex+1, this.lastIndex()+1)...)
+	} else {
+		this.emit(Event{Type: EventLogTruncate, Index: intPtr(this.firstIndex())})
+		this.log = nil
+	}
+	this.snapshot, this.snapshotData = meta, data
+	this.updateMembership()
+	this.commitIndex = max(this.commitIndex, meta.LastIncludedIndex)
+	this.lastApplied = meta.LastIncludedIndex
+	this.watches.Compact(meta.LastIncludedIndex) // Watchers can't be told about the changes it covers
+	this.watches.applied(meta.LastIncludedIndex)
+
+	// Whatever became of their commands is in the snapshot, not the log
+	for index, waiters := range this.applyWaiters {
+		if index <= meta.LastIncludedIndex {
+			for _, waiter := range waiters {
+				close(waiter.ch)
+			}
+			delete(this.applyWaiters, index)
+		}
+	}
+	return nil
+}
+
+// restoreStateMachine restores the state machine, if there is one, from a
+// snapshot of it. Expects this.mu to be held.
+func (this *RaftNode) restoreStateMachine(data []byte) error {
+	if this.stateMachine == nil {
+		return nil
+	}
+	snapshotter, ok := this.stateMachine.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("raft: %T can't be restored from a snapshot", this.stateMachine)
+	}
+	return snapshotter.Restore(data)
+}
+
+// Snapshot saves the state machine as of the last entry applied, and drops
+// the entries up to it from the log. It's done automatically every
+// GroupConfig.SnapshotThreshold entries, if that's set.
+func (this *RaftNode) Snapshot() (SnapshotMeta, error) {
+	this.snapshotMu.Lock()
+	defer this.snapshotMu.Unlock()
+
+	this.mu.Lock()
+	if this.lastApplied <= this.snapshot.LastIncludedIndex {
+		defer this.mu.Unlock()
+		return this.snapshot, nil
+	}
+	var data []byte
+	if this.stateMachine != nil {
+		snapshotter, ok := this.stateMachine.(Snapshotter)
+		if !ok {
+			this.mu.Unlock()
+			return this.snapshot, fmt.Errorf("raft: %T can't be snapshotted", this.stateMachine)
+		}
+		var err error
+		if data, err = snapshotter.Snapshot(); err != nil {
+			this.mu.Unlock()
+			return this.snapshot, err
+		}
+	}
+	term, _ := this.termAt(this.lastApplied)
+	meta := SnapshotMeta{LastIncludedIndex: this.lastApplied, LastIncludedTerm: term, Members: this.membersAt(this.lastApplied)}
+	this.mu.Unlock()
+
+	// Applied entries are never truncated, so the log can carry on meanwhile
+	if this.storage != nil {
+		if err := this.storage.SaveSnapshot(meta, data); err != nil {
+			return this.snapshot, err
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if meta.LastIncludedIndex > this.snapshot.LastIncludedIndex {
+		this.log = append([]LogEntry(nil), this.entries(meta.LastIncludedIndex+1, this.lastIndex()+1)...)
+		this.snapshot, this.snapshotData = meta, data
+		this.watches.Compact(meta.LastIncludedIndex) // The changes those entries made go with them
+		this.logger(LogApply).Info("took snapshot", "term", this.currentTerm, "meta", meta, "bytes", len(data))
+	}
+	return this.snapshot, nil
+}
+
+func removeSnapshotFiles(dir string, match func(name string) bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "snapshot-") && match(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LatestSnapshot returns the latest snapshot in dir, and its path; ok is
+// false if there is none.
+func LatestSnapshot(dir string) (meta SnapshotMeta, path string, ok bool, err error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return meta, "", false, nil
+	} else if err != nil {
+		return meta, "", false, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "snapshot-") && filepath.Ext(entry.Name()) == "" {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return meta, "", false, nil
+	}
+	sort.Strings(names)
+	name := names[len(names)-1]
+	if _, err := fmt.Sscanf(name, "snapshot-%016d-%016d", &meta.LastIncludedIndex, &meta.LastIncludedTerm); err != nil {
+		return meta, "", false, fmt.Errorf("bad snapshot file name %s", name)
+	}
+	path = filepath.Join(dir, name)
+	if meta.Members, err = readSnapshotMembers(path); err != nil {
+		return meta, "", false, err
+	}
+	return meta, path, true, nil
+}
+
+// The members a snapshot covers are kept next to it, in a file of their own
+// that's written first, so that the snapshot file stays the state machine's.
+
+func writeSnapshotMembers(path string, policy SyncPolicy, members []int) error {
+	return writeFileAtomic(path+membersExt, policy, func(w io.Writer) error { return gob.NewEncoder(w).Encode(members) })
+}
+
+// readSnapshotMembers returns nil for a snapshot that has no members file.
+func readSnapshotMembers(path string) ([]int, error) {
+	f, err := os.Open(path + membersExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var members []int
+	if err := gob.NewDecoder(f).Decode(&members); err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	return members, nil
+}
+
+const membersExt = ".members"
+
+// startSnapshotSend sends peerId the current snapshot in the background,
+// unless that's already under way, and moves its nextIndex past it once
+// it's installed. A peer that can't take snapshots isn't sent another for
+// the rest of the term. Expects this.mu to be held.
+func (this *RaftNode) startSnapshotSend(ctx context.Context, peerId int, term int) {
+	if this.sendingSnapshot[peerId] || this.snapshotsDisabled[peerId] {
+		return
+	}
+	this.sendingSnapshot[peerId] = true
+	meta, data := this.snapshot, this.snapshotData
+
+	go func() {
+		err := this.sendSnapshot(ctx, peerId, term, meta, data)
+
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		delete(this.sendingSnapshot, peerId)
+		if errors.Is(err, ErrSnapshotsDisabled) {
+			if this.currentTerm == term {
+				this.snapshotsDisabled[peerId] = true
+			}
+			this.logger(LogReplication).Warn("peer can't take snapshots; it won't catch up", "rpc", "InstallSnapshot", "peer", peerId, "term", term, "meta", meta)
+			return
+		}
+		if err != nil {
+			this.logger(LogReplication).Info("gave up sending snapshot", "rpc", "InstallSnapshot", "peer", peerId, "term", term, "meta", meta, "err", err)
+			return
+		}
+		this.lastContact[peerId] = time.Now()
+		if this.state == "Leader" && this.currentTerm == term && this.matchIndex[peerId] < meta.LastIncludedIndex {
+			this.matchIndex[peerId] = meta.LastIncludedIndex
+			this.nextIndex[peerId] = meta.LastIncludedIndex + 1
+		}
+	}()
+}
+
+// sendSnapshot streams data, the snapshot meta identifies, to peerId,
+// resuming from wherever the peer says it got to, until the peer has
+// installed it. Failed RPCs are retried with backoff, while the connection
+// manager redials. Gives up when ctx ends; pass the context of term, so that
+// happens once term is over.
+func (this *RaftNode) sendSnapshot(ctx context.Context, peerId int, term int, meta SnapshotMeta, data []byte) error {
+	size := int64(len(data))
+	checksum := crc32.Checksum(data, walCRCTable)
+
+	backoff := RedialMinBackoff
+	offset := int64(0)
+	for {
+		chunk := data[offset:min(offset+SnapshotChunkSize, size)]
+		args := InstallSnapshotArgs{
+			GroupId:  this.groupId,
+			Term:     term,
+			LeaderId: this.id,
+			Meta:     meta,
+			Offset:   offset,
+			Data:     chunk,
+			Done:     offset+int64(len(chunk)) == size,
+			MsgId:    this.server.newMsgId(),
+		}
+		if args.Done {
+			args.Checksum = checksum
+		}
+
+		var reply InstallSnapshotReply
+		if err := this.server.SendRPCCallTo(ctx, peerId, "RaftNode.InstallSnapshot", args, &reply); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			this.logger(LogReplication).Info("InstallSnapshot failed, retrying", "rpc", "InstallSnapshot", "peer", peerId, "term", term, "offset", offset, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff = min(2*backoff, RedialMaxBackoff)
+			continue
+		}
+		backoff = RedialMinBackoff
+
+		if reply.Term > term {
+			this.mu.Lock()
+			if reply.Term > this.currentTerm {
+				this.becomeFollower(reply.Term)
+			}
+			this.mu.Unlock()
+			return ErrLostLeadership
+		}
+		if reply.Installed {
+			return nil
+		}
+		if reply.Disabled {
+			return ErrSnapshotsDisabled
+		}
+		if reply.Offset > size {
+			return fmt.Errorf("raft: peer %d claims to have %d bytes of a %d byte snapshot", peerId, reply.Offset, size)
+		}
+		offset = reply.Offset
+	}
+}
@@ -0,0 +1,322 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newSnapshotTestPair starts two connected servers whose nodes never start
+// elections, so both stay followers in term 0; node 1 accepts snapshots.
+func newSnapshotTestPair(t *testing.T) (sender *Server, receiver *Server) {
+	ready := make(chan interface{}) // Never closed
+	sender = NewServer(0, []int{1}, ready, 0)
+	receiver = NewServer(1, []int{0}, ready, 0)
+	receiver.SetSnapshotDir(t.TempDir())
+	for _, server := range []*Server{sender, receiver} {
+		server.SetSimulatedLatency(false)
+		server.SetTracePath(filepath.Join(t.TempDir(), "applied"))
+		server.Serve()
+	}
+	if err := sender.ConnectToPeer(1, receiver.GetCurrentAddress()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sender.DisconnectAll()
+		sender.Shutdown()
+		receiver.Shutdown()
+	})
+	return sender, receiver
+}
+
+func testSnapshotData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// feedChunks hands the receiver the first n chunks of data directly, as if an
+// earlier transfer had got that far.
+func feedChunks(t *testing.T, receiver *Server, meta SnapshotMeta, data []byte, n int) {
+	for i := 0; i < n; i++ {
+		args := InstallSnapshotArgs{Meta: meta, LeaderId: 0, Offset: int64(i * SnapshotChunkSize), Data: data[i*SnapshotChunkSize : (i+1)*SnapshotChunkSize]}
+		var reply InstallSnapshotReply
+		if err := receiver.raftLogic.HandleInstallSnapshot(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkInstalledSnapshot(t *testing.T, receiver *Server, meta SnapshotMeta, data []byte) {
+	t.Helper()
+	node := receiver.raftLogic
+	node.mu.Lock()
+	installed, got, commitIndex, lastApplied := node.snapshot, node.snapshotData, node.commitIndex, node.lastApplied
+	node.mu.Unlock()
+	if !reflect.DeepEqual(installed, meta) || commitIndex != meta.LastIncludedIndex || lastApplied != meta.LastIncludedIndex {
+		t.Fatalf("installed %+v, commitIndex %d, lastApplied %d; want %+v", installed, commitIndex, lastApplied, meta)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("installed snapshot differs from the one sent (crc %x, want %x)", crc32.Checksum(got, walCRCTable), crc32.Checksum(data, walCRCTable))
+	}
+	// Nothing is left of the transfer
+	if entries, err := os.ReadDir(receiver.snapshotDir); err != nil || len(entries) != 0 {
+		t.Fatalf("left in the snapshot directory: %v, %v", entries, err)
+	}
+}
+
+func TestInstallSnapshotResumes(t *testing.T) {
+	sender, receiver := newSnapshotTestPair(t)
+	data := testSnapshotData(3*SnapshotChunkSize + SnapshotChunkSize/2)
+	meta := SnapshotMeta{LastIncludedIndex: 41, LastIncludedTerm: 3}
+
+	feedChunks(t, receiver, meta, data, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sender.raftLogic.sendSnapshot(ctx, 1, 0, meta, data); err != nil {
+		t.Fatal(err)
+	}
+	checkInstalledSnapshot(t, receiver, meta, data)
+
+	// One RPC to learn where to resume, then the two remaining chunks
+	if sent := sender.GetRPCStats()["RaftNode.InstallSnapshot"].Sent; sent != 3 {
+		t.Fatalf("sent %d InstallSnapshot RPCs, want 3", sent)
+	}
+}
+
+func TestInstallSnapshotChecksumMismatch(t *testing.T) {
+	sender, receiver := newSnapshotTestPair(t)
+	data := testSnapshotData(2*SnapshotChunkSize + 100)
+	meta := SnapshotMeta{LastIncludedIndex: 7, LastIncludedTerm: 1}
+
+	// A chunk that got corrupted on its way to disk
+	corrupt := append([]byte(nil), data...)
+	corrupt[10] ^= 1
+	feedChunks(t, receiver, meta, corrupt, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sender.raftLogic.sendSnapshot(ctx, 1, 0, meta, data); err != nil {
+		t.Fatal(err)
+	}
+	checkInstalledSnapshot(t, receiver, meta, data)
+
+	// Resumed after the first chunk, failed the checksum, then sent it all again
+	if sent := sender.GetRPCStats()["RaftNode.InstallSnapshot"].Sent; sent != 6 {
+		t.Fatalf("sent %d InstallSnapshot RPCs, want 6", sent)
+	}
+}
+
+// dropConnections closes every connection server has accepted, as a network
+// failure would; its peers find out on their next RPC, and redial.
+func dropConnections(server *Server) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for conn := range server.accepted {
+		conn.Close()
+	}
+}
+
+func TestInstallSnapshotSurvivesDroppedConnection(t *testing.T) {
+	sender, receiver := newSnapshotTestPair(t)
+	receiver.SetSimulatedLatency(true)
+	receiver.SetMinRPCLatency(50) // So that the transfer is still going when the connection drops
+	chunks := 8
+	data := testSnapshotData(chunks * SnapshotChunkSize)
+	meta := SnapshotMeta{LastIncludedIndex: 99, LastIncludedTerm: 2}
+
+	// Drop the connection once the receiver has a couple of chunks
+	tmp := filepath.Join(receiver.snapshotDir, meta.fileName()+".tmp")
+	dropped := make(chan interface{})
+	go func() {
+		defer close(dropped)
+		for {
+			if stat, err := os.Stat(tmp); err == nil && stat.Size() >= 2*SnapshotChunkSize {
+				dropConnections(receiver)
+				return
+			}
+			sleepMs(5)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := sender.raftLogic.sendSnapshot(ctx, 1, 0, meta, data); err != nil {
+		t.Fatal(err)
+	}
+	<-dropped
+	checkInstalledSnapshot(t, receiver, meta, data)
+
+	// The chunk in flight failed, and the transfer resumed rather than
+	// starting over: one RPC to learn where from, perhaps, then the rest
+	stats := sender.GetRPCStats()["RaftNode.InstallSnapshot"]
+	if stats.Failed == 0 {
+		t.Fatalf("no RPC failed, so the connection wasn't dropped mid-transfer: %+v", stats)
+	}
+	if stats.Succeeded > chunks+1 {
+		t.Fatalf("%d InstallSnapshot RPCs succeeded for %d chunks: %+v", stats.Succeeded, chunks, stats)
+	}
+}
+
+// awaitSnapshot waits until node has a snapshot covering index, and has
+// applied it.
+func awaitSnapshot(t *testing.T, node *RaftNode, index int) NodeStatus {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		status := node.Status()
+		if status.Snapshot.LastIncludedIndex >= index && status.LastApplied >= index {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d has no snapshot up to %d: %+v", node.id, index, status)
+		}
+		sleepMs(100)
+	}
+}
+
+// transferGroupLeader has the leader of group groupId hand leadership to
+// member to, and waits until to leads.
+func transferGroupLeader(t *testing.T, cluster *Cluster, groupId int, to int) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := cluster.getServers()[cluster.awaitGroupLeader(groupId)].Group(groupId).TransferLeadership(ctx, to); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); cluster.GroupLeader(groupId) != to; sleepMs(100) {
+		if time.Now().After(deadline) {
+			t.Fatalf("group %d's leader after the transfer: got %d, want %d", groupId, cluster.GroupLeader(groupId), to)
+		}
+	}
+}
+
+// snapshotAllBut has every server but lagging snapshot everything leader has
+// applied, so whichever of them leads when lagging is back has to send it a
+// snapshot; returns the index the snapshots cover.
+func snapshotAllBut(t *testing.T, cluster *Cluster, leader int, lagging int) int {
+	t.Helper()
+	return snapshotGroupAllBut(t, cluster, DefaultGroup, leader, lagging)
+}
+
+// snapshotGroupAllBut is snapshotAllBut for the members of group groupId.
+func snapshotGroupAllBut(t *testing.T, cluster *Cluster, groupId int, leader int, lagging int) int {
+	t.Helper()
+	index := cluster.getServers()[leader].Group(groupId).Status().LastApplied
+	for id, server := range cluster.getServers() {
+		node := server.Group(groupId)
+		if id == lagging || node == nil {
+			continue
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for node.Status().LastApplied < index {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d hasn't applied entry %d", id, index)
+			}
+			sleepMs(100)
+		}
+		meta, err := node.Snapshot()
+		if err != nil || meta.LastIncludedIndex < index {
+			t.Fatalf("node %d: snapshot %+v, %v", id, meta, err)
+		}
+		if status := node.Status(); !reflect.DeepEqual(status.Snapshot, meta) || status.FirstLogIndex >= 0 && status.FirstLogIndex <= index {
+			t.Fatalf("node %d didn't compact its log: %+v", id, status)
+		}
+	}
+	return index
+}
+
+// A follower that missed entries the rest have compacted away is sent a
+// snapshot, and carries on from there; it keeps the snapshot over a restart.
+func TestSnapshotCatchesUpLaggingFollower(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	lagging := (leader + 1) % 3
+	cluster.DisconnectPeer(lagging)
+
+	for i := 0; i < 5; i++ {
+		if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: fmt.Sprint(i)}, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := snapshotAllBut(t, cluster, leader, lagging)
+
+	cluster.ReconnectPeer(lagging)
+	awaitSnapshot(t, cluster.getServers()[lagging].raftLogic, index)
+
+	// Replication carries on after the snapshot
+	leader = cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "y", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	last := cluster.getServers()[leader].raftLogic.Status().LastApplied
+	for deadline := time.Now().Add(10 * time.Second); cluster.getServers()[lagging].raftLogic.Status().LastApplied < last; sleepMs(100) {
+		if time.Now().After(deadline) {
+			t.Fatalf("node %d didn't apply entry %d after the snapshot: %+v", lagging, last, cluster.getServers()[lagging].raftLogic.Status())
+		}
+	}
+
+	cluster.CrashPeer(lagging)
+	cluster.RestartPeer(lagging)
+	if status := cluster.getServers()[lagging].raftLogic.Status(); status.Snapshot.LastIncludedIndex < index || status.LastApplied < status.Snapshot.LastIncludedIndex {
+		t.Fatalf("node %d restarted without its snapshot: %+v", lagging, status)
+	}
+}
+
+// A follower without a snapshot directory says so in its reply, rather than
+// failing the RPC, and the leader gives up on it at once instead of retrying.
+func TestSnapshotToFollowerWithoutSnapshotDir(t *testing.T) {
+	sender, receiver := newSnapshotTestPair(t)
+	receiver.raftLogic.mu.Lock()
+	receiver.raftLogic.snapshotDir = ""
+	receiver.raftLogic.mu.Unlock()
+	data := testSnapshotData(100)
+	meta := SnapshotMeta{LastIncludedIndex: 7, LastIncludedTerm: 1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := sender.raftLogic.sendSnapshot(ctx, 1, 0, meta, data); !errors.Is(err, ErrSnapshotsDisabled) {
+		t.Fatalf("got %v, want %v", err, ErrSnapshotsDisabled)
+	}
+	if stats := sender.GetRPCStats()["RaftNode.InstallSnapshot"]; stats.Sent != 1 || stats.Failed != 0 {
+		t.Fatalf("InstallSnapshot RPCs: %+v, want one that succeeded", stats)
+	}
+
+	// Nor is it sent the snapshot again for the rest of the term
+	node := sender.raftLogic
+	node.mu.Lock()
+	node.snapshot, node.snapshotData = meta, data
+	node.startSnapshotSend(ctx, 1, 0)
+	node.mu.Unlock()
+	for deadline := time.Now().Add(10 * time.Second); ; sleepMs(10) {
+		node.mu.Lock()
+		disabled := node.snapshotsDisabled[1]
+		node.mu.Unlock()
+		if disabled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sender didn't note that node 1 can't take snapshots")
+		}
+	}
+	node.mu.Lock()
+	node.startSnapshotSend(ctx, 1, 0)
+	sending := node.sendingSnapshot[1]
+	node.mu.Unlock()
+	if sending {
+		t.Fatal("the snapshot was sent again")
+	}
+	if sent := sender.GetRPCStats()["RaftNode.InstallSnapshot"].Sent; sent != 2 {
+		t.Fatalf("sent %d InstallSnapshot RPCs, want 2", sent)
+	}
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSoak only runs when given a duration, e.g.:
+//
+//	go test -run TestSoak -soak 30s                         (CI)
+//	go test -run TestSoak -soak 1h -timeout 2h              (nightly)
+//	go test -run TestSoak -soak 30s -soak.seed 1697712345   (replay a failure)
+var soakDuration = flag.Duration("soak", 0, "run TestSoak for this long; skipped when 0")
+var soakSeed = flag.Int64("soak.seed", 0, "seed for TestSoak's nemesis and workload; random when 0")
+
+const soakClients = 3
+
+// How often TestSoak checks the history so far, so that a failure shows up,
+// with the seed, without waiting for the end of a long run.
+const soakCheckInterval = 30 * time.Second
+
+func TestSoak(t *testing.T) {
+	if *soakDuration == 0 {
+		t.Skip("soak test disabled; enable with -soak <duration>")
+	}
+
+	// The seed pins the fault schedule and the workload, but not goroutine
+	// scheduling or the nodes' own election timeouts.
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	testing_log("TestSoak: duration=%v seed=%d", *soakDuration, seed)
+	defer func() {
+		if t.Failed() {
+			t.Logf("TestSoak failed; replay with -soak %v -soak.seed %d", *soakDuration, seed)
+		}
+	}()
+	rng := rand.New(rand.NewSource(seed))
+
+	cluster := NewCluster(t, 5)
+	defer cluster.Shutdown()
+	history := cluster.NewHistoryRecorder()
+
+	stop := make(chan interface{})
+	var stopOnce sync.Once
+	stopSoak := func() { stopOnce.Do(func() { close(stop) }) }
+	// Read-held by every client operation, so that a check can wait until
+	// none is under way
+	var quiesce sync.RWMutex
+	var wg sync.WaitGroup
+	for c := 0; c < soakClients; c++ {
+		wg.Add(1)
+		go func(clientId int, rng *rand.Rand) {
+			defer wg.Done()
+			for seq := 0; ; seq++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				key := fmt.Sprintf("k%d", rng.Intn(3))
+				quiesce.RLock()
+				switch rng.Intn(3) {
+				case 0:
+					history.Get(clientId, key)
+				case 1:
+					history.Put(clientId, key, fmt.Sprintf("c%d.%d", clientId, seq))
+				default:
+					history.Append(clientId, key, fmt.Sprintf("[c%d.%d]", clientId, seq))
+				}
+				quiesce.RUnlock()
+			}
+		}(c, rand.New(rand.NewSource(rng.Int63())))
+	}
+
+	// Check the history so far every soakCheckInterval, with the clients
+	// paused so that it holds no operation that's still under way, and stop
+	// at the first failure
+	checked := make(chan interface{})
+	go func() {
+		defer close(checked)
+		ticker := time.NewTicker(soakCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			quiesce.Lock()
+			history.CheckLinearizable(KVModel, time.Minute)
+			quiesce.Unlock()
+			if t.Failed() {
+				stopSoak()
+				return
+			}
+		}
+	}()
+
+	time.AfterFunc(*soakDuration, stopSoak)
+	cluster.NewNemesis(rng).Run(stop)
+	wg.Wait()
+	<-checked
+
+	if !t.Failed() {
+		history.CheckLinearizable(KVModel, time.Minute)
+	}
+}
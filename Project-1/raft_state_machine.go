@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotLeader      = errors.New("raft: not the leader")
+	ErrLostLeadership = errors.New("raft: leadership lost before the command was committed")
+	ErrNodeKilled     = errors.New("raft: node killed")
+
+	// The node was sent a snapshot covering the command's entry, so it can't
+	// tell whether that was the command; it may or may not have been applied.
+	ErrSnapshotInstalled = errors.New("raft: entry replaced by a snapshot before it was applied")
+)
+
+// StateMachine is the replicated application committed log entries are applied to.
+// Apply is called in log order, exactly once per index, with the node's lock held,
+// so it must not block.
+type StateMachine interface {
+	Apply(index int, entry LogEntry) interface{}
+}
+
+// ApplyResult is what a client waiting on a submitted command gets back.
+type ApplyResult struct {
+	Index  int
+	Term   int
+	Result interface{}
+}
+
+type applyWaiter struct {
+	term int
+	ch   chan ApplyResult
+}
+
+// proposeCommand appends command to the log if this node is the leader.
+// Expects this.mu to be held.
+func (this *RaftNode) proposeCommand(command []byte) (index int, term int, isLeader bool) {
+	if this.state != "Leader" || this.transferTarget >= 0 {
+		return -1, this.currentTerm, false // Not taking new commands while handing over leadership
+	}
+	this.log = append(this.log, LogEntry{Command: command, Term: this.currentTerm, Time: time.Now().UnixNano()})
+	index = this.lastIndex()
+	this.persistEntries(index)
+	this.metrics.proposedAt[index] = time.Now()
+	this.emit(Event{Type: EventLogAppend, Index: intPtr(index), Entries: this.log[len(this.log)-1:]})
+	return index, this.currentTerm, true
+}
+
+// appendNoop appends an EntryNoop for the new leader's term.
+// Expects this.mu to be held.
+func (this *RaftNode) appendNoop() {
+	this.log = append(this.log, LogEntry{Term: this.currentTerm, Time: time.Now().UnixNano(), Type: EntryNoop})
+	this.persistEntries(this.lastIndex())
+	this.emit(Event{Type: EventLogAppend, Index: intPtr(this.lastIndex()), Entries: this.log[len(this.log)-1:]})
+}
+
+// SubmitCommand proposes command and waits until it has been applied to the
+// state machine, returning the state machine's result. It fails with ErrNotLeader
+// if this node isn't the leader, and with ErrLostLeadership if the entry was
+// replaced by another leader's; in both cases the command was certainly not
+// applied. If ctx ends first, or it fails with ErrSnapshotInstalled, the
+// outcome is unknown.
+func (this *RaftNode) SubmitCommand(ctx context.Context, command interface{}) (interface{}, error) {
+	data, err := EncodeCommand(this.codec, command)
+	if err != nil {
+		return nil, err
+	}
+	return this.SubmitEncodedCommand(ctx, data)
+}
+
+// SubmitEncodedCommand is SubmitCommand for a command already encoded with
+// EncodeCommand, e.g. by a remote client. Commands that don't decode are
+// refused rather than put in the log.
+func (this *RaftNode) SubmitEncodedCommand(ctx context.Context, command []byte) (interface{}, error) {
+	decoded, err := DecodeCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	index, term, isLeader := this.proposeCommand(command)
+	if !isLeader {
+		this.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	this.logger(LogClient).Info("SubmitCommand appended", "term", term, "index", index, "command", decoded.Value, "log", this.log)
+
+	ch := make(chan ApplyResult, 1)
+	this.applyWaiters[index] = append(this.applyWaiters[index], applyWaiter{term: term, ch: ch})
+	this.mu.Unlock()
+	return this.awaitApplied(ctx, term, ch)
+}
+
+// awaitApplied waits for the result of the entry appended in term that ch is
+// the applyWaiter of, and fails like SubmitCommand.
+func (this *RaftNode) awaitApplied(ctx context.Context, term int, ch chan ApplyResult) (interface{}, error) {
+	select {
+	case applied, ok := <-ch:
+		if !ok {
+			return nil, ErrSnapshotInstalled
+		}
+		if applied.Term != term {
+			return nil, ErrLostLeadership
+		}
+		return applied.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-this.ctx.Done():
+		return nil, ErrNodeKilled
+	}
+}
+
+// applyEntry applies a single committed entry and hands the result to anyone
+// waiting on its index. Expects this.mu to be held.
+func (this *RaftNode) applyEntry(index int, entry LogEntry) {
+	var result interface{}
+	if this.stateMachine != nil && entry.Type == EntryCommand {
+		result = this.stateMachine.Apply(index, entry)
+	}
+	this.watches.applied(index)
+	this.emit(Event{Type: EventApply, Index: intPtr(index), Entries: []LogEntry{entry}})
+
+	for _, waiter := range this.applyWaiters[index] {
+		waiter.ch <- ApplyResult{Index: index, Term: entry.Term, Result: result}
+	}
+	delete(this.applyWaiters, index)
+}
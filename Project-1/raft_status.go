@@ -0,0 +1,84 @@
+package raft
+
+import "time"
+
+// NodeStatus is a consistent snapshot of a node's Raft state, as returned by
+// RaftNode.Status. The log starts after Snapshot. FirstLogIndex and
+// FirstLogTerm are -1 if it's empty, when LastLogIndex and LastLogTerm are
+// those of the snapshot's last entry, or also -1 without a snapshot.
+type NodeStatus struct {
+	Id       int
+	Group    int
+	State    string
+	Term     int
+	VotedFor int
+	Leader   int   // -1 if not known
+	Members  []int // As of the latest config the node has; see raft_membership.go
+
+	CommitIndex int
+	LastApplied int
+
+	FirstLogIndex int
+	FirstLogTerm  int
+	LastLogIndex  int
+	LastLogTerm   int
+	Snapshot      SnapshotMeta // LastIncludedIndex -1 if there's none
+
+	Peers map[int]PeerStatus // Only reported by the leader
+
+	// Since the leader last sent a round of heartbeats or, on any other node,
+	// since it last heard from a leader; zero if neither has happened yet.
+	SinceHeartbeat time.Duration
+}
+
+// PeerStatus is the leader's view of one of its peers.
+type PeerStatus struct {
+	NextIndex   int
+	MatchIndex  int
+	LastContact time.Time // Zero if the peer hasn't replied this term
+}
+
+// Status reports this node's state. Safe to call concurrently with everything else.
+func (this *RaftNode) Status() NodeStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	status := NodeStatus{
+		Id:       this.id,
+		Group:    this.groupId,
+		State:    this.state,
+		Term:     this.currentTerm,
+		VotedFor: this.votedFor,
+		Leader:   this.leaderId,
+		Members:  append([]int(nil), this.members...),
+
+		CommitIndex: this.commitIndex,
+		LastApplied: this.lastApplied,
+
+		FirstLogIndex: -1,
+		FirstLogTerm:  -1,
+		LastLogIndex:  -1,
+		LastLogTerm:   -1,
+		Snapshot:      this.snapshot,
+	}
+	if len(this.log) > 0 {
+		status.FirstLogIndex, status.FirstLogTerm = this.firstIndex(), this.log[0].Term
+	}
+	status.LastLogIndex, status.LastLogTerm = this.lastIndex(), this.lastTerm()
+
+	if this.state == "Leader" {
+		status.Peers = make(map[int]PeerStatus)
+		for _, peerId := range this.replicas() {
+			status.Peers[peerId] = PeerStatus{
+				NextIndex:   this.nextIndex[peerId],
+				MatchIndex:  this.matchIndex[peerId],
+				LastContact: this.lastContact[peerId],
+			}
+		}
+	}
+
+	if !this.lastHeartbeat.IsZero() {
+		status.SinceHeartbeat = time.Since(this.lastHeartbeat)
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusOfEmptyNode(t *testing.T) {
+	server := NewServer(0, []int{1, 2}, make(chan interface{}), 0)
+	node := NewRaftNode(0, DefaultGroup, []int{1, 2}, server, GroupConfig{TracePath: filepath.Join(t.TempDir(), "applied")}, make(chan interface{}))
+	defer node.KillNode()
+
+	want := NodeStatus{
+		Id: 0, Group: DefaultGroup, State: "Follower", Term: 0, VotedFor: -1, Leader: -1, Members: []int{0, 1, 2},
+		CommitIndex: -1, LastApplied: -1,
+		FirstLogIndex: -1, FirstLogTerm: -1, LastLogIndex: -1, LastLogTerm: -1, Snapshot: noSnapshot,
+	}
+	if status := node.Status(); !reflect.DeepEqual(status, want) {
+		t.Fatalf("got %+v, want %+v", status, want)
+	}
+}
+
+func TestStatusOfCluster(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	leaderStatus := cluster.getServers()[leader].raftLogic.Status()
+	awaitApplied(t, cluster, leaderStatus.LastApplied)
+	// Give the followers a heartbeat to learn the commit, and the leader
+	// their replies to it
+	sleepMs(1500)
+
+	leaderStatus = cluster.getServers()[leader].raftLogic.Status()
+	last := leaderStatus.LastLogIndex
+	// The leader's no-op, then the put
+	if leaderStatus.State != "Leader" || leaderStatus.Leader != leader || leaderStatus.VotedFor != leader ||
+		leaderStatus.FirstLogIndex != 0 || last != 1 || leaderStatus.LastLogTerm != leaderStatus.Term ||
+		leaderStatus.CommitIndex != last || leaderStatus.LastApplied != last {
+		t.Fatalf("leader: %+v", leaderStatus)
+	}
+	if len(leaderStatus.Peers) != 2 {
+		t.Fatalf("leader reports peers %+v", leaderStatus.Peers)
+	}
+	for id, peer := range leaderStatus.Peers {
+		if id == leader || peer.MatchIndex != last || peer.NextIndex != last+1 || time.Since(peer.LastContact) > 2*time.Second {
+			t.Fatalf("leader's view of peer %d: %+v", id, peer)
+		}
+	}
+	if leaderStatus.SinceHeartbeat > 1500*time.Millisecond {
+		t.Fatalf("leader hasn't sent heartbeats for %v", leaderStatus.SinceHeartbeat)
+	}
+
+	for id, server := range cluster.getServers() {
+		if id == leader {
+			continue
+		}
+		status := server.raftLogic.Status()
+		if status.State != "Follower" || status.Term != leaderStatus.Term || status.Leader != leader || status.Peers != nil ||
+			status.LastLogIndex != last || status.LastLogTerm != leaderStatus.LastLogTerm ||
+			status.CommitIndex != last || status.LastApplied != last {
+			t.Fatalf("follower %d: %+v", id, status)
+		}
+		if status.SinceHeartbeat <= 0 || status.SinceHeartbeat > 1500*time.Millisecond {
+			t.Fatalf("follower %d last heard from the leader %v ago", id, status.SinceHeartbeat)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package raft
+
+import (
+	"context"
+	"time"
+)
+
+// AdminTimeout bounds admin requests that wait on the cluster, such as
+// Submit, TransferLeadership and membership changes; long enough for an
+// election or two.
+const AdminTimeout = 10 * time.Second
+
+// AdminService is the RPC service operators talk to (see cmd/raftctl). It is
+// registered as "RaftAdmin" on the same listener as the "RaftNode" service.
+type AdminService struct {
+	server *Server
+}
+
+// Requests about a node are about its member of Group, DefaultGroup unless set.
+
+type AdminStatusArgs struct {
+	Group int
+}
+
+type AdminSubmitArgs struct {
+	Group   int
+	Command []byte // Encoded with EncodeCommand
+}
+
+type AdminSubmitReply struct {
+	Result interface{}
+}
+
+type AdminTransferArgs struct {
+	Group  int
+	Target int
+}
+
+// AdminMemberArgs names the server to add to or remove from the group's
+// members; Addr, only for AddMember, is where the others can reach it.
+type AdminMemberArgs struct {
+	Group int
+	Id    int
+	Addr  string
+}
+
+// AdminWatchArgs asks for the changes to Key, or to the keys starting with it
+// if Prefix, from revision From on (-1 for from now on), waiting up to Wait
+// for there to be some.
+type AdminWatchArgs struct {
+	Group  int
+	Key    string
+	Prefix bool
+	From   int
+	Max    int // 0 for no limit
+	Wait   time.Duration
+}
+
+type AdminWatchReply struct {
+	Events    []WatchEvent
+	Next      int  // Revision to ask from next
+	Compacted bool // From has been compacted away; the watcher has to start over
+}
+
+type AdminSnapshotArgs struct {
+	Group int
+}
+
+type AdminReply struct{}
+
+func (this *AdminService) Status(args AdminStatusArgs, reply *NodeStatus) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	*reply = node.Status()
+	return nil
+}
+
+// Submit proposes a command and waits for it to be applied; it fails with
+// ErrNotLeader on anything but the leader.
+func (this *AdminService) Submit(args AdminSubmitArgs, reply *AdminSubmitReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), AdminTimeout)
+	defer cancel()
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	result, err := node.SubmitEncodedCommand(ctx, args.Command)
+	if err != nil {
+		return err
+	}
+	reply.Result = result
+	return nil
+}
+
+// Watch is a long poll for changes to the node's state machine, which any
+// node, leader or not, can answer; a watcher that loses its node can carry on
+// from another with the last Next it got.
+func (this *AdminService) Watch(args AdminWatchArgs, reply *AdminWatchReply) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	wait := args.Wait
+	if wait <= 0 || wait > AdminTimeout {
+		wait = AdminTimeout
+	}
+	reply.Events, reply.Next, err = node.WatchEvents(args.Key, args.Prefix, args.From, args.Max, wait)
+	if err == ErrCompacted {
+		reply.Compacted, err = true, nil
+	}
+	return err
+}
+
+func (this *AdminService) TransferLeadership(args AdminTransferArgs, reply *AdminReply) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AdminTimeout)
+	defer cancel()
+	return node.TransferLeadership(ctx, args.Target)
+}
+
+// AddMember has the leader make server Id a member, and waits until that's
+// committed; see RaftNode.AddMember.
+func (this *AdminService) AddMember(args AdminMemberArgs, reply *AdminReply) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AdminTimeout)
+	defer cancel()
+	return node.AddMember(ctx, args.Id, args.Addr)
+}
+
+// RemoveMember has the leader take server Id out of the members, and waits
+// until that's committed; see RaftNode.RemoveMember.
+func (this *AdminService) RemoveMember(args AdminMemberArgs, reply *AdminReply) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), AdminTimeout)
+	defer cancel()
+	return node.RemoveMember(ctx, args.Id)
+}
+
+// Snapshot has the node snapshot its state machine and compact its log, and
+// returns what the snapshot covers.
+func (this *AdminService) Snapshot(args AdminSnapshotArgs, reply *SnapshotMeta) error {
+	node, err := this.server.group(args.Group)
+	if err != nil {
+		return err
+	}
+	*reply, err = node.Snapshot()
+	return err
+}
@@ -0,0 +1,261 @@
+package raft
+
+import (
+	"math/rand"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// Bounds for the exponential backoff between redials of a broken peer connection.
+const (
+	RedialMinBackoff = 50 * time.Millisecond
+	RedialMaxBackoff = 5 * time.Second
+)
+
+// PeerTimeoutsBeforeRedial is how many RPCs in a row to a peer may time out
+// before its connection is taken for broken and redialled: a peer that went
+// away without closing it, leaving it half open, never fails an RPC outright.
+const PeerTimeoutsBeforeRedial = 3
+
+// PeerDialTimeout bounds every dial of a peer, so that one whose address
+// has gone dark doesn't leave a connection attempt hanging.
+const PeerDialTimeout = 2 * time.Second
+
+// PeerConnState describes the connection a Server holds to one of its peers.
+type PeerConnState int
+
+const (
+	PeerDisconnected PeerConnState = iota // Closed on purpose; never redialled
+	PeerConnecting                        // Dial failed or connection broke; redialling with backoff
+	PeerConnected
+)
+
+func (this PeerConnState) String() string {
+	switch this {
+	case PeerDisconnected:
+		return "Disconnected"
+	case PeerConnecting:
+		return "Connecting"
+	case PeerConnected:
+		return "Connected"
+	}
+	return "Unknown"
+}
+
+// PeerConnStatus is a snapshot of a single managed peer connection.
+type PeerConnStatus struct {
+	Addr      string
+	State     PeerConnState
+	Failures  int // Consecutive failed dials since the last successful one
+	LastError string
+}
+
+// peerConn is the connection manager's bookkeeping for one peer; guarded by Server.mu.
+type peerConn struct {
+	addr     net.Addr
+	client   *rpc.Client
+	state    PeerConnState
+	failures int
+	lastErr  error
+	timeouts int // RPCs on client that timed out since the last reply
+
+	// Bumped whenever the connection is explicitly (re)configured, so that a
+	// redial loop started for an older configuration knows to stop.
+	generation int
+}
+
+// dialPeer connects to a peer's RPC server; a variable so that tests can
+// stand in for an unreachable peer.
+var dialPeer = func(addr net.Addr) (*rpc.Client, error) {
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), PeerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (this *Server) getPeerClient(peerId int) *rpc.Client {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if peer := this.peers[peerId]; peer != nil {
+		return peer.client
+	}
+	return nil
+}
+
+// disconnectPeer expects this.mu to be held.
+func (this *Server) disconnectPeer(peerId int) error {
+	peer := this.peers[peerId]
+	if peer == nil {
+		return nil
+	}
+	peer.generation++
+	peer.state = PeerDisconnected
+
+	var err error
+	if peer.client != nil {
+		err = peer.client.Close()
+		peer.client = nil
+	}
+	return err
+}
+
+// markPeerBroken is called after a transport error on client. Unless the
+// connection has been replaced or closed on purpose in the meantime, the client
+// is dropped and a redial loop takes over.
+func (this *Server) markPeerBroken(peerId int, client *rpc.Client) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	peer := this.peers[peerId]
+	if peer == nil || peer.client != client || peer.state != PeerConnected {
+		return
+	}
+	client.Close()
+	peer.client = nil
+	peer.timeouts = 0
+	peer.state = PeerConnecting
+	peer.generation++
+	go this.redialPeer(peerId, peer.generation)
+}
+
+// peerReplied is called when an RPC on client got a reply, or timed out if
+// timedOut; after PeerTimeoutsBeforeRedial timeouts in a row the connection
+// is marked broken.
+func (this *Server) peerReplied(peerId int, client *rpc.Client, timedOut bool) {
+	this.mu.Lock()
+	peer := this.peers[peerId]
+	if peer == nil || peer.client != client {
+		this.mu.Unlock()
+		return
+	}
+	if !timedOut {
+		peer.timeouts = 0
+		this.mu.Unlock()
+		return
+	}
+	peer.timeouts++
+	timeouts := peer.timeouts
+	this.mu.Unlock()
+
+	if timeouts >= PeerTimeoutsBeforeRedial {
+		this.logger.Info("peer not replying; redialling", "peer", peerId, "timeouts", timeouts)
+		this.markPeerBroken(peerId, client)
+	}
+}
+
+// redialPeer keeps dialling peerId with exponential backoff until it connects,
+// the server shuts down, or the connection is reconfigured (generation changes).
+// This function runs as a go routine.
+func (this *Server) redialPeer(peerId int, generation int) {
+	backoff := RedialMinBackoff
+	for {
+		// Equal jitter (half the backoff, then up to as much again at random),
+		// so that all nodes don't redial a restarted peer in lockstep.
+		select {
+		case <-this.quit:
+			return
+		case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		}
+
+		this.mu.Lock()
+		peer := this.peers[peerId]
+		if peer == nil || peer.generation != generation {
+			this.mu.Unlock()
+			return
+		}
+		addr, resolve := peer.addr, this.resolvePeer
+		this.mu.Unlock()
+
+		if resolve != nil {
+			if resolved, err := resolve(peerId); err == nil {
+				addr = resolved
+			} else {
+				this.logger.Info("can't resolve peer; redialling its last address", "peer", peerId, "addr", addr, "err", err)
+			}
+		}
+		client, err := dialPeer(addr)
+
+		this.mu.Lock()
+		if peer.generation != generation {
+			this.mu.Unlock()
+			if client != nil {
+				client.Close()
+			}
+			return
+		}
+		if err == nil {
+			peer.addr = addr
+			peer.client = client
+			peer.timeouts = 0
+			peer.state = PeerConnected
+			peer.failures = 0
+			peer.lastErr = nil
+			this.mu.Unlock()
+			this.logger.Info("reconnected to peer", "peer", peerId, "addr", addr)
+			return
+		}
+		peer.failures++
+		peer.lastErr = err
+		this.mu.Unlock()
+
+		backoff *= 2
+		if backoff > RedialMaxBackoff {
+			backoff = RedialMaxBackoff
+		}
+	}
+}
+
+// connectMembers connects to the servers of addrs, the members of one of this
+// server's groups, that it has never been connected to, as a member just
+// added to the group may be. Those it knows, connected or not, are left as
+// they are.
+func (this *Server) connectMembers(addrs map[int]string) {
+	for id, addr := range addrs {
+		this.mu.Lock()
+		known := id == this.serverId || this.peers[id] != nil
+		this.mu.Unlock()
+		if known {
+			continue
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			this.logger.Warn("can't resolve new member", "peer", id, "addr", addr, "err", err)
+			continue
+		}
+		if err := this.ConnectToPeer(id, tcpAddr); err != nil {
+			this.logger.Info("new member not reachable yet; redialling", "peer", id, "addr", addr, "err", err)
+		}
+	}
+}
+
+// SetPeerResolver sets how to find where a peer is now: before every redial
+// of a broken connection, resolve is asked for the peer's address, so that a
+// peer that comes back at another address is reconnected to without another
+// ConnectToPeer. Without a resolver, or if it fails, a peer is redialled at
+// the address it was last connected at.
+func (this *Server) SetPeerResolver(resolve func(peerId int) (net.Addr, error)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.resolvePeer = resolve
+}
+
+// GetPeerConnStates reports the state of every peer connection this Server manages.
+func (this *Server) GetPeerConnStates() map[int]PeerConnStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	states := make(map[int]PeerConnStatus, len(this.peers))
+	for id, peer := range this.peers {
+		status := PeerConnStatus{State: peer.state, Failures: peer.failures}
+		if peer.addr != nil {
+			status.Addr = peer.addr.String()
+		}
+		if peer.lastErr != nil {
+			status.LastError = peer.lastErr.Error()
+		}
+		states[id] = status
+	}
+	return states
+}
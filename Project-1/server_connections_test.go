@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// awaitPeerState waits for server's connection to peerId to satisfy ok.
+func awaitPeerState(t *testing.T, server *Server, peerId int, ok func(PeerConnStatus) bool) PeerConnStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := server.GetPeerConnStates()[peerId]
+		if ok(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection to %d: %+v", peerId, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPeerRedialledAtNewAddress(t *testing.T) {
+	ready := make(chan interface{})
+	start := func(id int, peer int) *Server {
+		server := NewServer(id, []int{peer}, ready, 0)
+		server.SetSimulatedLatency(false)
+		server.SetTracePath(filepath.Join(t.TempDir(), "applied"))
+		server.Serve()
+		return server
+	}
+	a, b := start(0, 1), start(1, 0)
+	defer a.Shutdown()
+	var current atomic.Pointer[Server]
+	current.Store(b)
+	a.SetPeerResolver(func(peerId int) (net.Addr, error) { return current.Load().GetCurrentAddress(), nil })
+	if err := a.ConnectToPeer(1, b.GetCurrentAddress()); err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+	call := func() error {
+		var reply TimeoutNowReply
+		return a.SendRPCCallTo(context.Background(), 1, "RaftNode.TimeoutNow", TimeoutNowArgs{GroupId: 9}, &reply)
+	}
+
+	// The peer goes away; the failed call sets off redials, which back off
+	b.Shutdown()
+	if err := call(); err == nil {
+		t.Fatal("call to a peer that's down succeeded")
+	}
+	status := awaitPeerState(t, a, 1, func(status PeerConnStatus) bool { return status.Failures >= 3 })
+	if status.State != PeerConnecting || status.LastError == "" {
+		t.Fatalf("connection to a peer that's down: %+v", status)
+	}
+
+	// It comes back at another address
+	restarted := start(1, 0)
+	defer restarted.Shutdown()
+	current.Store(restarted)
+	status = awaitPeerState(t, a, 1, func(status PeerConnStatus) bool { return status.State == PeerConnected })
+	if status.Addr != restarted.GetCurrentAddress().String() || status.Failures != 0 {
+		t.Fatalf("connection to the restarted peer: %+v", status)
+	}
+	if err := call(); err == nil || !strings.Contains(err.Error(), "hosts no group 9") {
+		t.Fatalf("call to the restarted peer: got %v", err)
+	}
+}
+
+// A restarted Cluster server is redialled at its new address by the servers
+// that were connected to it, with nothing reconnecting them by hand.
+func TestRestartedPeerRedialled(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	restarted := (leader + 1) % 3
+
+	cluster.CrashPeer(restarted)
+	cluster.RestartPeer(restarted)
+	server := cluster.getServers()[restarted]
+	status := awaitPeerState(t, cluster.getServers()[leader], restarted, func(status PeerConnStatus) bool {
+		return status.State == PeerConnected && status.Addr == server.GetCurrentAddress().String()
+	})
+	if status.Failures != 0 {
+		t.Fatalf("leader's connection to the restarted server: %+v", status)
+	}
+	for id := range cluster.getServers() {
+		if id != restarted {
+			awaitPeerState(t, server, id, func(status PeerConnStatus) bool { return status.State == PeerConnected })
+		}
+	}
+
+	// and it's sent what it missed
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "x", Value: "1"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	awaitApplied(t, cluster, cluster.getServers()[leader].raftLogic.Status().LastApplied)
+}
+
+func TestConnectToPeerDialsOffTheLock(t *testing.T) {
+	server := NewServer(0, []int{1}, make(chan interface{}), 0)
+	server.SetTracePath(filepath.Join(t.TempDir(), "applied"))
+	server.Serve()
+	defer server.Shutdown()
+
+	// A peer whose dial hangs until it times out
+	timedOut := make(chan interface{})
+	dial := dialPeer
+	dialPeer = func(addr net.Addr) (*rpc.Client, error) {
+		<-timedOut
+		return nil, errors.New("dial timed out")
+	}
+	defer func() { dialPeer = dial }()
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:9")
+	dialled := make(chan error)
+	go func() { dialled <- server.ConnectToPeer(1, addr) }()
+
+	// Meanwhile the server carries on
+	awaitPeerState(t, server, 1, func(status PeerConnStatus) bool { return status.State == PeerConnecting })
+	var reply TimeoutNowReply
+	if err := server.SendRPCCallTo(context.Background(), 1, "RaftNode.TimeoutNow", TimeoutNowArgs{}, &reply); err == nil {
+		t.Fatal("call to a peer being dialled succeeded")
+	}
+
+	// A DisconnectPeer while it dials wins over the dial
+	server.DisconnectPeer(1)
+	close(timedOut)
+	if err := <-dialled; err == nil {
+		t.Fatal("ConnectToPeer succeeded")
+	}
+	if status := server.GetPeerConnStates()[1]; status.State != PeerDisconnected {
+		t.Fatalf("connection disconnected while dialling: %+v", status)
+	}
+}
+
+// A peer that keeps its end of the connection open but never replies, as one
+// that went away without closing it does, is redialled once
+// PeerTimeoutsBeforeRedial RPCs in a row have timed out. Calls the caller gave
+// up on first don't count.
+func TestHalfOpenPeerRedialled(t *testing.T) {
+	server := NewServer(0, []int{1}, make(chan interface{}), 0)
+	server.SetTracePath(filepath.Join(t.TempDir(), "applied"))
+	server.Serve()
+	defer server.Shutdown()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			accepted <- conn
+		}
+	}()
+	if err := server.ConnectToPeer(1, listener.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	client := server.getPeerClient(1)
+
+	call := func(ctx context.Context) {
+		t.Helper()
+		var reply TimeoutNowReply
+		if err := server.SendRPCCallTo(ctx, 1, "RaftNode.TimeoutNow", TimeoutNowArgs{}, &reply); err != context.DeadlineExceeded {
+			t.Fatalf("call to a peer that never replies: got %v", err)
+		}
+	}
+	for i := 0; i < PeerTimeoutsBeforeRedial; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		call(ctx)
+		cancel()
+	}
+	for i := 0; i < PeerTimeoutsBeforeRedial-1; i++ {
+		call(context.Background())
+	}
+	if status := server.GetPeerConnStates()[1]; status.State != PeerConnected || server.getPeerClient(1) != client {
+		t.Fatalf("connection replaced before %d RPCs timed out: %+v", PeerTimeoutsBeforeRedial, status)
+	}
+
+	call(context.Background())
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the peer wasn't redialled")
+	}
+	awaitPeerState(t, server, 1, func(status PeerConnStatus) bool { return status.State == PeerConnected })
+	if server.getPeerClient(1) == client {
+		t.Fatal("still the old connection")
+	}
+}
@@ -0,0 +1,158 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A Server can host many independent Raft groups, each with its own log,
+// storage and state machine, which share the server's listener and peer
+// connections. Every RPC carries the id of the group it's for. Serve starts
+// DefaultGroup, configured with SetStorage, SetStateMachine and so on, which
+// is the only group unless AddGroup is called.
+const DefaultGroup = 0
+
+// GroupConfig is what a group has of its own.
+type GroupConfig struct {
+	Peers        []int        // Servers hosting the group's other members; all the server's peers if nil
+	StateMachine StateMachine // May be nil
+	Storage      Storage      // May be nil
+	TracePath    string       // Where applied commands are written; derived from the server's if ""
+	SnapshotDir  string       // Where snapshots sent to the group are received; "" refuses them
+
+	// The member is being added to a group that's already running, with
+	// RaftNode.AddMember: it isn't one of its members, nor has Peers as
+	// members, until the leader sends it the config that says so.
+	Joining bool
+
+	// Applied entries after which a snapshot is taken and the log compacted;
+	// 0 never does. Needs a StateMachine that's a Snapshotter, or none.
+	SnapshotThreshold int
+}
+
+// UnknownGroupError is returned for RPCs addressed to a group this server doesn't host.
+type UnknownGroupError struct {
+	Node  int
+	Group int
+}
+
+func (this UnknownGroupError) Error() string {
+	return fmt.Sprintf("raft: node %d hosts no group %d", this.Node, this.Group)
+}
+
+// AddGroup starts a member of Raft group groupId on this server. The group's
+// other members must be added on config.Peers, with the same group id, for it
+// to elect a leader.
+func (this *Server) AddGroup(groupId int, config GroupConfig) (*RaftNode, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.addGroup(groupId, config)
+}
+
+// addGroup expects this.mu to be held.
+func (this *Server) addGroup(groupId int, config GroupConfig) (*RaftNode, error) {
+	if this.groups[groupId] != nil {
+		return nil, fmt.Errorf("raft: node %d already hosts group %d", this.serverId, groupId)
+	}
+	if config.Peers == nil {
+		config.Peers = this.peersIds
+	}
+	if config.TracePath == "" {
+		config.TracePath = fmt.Sprintf("%s.group%d", this.tracePath, groupId)
+	}
+
+	node := NewRaftNode(this.serverId, groupId, config.Peers, this, config, this.ready)
+	this.groups[groupId] = node
+	this.logger.Info("added group", "group", groupId, "peers", config.Peers)
+	return node, nil
+}
+
+// RemoveGroup stops this server's member of groupId. Its storage is left as
+// it is, for the caller to close or delete.
+func (this *Server) RemoveGroup(groupId int) error {
+	this.mu.Lock()
+	node := this.groups[groupId]
+	delete(this.groups, groupId)
+	this.mu.Unlock()
+
+	if node == nil {
+		return UnknownGroupError{Node: this.serverId, Group: groupId}
+	}
+	node.KillNode()
+	this.logger.Info("removed group", "group", groupId)
+	return nil
+}
+
+// Group returns this server's member of groupId, or nil if it hosts none.
+func (this *Server) Group(groupId int) *RaftNode {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.groups[groupId]
+}
+
+// GroupIds lists the groups this server hosts, in order.
+func (this *Server) GroupIds() []int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	ids := make([]int, 0, len(this.groups))
+	for id := range this.groups {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// group looks up the node an incoming RPC is for.
+func (this *Server) group(groupId int) (*RaftNode, error) {
+	if node := this.Group(groupId); node != nil {
+		return node, nil
+	}
+	return nil, UnknownGroupError{Node: this.serverId, Group: groupId}
+}
+
+func (this *Server) allGroups() []*RaftNode {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	nodes := make([]*RaftNode, 0, len(this.groups))
+	for _, node := range this.groups {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].groupId < nodes[j].groupId })
+	return nodes
+}
+
+// GroupExecutor runs commands on Raft groups: ExecuteGroupCommand submits
+// command to serverId's member of groupId and waits up to timeout for it to
+// be applied, returning the state machine's result. It fails if that member
+// isn't the group's leader.
+type GroupExecutor interface {
+	ExecuteGroupCommand(serverId int, groupId int, command interface{}, timeout time.Duration) (interface{}, error)
+}
+
+// ExecuteGroupCommand implements GroupExecutor over this server's peer
+// connections, so that its groups can reach other groups, such as the shard
+// controller, hosted elsewhere.
+func (this *Server) ExecuteGroupCommand(serverId int, groupId int, command interface{}, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if serverId == this.serverId {
+		node, err := this.group(groupId)
+		if err != nil {
+			return nil, err
+		}
+		return node.SubmitCommand(ctx, command)
+	}
+
+	data, err := EncodeCommand(this.codec, command)
+	if err != nil {
+		return nil, err
+	}
+	var reply AdminSubmitReply
+	if err := this.sendRPC(ctx, serverId, "RaftAdmin.Submit", AdminSubmitArgs{Group: groupId, Command: data}, &reply, timeout); err != nil {
+		return nil, err
+	}
+	return reply.Result, nil
+}
@@ -0,0 +1,123 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMultiGroupServers starts n connected servers, each hosting the default
+// group and groups 1 and 2, every group with a KVStore of its own.
+func newMultiGroupServers(t *testing.T, n int) []*Server {
+	ready := make(chan interface{})
+	servers := make([]*Server, n)
+	for id := range servers {
+		var peers []int
+		for peerId := 0; peerId < n; peerId++ {
+			if peerId != id {
+				peers = append(peers, peerId)
+			}
+		}
+		servers[id] = NewServer(id, peers, ready, 0)
+		servers[id].SetSimulatedLatency(false)
+		servers[id].SetTracePath(filepath.Join(t.TempDir(), "applied"))
+		servers[id].SetStateMachine(NewKVStore())
+		servers[id].Serve()
+		for _, groupId := range []int{1, 2} {
+			if _, err := servers[id].AddGroup(groupId, GroupConfig{StateMachine: NewKVStore(), Storage: NewMemoryStorage()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, server := range servers {
+		for _, peerId := range server.peersIds {
+			if err := server.ConnectToPeer(peerId, servers[peerId].GetCurrentAddress()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(ready)
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.DisconnectAll()
+			server.Shutdown()
+		}
+	})
+	return servers
+}
+
+// groupLeader waits for groupId to elect a leader and returns it.
+func groupLeader(t *testing.T, servers []*Server, groupId int) *RaftNode {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		for _, server := range servers {
+			if _, _, isLeader := server.Group(groupId).GetNodeState(); isLeader {
+				return server.Group(groupId)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("group %d elected no leader", groupId)
+	return nil
+}
+
+func TestGroupsAreIndependent(t *testing.T) {
+	servers := newMultiGroupServers(t, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, groupId := range []int{DefaultGroup, 1, 2} {
+		value := fmt.Sprintf("group%d", groupId)
+		if _, err := groupLeader(t, servers, groupId).SubmitCommand(ctx, KVCommand{Op: KVPut, Key: "k", Value: value}); err != nil {
+			t.Fatalf("group %d: %v", groupId, err)
+		}
+	}
+	for _, groupId := range []int{DefaultGroup, 1, 2} {
+		result, err := groupLeader(t, servers, groupId).SubmitCommand(ctx, KVCommand{Op: KVGet, Key: "k"})
+		if err != nil {
+			t.Fatalf("group %d: %v", groupId, err)
+		}
+		if want := (KVResult{Value: fmt.Sprintf("group%d", groupId), Found: true}); result != want {
+			t.Errorf("group %d: got %v, want %v", groupId, result, want)
+		}
+	}
+
+	// Removing a group leaves the others running
+	for _, server := range servers {
+		if err := server.RemoveGroup(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := groupLeader(t, servers, 1).SubmitCommand(ctx, KVCommand{Op: KVGet, Key: "k"}); err != nil {
+		t.Fatalf("group 1 after removing group 2: %v", err)
+	}
+	if ids := servers[0].GroupIds(); len(ids) != 2 || ids[0] != DefaultGroup || ids[1] != 1 {
+		t.Errorf("GroupIds = %v, want [%d 1]", ids, DefaultGroup)
+	}
+}
+
+func TestUnknownGroupRejected(t *testing.T) {
+	servers := newMultiGroupServers(t, 2)
+
+	args := RequestVoteArgs{GroupId: 9, Term: 1, CandidateId: 0, LastLogIndex: -1, LastLogTerm: -1}
+	var reply RequestVoteReply
+	err := servers[0].SendRPCCallTo(context.Background(), 1, "RaftNode.RequestVote", args, &reply)
+	if err == nil || !strings.Contains(err.Error(), "hosts no group 9") {
+		t.Fatalf("RequestVote for group 9: got %v, want an unknown group error", err)
+	}
+	// The connection is fine; it was the group that was missing
+	if state := servers[0].GetPeerConnStates()[1].State; state != PeerConnected {
+		t.Errorf("peer connection %v after the rejected RPC, want Connected", state)
+	}
+
+	if _, err := servers[0].AddGroup(1, GroupConfig{}); err == nil {
+		t.Errorf("adding group 1 twice succeeded")
+	}
+	if err := servers[0].RemoveGroup(9); !errors.As(err, new(UnknownGroupError)) {
+		t.Errorf("RemoveGroup(9) = %v, want an UnknownGroupError", err)
+	}
+}
@@ -0,0 +1,68 @@
+package raft
+
+import "time"
+
+// RPCStats counts the outcomes of outgoing RPCs for a single service method.
+type RPCStats struct {
+	Sent      int
+	Succeeded int
+	Failed    int // Transport errors, including calls to disconnected peers
+	TimedOut  int // Hit RPCTimeout or the caller's deadline
+	Cancelled int // Caller gave up, e.g. the term changed or the node was killed
+}
+
+type rpcOutcome int
+
+const (
+	rpcSucceeded rpcOutcome = iota
+	rpcFailed
+	rpcTimedOut
+	rpcCancelled
+)
+
+func (this *Server) recordRPC(serviceMethod string, outcome rpcOutcome) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	stats := this.rpcStats[serviceMethod]
+	if stats == nil {
+		stats = new(RPCStats)
+		this.rpcStats[serviceMethod] = stats
+	}
+
+	stats.Sent++
+	switch outcome {
+	case rpcSucceeded:
+		stats.Succeeded++
+	case rpcFailed:
+		stats.Failed++
+	case rpcTimedOut:
+		stats.TimedOut++
+	case rpcCancelled:
+		stats.Cancelled++
+	}
+}
+
+// GetRPCStats returns a copy of the outgoing RPC counters, keyed by service method.
+func (this *Server) GetRPCStats() map[string]RPCStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	stats := make(map[string]RPCStats, len(this.rpcStats))
+	for method, s := range this.rpcStats {
+		stats[method] = *s
+	}
+	return stats
+}
+
+func (this *Server) observeRPCLatency(serviceMethod string, d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	h := this.rpcLatency[serviceMethod]
+	if h == nil {
+		h = newHistogram()
+		this.rpcLatency[serviceMethod] = h
+	}
+	h.observe(d)
+}
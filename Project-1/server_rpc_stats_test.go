@@ -0,0 +1,53 @@
+package raft
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRPCOutcomesCounted(t *testing.T) {
+	servers := newMultiGroupServers(t, 2)
+	servers[1].SetSimulatedLatency(true)
+	servers[1].SetMinRPCLatency(300)
+	// Nothing but this test sends TimeoutNow; group 9 makes it fail once it arrives
+	call := func(ctx context.Context) error {
+		var reply TimeoutNowReply
+		return servers[0].SendRPCCallTo(ctx, 1, "RaftNode.TimeoutNow", TimeoutNowArgs{GroupId: 9}, &reply)
+	}
+
+	if err := call(context.Background()); err == nil || !strings.Contains(err.Error(), "hosts no group 9") {
+		t.Fatalf("call that arrives: got %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := call(timeout); err != context.DeadlineExceeded {
+		t.Fatalf("call past its deadline: got %v", err)
+	}
+
+	// A call sent for a term is abandoned as soon as the node moves past it
+	node := servers[0].raftLogic
+	node.mu.Lock()
+	termCtx := node.currentTermContext()
+	node.mu.Unlock()
+	done := make(chan error)
+	go func() { done <- call(termCtx) }()
+	sleepMs(50)
+	node.mu.Lock()
+	node.becomeFollower(node.currentTerm + 1)
+	node.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("call for an old term: got %v", err)
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("call for an old term still running")
+	}
+
+	want := RPCStats{Sent: 3, Failed: 1, TimedOut: 1, Cancelled: 1}
+	if stats := servers[0].GetRPCStats()["RaftNode.TimeoutNow"]; stats != want {
+		t.Fatalf("stats: got %+v, want %+v", stats, want)
+	}
+}
@@ -1,13 +1,23 @@
 package raft
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"net/rpc"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// RPCTimeout bounds every outgoing RPC, on top of whatever deadline the
+// caller's context already carries. Well above the simulated latency.
+const RPCTimeout = 1500 * time.Millisecond
+
 // Server
 type Server struct {
 	mu sync.Mutex
@@ -17,15 +27,40 @@ type Server struct {
 
 	RPCServer *rpc.Server
 	listener  net.Listener
+	accepted  map[net.Conn]bool // Incoming connections, closed on Shutdown
 
-	peerClients map[int]*rpc.Client
+	peers       map[int]*peerConn                  // Managed connections; see server_connections.go
+	resolvePeer func(peerId int) (net.Addr, error) // Nil unless SetPeerResolver was called
 
 	ready <-chan interface{}
 	quit  chan interface{}
 	wg    sync.WaitGroup
 
-	raftLogic     *RaftNode // Added in RaftLogic component
+	raftLogic     *RaftNode         // Added in RaftLogic component; the DefaultGroup member
+	groups        map[int]*RaftNode // Every group hosted, raftLogic included; see server_groups.go
 	minRPCLatency int
+
+	stateMachine      StateMachine // Handed to raftLogic; may be nil
+	codec             Codec        // Handed to the nodes of every group
+	storage           Storage      // Handed to raftLogic; may be nil
+	tracePath         string       // Where raftLogic writes applied commands
+	snapshotDir       string       // Where raftLogic receives snapshots sent to it
+	snapshotThreshold int          // Handed to raftLogic
+	joining           bool         // Handed to raftLogic
+
+	listenAddr       string
+	simulatedLatency bool // Whether incoming RPCs are delayed by minRPCLatency and their Latency
+
+	logging *Logging
+	logger  *slog.Logger // For the network subsystem
+
+	journal  atomic.Pointer[Journal]     // Nil unless SetJournal was called
+	observer atomic.Pointer[func(Event)] // Nil unless SetEventObserver was called
+
+	rpcStats   map[string]*RPCStats  // Keyed by service method
+	rpcLatency map[string]*histogram // Keyed by service method
+
+	metricsServer *http.Server // Only if ServeMetrics was called
 }
 
 func NewServer(serverId int, peersIds []int, ready <-chan interface{}, minRPCLatency int) *Server {
@@ -33,12 +68,24 @@ func NewServer(serverId int, peersIds []int, ready <-chan interface{}, minRPCLat
 
 	this.serverId = serverId
 	this.peersIds = peersIds
-	this.peerClients = make(map[int]*rpc.Client)
+	this.peers = make(map[int]*peerConn)
+	this.groups = make(map[int]*RaftNode)
+	this.accepted = make(map[net.Conn]bool)
+	this.rpcStats = make(map[string]*RPCStats)
+	this.rpcLatency = make(map[string]*histogram)
 
 	this.ready = ready
 	this.quit = make(chan interface{})
 
 	this.minRPCLatency = minRPCLatency
+	this.simulatedLatency = true
+	this.codec = GobCodec
+
+	this.tracePath = "NodeLogs/" + strconv.Itoa(serverId)
+	this.listenAddr = ":0"
+
+	this.logging = newLogging()
+	this.logger = this.logging.Logger(LogNetwork, "node", serverId)
 
 	return this
 }
@@ -47,18 +94,30 @@ func (this *Server) Serve() {
 	this.mu.Lock()
 
 	// Add in logic component
-	this.raftLogic = NewRaftNode(this.serverId, this.peersIds, this, this.ready)
+	var err error
+	this.raftLogic, err = this.addGroup(DefaultGroup, GroupConfig{
+		StateMachine: this.stateMachine,
+		Storage:      this.storage,
+		TracePath:    this.tracePath,
+		SnapshotDir:  this.snapshotDir,
+		Joining:      this.joining,
+
+		SnapshotThreshold: this.snapshotThreshold,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create a new RPC server
 	this.RPCServer = rpc.NewServer()
 	this.RPCServer.RegisterName("RaftNode", this)
+	this.RPCServer.RegisterName("RaftAdmin", &AdminService{server: this})
 
-	var err error
-	if this.listener, err = net.Listen("tcp", ":0"); err != nil {
+	if this.listener, err = net.Listen("tcp", this.listenAddr); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("[%v] listening at %v", this.serverId, this.listener.Addr())
+	this.logger.Info("listening", "addr", this.listener.Addr())
 	this.mu.Unlock()
 
 	this.wg.Add(1)
@@ -75,9 +134,17 @@ func (this *Server) Serve() {
 					log.Fatal("accept error:", err)
 				}
 			}
+			this.mu.Lock()
+			this.accepted[conn] = true
+			this.mu.Unlock()
+
 			this.wg.Add(1)
 			go func() {
 				this.RPCServer.ServeConn(conn)
+
+				this.mu.Lock()
+				delete(this.accepted, conn)
+				this.mu.Unlock()
 				this.wg.Done()
 			}()
 		}
@@ -85,65 +152,261 @@ func (this *Server) Serve() {
 
 }
 
-func (this *Server) GetCurrentAddress() net.Addr {
+// SetStateMachine sets the application the node applies committed entries to.
+// Must be called before Serve.
+func (this *Server) SetStateMachine(stateMachine StateMachine) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	return this.listener.Addr()
+	this.stateMachine = stateMachine
+}
+
+// SetCodec sets the codec commands submitted to this node are encoded with,
+// GobCodec by default. Entries are decoded with whichever codec encoded them,
+// so nodes needn't agree. Must be called before Serve.
+func (this *Server) SetCodec(codec Codec) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.codec = codec
+}
+
+// SetStorage sets where the node keeps its persistent state. Must be called before Serve.
+func (this *Server) SetStorage(storage Storage) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.storage = storage
+}
+
+// SetListenAddress sets the address Serve listens at; the default ":0" picks
+// any free port. Must be called before Serve.
+func (this *Server) SetListenAddress(addr string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.listenAddr = addr
+}
+
+// SetTracePath sets the file applied commands are written to, by default
+// NodeLogs/<id>. Must be called before Serve.
+func (this *Server) SetTracePath(path string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.tracePath = path
+}
+
+// SetSnapshotDir sets the directory snapshots sent with InstallSnapshot are
+// received in; without one, they are refused. Must be called before Serve.
+func (this *Server) SetSnapshotDir(dir string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.snapshotDir = dir
+}
+
+// SetJoining has raftLogic join a group that's already running, as the
+// member its leader is told to add; see GroupConfig. Must be called before Serve.
+func (this *Server) SetJoining(joining bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.joining = joining
+}
+
+// SetSnapshotThreshold has raftLogic snapshot its state machine and compact
+// its log every threshold applied entries; see GroupConfig. Must be called
+// before Serve.
+func (this *Server) SetSnapshotThreshold(threshold int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.snapshotThreshold = threshold
+}
+
+// SetSimulatedLatency turns the artificial delay of incoming RPCs on or off;
+// real deployments have real latency.
+func (this *Server) SetSimulatedLatency(enabled bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.simulatedLatency = enabled
 }
 
-func (this *Server) SendRPCCallTo(id int, serviceMethod string, args interface{}, reply interface{}) error {
+// SetMinRPCLatency changes the latency added to every incoming RPC, e.g. to
+// simulate a slow network link.
+func (this *Server) SetMinRPCLatency(minRPCLatency int) {
 	this.mu.Lock()
-	peer := this.peerClients[id]
+	defer this.mu.Unlock()
+	this.minRPCLatency = minRPCLatency
+}
+
+func (this *Server) getMinRPCLatency() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.minRPCLatency
+}
+
+// simulateLatency delays an incoming RPC, unless simulated latency is off.
+func (this *Server) simulateLatency(latency int) {
+	this.mu.Lock()
+	enabled, minRPCLatency := this.simulatedLatency, this.minRPCLatency
 	this.mu.Unlock()
 
+	if enabled {
+		sleepMs(minRPCLatency + latency)
+	}
+}
+
+// Logging returns the log levels and sink of this server and its node, to adjust at runtime.
+func (this *Server) Logging() *Logging {
+	return this.logging
+}
+
+func (this *Server) GetCurrentAddress() net.Addr {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.listener.Addr()
+}
+
+// SendRPCCallTo calls serviceMethod on peer id, giving up once ctx is done or
+// RPCTimeout has passed, whichever comes first. A call that is given up on
+// keeps running inside net/rpc, but its reply is never looked at. A live peer
+// answers these at once, so one that lets PeerTimeoutsBeforeRedial of them in
+// a row time out has its connection redialled.
+func (this *Server) SendRPCCallTo(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}) error {
+	return this.sendRPC(ctx, id, serviceMethod, args, reply, RPCTimeout)
+}
+
+// sendRPC is SendRPCCallTo with a bound other than RPCTimeout, for RPCs that
+// wait on the cluster; those time out on healthy connections too, and aren't
+// counted against them.
+func (this *Server) sendRPC(ctx context.Context, id int, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	peer := this.getPeerClient(id)
 	if peer == nil {
+		this.recordRPC(serviceMethod, rpcFailed)
 		return fmt.Errorf("call client %d after it'this closed", id)
-	} else {
-		return peer.Call(serviceMethod, args, reply)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	sent := time.Now()
+	this.emitRPC(EventRPCSend, id, serviceMethod, args, nil, nil)
+	call := peer.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		this.observeRPCLatency(serviceMethod, time.Since(sent))
+		this.emitRPC(EventRPCDone, id, serviceMethod, args, reply, call.Error)
+		if call.Error != nil {
+			this.recordRPC(serviceMethod, rpcFailed)
+			if _, isServerError := call.Error.(rpc.ServerError); !isServerError {
+				this.markPeerBroken(id, peer) // Transport failure; redial in the background
+				return call.Error
+			}
+		} else {
+			this.recordRPC(serviceMethod, rpcSucceeded)
+		}
+		if timeout == RPCTimeout {
+			this.peerReplied(id, peer, false)
+		}
+		return call.Error
+	case <-ctx.Done():
+		this.emitRPC(EventRPCDone, id, serviceMethod, args, nil, ctx.Err())
+		if ctx.Err() == context.DeadlineExceeded {
+			this.recordRPC(serviceMethod, rpcTimedOut)
+			if timeout == RPCTimeout && parent.Err() == nil {
+				this.peerReplied(id, peer, true) // Not the caller's deadline, but ours
+			}
+		} else {
+			this.recordRPC(serviceMethod, rpcCancelled)
+		}
+		return ctx.Err()
 	}
 }
 
 func (this *Server) Shutdown() {
-	this.raftLogic.KillNode() // Make sure heartbeats and requests stop
+	for _, node := range this.allGroups() {
+		node.KillNode() // Make sure heartbeats and requests stop
+	}
+
+	this.mu.Lock()
+	if this.metricsServer != nil {
+		this.metricsServer.Close()
+	}
+	this.mu.Unlock()
+
 	close(this.quit)
 	this.listener.Close()
+
+	// Peers in other processes won't hang up on us, so do it for them
+	this.mu.Lock()
+	for conn := range this.accepted {
+		conn.Close()
+	}
+	this.mu.Unlock()
 	this.wg.Wait()
 }
 
 /* Functions that facilitate peer to peer connection/disconnection */
 
+// ConnectToPeer remembers addr for peerId and dials it unless already connected.
+// If the dial fails, the error is returned and the connection manager keeps
+// redialling in the background until it succeeds or DisconnectPeer is called.
+// The dial, which can take up to PeerDialTimeout, doesn't hold up RPCs to
+// other peers.
 func (this *Server) ConnectToPeer(peerId int, addr net.Addr) error {
+	this.mu.Lock()
+	peer := this.peers[peerId]
+	if peer == nil {
+		peer = new(peerConn)
+		this.peers[peerId] = peer
+	}
+	if peer.client != nil && peer.addr.String() == addr.String() {
+		this.mu.Unlock()
+		return nil
+	}
+	if peer.client != nil {
+		peer.client.Close()
+		peer.client = nil
+	}
+	peer.addr = addr
+	peer.state = PeerConnecting
+	peer.generation++
+	generation := peer.generation
+	this.mu.Unlock()
+
+	client, err := dialPeer(addr)
+
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	if this.peerClients[peerId] == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
-		if err != nil {
-			return err
+	if peer.generation != generation {
+		// Reconfigured or disconnected while we dialled; that wins
+		if client != nil {
+			client.Close()
 		}
-		this.peerClients[peerId] = client
+		return err
 	}
+	if err != nil {
+		peer.failures = 1
+		peer.lastErr = err
+		go this.redialPeer(peerId, peer.generation)
+		return err
+	}
+	peer.client = client
+	peer.timeouts = 0
+	peer.state = PeerConnected
+	peer.failures = 0
+	peer.lastErr = nil
 	return nil
 }
 
+// DisconnectPeer closes the connection to peerId and stops any redialling;
+// the peer stays disconnected until ConnectToPeer is called again.
 func (this *Server) DisconnectPeer(peerId int) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	if this.peerClients[peerId] != nil {
-		err := this.peerClients[peerId].Close()
-		this.peerClients[peerId] = nil
-		return err
-	}
-	return nil
+	return this.disconnectPeer(peerId)
 }
 
 func (this *Server) DisconnectAll() {
 	this.mu.Lock()
 	defer this.mu.Unlock()
-	for id := range this.peerClients {
-		if this.peerClients[id] != nil {
-			this.peerClients[id].Close()
-			this.peerClients[id] = nil
-		}
+	for id := range this.peers {
+		this.disconnectPeer(id)
 	}
 }
 
@@ -152,11 +415,45 @@ func (this *Server) DisconnectAll() {
 /* To actually add a delay for each request, a wrapper */
 
 func (this *Server) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	sleepMs(this.minRPCLatency + args.Latency) // Add Latency
-	return this.raftLogic.HandleRequestVote(args, reply)
+	this.simulateLatency(args.Latency) // Add Latency
+	this.emitRPC(EventRPCReceive, args.CandidateId, "RaftNode.RequestVote", args, nil, nil)
+	node, err := this.group(args.GroupId)
+	if err == nil {
+		err = node.HandleRequestVote(args, reply)
+	}
+	this.emitRPC(EventRPCRespond, args.CandidateId, "RaftNode.RequestVote", args, *reply, err)
+	return err
 }
 
 func (this *Server) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	sleepMs(this.minRPCLatency + args.Latency) // Add Latency
-	return this.raftLogic.HandleAppendEntries(args, reply)
+	this.simulateLatency(args.Latency) // Add Latency
+	this.emitRPC(EventRPCReceive, args.LeaderId, "RaftNode.AppendEntries", args, nil, nil)
+	node, err := this.group(args.GroupId)
+	if err == nil {
+		err = node.HandleAppendEntries(args, reply)
+	}
+	this.emitRPC(EventRPCRespond, args.LeaderId, "RaftNode.AppendEntries", args, *reply, err)
+	return err
+}
+
+func (this *Server) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	this.simulateLatency(args.Latency) // Add Latency
+	this.emitRPC(EventRPCReceive, args.LeaderId, "RaftNode.TimeoutNow", args, nil, nil)
+	node, err := this.group(args.GroupId)
+	if err == nil {
+		err = node.HandleTimeoutNow(args, reply)
+	}
+	this.emitRPC(EventRPCRespond, args.LeaderId, "RaftNode.TimeoutNow", args, *reply, err)
+	return err
+}
+
+func (this *Server) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	this.simulateLatency(args.Latency) // Add Latency
+	this.emitRPC(EventRPCReceive, args.LeaderId, "RaftNode.InstallSnapshot", args, nil, nil)
+	node, err := this.group(args.GroupId)
+	if err == nil {
+		err = node.HandleInstallSnapshot(args, reply)
+	}
+	this.emitRPC(EventRPCRespond, args.LeaderId, "RaftNode.InstallSnapshot", args, *reply, err)
+	return err
 }
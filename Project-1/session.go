@@ -0,0 +1,206 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// DefaultSessionTTL is how long a client session lives without being used.
+const DefaultSessionTTL = 10 * time.Minute
+
+// SessionError is what Sessions returns, as a result rather than an error,
+// for a request it won't apply.
+type SessionError string
+
+func (this SessionError) Error() string { return string(this) }
+
+const (
+	// The session expired or was never registered. The request may or may not
+	// have been applied before that; the client must register a new session.
+	ErrSessionExpired SessionError = "raft: client session expired or unknown"
+	// The request is older than the last one applied for the session, whose
+	// response is the only one kept.
+	ErrStaleRequest SessionError = "raft: request is older than the session's last one"
+)
+
+// SessionRegister starts a client session. Its result is the new session's
+// client id (a uint64), which is the log index of the entry.
+type SessionRegister struct{}
+
+// SessionRequest is a command submitted within a client session. Seq starts
+// at 1 and goes up by one with each new request; a retry of a request must
+// use the same Seq.
+type SessionRequest struct {
+	ClientId uint64
+	Seq      uint64
+	Command  []byte // Encoded with EncodeCommand
+}
+
+func init() {
+	RegisterCommand("session/register", 1, SessionRegister{})
+	RegisterCommand("session/request", 1, SessionRequest{})
+	gob.Register(SessionError(""))
+	gob.Register(uint64(0))
+}
+
+// Sessions wraps a StateMachine so that every SessionRequest is applied at
+// most once, however many times it's retried and committed: the response
+// to each client's latest request is kept and handed back to retries.
+// Commands outside of sessions go straight to the wrapped state machine.
+//
+// Sessions expire after ttl without requests, as measured by the leader
+// timestamps on the log entries themselves, so every replica expires the same
+// sessions at the same point in the log.
+type Sessions struct {
+	inner    StateMachine
+	ttl      time.Duration
+	sessions sessionTable
+	now      int64 // Latest entry timestamp seen; leaders' clocks may disagree
+}
+
+func NewSessions(inner StateMachine, ttl time.Duration) *Sessions {
+	return &Sessions{inner: inner, ttl: ttl, sessions: make(sessionTable)}
+}
+
+// SetWatchHub passes hub on to the wrapped state machine, if it's Watchable.
+func (this *Sessions) SetWatchHub(hub *WatchHub) {
+	if watchable, ok := this.inner.(Watchable); ok {
+		watchable.SetWatchHub(hub)
+	}
+}
+
+func (this *Sessions) Apply(index int, entry LogEntry) interface{} {
+	if entry.Time > this.now {
+		this.now = entry.Time
+		this.sessions.expire(this.now, this.ttl)
+	}
+
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return this.inner.Apply(index, entry)
+	}
+	switch request := command.Value.(type) {
+	case SessionRegister:
+		clientId := uint64(index)
+		this.sessions[clientId] = &clientSession{lastActive: this.now}
+		return clientId
+
+	case SessionRequest:
+		return this.sessions.apply(request, this.now, func() interface{} {
+			return this.inner.Apply(index, LogEntry{Command: request.Command, Term: entry.Term, Time: entry.Time})
+		})
+	}
+	return this.inner.Apply(index, entry)
+}
+
+// sessionsSnapshot is the whole of a Sessions, wrapped state machine included.
+type sessionsSnapshot struct {
+	Now      int64
+	Sessions map[uint64]sessionSnapshot
+	Inner    []byte
+}
+
+type sessionSnapshot struct {
+	LastSeq      uint64
+	LastResponse interface{}
+	LastActive   int64
+}
+
+// Snapshot saves the sessions along with the wrapped state machine, which
+// must be a Snapshotter.
+func (this *Sessions) Snapshot() ([]byte, error) {
+	inner, ok := this.inner.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("raft: %T can't be snapshotted", this.inner)
+	}
+	snapshot := sessionsSnapshot{Now: this.now, Sessions: make(map[uint64]sessionSnapshot, len(this.sessions))}
+	for clientId, session := range this.sessions {
+		snapshot.Sessions[clientId] = sessionSnapshot{LastSeq: session.lastSeq, LastResponse: session.lastResponse, LastActive: session.lastActive}
+	}
+	var err error
+	if snapshot.Inner, err = inner.Snapshot(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(snapshot)
+	return buf.Bytes(), err
+}
+
+func (this *Sessions) Restore(data []byte) error {
+	inner, ok := this.inner.(Snapshotter)
+	if !ok {
+		return fmt.Errorf("raft: %T can't be snapshotted", this.inner)
+	}
+	var snapshot sessionsSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return err
+	}
+	if err := inner.Restore(snapshot.Inner); err != nil {
+		return err
+	}
+	this.now = snapshot.Now
+	this.sessions = make(sessionTable, len(snapshot.Sessions))
+	for clientId, session := range snapshot.Sessions {
+		this.sessions[clientId] = &clientSession{lastSeq: session.LastSeq, lastResponse: session.LastResponse, lastActive: session.LastActive}
+	}
+	return nil
+}
+
+// sessionTable holds the sessions of a Sessions, keyed by client id.
+type sessionTable map[uint64]*clientSession
+
+type clientSession struct {
+	lastSeq      uint64
+	lastResponse interface{}
+	lastActive   int64
+}
+
+// apply runs apply for request unless the request was already applied, and
+// returns the request's response either way.
+func (this sessionTable) apply(request SessionRequest, now int64, apply func() interface{}) interface{} {
+	session := this[request.ClientId]
+	if session == nil {
+		return ErrSessionExpired
+	}
+	session.lastActive = now
+	if request.Seq < session.lastSeq {
+		return ErrStaleRequest
+	}
+	if request.Seq == session.lastSeq {
+		return session.lastResponse
+	}
+	session.lastSeq = request.Seq
+	session.lastResponse = apply()
+	return session.lastResponse
+}
+
+// expire drops the sessions idle for longer than ttl, and returns their ids.
+func (this sessionTable) expire(now int64, ttl time.Duration) []uint64 {
+	var expired []uint64
+	for clientId, session := range this {
+		if now-session.lastActive > int64(ttl) {
+			delete(this, clientId)
+			expired = append(expired, clientId)
+		}
+	}
+	return expired
+}
+
+// ClientSession is the client's side of a session: it numbers requests.
+type ClientSession struct {
+	ClientId uint64
+	lastSeq  uint64
+}
+
+// Next wraps command as the session's next request. Resubmit the returned
+// request itself, not command, when retrying.
+func (this *ClientSession) Next(codec Codec, command interface{}) (SessionRequest, error) {
+	data, err := EncodeCommand(codec, command)
+	if err != nil {
+		return SessionRequest{}, err
+	}
+	this.lastSeq++
+	return SessionRequest{ClientId: this.ClientId, Seq: this.lastSeq, Command: data}, nil
+}
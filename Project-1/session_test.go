@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+// sessionEntry encodes command into an entry stamped at the given time.
+func sessionEntry(t *testing.T, command interface{}, at time.Duration) LogEntry {
+	t.Helper()
+	data, err := EncodeCommand(GobCodec, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LogEntry{Command: data, Term: 1, Time: int64(at)}
+}
+
+func registerSession(t *testing.T, sessions *Sessions, index int, at time.Duration) *ClientSession {
+	t.Helper()
+	result := sessions.Apply(index, sessionEntry(t, SessionRegister{}, at))
+	clientId, ok := result.(uint64)
+	if !ok || clientId != uint64(index) {
+		t.Fatalf("registering: got %v, want client id %d", result, index)
+	}
+	return &ClientSession{ClientId: clientId}
+}
+
+func TestSessionsApplyOnce(t *testing.T) {
+	sessions := NewSessions(NewKVStore(), time.Minute)
+	client := registerSession(t, sessions, 1, 0)
+
+	next := func(cmd KVCommand) SessionRequest {
+		request, err := client.Next(GobCodec, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return request
+	}
+
+	// The append is committed three times, as a client retrying after
+	// timeouts might manage; it must only be applied once.
+	appendX := next(KVCommand{Op: KVAppend, Key: "k", Value: "x"})
+	for index := 2; index <= 4; index++ {
+		if result := sessions.Apply(index, sessionEntry(t, appendX, time.Second)); result != (KVResult{}) {
+			t.Fatalf("attempt at index %d: got %v", index, result)
+		}
+	}
+
+	get := next(KVCommand{Op: KVGet, Key: "k"})
+	want := KVResult{Value: "x", Found: true}
+	if result := sessions.Apply(5, sessionEntry(t, get, time.Second)); result != want {
+		t.Fatalf("after duplicate appends: got %v, want %v", result, want)
+	}
+	// A retry of the latest request gets the cached response
+	if result := sessions.Apply(6, sessionEntry(t, get, time.Second)); result != want {
+		t.Fatalf("retried get: got %v, want %v", result, want)
+	}
+	// Anything older is gone
+	if result := sessions.Apply(7, sessionEntry(t, appendX, time.Second)); result != ErrStaleRequest {
+		t.Fatalf("stale request: got %v, want %v", result, ErrStaleRequest)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	sessions := NewSessions(NewKVStore(), time.Minute)
+	idle := registerSession(t, sessions, 1, 0)
+	busy := registerSession(t, sessions, 2, 0)
+
+	put := func(client *ClientSession, index int, at time.Duration) interface{} {
+		request, err := client.Next(GobCodec, KVCommand{Op: KVPut, Key: "k", Value: "v"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessions.Apply(index, sessionEntry(t, request, at))
+	}
+
+	if result := put(busy, 3, 50*time.Second); result == ErrSessionExpired {
+		t.Fatalf("session expired before its TTL")
+	}
+	// Entries without a timestamp, such as those of older releases, don't move time back
+	sessions.Apply(4, LogEntry{Command: sessionEntry(t, KVCommand{Op: KVGet, Key: "k"}, 0).Command})
+	if result := put(busy, 5, 100*time.Second); result == ErrSessionExpired {
+		t.Fatalf("session in use expired")
+	}
+	if result := put(idle, 6, 100*time.Second); result != ErrSessionExpired {
+		t.Fatalf("idle session: got %v, want %v", result, ErrSessionExpired)
+	}
+
+	unknown := &ClientSession{ClientId: 42}
+	if result := put(unknown, 7, 100*time.Second); result != ErrSessionExpired {
+		t.Fatalf("unknown session: got %v, want %v", result, ErrSessionExpired)
+	}
+}
@@ -0,0 +1,281 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ShardClerkTimeout is how long clerks keep retrying a request, through
+// leader changes and config changes, before giving up on it.
+const ShardClerkTimeout = 10 * time.Second
+
+// executeOnGroup submits command to the members of groupId on servers in turn,
+// starting with servers[*leader], until one applies it or deadline passes;
+// *leader is left at the one that did. Only for commands that are safe to
+// apply more than once, i.e. reads and SessionRequests.
+//
+// A server that turns the command away, e.g. with ErrNotLeader, is asked
+// again on the next round, as it may win the election under way. One that
+// takes the command but doesn't apply it in time is most likely a leader cut
+// off from the rest of its group, so the others get ClientAttemptTimeout to
+// elect a new leader before it's asked again.
+func executeOnGroup(exec GroupExecutor, groupId int, servers []int, leader *int, command interface{}, deadline time.Time) (interface{}, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("raft: group %d has no servers", groupId)
+	}
+	timedOut := make([]time.Time, len(servers))
+	for tried := 0; ; tried++ {
+		if tried > 0 && tried%len(servers) == 0 {
+			sleepMs(100) // Went round every server; give an election time to finish
+		}
+		if time.Now().After(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		i := *leader % len(servers)
+		if time.Since(timedOut[i]) < ClientAttemptTimeout {
+			*leader = (i + 1) % len(servers)
+			continue
+		}
+
+		attempt := ClientAttemptTimeout
+		if remaining := time.Until(deadline); remaining < attempt {
+			attempt = remaining
+		}
+		started := time.Now()
+		result, err := exec.ExecuteGroupCommand(servers[i], groupId, command, attempt)
+		if err == nil {
+			return result, nil
+		}
+		if time.Since(started) >= attempt {
+			timedOut[i] = time.Now()
+		}
+		*leader = (i + 1) % len(servers)
+	}
+}
+
+// ControllerClerk is a client of the shard controller running on servers.
+// Its methods may be called concurrently; they are run one at a time.
+type ControllerClerk struct {
+	mu      sync.Mutex
+	exec    GroupExecutor
+	servers []int
+	leader  int            // Index into servers of the last known leader
+	session *ClientSession // Registered on first use
+
+	Timeout time.Duration // How long each request is retried for; ShardClerkTimeout unless set
+}
+
+func NewControllerClerk(exec GroupExecutor, servers []int) *ControllerClerk {
+	return &ControllerClerk{exec: exec, servers: servers, Timeout: ShardClerkTimeout}
+}
+
+// ClientId returns the clerk's client id, registering a session for it if
+// need be. Client ids are unique across the whole sharded service.
+func (this *ControllerClerk) ClientId() (uint64, error) {
+	return this.clientId(time.Now().Add(this.Timeout))
+}
+
+func (this *ControllerClerk) clientId(deadline time.Time) (uint64, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err := this.register(deadline); err != nil {
+		return 0, err
+	}
+	return this.session.ClientId, nil
+}
+
+// forgetClientId has the clerk register a new session, and so a new client id,
+// next time, if its session is still clientId: one whose session a shard let
+// expire can't use it there again.
+func (this *ControllerClerk) forgetClientId(clientId uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.session != nil && this.session.ClientId == clientId {
+		this.session = nil
+	}
+}
+
+// register expects this.mu to be held.
+func (this *ControllerClerk) register(deadline time.Time) error {
+	if this.session != nil {
+		return nil
+	}
+	result, err := executeOnGroup(this.exec, ShardControllerGroup, this.servers, &this.leader, SessionRegister{}, deadline)
+	if err != nil {
+		return err
+	}
+	clientId, ok := result.(uint64)
+	if !ok {
+		return fmt.Errorf("raft: unexpected shard controller client id %v", result)
+	}
+	this.session = &ClientSession{ClientId: clientId}
+	return nil
+}
+
+func (this *ControllerClerk) Join(groups map[int][]int) error {
+	_, err := this.change(ShardJoin{Groups: groups})
+	return err
+}
+
+func (this *ControllerClerk) Leave(gids ...int) error {
+	_, err := this.change(ShardLeave{GIDs: gids})
+	return err
+}
+
+func (this *ControllerClerk) Move(shard int, gid int) error {
+	_, err := this.change(ShardMove{Shard: shard, GID: gid})
+	return err
+}
+
+// Query returns config num, or the latest config if num is -1.
+func (this *ControllerClerk) Query(num int) (ShardConfig, error) {
+	return this.query(num, time.Now().Add(this.Timeout))
+}
+
+func (this *ControllerClerk) query(num int, deadline time.Time) (ShardConfig, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	result, err := executeOnGroup(this.exec, ShardControllerGroup, this.servers, &this.leader, ShardQuery{Num: num}, deadline)
+	if err != nil {
+		return ShardConfig{}, err
+	}
+	return controllerResult(result)
+}
+
+// change runs command within the clerk's session, so that retrying it is safe.
+func (this *ControllerClerk) change(command interface{}) (ShardConfig, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	deadline := time.Now().Add(this.Timeout)
+	if err := this.register(deadline); err != nil {
+		return ShardConfig{}, err
+	}
+	request, err := this.session.Next(GobCodec, command)
+	if err != nil {
+		return ShardConfig{}, err
+	}
+	result, err := executeOnGroup(this.exec, ShardControllerGroup, this.servers, &this.leader, request, deadline)
+	if err != nil {
+		return ShardConfig{}, err
+	}
+	if result == ErrSessionExpired {
+		this.session = nil // Whether it was applied is unknown; start over next time
+	}
+	return controllerResult(result)
+}
+
+func controllerResult(result interface{}) (ShardConfig, error) {
+	switch result := result.(type) {
+	case ShardConfig:
+		return result, nil
+	case error:
+		return ShardConfig{}, result
+	}
+	return ShardConfig{}, fmt.Errorf("raft: unexpected shard controller result %v", result)
+}
+
+var ErrNoShardOwner = errors.New("raft: the key's shard is assigned to no group")
+
+// ShardClerk is a client of the sharded key/value service: it sends each
+// request to the group serving the key's shard in the latest config it knows
+// of, and fetches a newer config whenever that group turns it away. Its
+// methods may be called concurrently; they are run one at a time.
+type ShardClerk struct {
+	mu      sync.Mutex
+	exec    GroupExecutor
+	ctrl    *ControllerClerk
+	config  ShardConfig
+	leaders map[int]int    // Index into the group's servers of its last known leader, by gid
+	session *ClientSession // Uses the client id the controller handed ctrl
+
+	Timeout time.Duration // How long each request is retried for; ShardClerkTimeout unless set
+}
+
+func NewShardClerk(exec GroupExecutor, controllers []int) *ShardClerk {
+	return &ShardClerk{exec: exec, ctrl: NewControllerClerk(exec, controllers), leaders: make(map[int]int), Timeout: ShardClerkTimeout}
+}
+
+func (this *ShardClerk) Get(key string) (string, error) {
+	result, err := this.Do(KVCommand{Op: KVGet, Key: key})
+	return result.Value, err
+}
+
+func (this *ShardClerk) Put(key string, value string) error {
+	_, err := this.Do(KVCommand{Op: KVPut, Key: key, Value: value})
+	return err
+}
+
+func (this *ShardClerk) Append(key string, value string) error {
+	_, err := this.Do(KVCommand{Op: KVAppend, Key: key, Value: value})
+	return err
+}
+
+// Do runs cmd on whichever group serves its key, exactly once however many
+// times it has to be retried, unless Timeout runs out first, in which case
+// the outcome is unknown.
+func (this *ShardClerk) Do(cmd KVCommand) (KVResult, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	deadline := time.Now().Add(this.Timeout)
+	if this.session == nil {
+		clientId, err := this.ctrl.clientId(deadline)
+		if err != nil {
+			return KVResult{}, err
+		}
+		this.session = &ClientSession{ClientId: clientId}
+	}
+	request, err := this.session.Next(GobCodec, cmd)
+	if err != nil {
+		return KVResult{}, err
+	}
+
+	shard := KeyShard(cmd.Key)
+	for {
+		if gid := this.config.Shards[shard]; gid != 0 {
+			leader := this.leaders[gid]
+			groupDeadline := time.Now().Add(time.Duration(len(this.config.Groups[gid])) * ClientAttemptTimeout)
+			if groupDeadline.After(deadline) {
+				groupDeadline = deadline
+			}
+			result, err := executeOnGroup(this.exec, gid, this.config.Groups[gid], &leader, request, groupDeadline)
+			this.leaders[gid] = leader
+			if err == nil {
+				switch result := result.(type) {
+				case KVResult:
+					if result.Err == KVErrShardNotReady {
+						if time.Now().Before(deadline) {
+							sleepMs(100) // Right group; the shard is on its way
+							continue
+						}
+					} else if result.Err != KVErrWrongGroup {
+						return result, nil
+					}
+				case error:
+					if result == ErrSessionExpired {
+						// Whether it was applied is unknown; start over next time
+						this.ctrl.forgetClientId(this.session.ClientId)
+						this.session = nil
+					}
+					return KVResult{}, result
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return KVResult{}, context.DeadlineExceeded
+		}
+		config, err := this.ctrl.query(-1, deadline)
+		if err == nil {
+			this.config = config
+		}
+		if this.config.Shards[shard] == 0 && this.config.Num > 0 {
+			return KVResult{}, ErrNoShardOwner
+		}
+		sleepMs(100)
+	}
+}
@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Keys are spread over NShards shards, each served by one replica group at a
+// time. Which group that is, is up to the shard controller: a Raft group of
+// its own whose state machine is the history of ShardConfigs.
+const NShards = 10
+
+// ShardControllerGroup is the Raft group id the shard controller runs as.
+// Replica groups are Raft groups too, with their gid as group id.
+const ShardControllerGroup = -1
+
+// ShardConfig assigns every shard to a replica group, numbered from 1; gid 0
+// means the shard is assigned to none. Num goes up by one with every change,
+// from the empty config 0.
+type ShardConfig struct {
+	Num    int
+	Shards [NShards]int
+	Groups map[int][]int // Server ids of each replica group's members, by gid
+}
+
+// KeyShard returns the shard key belongs to.
+func KeyShard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % NShards)
+}
+
+// Commands for ShardController.
+type (
+	// ShardJoin adds replica groups, and moves shards to them to even out the load.
+	ShardJoin struct {
+		Groups map[int][]int
+	}
+	// ShardLeave removes replica groups, handing their shards to the others.
+	ShardLeave struct {
+		GIDs []int
+	}
+	// ShardMove assigns one shard to a group, whatever the balance.
+	ShardMove struct {
+		Shard int
+		GID   int
+	}
+	// ShardQuery asks for config Num, or the latest one if Num is -1 or
+	// past it.
+	ShardQuery struct {
+		Num int
+	}
+)
+
+// ShardControllerError is what ShardController returns for commands it refuses.
+type ShardControllerError string
+
+func (this ShardControllerError) Error() string { return string(this) }
+
+func init() {
+	RegisterCommand("shardctrl/join", 1, ShardJoin{})
+	RegisterCommand("shardctrl/leave", 1, ShardLeave{})
+	RegisterCommand("shardctrl/move", 1, ShardMove{})
+	RegisterCommand("shardctrl/query", 1, ShardQuery{})
+	gob.Register(ShardConfig{})
+	gob.Register(ShardControllerError(""))
+}
+
+// ShardController is the shard controller's StateMachine. Every command
+// returns the latest ShardConfig, or a ShardControllerError. Wrap it in
+// Sessions so that retried Joins and Leaves aren't refused. It's a
+// Snapshotter.
+type ShardController struct {
+	configs []ShardConfig
+}
+
+func NewShardController() *ShardController {
+	return &ShardController{configs: []ShardConfig{{Groups: map[int][]int{}}}}
+}
+
+func (this *ShardController) Apply(index int, entry LogEntry) interface{} {
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return ShardControllerError(err.Error())
+	}
+	latest := this.configs[len(this.configs)-1]
+
+	switch cmd := command.Value.(type) {
+	case ShardQuery:
+		if cmd.Num < 0 || cmd.Num >= len(this.configs) {
+			return latest.clone()
+		}
+		return this.configs[cmd.Num].clone()
+
+	case ShardJoin:
+		next := latest.next()
+		for gid, servers := range cmd.Groups {
+			if gid <= 0 {
+				return ShardControllerError(fmt.Sprintf("bad gid %d", gid))
+			}
+			if _, ok := next.Groups[gid]; ok {
+				return ShardControllerError(fmt.Sprintf("group %d has already joined", gid))
+			}
+			next.Groups[gid] = append([]int(nil), servers...)
+		}
+		next.rebalance()
+		return this.add(next)
+
+	case ShardLeave:
+		next := latest.next()
+		for _, gid := range cmd.GIDs {
+			if _, ok := next.Groups[gid]; !ok {
+				return ShardControllerError(fmt.Sprintf("no group %d", gid))
+			}
+			delete(next.Groups, gid)
+			for shard, owner := range next.Shards {
+				if owner == gid {
+					next.Shards[shard] = 0
+				}
+			}
+		}
+		next.rebalance()
+		return this.add(next)
+
+	case ShardMove:
+		if cmd.Shard < 0 || cmd.Shard >= NShards {
+			return ShardControllerError(fmt.Sprintf("no shard %d", cmd.Shard))
+		}
+		if _, ok := latest.Groups[cmd.GID]; !ok {
+			return ShardControllerError(fmt.Sprintf("no group %d", cmd.GID))
+		}
+		next := latest.next()
+		next.Shards[cmd.Shard] = cmd.GID
+		return this.add(next)
+	}
+	return ShardControllerError(fmt.Sprintf("not a shard controller command: %s v%d", command.Type, command.Version))
+}
+
+// Snapshot saves every config, as ShardQuery can ask for any of them.
+func (this *ShardController) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(this.configs)
+	return buf.Bytes(), err
+}
+
+func (this *ShardController) Restore(data []byte) error {
+	var configs []ShardConfig
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&configs); err != nil {
+		return err
+	}
+	this.configs = configs
+	return nil
+}
+
+func (this *ShardController) add(config ShardConfig) ShardConfig {
+	this.configs = append(this.configs, config)
+	return config.clone()
+}
+
+// clone returns a copy of this that shares nothing with it, as a result
+// handed out by Apply may be changed by whoever it goes to.
+func (this ShardConfig) clone() ShardConfig {
+	clone := ShardConfig{Num: this.Num, Shards: this.Shards, Groups: make(map[int][]int, len(this.Groups))}
+	for gid, servers := range this.Groups {
+		clone.Groups[gid] = append([]int(nil), servers...)
+	}
+	return clone
+}
+
+// next returns a copy of this numbered as its successor.
+func (this ShardConfig) next() ShardConfig {
+	next := ShardConfig{Num: this.Num + 1, Shards: this.Shards, Groups: make(map[int][]int, len(this.Groups))}
+	for gid, servers := range this.Groups {
+		next.Groups[gid] = servers
+	}
+	return next
+}
+
+// rebalance assigns unassigned shards, and moves as few others as it can, so
+// that no two groups' shard counts differ by more than one. It is
+// deterministic, as every replica of the controller must come to the same config.
+func (this *ShardConfig) rebalance() {
+	if len(this.Groups) == 0 {
+		this.Shards = [NShards]int{}
+		return
+	}
+
+	owned := make(map[int][]int) // Shards of each group, in order
+	var free []int
+	for shard, gid := range this.Shards {
+		if _, ok := this.Groups[gid]; ok {
+			owned[gid] = append(owned[gid], shard)
+		} else {
+			free = append(free, shard)
+		}
+	}
+
+	// The groups with the most shards already keep the larger shares
+	gids := make([]int, 0, len(this.Groups))
+	for gid := range this.Groups {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool {
+		if len(owned[gids[i]]) != len(owned[gids[j]]) {
+			return len(owned[gids[i]]) > len(owned[gids[j]])
+		}
+		return gids[i] < gids[j]
+	})
+	target := make(map[int]int)
+	for i, gid := range gids {
+		target[gid] = NShards / len(gids)
+		if i < NShards%len(gids) {
+			target[gid]++
+		}
+	}
+
+	for _, gid := range gids {
+		if extra := len(owned[gid]) - target[gid]; extra > 0 {
+			free = append(free, owned[gid][target[gid]:]...)
+			owned[gid] = owned[gid][:target[gid]]
+		}
+	}
+	sort.Ints(free)
+	for _, gid := range gids {
+		for len(owned[gid]) < target[gid] {
+			this.Shards[free[0]] = gid
+			owned[gid] = append(owned[gid], free[0])
+			free = free[1:]
+		}
+	}
+}
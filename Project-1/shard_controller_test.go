@@ -0,0 +1,134 @@
+package raft
+
+import (
+	"testing"
+)
+
+// applyController applies command to controller as if it were committed next.
+func applyController(t *testing.T, controller *ShardController, command interface{}) interface{} {
+	t.Helper()
+	data, err := EncodeCommand(GobCodec, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controller.Apply(0, LogEntry{Command: data})
+}
+
+func checkBalanced(t *testing.T, config ShardConfig) {
+	t.Helper()
+	counts := make(map[int]int)
+	for shard, gid := range config.Shards {
+		if _, ok := config.Groups[gid]; !ok {
+			t.Fatalf("config %d: shard %d assigned to group %d, which isn't in %v", config.Num, shard, gid, config.Groups)
+		}
+		counts[gid]++
+	}
+	least, most := NShards, 0
+	for gid := range config.Groups {
+		least, most = min(least, counts[gid]), max(most, counts[gid])
+	}
+	if most-least > 1 {
+		t.Fatalf("config %d is unbalanced: %v", config.Num, config.Shards)
+	}
+}
+
+func moved(from ShardConfig, to ShardConfig) int {
+	n := 0
+	for shard := range from.Shards {
+		if from.Shards[shard] != to.Shards[shard] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestShardControllerRebalance(t *testing.T) {
+	controller := NewShardController()
+
+	config := applyController(t, controller, ShardJoin{Groups: map[int][]int{1: {0, 1, 2}}}).(ShardConfig)
+	if config.Num != 1 {
+		t.Fatalf("first join gave config %d", config.Num)
+	}
+	checkBalanced(t, config)
+
+	for gid := 2; gid <= 4; gid++ {
+		previous := config
+		config = applyController(t, controller, ShardJoin{Groups: map[int][]int{gid: {gid}}}).(ShardConfig)
+		checkBalanced(t, config)
+		// Only the joining group's share moves
+		if n := moved(previous, config); n > NShards/gid+1 {
+			t.Fatalf("joining group %d moved %d shards: %v -> %v", gid, n, previous.Shards, config.Shards)
+		}
+	}
+
+	previous := config
+	config = applyController(t, controller, ShardLeave{GIDs: []int{2}}).(ShardConfig)
+	checkBalanced(t, config)
+	for shard, gid := range previous.Shards {
+		if gid != 2 && config.Shards[shard] != gid {
+			t.Fatalf("leave of group 2 moved shard %d, of group %d", shard, gid)
+		}
+	}
+
+	config = applyController(t, controller, ShardMove{Shard: 0, GID: 4}).(ShardConfig)
+	if config.Shards[0] != 4 {
+		t.Fatalf("shard 0 is with group %d after moving it to 4", config.Shards[0])
+	}
+
+	if result := applyController(t, controller, ShardJoin{Groups: map[int][]int{1: {0}}}); result != ShardControllerError("group 1 has already joined") {
+		t.Fatalf("joining group 1 twice: got %v", result)
+	}
+	if result := applyController(t, controller, ShardMove{Shard: 0, GID: 2}); result != ShardControllerError("no group 2") {
+		t.Fatalf("moving a shard to a group that left: got %v", result)
+	}
+
+	// Every config stays queryable
+	if old := applyController(t, controller, ShardQuery{Num: 1}).(ShardConfig); old.Num != 1 || len(old.Groups) != 1 {
+		t.Fatalf("query of config 1: got %+v", old)
+	}
+	if latest := applyController(t, controller, ShardQuery{Num: -1}).(ShardConfig); latest.Num != config.Num {
+		t.Fatalf("query of the latest config: got %d, want %d", latest.Num, config.Num)
+	}
+	// What a query returns is the caller's to change
+	old := applyController(t, controller, ShardQuery{Num: 1}).(ShardConfig)
+	old.Groups[1][0] = 9
+	old.Groups[5] = []int{5}
+	if again := applyController(t, controller, ShardQuery{Num: 1}).(ShardConfig); len(again.Groups) != 1 || again.Groups[1][0] != 0 {
+		t.Fatalf("query of config 1 after changing an earlier result: got %+v", again)
+	}
+
+	config = applyController(t, controller, ShardLeave{GIDs: []int{1, 3, 4}}).(ShardConfig)
+	if config.Shards != ([NShards]int{}) {
+		t.Fatalf("shards still assigned once every group left: %v", config.Shards)
+	}
+}
+
+func TestShardControllerDeterministic(t *testing.T) {
+	// Replicas apply the same commands, so must end up with the same configs,
+	// whatever order Go's maps iterate in
+	commands := []interface{}{
+		ShardJoin{Groups: map[int][]int{1: {0}, 2: {1}, 3: {2}}},
+		ShardJoin{Groups: map[int][]int{4: {0}, 5: {1}, 6: {2}, 7: {0}}},
+		ShardLeave{GIDs: []int{2, 5}},
+		ShardJoin{Groups: map[int][]int{8: {0}, 9: {1}, 10: {2}, 11: {0}, 12: {1}}},
+	}
+	var reference []ShardConfig
+	for run := 0; run < 20; run++ {
+		controller := NewShardController()
+		var configs []ShardConfig
+		for _, command := range commands {
+			config := applyController(t, controller, command).(ShardConfig)
+			checkBalanced(t, config)
+			configs = append(configs, config)
+		}
+		if reference == nil {
+			reference = configs
+			continue
+		}
+		for i := range configs {
+			if configs[i].Shards != reference[i].Shards {
+				t.Fatalf("run %d: config %d is %v, but was %v before", run, configs[i].Num, configs[i].Shards, reference[i].Shards)
+			}
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KVResult.Err of a command for a key whose shard the group doesn't serve; the
+// client should fetch the latest config and go to the group that does.
+const KVErrWrongGroup = "wrong group"
+
+// KVResult.Err of a command for a key whose shard the group has been given,
+// but whose data is still on its way from the previous owner; try again shortly.
+const KVErrShardNotReady = "shard not ready"
+
+// How often the leader of a replica group asks the shard controller for the
+// config after its current one, or retries pulling shards.
+const ShardConfigPollInterval = 100 * time.Millisecond
+
+// ShardConfigUpdate moves a replica group on to Config, which must be the
+// successor of its current one. The group's leader proposes it, so that every
+// member switches configs at the same point in the log.
+type ShardConfigUpdate struct {
+	Config ShardConfig
+}
+
+func init() {
+	RegisterCommand("shardkv/config", 1, ShardConfigUpdate{})
+}
+
+// ShardKV is the StateMachine of a replica group: a KVStore per shard the
+// group serves in its current config. It takes KVCommands, plain or in a
+// SessionRequest, and refuses those for other shards with KVErrWrongGroup.
+//
+// Requests are deduplicated per shard, by the client ids the shard
+// controller hands out; the sessions a shard's requests were made in belong
+// to the shard, not the group, and move with it. They expire after ttl, like
+// those of Sessions. A client's first request for a shard starts its session
+// there, so the shard remembers the client ids whose sessions expired, and
+// answers their requests with ErrSessionExpired rather than starting afresh.
+//
+// A shard the group gains from another group is pulled from it, see
+// shard_migration.go, and refused with KVErrShardNotReady until it's in. The
+// group stays in a config until all of its shards are. It's a Snapshotter.
+type ShardKV struct {
+	mu sync.Mutex // Apply runs with the node's lock held; the poller doesn't
+
+	gid      int
+	ttl      time.Duration
+	previous ShardConfig // Gained shards are pulled from their owners in it
+	config   ShardConfig
+	shards   map[int]*kvShard       // Shards of config, served or still being pulled
+	outgoing map[int]*outgoingShard // Shards config took away, until their new owner has them deleted
+	deleting []pendingPull          // Shards pulled in whose old owner may still have a copy
+	now      int64                  // Latest entry timestamp seen
+}
+
+type kvShard struct {
+	store    *KVStore
+	sessions sessionTable
+	expired  map[uint64]bool // Client ids whose session expired; they get no new one
+	pulling  bool            // Given to this group, but its data isn't here yet
+}
+
+func newKVShard() *kvShard {
+	return &kvShard{store: NewKVStore(), sessions: make(sessionTable), expired: make(map[uint64]bool)}
+}
+
+func (this *kvShard) expire(now int64, ttl time.Duration) {
+	for _, clientId := range this.sessions.expire(now, ttl) {
+		this.expired[clientId] = true
+	}
+}
+
+// expiredIds returns the client ids of the shard's expired sessions, in order,
+// as they're handed over.
+func (this *kvShard) expiredIds() []uint64 {
+	ids := make([]uint64, 0, len(this.expired))
+	for clientId := range this.expired {
+		ids = append(ids, clientId)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func expiredSet(ids []uint64) map[uint64]bool {
+	expired := make(map[uint64]bool, len(ids))
+	for _, clientId := range ids {
+		expired[clientId] = true
+	}
+	return expired
+}
+
+func NewShardKV(gid int, ttl time.Duration) *ShardKV {
+	return &ShardKV{
+		gid:      gid,
+		ttl:      ttl,
+		previous: ShardConfig{Groups: map[int][]int{}},
+		config:   ShardConfig{Groups: map[int][]int{}},
+		shards:   make(map[int]*kvShard),
+		outgoing: make(map[int]*outgoingShard),
+	}
+}
+
+// Config returns the config the group is in, as of the entries applied so far.
+func (this *ShardKV) Config() ShardConfig {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.config
+}
+
+// shardKVSnapshot is a ShardKV as gob encodes it, shards being handed over
+// or pulled and deletes still to be made included.
+type shardKVSnapshot struct {
+	Now      int64
+	Previous ShardConfig
+	Config   ShardConfig
+	Shards   map[int]kvShardSnapshot
+	Outgoing map[int]outgoingShardSnapshot
+	Deleting []pendingPullSnapshot
+}
+
+type kvShardSnapshot struct {
+	Store    []byte // Of KVStore.Snapshot, history and all
+	Sessions map[uint64]ShardSession
+	Expired  []uint64
+	Pulling  bool
+}
+
+type outgoingShardSnapshot struct {
+	ConfigNum int
+	Shard     kvShardSnapshot
+}
+
+type pendingPullSnapshot struct {
+	ConfigNum int
+	Shard     int
+	GID       int
+	Servers   []int
+}
+
+func (this *ShardKV) Snapshot() ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	snapshot := shardKVSnapshot{Now: this.now, Previous: this.previous, Config: this.config,
+		Shards: make(map[int]kvShardSnapshot, len(this.shards)), Outgoing: make(map[int]outgoingShardSnapshot, len(this.outgoing))}
+	for id, shard := range this.shards {
+		data, err := shard.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Shards[id] = data
+	}
+	for id, out := range this.outgoing {
+		data, err := out.shard.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Outgoing[id] = outgoingShardSnapshot{ConfigNum: out.configNum, Shard: data}
+	}
+	for _, pull := range this.deleting {
+		snapshot.Deleting = append(snapshot.Deleting, pendingPullSnapshot{ConfigNum: pull.configNum, Shard: pull.shard, GID: pull.gid, Servers: pull.servers})
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(snapshot)
+	return buf.Bytes(), err
+}
+
+// Restore replaces the group's config and shards with those in data.
+func (this *ShardKV) Restore(data []byte) error {
+	var snapshot shardKVSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot); err != nil {
+		return err
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	shards := make(map[int]*kvShard, len(snapshot.Shards))
+	for id, data := range snapshot.Shards {
+		shard, err := restoreKVShard(data)
+		if err != nil {
+			return err
+		}
+		shards[id] = shard
+	}
+	outgoing := make(map[int]*outgoingShard, len(snapshot.Outgoing))
+	for id, out := range snapshot.Outgoing {
+		shard, err := restoreKVShard(out.Shard)
+		if err != nil {
+			return err
+		}
+		outgoing[id] = &outgoingShard{configNum: out.ConfigNum, shard: shard}
+	}
+	this.deleting = nil
+	for _, pull := range snapshot.Deleting {
+		this.deleting = append(this.deleting, pendingPull{configNum: pull.ConfigNum, shard: pull.Shard, gid: pull.GID, servers: pull.Servers})
+	}
+	this.now, this.previous, this.config, this.shards, this.outgoing = snapshot.Now, snapshot.Previous, snapshot.Config, shards, outgoing
+	return nil
+}
+
+func (this *kvShard) snapshot() (kvShardSnapshot, error) {
+	store, err := this.store.Snapshot()
+	return kvShardSnapshot{Store: store, Sessions: this.sessions.shardSessions(), Expired: this.expiredIds(), Pulling: this.pulling}, err
+}
+
+func restoreKVShard(data kvShardSnapshot) (*kvShard, error) {
+	shard := newKVShard()
+	if err := shard.store.Restore(data.Store); err != nil {
+		return nil, err
+	}
+	shard.sessions, shard.expired, shard.pulling = shardSessionTable(data.Sessions), expiredSet(data.Expired), data.Pulling
+	return shard, nil
+}
+
+func (this *ShardKV) Apply(index int, entry LogEntry) interface{} {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if entry.Time > this.now {
+		this.now = entry.Time
+		for _, shard := range this.shards {
+			shard.expire(this.now, this.ttl)
+		}
+	}
+
+	command, err := DecodeCommand(entry.Command)
+	if err != nil {
+		return KVResult{Err: err.Error()}
+	}
+	switch cmd := command.Value.(type) {
+	case ShardConfigUpdate:
+		this.updateConfig(cmd.Config)
+		return nil
+
+	case ShardPull:
+		return this.handOver(cmd)
+
+	case ShardInstall:
+		this.install(index, cmd.Data)
+		return nil
+
+	case ShardDelete:
+		this.dropOutgoing(cmd)
+		return nil
+
+	case ShardDeleted:
+		this.deleted(cmd)
+		return nil
+
+	case KVCommand:
+		shard, result := this.serving(cmd.Key)
+		if shard == nil {
+			return result
+		}
+		return shard.store.Apply(index, entry)
+
+	case SessionRequest:
+		inner, err := DecodeCommand(cmd.Command)
+		if err != nil {
+			return KVResult{Err: err.Error()}
+		}
+		kv, ok := inner.Value.(KVCommand)
+		if !ok {
+			return KVResult{Err: "not a KVCommand: " + inner.Type}
+		}
+		shard, result := this.serving(kv.Key)
+		if shard == nil {
+			return result
+		}
+		if shard.sessions[cmd.ClientId] == nil && !shard.expired[cmd.ClientId] {
+			// The client registered with the shard controller; this is
+			// its first request for the shard
+			shard.sessions[cmd.ClientId] = &clientSession{}
+		}
+		return shard.sessions.apply(cmd, this.now, func() interface{} {
+			return shard.store.Apply(index, LogEntry{Command: cmd.Command, Term: entry.Term, Time: entry.Time})
+		})
+	}
+	return KVResult{Err: "not a shard KV command: " + command.Type}
+}
+
+// serving returns the shard of key if the group can serve it, or else the
+// result to refuse the command with.
+func (this *ShardKV) serving(key string) (*kvShard, KVResult) {
+	shard := this.shards[KeyShard(key)]
+	if shard == nil {
+		return nil, KVResult{Err: KVErrWrongGroup}
+	}
+	if shard.pulling {
+		return nil, KVResult{Err: KVErrShardNotReady}
+	}
+	return shard, KVResult{}
+}
+
+// updateConfig switches to config if it's the next one and every shard of the
+// current one is in. Shards the group gains from no group start out empty;
+// those from another group are pulled. Those it loses are set aside for
+// their new owner.
+func (this *ShardKV) updateConfig(config ShardConfig) {
+	if config.Num != this.config.Num+1 {
+		return // A duplicate proposal, from a leader that hadn't seen the first applied
+	}
+	for _, shard := range this.shards {
+		if shard.pulling {
+			return // Proposed by a leader that hadn't seen a pull applied; it'll propose it again
+		}
+	}
+
+	for shard, gid := range config.Shards {
+		owned := this.shards[shard]
+		switch {
+		case gid == this.gid && owned == nil:
+			owned = newKVShard()
+			owned.pulling = this.config.Shards[shard] != 0
+			this.shards[shard] = owned
+		case gid != this.gid && owned != nil:
+			this.outgoing[shard] = &outgoingShard{configNum: config.Num, shard: owned}
+			delete(this.shards, shard)
+		}
+	}
+	this.previous, this.config = this.config, config
+}
+
+// StartShardKV starts server's member of replica group gid, whose state
+// machine is a ShardKV, and has it follow the configs of the shard controller
+// hosted on controllers. The group must have joined, through a
+// ControllerClerk, to be given shards, and should keep running after it
+// leaves until the shards it had are pulled and deleted.
+func StartShardKV(server *Server, gid int, config GroupConfig, controllers []int) (*ShardKV, error) {
+	store := NewShardKV(gid, DefaultSessionTTL)
+	config.StateMachine = store
+	node, err := server.AddGroup(gid, config)
+	if err != nil {
+		return nil, err
+	}
+	go pollShardConfigs(node, store, server, NewControllerClerk(server, controllers))
+	return store, nil
+}
+
+// pollShardConfigs has node, while it leads its group, pull the shards the
+// group is waiting for or, once there are none, propose the config the shard
+// controller has after the group's current one. Meanwhile, it has the old
+// owners of the shards pulled delete them.
+// This function runs as a go routine until the node is killed.
+func pollShardConfigs(node *RaftNode, store *ShardKV, exec GroupExecutor, ctrl *ControllerClerk) {
+	ctrl.Timeout = 2 * ClientAttemptTimeout
+	var deleting sync.Map // Of [2]int{configNum, shard}, for the deletes under way
+	for {
+		select {
+		case <-node.ctx.Done():
+			return
+		case <-time.After(ShardConfigPollInterval):
+		}
+		if _, _, isLeader := node.GetNodeState(); !isLeader {
+			continue
+		}
+
+		// An old owner that's gone mustn't hold up the configs, so these
+		// aren't waited for
+		for _, pull := range store.pendingDeletes() {
+			key := [2]int{pull.configNum, pull.shard}
+			if _, busy := deleting.LoadOrStore(key, true); !busy {
+				go func(pull pendingPull) {
+					defer deleting.Delete(key)
+					deleteShard(node, exec, pull)
+				}(pull)
+			}
+		}
+
+		if pulls := store.pendingPulls(); len(pulls) > 0 {
+			var wg sync.WaitGroup
+			for _, pull := range pulls {
+				wg.Add(1)
+				go func(pull pendingPull) {
+					defer wg.Done()
+					pullShard(node, exec, pull)
+				}(pull)
+			}
+			wg.Wait()
+			continue
+		}
+
+		current := store.Config()
+		next, err := ctrl.Query(current.Num + 1)
+		if err != nil || next.Num != current.Num+1 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(node.ctx, 2*ClientAttemptTimeout)
+		if _, err := node.SubmitCommand(ctx, ShardConfigUpdate{Config: next}); err == nil {
+			node.logger(LogClient).Info("moved to shard config", "config", next.Num, "shards", next.Shards)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newShardCluster starts a cluster of n servers hosting the shard controller
+// on controllers and the replica groups in groups, and joins the groups in join.
+func newShardCluster(t *testing.T, n int, controllers []int, groups map[int][]int, join ...int) *Cluster {
+	cluster := NewClusterTracedTo(t, n, t.TempDir())
+	cluster.StartShardController(controllers)
+	for gid := 1; gid <= len(groups); gid++ {
+		cluster.StartShardGroup(gid, groups[gid])
+	}
+
+	joining := make(map[int][]int)
+	for _, gid := range join {
+		joining[gid] = groups[gid]
+	}
+	if err := cluster.NewControllerClerk().Join(joining); err != nil {
+		cluster.Shutdown()
+		t.Fatal(err)
+	}
+	return cluster
+}
+
+// shardKeys returns a key in each shard.
+func shardKeys() []string {
+	keys := make([]string, NShards)
+	for i, found := 0, 0; found < NShards; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if keys[KeyShard(key)] == "" {
+			keys[KeyShard(key)] = key
+			found++
+		}
+	}
+	return keys
+}
+
+// forEachKey runs do for every key at once, with a clerk per key.
+func forEachKey(cluster *Cluster, keys []string, do func(clerk *ShardClerk, key string) error) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, len(keys))
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			if err := do(cluster.NewShardClerk(), key); err != nil {
+				errs <- fmt.Errorf("%s: %v", key, err)
+			}
+		}(key)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func TestShardKVRouting(t *testing.T) {
+	all := []int{0, 1, 2}
+	cluster := newShardCluster(t, 3, all, map[int][]int{1: all, 2: all}, 1, 2)
+	defer cluster.Shutdown()
+	keys := shardKeys()
+
+	err := forEachKey(cluster, keys, func(clerk *ShardClerk, key string) error {
+		if err := clerk.Put(key, "a"); err != nil {
+			return err
+		}
+		if err := clerk.Append(key, "b"); err != nil {
+			return err
+		}
+		value, err := clerk.Get(key)
+		if err == nil && value != "ab" {
+			err = fmt.Errorf("got %q, want %q", value, "ab")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each group serves only the shards the config gives it
+	config, err := cluster.NewControllerClerk().Query(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		owner := config.Shards[KeyShard(key)]
+		other := 3 - owner
+		leader := -1
+		for deadline := time.Now().Add(10 * time.Second); leader < 0 && time.Now().Before(deadline); sleepMs(100) {
+			leader = cluster.GroupLeader(other)
+		}
+		if leader < 0 {
+			t.Fatalf("group %d has no leader", other)
+		}
+		result, err := cluster.ExecuteGroupCommand(leader, other, KVCommand{Op: KVGet, Key: key}, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.(KVResult).Err != KVErrWrongGroup {
+			t.Errorf("group %d served %s, whose shard %d is group %d's: %+v", other, key, KeyShard(key), owner, result)
+		}
+	}
+}
+
+func TestShardKVLeave(t *testing.T) {
+	all := []int{0, 1, 2}
+	cluster := newShardCluster(t, 3, all, map[int][]int{1: all, 2: all}, 1, 2)
+	defer cluster.Shutdown()
+	keys := shardKeys()
+
+	if err := forEachKey(cluster, keys, func(clerk *ShardClerk, key string) error { return clerk.Put(key, "x") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.NewControllerClerk().Leave(2); err != nil {
+		t.Fatal(err)
+	}
+	// Clerks find their way to group 1, which now has every shard, data and all
+	err := forEachKey(cluster, keys, func(clerk *ShardClerk, key string) error {
+		if err := clerk.Append(key, "y"); err != nil {
+			return err
+		}
+		value, err := clerk.Get(key)
+		if err == nil && value != "xy" {
+			err = fmt.Errorf("got %q, want %q", value, "xy")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := cluster.NewControllerClerk().Query(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Shards != ([NShards]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}) {
+		t.Fatalf("shards after group 2 left: %v", config.Shards)
+	}
+}
+
+// A member that missed the group's and the controller's changes gets them, the
+// shards and their sessions included, from snapshots, and serves from there
+// as leader of both.
+func TestShardKVSnapshotInstalled(t *testing.T) {
+	all := []int{0, 1, 2}
+	cluster := newShardCluster(t, 3, all, map[int][]int{1: all}, 1)
+	defer cluster.Shutdown()
+	keys := shardKeys()
+	if err := <-appendAll(cluster, keys, "a", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither group's leader, so both keep theirs while it's away
+	lagging := 0
+	for lagging == cluster.awaitGroupLeader(ShardControllerGroup) || lagging == cluster.awaitGroupLeader(1) {
+		lagging++
+	}
+	cluster.DisconnectPeer(lagging)
+	if err := <-appendAll(cluster, keys, "b", 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	controllerIndex := snapshotGroupAllBut(t, cluster, ShardControllerGroup, cluster.awaitGroupLeader(ShardControllerGroup), lagging)
+	groupIndex := snapshotGroupAllBut(t, cluster, 1, cluster.awaitGroupLeader(1), lagging)
+	cluster.ReconnectPeer(lagging)
+	awaitSnapshot(t, cluster.getServers()[lagging].Group(ShardControllerGroup), controllerIndex)
+	awaitSnapshot(t, cluster.getServers()[lagging].Group(1), groupIndex)
+
+	transferGroupLeader(t, cluster, ShardControllerGroup, lagging)
+	transferGroupLeader(t, cluster, 1, lagging)
+	config, err := cluster.NewControllerClerk().Query(-1)
+	if err != nil || config.Num != 1 || len(config.Groups[1]) != len(all) {
+		t.Fatalf("latest config from the restored controller: got %+v, %v", config, err)
+	}
+	checkValues(t, cluster, keys, "ab")
+}
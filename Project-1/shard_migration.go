@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// When a config gives a replica group a shard that another group had, the
+// new owner's leader pulls it: it submits a ShardPull to the old owner, which
+// answers, through its log, once it has applied that config too and so stopped
+// serving the shard. The new owner then puts the data in its own log with a
+// ShardInstall, so that all its members install it at the same point.
+//
+// Either group may be partitioned away or change leaders meanwhile; the pull
+// is simply retried until it gets through. Neither group moves on to another
+// config until the shards it's waiting for are in, which is also what keeps
+// the old owner's copy around until it's been pulled: it can't be given the
+// shard back before then.
+//
+// Once the shard is installed, the new owner's leader tells the old owner, with
+// a ShardDelete through its log, that it can drop its copy, and then records
+// that it has, with a ShardDeleted through its own. That too is retried until
+// it gets through, but without holding up configs.
+
+// ShardPull asks the group that served Shard before config ConfigNum for its
+// contents. It changes nothing, and returns a ShardData.
+type ShardPull struct {
+	ConfigNum int
+	Shard     int
+}
+
+// ShardData is a shard's contents, and the sessions of the requests made on it,
+// expired ones included.
+// KV is the latest value of each key: revisions are indexes in the old owner's
+// log, which mean nothing in the new owner's, so the shard's history stays
+// behind, and the new owner starts it as compacted at the ShardInstall.
+type ShardData struct {
+	ConfigNum int
+	Shard     int
+	KV        map[string]string
+	Sessions  map[uint64]ShardSession
+	Expired   []uint64 // Client ids whose session expired
+	Err       string   // KVErrShardNotReady if the old owner isn't in ConfigNum yet
+}
+
+type ShardSession struct {
+	LastSeq      uint64
+	LastResponse KVResult
+	LastActive   int64
+}
+
+// shardSessions returns the sessions of a shard as they're handed over.
+func (this sessionTable) shardSessions() map[uint64]ShardSession {
+	sessions := make(map[uint64]ShardSession, len(this))
+	for clientId, session := range this {
+		response, _ := session.lastResponse.(KVResult)
+		sessions[clientId] = ShardSession{LastSeq: session.lastSeq, LastResponse: response, LastActive: session.lastActive}
+	}
+	return sessions
+}
+
+func shardSessionTable(sessions map[uint64]ShardSession) sessionTable {
+	table := make(sessionTable, len(sessions))
+	for clientId, session := range sessions {
+		table[clientId] = &clientSession{lastSeq: session.LastSeq, lastResponse: session.LastResponse, lastActive: session.LastActive}
+	}
+	return table
+}
+
+// ShardInstall hands a replica group the data of a shard it pulled.
+type ShardInstall struct {
+	Data ShardData
+}
+
+// ShardDelete tells the group that served Shard before config ConfigNum that
+// the new owner has installed it, so the old owner's copy can go.
+type ShardDelete struct {
+	ConfigNum int
+	Shard     int
+}
+
+// ShardDeleted records, in the new owner's log, that the old owner of Shard
+// before config ConfigNum has been told to drop it.
+type ShardDeleted struct {
+	ConfigNum int
+	Shard     int
+}
+
+func init() {
+	RegisterCommand("shardkv/pull", 1, ShardPull{})
+	RegisterCommand("shardkv/install", 1, ShardInstall{})
+	RegisterCommand("shardkv/delete", 1, ShardDelete{})
+	RegisterCommand("shardkv/deleted", 1, ShardDeleted{})
+	gob.Register(ShardData{})
+}
+
+// outgoingShard is a shard the group lost in config configNum, frozen.
+type outgoingShard struct {
+	configNum int
+	shard     *kvShard
+}
+
+// handOver answers a ShardPull.
+func (this *ShardKV) handOver(pull ShardPull) ShardData {
+	data := ShardData{ConfigNum: pull.ConfigNum, Shard: pull.Shard}
+	out := this.outgoing[pull.Shard]
+	switch {
+	case out != nil && out.configNum == pull.ConfigNum:
+		data.KV = out.shard.store.values()
+		data.Sessions = out.shard.sessions.shardSessions()
+		data.Expired = out.shard.expiredIds()
+	case this.config.Num < pull.ConfigNum:
+		data.Err = KVErrShardNotReady
+	default:
+		data.Err = fmt.Sprintf("group %d did not hand over shard %d in config %d", this.gid, pull.Shard, pull.ConfigNum)
+	}
+	return data
+}
+
+// install applies a ShardInstall; installs of shards no longer waited for are
+// duplicates, and ignored.
+func (this *ShardKV) install(index int, data ShardData) {
+	shard := this.shards[data.Shard]
+	if data.ConfigNum != this.config.Num || shard == nil || !shard.pulling {
+		return
+	}
+	shard.store.load(index, data.KV)
+	shard.sessions = shardSessionTable(data.Sessions)
+	shard.expired = expiredSet(data.Expired)
+	shard.pulling = false
+	from := this.previous.Shards[data.Shard]
+	this.deleting = append(this.deleting, pendingPull{configNum: data.ConfigNum, shard: data.Shard, gid: from, servers: this.previous.Groups[from]})
+}
+
+// dropOutgoing applies a ShardDelete. The shard may be gone already, if the
+// ShardDelete is a retry, and is then left alone.
+func (this *ShardKV) dropOutgoing(cmd ShardDelete) {
+	if out := this.outgoing[cmd.Shard]; out != nil && out.configNum == cmd.ConfigNum {
+		delete(this.outgoing, cmd.Shard)
+	}
+}
+
+// deleted applies a ShardDeleted.
+func (this *ShardKV) deleted(cmd ShardDeleted) {
+	for i, deleting := range this.deleting {
+		if deleting.configNum == cmd.ConfigNum && deleting.shard == cmd.Shard {
+			this.deleting = append(this.deleting[:i:i], this.deleting[i+1:]...)
+			return
+		}
+	}
+}
+
+// pendingPull is a shard the group is waiting for, or has pulled but not yet
+// had deleted, and where it was.
+type pendingPull struct {
+	configNum int
+	shard     int
+	gid       int
+	servers   []int
+}
+
+func (this *ShardKV) pendingPulls() []pendingPull {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var pulls []pendingPull
+	for shardId, shard := range this.shards {
+		if shard.pulling {
+			gid := this.previous.Shards[shardId]
+			pulls = append(pulls, pendingPull{configNum: this.config.Num, shard: shardId, gid: gid, servers: this.previous.Groups[gid]})
+		}
+	}
+	return pulls
+}
+
+// pullShard makes one attempt at pulling a shard from its old owner and
+// installing it in node's group.
+func pullShard(node *RaftNode, exec GroupExecutor, pull pendingPull) {
+	leader := 0
+	result, err := executeOnGroup(exec, pull.gid, pull.servers, &leader, ShardPull{ConfigNum: pull.configNum, Shard: pull.shard}, time.Now().Add(2*ClientAttemptTimeout))
+	if err != nil {
+		node.logger(LogClient).Info("pulling shard failed", "shard", pull.shard, "config", pull.configNum, "from", pull.gid, "err", err)
+		return
+	}
+	data, ok := result.(ShardData)
+	if !ok || data.Err != "" {
+		node.logger(LogClient).Info("shard not handed over yet", "shard", pull.shard, "config", pull.configNum, "from", pull.gid, "result", result)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(node.ctx, 2*ClientAttemptTimeout)
+	defer cancel()
+	if _, err := node.SubmitCommand(ctx, ShardInstall{Data: data}); err == nil {
+		node.logger(LogClient).Info("installed shard", "shard", pull.shard, "config", pull.configNum, "from", pull.gid, "keys", len(data.KV))
+	}
+}
+
+func (this *ShardKV) pendingDeletes() []pendingPull {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return append([]pendingPull(nil), this.deleting...)
+}
+
+// deleteShard makes one attempt at having the old owner of a shard node's
+// group has installed drop its copy, and at recording that it did.
+func deleteShard(node *RaftNode, exec GroupExecutor, pull pendingPull) {
+	leader := 0
+	if _, err := executeOnGroup(exec, pull.gid, pull.servers, &leader, ShardDelete{ConfigNum: pull.configNum, Shard: pull.shard}, time.Now().Add(2*ClientAttemptTimeout)); err != nil {
+		node.logger(LogClient).Info("deleting shard failed", "shard", pull.shard, "config", pull.configNum, "from", pull.gid, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(node.ctx, 2*ClientAttemptTimeout)
+	defer cancel()
+	if _, err := node.SubmitCommand(ctx, ShardDeleted{ConfigNum: pull.configNum, Shard: pull.shard}); err == nil {
+		node.logger(LogClient).Info("deleted shard from its old owner", "shard", pull.shard, "config", pull.configNum, "from", pull.gid)
+	}
+}
@@ -0,0 +1,292 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// applyShardKV applies command to store as if it were committed next.
+func applyShardKV(t *testing.T, store *ShardKV, command interface{}) interface{} {
+	t.Helper()
+	return applyShardKVAt(t, store, command, time.Now())
+}
+
+// applyShardKVAt is applyShardKV for an entry stamped at.
+func applyShardKVAt(t *testing.T, store *ShardKV, command interface{}, at time.Time) interface{} {
+	t.Helper()
+	data, err := EncodeCommand(GobCodec, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.Apply(0, LogEntry{Command: data, Time: at.UnixNano()})
+}
+
+func TestShardKVHandOver(t *testing.T) {
+	controller := NewShardController()
+	join1 := applyController(t, controller, ShardJoin{Groups: map[int][]int{1: {0}}}).(ShardConfig)
+	join2 := applyController(t, controller, ShardJoin{Groups: map[int][]int{2: {1}}}).(ShardConfig)
+
+	old, gaining := NewShardKV(1, DefaultSessionTTL), NewShardKV(2, DefaultSessionTTL)
+	applyShardKV(t, old, ShardConfigUpdate{Config: join1})
+	applyShardKV(t, gaining, ShardConfigUpdate{Config: join1})
+
+	var key string
+	for _, candidate := range shardKeys() {
+		if join2.Shards[KeyShard(candidate)] == 2 {
+			key = candidate
+		}
+	}
+	client := &ClientSession{ClientId: 7}
+	appendA, _ := client.Next(GobCodec, KVCommand{Op: KVAppend, Key: key, Value: "a"})
+	if result := applyShardKV(t, old, appendA); result != (KVResult{}) {
+		t.Fatalf("append at the old owner: %v", result)
+	}
+
+	// The old owner is asked before it knows the shard has moved
+	pull := ShardPull{ConfigNum: join2.Num, Shard: KeyShard(key)}
+	if data := applyShardKV(t, old, pull).(ShardData); data.Err != KVErrShardNotReady {
+		t.Fatalf("early pull: got %+v", data)
+	}
+
+	applyShardKV(t, gaining, ShardConfigUpdate{Config: join2})
+	if result := applyShardKV(t, gaining, appendA); result != (KVResult{Err: KVErrShardNotReady}) {
+		t.Fatalf("request before the shard is in: got %v", result)
+	}
+	// Nor does the group move on while it waits
+	applyShardKV(t, gaining, ShardConfigUpdate{Config: ShardConfig{Num: join2.Num + 1, Groups: join2.Groups}})
+	if num := gaining.Config().Num; num != join2.Num {
+		t.Fatalf("moved on to config %d with a shard missing", num)
+	}
+
+	applyShardKV(t, old, ShardConfigUpdate{Config: join2})
+	if result := applyShardKV(t, old, appendA); result != (KVResult{Err: KVErrWrongGroup}) {
+		t.Fatalf("request at the old owner after the move: got %v", result)
+	}
+	data := applyShardKV(t, old, pull).(ShardData)
+	if data.Err != "" || data.KV[key] != "a" {
+		t.Fatalf("pull: got %+v", data)
+	}
+
+	applyShardKV(t, gaining, ShardInstall{Data: data})
+	applyShardKV(t, gaining, ShardInstall{Data: data}) // A duplicate changes nothing
+	// The retried append was applied before the move, and isn't again
+	if result := applyShardKV(t, gaining, appendA); result != (KVResult{}) {
+		t.Fatalf("retried append: got %v", result)
+	}
+	get, _ := client.Next(GobCodec, KVCommand{Op: KVGet, Key: key})
+	if result := applyShardKV(t, gaining, get); result != (KVResult{Value: "a", Found: true}) {
+		t.Fatalf("get at the new owner: got %v", result)
+	}
+
+	// The new owner has the old one drop its copy, once, then stops asking
+	deletes := gaining.pendingDeletes()
+	if len(deletes) != 1 || deletes[0].configNum != join2.Num || deletes[0].shard != pull.Shard || deletes[0].gid != 1 || len(deletes[0].servers) != 1 {
+		t.Fatalf("deletes pending after the install: %+v", deletes)
+	}
+	applyShardKV(t, old, ShardDelete{ConfigNum: join2.Num, Shard: pull.Shard})
+	applyShardKV(t, old, ShardDelete{ConfigNum: join2.Num, Shard: pull.Shard})
+	if old.outgoing[pull.Shard] != nil {
+		t.Fatalf("old owner kept shard %d after deleting it", pull.Shard)
+	}
+	if data := applyShardKV(t, old, pull).(ShardData); data.Err == "" {
+		t.Fatalf("pull after deleting: got %+v", data)
+	}
+	applyShardKV(t, gaining, ShardDeleted{ConfigNum: join2.Num, Shard: pull.Shard})
+	if deletes := gaining.pendingDeletes(); len(deletes) != 0 {
+		t.Fatalf("deletes pending after ShardDeleted: %+v", deletes)
+	}
+}
+
+// A late retry from a session the shard let expire is refused, not taken for
+// a new session's first request, by the shard's owner now and after a restart
+// or a move.
+func TestShardKVSessionExpired(t *testing.T) {
+	controller := NewShardController()
+	join1 := applyController(t, controller, ShardJoin{Groups: map[int][]int{1: {0}}}).(ShardConfig)
+	join2 := applyController(t, controller, ShardJoin{Groups: map[int][]int{2: {1}}}).(ShardConfig)
+	ttl := time.Minute
+	old, gaining := NewShardKV(1, ttl), NewShardKV(2, ttl)
+	start := time.Now()
+	applyShardKVAt(t, old, ShardConfigUpdate{Config: join1}, start)
+	applyShardKVAt(t, gaining, ShardConfigUpdate{Config: join1}, start)
+
+	var key string
+	for _, candidate := range shardKeys() {
+		if join2.Shards[KeyShard(candidate)] == 2 {
+			key = candidate
+		}
+	}
+	client, other := &ClientSession{ClientId: 7}, &ClientSession{ClientId: 8}
+	appendA, _ := client.Next(GobCodec, KVCommand{Op: KVAppend, Key: key, Value: "a"})
+	if result := applyShardKVAt(t, old, appendA, start); result != (KVResult{}) {
+		t.Fatalf("append: %v", result)
+	}
+	// Another client's request, long after, expires the first one's session
+	get, _ := other.Next(GobCodec, KVCommand{Op: KVGet, Key: key})
+	if result := applyShardKVAt(t, old, get, start.Add(2*ttl)); result != (KVResult{Value: "a", Found: true}) {
+		t.Fatalf("get: %v", result)
+	}
+	if result := applyShardKVAt(t, old, appendA, start.Add(2*ttl)); result != ErrSessionExpired {
+		t.Fatalf("retried append after its session expired: got %v", result)
+	}
+
+	snapshot, err := old.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewShardKV(1, ttl)
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if result := applyShardKVAt(t, restored, appendA, start.Add(2*ttl)); result != ErrSessionExpired {
+		t.Fatalf("retried append after a restore: got %v", result)
+	}
+
+	applyShardKVAt(t, old, ShardConfigUpdate{Config: join2}, start.Add(2*ttl))
+	applyShardKVAt(t, gaining, ShardConfigUpdate{Config: join2}, start.Add(2*ttl))
+	data := applyShardKVAt(t, old, ShardPull{ConfigNum: join2.Num, Shard: KeyShard(key)}, start.Add(2*ttl)).(ShardData)
+	applyShardKVAt(t, gaining, ShardInstall{Data: data}, start.Add(2*ttl))
+	if result := applyShardKVAt(t, gaining, appendA, start.Add(2*ttl)); result != ErrSessionExpired {
+		t.Fatalf("retried append after the shard moved: got %v", result)
+	}
+	get, _ = other.Next(GobCodec, KVCommand{Op: KVGet, Key: key})
+	if result := applyShardKVAt(t, gaining, get, start.Add(2*ttl)); result != (KVResult{Value: "a", Found: true}) {
+		t.Fatalf("get at the new owner: %v", result)
+	}
+}
+
+// A shard's history stays with its old owner: the new one reads it as of the
+// install, and not before.
+func TestShardKVInstallCompacted(t *testing.T) {
+	controller := NewShardController()
+	join1 := applyController(t, controller, ShardJoin{Groups: map[int][]int{1: {0}}}).(ShardConfig)
+	join2 := applyController(t, controller, ShardJoin{Groups: map[int][]int{2: {1}}}).(ShardConfig)
+	gaining := NewShardKV(2, DefaultSessionTTL)
+	applyShardKV(t, gaining, ShardConfigUpdate{Config: join1})
+	applyShardKV(t, gaining, ShardConfigUpdate{Config: join2})
+
+	var key string
+	for _, candidate := range shardKeys() {
+		if join2.Shards[KeyShard(candidate)] == 2 {
+			key = candidate
+		}
+	}
+	const installedAt = 5
+	install, err := EncodeCommand(GobCodec, ShardInstall{Data: ShardData{ConfigNum: join2.Num, Shard: KeyShard(key), KV: map[string]string{key: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaining.Apply(installedAt, LogEntry{Command: install, Time: time.Now().UnixNano()})
+
+	store := gaining.shards[KeyShard(key)].store
+	if result := store.readRange(KVRange{Key: key, Revision: installedAt - 1}); result.Err != KVErrCompacted {
+		t.Fatalf("read from before the install: got %+v, want %q", result, KVErrCompacted)
+	}
+	result := store.readRange(KVRange{Key: key, Revision: installedAt})
+	if result.Err != "" || len(result.KVs) != 1 || result.KVs[0].Value != "a" || result.KVs[0].ModRevision != installedAt {
+		t.Fatalf("read as of the install: got %+v", result)
+	}
+}
+
+// awaitShardsDeleted waits until no member of the groups still holds shards
+// it has handed over, or is waiting to have them deleted.
+func awaitShardsDeleted(t *testing.T, cluster *Cluster, groups map[int][]int) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for gid, members := range groups {
+		for _, id := range members {
+			store := cluster.getServers()[id].Group(gid).stateMachine.(*ShardKV)
+			for {
+				store.mu.Lock()
+				outgoing, deleting := len(store.outgoing), len(store.deleting)
+				store.mu.Unlock()
+				if outgoing == 0 && deleting == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("group %d on server %d holds %d handed over shards, and is deleting %d", gid, id, outgoing, deleting)
+				}
+				sleepMs(100)
+			}
+		}
+	}
+}
+
+// appendAll appends value to every key at once, with a clerk per key that
+// retries for up to timeout.
+func appendAll(cluster *Cluster, keys []string, value string, timeout time.Duration) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- forEachKey(cluster, keys, func(clerk *ShardClerk, key string) error {
+			clerk.Timeout = timeout
+			return clerk.Append(key, value)
+		})
+	}()
+	return done
+}
+
+func checkValues(t *testing.T, cluster *Cluster, keys []string, want string) {
+	t.Helper()
+	err := forEachKey(cluster, keys, func(clerk *ShardClerk, key string) error {
+		clerk.Timeout = 30 * time.Second
+		value, err := clerk.Get(key)
+		if err == nil && value != want {
+			err = fmt.Errorf("got %q, want %q", value, want)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardMigrationDuringPartitions(t *testing.T) {
+	// The controller and group 1 share servers 0-2; group 2 is on 3-5
+	groups := map[int][]int{1: {0, 1, 2}, 2: {3, 4, 5}}
+	cluster := newShardCluster(t, 6, []int{0, 1, 2}, groups, 1)
+	defer cluster.Shutdown()
+	ctrl := cluster.NewControllerClerk()
+	keys := shardKeys()
+
+	if err := <-appendAll(cluster, keys, "a", ShardClerkTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// Group 2 joins while cut off from group 1 and the controller, so it can
+	// neither learn that it has been given shards nor pull them. Requests for
+	// those shards wait until the partition heals.
+	cluster.PartitionPeers([]int{3, 4, 5})
+	if err := ctrl.Join(map[int][]int{2: {3, 4, 5}}); err != nil {
+		t.Fatal(err)
+	}
+	appended := appendAll(cluster, keys, "b", 60*time.Second)
+	sleepMs(5000)
+	cluster.HealAll()
+	if err := <-appended; err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, cluster, keys, "ab")
+
+	// Group 1 leaves while one of its servers, a controller too, is cut off;
+	// the majorities carry on and group 2 pulls every shard group 1 had
+	cluster.PartitionPeers([]int{0})
+	if err := ctrl.Leave(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-appendAll(cluster, keys, "c", 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cluster.HealAll()
+	checkValues(t, cluster, keys, "abc")
+
+	config, err := ctrl.Query(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Shards != ([NShards]int{2, 2, 2, 2, 2, 2, 2, 2, 2, 2}) {
+		t.Fatalf("shards after group 1 left: %v", config.Shards)
+	}
+	// Group 1's copies are gone too
+	awaitShardsDeleted(t, cluster, groups)
+}
@@ -0,0 +1,316 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// HardState is the part of Figure 2's persistent state that isn't the log.
+type HardState struct {
+	CurrentTerm int
+	VotedFor    int
+}
+
+// Storage keeps a node's persistent state across restarts. Every method must
+// have made its change durable by the time it returns, since the node acts on
+// it (votes, acknowledges entries) right afterwards; FileStorage can be told
+// to cut that corner.
+type Storage interface {
+	// Load returns the hard state and the log entries after the latest
+	// snapshot, the first of them at index Snapshot().LastIncludedIndex+1; a
+	// fresh Storage returns HardState{0, -1} and an empty log.
+	Load() (HardState, []LogEntry, error)
+	SaveHardState(state HardState) error
+	// AppendEntries stores entries at log indexes index, index+1, ..., first
+	// dropping any stored entries from index onwards. Those the snapshot
+	// covers are skipped: they're committed, so already in it.
+	AppendEntries(index int, entries []LogEntry) error
+	// Snapshot returns the latest snapshot, or LastIncludedIndex -1 and no
+	// data if there is none.
+	Snapshot() (SnapshotMeta, []byte, error)
+	// SaveSnapshot stores a snapshot and drops the log entries it covers, all
+	// of them if the log ends before meta.LastIncludedIndex.
+	SaveSnapshot(meta SnapshotMeta, data []byte) error
+	Close() error
+}
+
+/* MemoryStorage */
+
+// MemoryStorage keeps state in memory only; it survives a RaftNode being
+// killed and replaced within the same process, which is what the Cluster
+// harness uses to simulate crashes.
+type MemoryStorage struct {
+	mu       sync.Mutex
+	state    HardState
+	snapshot SnapshotMeta
+	data     []byte
+	log      []LogEntry // Starting at index snapshot.LastIncludedIndex+1
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{state: HardState{CurrentTerm: 0, VotedFor: -1}, snapshot: noSnapshot}
+}
+
+func (this *MemoryStorage) Load() (HardState, []LogEntry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.state, append([]LogEntry(nil), this.log...), nil
+}
+
+func (this *MemoryStorage) SaveHardState(state HardState) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.state = state
+	return nil
+}
+
+func (this *MemoryStorage) AppendEntries(index int, entries []LogEntry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	index, entries = skipCovered(this.snapshot, index, entries)
+	first := this.snapshot.LastIncludedIndex + 1
+	if index > first+len(this.log) {
+		return fmt.Errorf("storage: appending at index %d to a log of [%d, %d)", index, first, first+len(this.log))
+	}
+	this.log = append(append([]LogEntry(nil), this.log[:index-first]...), entries...)
+	return nil
+}
+
+func (this *MemoryStorage) Snapshot() (SnapshotMeta, []byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.snapshot, this.data, nil
+}
+
+func (this *MemoryStorage) SaveSnapshot(meta SnapshotMeta, data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	covered := meta.LastIncludedIndex - this.snapshot.LastIncludedIndex
+	if covered <= 0 {
+		return nil
+	}
+	if covered < len(this.log) {
+		this.log = append([]LogEntry(nil), this.log[covered:]...)
+	} else {
+		this.log = nil
+	}
+	this.snapshot, this.data = meta, data
+	return nil
+}
+
+func (this *MemoryStorage) Close() error {
+	return nil
+}
+
+// skipCovered drops the entries snapshot covers from those to be appended at
+// index.
+func skipCovered(snapshot SnapshotMeta, index int, entries []LogEntry) (int, []LogEntry) {
+	if covered := snapshot.LastIncludedIndex + 1 - index; covered > 0 {
+		return snapshot.LastIncludedIndex + 1, entries[min(covered, len(entries)):]
+	}
+	return index, entries
+}
+
+/* FileStorage */
+
+// FileStorage keeps the log in a WAL in dir/wal, and currentTerm and votedFor
+// in dir/state, a small gob file rewritten (to a temporary file, fsynced, then
+// renamed over the old one, and dir fsynced) whenever they change. Snapshots
+// are written the same way to dir/snapshots, and the WAL is compacted once
+// the snapshot is in place. With a SyncPolicy other than SyncAlways, a crash
+// may lose the last few changes.
+type FileStorage struct {
+	mu          sync.Mutex
+	statePath   string
+	snapshotDir string
+	policy      SyncPolicy
+	state       HardState
+	snapshot    SnapshotMeta
+	wal         *WAL
+}
+
+func NewFileStorage(dir string, policy SyncPolicy) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	this := &FileStorage{
+		statePath:   filepath.Join(dir, "state"),
+		snapshotDir: filepath.Join(dir, "snapshots"),
+		policy:      policy,
+		state:       HardState{CurrentTerm: 0, VotedFor: -1},
+		snapshot:    noSnapshot,
+	}
+
+	f, err := os.Open(this.statePath)
+	if err == nil {
+		// Decoded into a zero HardState, as gob leaves out zero fields: a
+		// vote for node 0 would otherwise read back as the default of -1
+		var state HardState
+		if err = gob.NewDecoder(f).Decode(&state); err == nil {
+			this.state = state
+		}
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", this.statePath, err)
+	}
+
+	if meta, _, ok, err := LatestSnapshot(this.snapshotDir); err != nil {
+		return nil, err
+	} else if ok {
+		this.snapshot = meta
+	}
+
+	if this.wal, err = OpenWAL(filepath.Join(dir, "wal"), policy); err != nil {
+		return nil, err
+	}
+	// In case we crashed between saving the last snapshot and compacting
+	if err := this.wal.Compact(this.snapshot.LastIncludedIndex + 1); err != nil {
+		this.wal.Close()
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *FileStorage) Load() (HardState, []LogEntry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	entries, err := this.wal.Entries()
+	if err != nil {
+		return this.state, nil, err
+	}
+	// The WAL only drops whole segments, so it may start before the snapshot ends
+	if covered := this.snapshot.LastIncludedIndex + 1 - this.wal.First(); covered > 0 {
+		entries = entries[min(covered, len(entries)):]
+	}
+	return this.state, entries, nil
+}
+
+func (this *FileStorage) SaveHardState(state HardState) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	err := writeFileAtomic(this.statePath, this.policy, func(w io.Writer) error { return gob.NewEncoder(w).Encode(state) })
+	if err != nil {
+		return err
+	}
+	this.state = state
+	return nil
+}
+
+// writeFileAtomic has write fill a temporary file, which then replaces path;
+// unless policy is SyncNone, the file and the rename are fsynced.
+func writeFileAtomic(path string, policy SyncPolicy, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if policy != SyncNone {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// The rename itself is only durable once the directory is
+	if policy != SyncNone {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+func (this *FileStorage) AppendEntries(index int, entries []LogEntry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	index, entries = skipCovered(this.snapshot, index, entries)
+	return this.wal.Append(index, entries)
+}
+
+func (this *FileStorage) Snapshot() (SnapshotMeta, []byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.snapshot.LastIncludedIndex < 0 {
+		return this.snapshot, nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(this.snapshotDir, this.snapshot.fileName()))
+	return this.snapshot, data, err
+}
+
+// SaveSnapshot writes the snapshot out in full before compacting the WAL, so
+// that a crash in between leaves both, never neither.
+func (this *FileStorage) SaveSnapshot(meta SnapshotMeta, data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if meta.LastIncludedIndex <= this.snapshot.LastIncludedIndex {
+		return nil
+	}
+	if err := os.MkdirAll(this.snapshotDir, 0755); err != nil {
+		return err
+	}
+	name := meta.fileName()
+	path := filepath.Join(this.snapshotDir, name)
+	if meta.Members != nil {
+		if err := writeSnapshotMembers(path, this.policy, meta.Members); err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(path, this.policy, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	this.snapshot = meta
+	if err := removeSnapshotFiles(this.snapshotDir, func(other string) bool { return other != name && other != name+membersExt }); err != nil {
+		return err
+	}
+	return this.wal.Compact(meta.LastIncludedIndex + 1)
+}
+
+func (this *FileStorage) Close() error {
+	return this.wal.Close()
+}
+
+/* RaftNode persistence */
+
+// persistHardState writes currentTerm and votedFor if they changed since they
+// were last written. A node that can't persist mustn't carry on.
+// Expects this.mu to be held.
+func (this *RaftNode) persistHardState() {
+	state := HardState{CurrentTerm: this.currentTerm, VotedFor: this.votedFor}
+	if this.storage == nil || state == this.persistedHardState {
+		return
+	}
+	if err := this.storage.SaveHardState(state); err != nil {
+		log.Fatalf("node %d: persisting hard state: %v", this.id, err)
+	}
+	this.persistedHardState = state
+}
+
+// persistEntries writes the log from index onwards. Expects this.mu to be held.
+func (this *RaftNode) persistEntries(index int) {
+	this.logWrites++
+	if this.storage == nil {
+		return
+	}
+	if err := this.storage.AppendEntries(index, this.entries(index, this.lastIndex()+1)); err != nil {
+		log.Fatalf("node %d: persisting log entries from index %d: %v", this.id, index, err)
+	}
+}
@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func checkStorage(t *testing.T, storage Storage, wantState HardState, wantLog []LogEntry) {
+	t.Helper()
+	state, log, err := storage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != wantState || len(log) != len(wantLog) || len(log) > 0 && !reflect.DeepEqual(log, wantLog) {
+		t.Fatalf("loaded %+v %v, want %+v %v", state, log, wantState, wantLog)
+	}
+}
+
+func TestFileStorageReload(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatched, SyncNone} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			storage, err := NewFileStorage(dir, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStorage(t, storage, HardState{CurrentTerm: 0, VotedFor: -1}, nil)
+
+			state := HardState{CurrentTerm: 3, VotedFor: 2}
+			log := append(walTestEntries(0, 5, 1), walTestEntries(5, 8, 3)...)
+			if err := storage.SaveHardState(HardState{CurrentTerm: 2, VotedFor: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.SaveHardState(state); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.AppendEntries(0, walTestEntries(0, 7, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.AppendEntries(5, log[5:]); err != nil {
+				t.Fatal(err)
+			}
+			checkStorage(t, storage, state, log)
+			if err := storage.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Everything is read back, and no temporary state file is left behind
+			storage, err = NewFileStorage(dir, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			checkStorage(t, storage, state, log)
+			if _, err := os.Stat(filepath.Join(dir, "state.tmp")); !os.IsNotExist(err) {
+				t.Fatalf("state.tmp: %v", err)
+			}
+		})
+	}
+}
+
+// A node restarted on the same FileStorage picks up where it left off.
+func TestFileStorageRestoresNode(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *FileStorage {
+		storage, err := NewFileStorage(dir, SyncAlways)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+	storage := open()
+	state := HardState{CurrentTerm: 4, VotedFor: 0}
+	log := walTestEntries(0, 3, 4)
+	if err := storage.SaveHardState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AppendEntries(0, log); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	storage = open()
+	defer storage.Close()
+	server := NewServer(0, []int{1, 2}, make(chan interface{}), 0)
+	node := NewRaftNode(0, DefaultGroup, []int{1, 2}, server, GroupConfig{Storage: storage, TracePath: filepath.Join(dir, "applied")}, make(chan interface{}))
+	defer node.KillNode()
+	if s := node.Status(); s.Term != 4 || s.VotedFor != 0 || s.LastLogIndex != 2 || s.LastLogTerm != 4 {
+		t.Fatalf("restored node: %+v", s)
+	}
+}
+
+// Saving a snapshot drops the entries it covers, keeping those after it, or
+// all of them if the log ends before the snapshot does.
+func TestStorageSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	storages := map[string]func() Storage{
+		"memory": func() Storage { return NewMemoryStorage() },
+		"file": func() Storage {
+			storage, err := NewFileStorage(dir, SyncAlways)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return storage
+		},
+	}
+	for name, open := range storages {
+		t.Run(name, func(t *testing.T) {
+			storage := open()
+			state := HardState{CurrentTerm: 2, VotedFor: 1}
+			log := walTestEntries(0, 10, 2)
+			if err := storage.SaveHardState(state); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.AppendEntries(0, log); err != nil {
+				t.Fatal(err)
+			}
+			if meta, data, err := storage.Snapshot(); err != nil || !reflect.DeepEqual(meta, noSnapshot) || data != nil {
+				t.Fatalf("Snapshot() = %+v, %q, %v before one was saved", meta, data, err)
+			}
+
+			meta := SnapshotMeta{LastIncludedIndex: 5, LastIncludedTerm: 2, Members: []int{0, 1, 3}}
+			if err := storage.SaveSnapshot(meta, []byte("up to 5")); err != nil {
+				t.Fatal(err)
+			}
+			// An older one is ignored
+			if err := storage.SaveSnapshot(SnapshotMeta{LastIncludedIndex: 3, LastIncludedTerm: 2}, []byte("up to 3")); err != nil {
+				t.Fatal(err)
+			}
+			checkStorageSnapshot(t, storage, meta, "up to 5")
+			checkStorage(t, storage, state, log[6:])
+			// Entries the snapshot covers are skipped
+			if err := storage.AppendEntries(4, log[4:]); err != nil {
+				t.Fatal(err)
+			}
+			checkStorage(t, storage, state, log[6:])
+			if err := storage.AppendEntries(8, walTestEntries(8, 9, 3)); err != nil {
+				t.Fatal(err)
+			}
+			log = append(log[:8:8], walTestEntries(8, 9, 3)...)
+
+			if name == "file" {
+				storage.Close()
+				storage = open()
+				checkStorageSnapshot(t, storage, meta, "up to 5")
+				checkStorage(t, storage, state, log[6:])
+			}
+
+			// One past the end of the log leaves it empty, carrying on after it
+			meta = SnapshotMeta{LastIncludedIndex: 20, LastIncludedTerm: 4, Members: []int{0, 3}}
+			if err := storage.SaveSnapshot(meta, []byte("up to 20")); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.AppendEntries(21, walTestEntries(21, 22, 4)); err != nil {
+				t.Fatal(err)
+			}
+			if name == "file" {
+				storage.Close()
+				storage = open()
+			}
+			defer storage.Close()
+			checkStorageSnapshot(t, storage, meta, "up to 20")
+			checkStorage(t, storage, state, walTestEntries(21, 22, 4))
+		})
+	}
+}
+
+func checkStorageSnapshot(t *testing.T, storage Storage, want SnapshotMeta, wantData string) {
+	t.Helper()
+	meta, data, err := storage.Snapshot()
+	if err != nil || !reflect.DeepEqual(meta, want) || string(data) != wantData {
+		t.Fatalf("Snapshot() = %+v, %q, %v; want %+v, %q", meta, data, err, want, wantData)
+	}
+}
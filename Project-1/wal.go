@@ -0,0 +1,555 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy says when a WAL fsyncs what it has written.
+type SyncPolicy int
+
+const (
+	SyncAlways  SyncPolicy = iota // Before every write returns
+	SyncBatched                   // Every WALBatchInterval, so a crash can lose the last few writes
+	SyncNone                      // Only on Close; the OS decides otherwise
+)
+
+func (this SyncPolicy) String() string {
+	switch this {
+	case SyncAlways:
+		return "always"
+	case SyncBatched:
+		return "batched"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(this))
+}
+
+// ParseSyncPolicy is the inverse of SyncPolicy.String.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatched, SyncNone} {
+		if s == policy.String() {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q (want always, batched or none)", s)
+}
+
+const (
+	WALSegmentSize   = 16 << 20 // A new segment is started once the current one is this big
+	WALBatchInterval = 10 * time.Millisecond
+
+	walSegmentExt    = ".wal"
+	walHeaderSize    = 8       // Length and checksum
+	walMaxRecordSize = 1 << 30 // Anything longer is taken to be garbage
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL is an append-only log of LogEntries kept in segment files named after
+// the index of their first entry (0000000000000000.wal, ...). Each entry is one
+// record:
+//
+//	length  uint32, little endian, of the payload
+//	crc     uint32, CRC-32C of the payload
+//	payload uint64 log index, then the gob encoded LogEntry
+//
+// Where each entry lives is kept in memory, so reading any index costs a
+// single read.
+type WAL struct {
+	mu     sync.Mutex
+	dir    string
+	policy SyncPolicy
+
+	segments  []*walSegment // In log order; appends go to the last one
+	first     int           // Index of the first entry; more than 0 once compacted
+	positions []walPosition // positions[i] is where log index first+i is
+	dirty     bool          // Written to since the last fsync
+
+	stop chan struct{} // Closed on Close, to stop batched syncing
+	done chan struct{}
+}
+
+type walSegment struct {
+	firstIndex int
+	file       *os.File
+	size       int64
+}
+
+type walPosition struct {
+	segment *walSegment
+	offset  int64 // Of the record's header
+	length  int   // Of the payload
+}
+
+// OpenWAL opens the WAL in dir, creating dir if need be, and reads the
+// position of every record in it.
+func OpenWAL(dir string, policy SyncPolicy) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	this := &WAL{dir: dir, policy: policy, stop: make(chan struct{}), done: make(chan struct{})}
+
+	names, err := walSegmentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		firstIndex, err := walSegmentIndex(name)
+		if err != nil {
+			this.closeFiles()
+			return nil, err
+		}
+		if i == 0 {
+			this.first = firstIndex // Entries before it were compacted away
+		} else if firstIndex > this.end() {
+			if err := this.removeAfterGap(names[i:]); err != nil {
+				this.closeFiles()
+				return nil, err
+			}
+			break
+		}
+		if err := this.openSegment(name, i == len(names)-1); err != nil {
+			this.closeFiles()
+			return nil, err
+		}
+	}
+
+	if policy == SyncBatched {
+		go this.syncPeriodically()
+	} else {
+		close(this.done)
+	}
+	return this, nil
+}
+
+// walSegmentNames returns the segment files in dir, in log order.
+func walSegmentNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), walSegmentExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names) // Zero padded, so lexical order is log order
+	return names, nil
+}
+
+func walSegmentName(firstIndex int) string {
+	return fmt.Sprintf("%016d%s", firstIndex, walSegmentExt)
+}
+
+// walSegmentIndex returns the index of the first entry of a segment, from its name.
+func walSegmentIndex(name string) (int, error) {
+	var firstIndex int
+	if _, err := fmt.Sscanf(name, "%016d"+walSegmentExt, &firstIndex); err != nil {
+		return 0, fmt.Errorf("wal: bad segment name %s", name)
+	}
+	return firstIndex, nil
+}
+
+// removeAfterGap removes the segments a truncate didn't get to remove before
+// a crash: those after the first one that doesn't start where the log ends.
+func (this *WAL) removeAfterGap(names []string) error {
+	walLogger.Warn("removing segments left by an interrupted truncation", "dir", this.dir, "index", this.end(), "segments", names)
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := os.Remove(filepath.Join(this.dir, names[i])); err != nil {
+			return err
+		}
+	}
+	return syncDir(this.dir)
+}
+
+// openSegment scans an existing segment and appends it to this.segments. A
+// torn record at the end of the last segment, left by a crash mid-write, is
+// cut off; anything else that fails its checksum is a WALCorruptionError.
+func (this *WAL) openSegment(name string, last bool) error {
+	firstIndex, err := walSegmentIndex(name)
+	if err != nil {
+		return err
+	}
+	if firstIndex != this.end() {
+		return fmt.Errorf("wal: segment %s should start at index %d", name, this.end())
+	}
+
+	f, err := os.OpenFile(filepath.Join(this.dir, name), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	segment := &walSegment{firstIndex: firstIndex, file: f}
+	this.segments = append(this.segments, segment)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	scan := scanWALSegment(data, firstIndex)
+	for _, position := range scan.positions {
+		position.segment = segment
+		this.positions = append(this.positions, position)
+	}
+	segment.size = scan.validSize
+	if scan.err == nil {
+		return nil
+	}
+	if !last || !scan.torn {
+		return &WALCorruptionError{Segment: filepath.Join(this.dir, name), Offset: scan.validSize, Index: this.end(), Err: scan.err}
+	}
+
+	walLogger.Warn("truncating torn record at the end of the WAL", "segment", f.Name(), "offset", scan.validSize, "index", this.end(), "bytes", int64(len(data))-scan.validSize, "err", scan.err)
+	if err := f.Truncate(scan.validSize); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// decodeWALRecordHeader checks the record at the start of data and returns its
+// log index and payload length.
+func decodeWALRecordHeader(data []byte) (index int, length int, err error) {
+	if len(data) < walHeaderSize {
+		return 0, 0, fmt.Errorf("short record header")
+	}
+	length = int(binary.LittleEndian.Uint32(data[0:4]))
+	if length < 8 || length > walMaxRecordSize {
+		return 0, 0, fmt.Errorf("bad record length %d", length)
+	}
+	if len(data) < walHeaderSize+length {
+		return 0, 0, fmt.Errorf("record of length %d runs past the end of the file", length)
+	}
+	payload := data[walHeaderSize : walHeaderSize+length]
+	if crc32.Checksum(payload, walCRCTable) != binary.LittleEndian.Uint32(data[4:8]) {
+		return 0, 0, fmt.Errorf("checksum mismatch")
+	}
+	return int(binary.LittleEndian.Uint64(payload[0:8])), length, nil
+}
+
+func encodeWALRecord(buf *bytes.Buffer, index int, entry LogEntry) error {
+	start := buf.Len()
+	var header [walHeaderSize + 8]byte
+	binary.LittleEndian.PutUint64(header[walHeaderSize:], uint64(index))
+	buf.Write(header[:])
+	if err := gob.NewEncoder(buf).Encode(&entry); err != nil {
+		return err
+	}
+
+	record := buf.Bytes()[start:]
+	payload := record[walHeaderSize:]
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCRCTable))
+	return nil
+}
+
+// Len returns one past the last index in the log.
+func (this *WAL) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.end()
+}
+
+// First returns the index of the first entry in the log: 0, unless it has
+// been compacted.
+func (this *WAL) First() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.first
+}
+
+func (this *WAL) end() int {
+	return this.first + len(this.positions)
+}
+
+// Entry reads the entry at index.
+func (this *WAL) Entry(index int) (LogEntry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.entry(index)
+}
+
+// Entries reads the whole log, from First on.
+func (this *WAL) Entries() ([]LogEntry, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	entries := make([]LogEntry, len(this.positions))
+	for i := range entries {
+		var err error
+		if entries[i], err = this.entry(this.first + i); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (this *WAL) entry(index int) (LogEntry, error) {
+	if index < this.first || index >= this.end() {
+		return LogEntry{}, fmt.Errorf("wal: index %d out of range [%d, %d)", index, this.first, this.end())
+	}
+	position := this.positions[index-this.first]
+	record := make([]byte, walHeaderSize+position.length)
+	if _, err := position.segment.file.ReadAt(record, position.offset); err != nil {
+		return LogEntry{}, err
+	}
+	if _, _, err := decodeWALRecordHeader(record); err != nil {
+		return LogEntry{}, fmt.Errorf("wal: index %d: %v", index, err)
+	}
+
+	var entry LogEntry
+	err := gob.NewDecoder(bytes.NewReader(record[walHeaderSize+8:])).Decode(&entry)
+	return entry, err
+}
+
+// Append writes entries at indexes index, index+1, ..., first truncating the
+// log to index entries if it's longer.
+func (this *WAL) Append(index int, entries []LogEntry) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if index > this.end() {
+		return fmt.Errorf("wal: appending at index %d would leave a gap after %d", index, this.end()-1)
+	}
+	if index < this.first {
+		return fmt.Errorf("wal: appending at index %d, before the first entry %d", index, this.first)
+	}
+	if index < this.end() {
+		if err := this.truncate(index); err != nil {
+			return err
+		}
+	}
+
+	for len(entries) > 0 {
+		segment, err := this.segmentForAppend()
+		if err != nil {
+			return err
+		}
+
+		// Fill the segment up to WALSegmentSize, but always with at least one entry
+		var buf bytes.Buffer
+		var positions []walPosition
+		for len(entries) > 0 && (len(positions) == 0 || segment.size+int64(buf.Len()) < WALSegmentSize) {
+			offset := buf.Len()
+			if err := encodeWALRecord(&buf, index, entries[0]); err != nil {
+				return err
+			}
+			positions = append(positions, walPosition{segment: segment, offset: segment.size + int64(offset), length: buf.Len() - offset - walHeaderSize})
+			index++
+			entries = entries[1:]
+		}
+
+		if _, err := segment.file.WriteAt(buf.Bytes(), segment.size); err != nil {
+			return err
+		}
+		segment.size += int64(buf.Len())
+		this.positions = append(this.positions, positions...)
+		this.dirty = true
+	}
+
+	if this.policy == SyncAlways {
+		return this.sync()
+	}
+	return nil
+}
+
+// segmentForAppend returns the last segment, starting a new one first if
+// there is none or it's full.
+func (this *WAL) segmentForAppend() (*walSegment, error) {
+	if n := len(this.segments); n > 0 && this.segments[n-1].size < WALSegmentSize {
+		return this.segments[n-1], nil
+	}
+
+	// Whatever went into the full segment must be durable before we move on
+	if this.policy != SyncNone {
+		if err := this.sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(this.dir, walSegmentName(this.end())), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	segment := &walSegment{firstIndex: this.end(), file: f}
+	this.segments = append(this.segments, segment)
+	if this.policy != SyncNone {
+		if err := syncDir(this.dir); err != nil {
+			return nil, err
+		}
+	}
+	return segment, nil
+}
+
+// Truncate drops the entries from index onwards.
+func (this *WAL) Truncate(index int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if index >= this.end() {
+		return nil
+	}
+	if index < this.first {
+		return fmt.Errorf("wal: truncating at index %d, before the first entry %d", index, this.first)
+	}
+	if err := this.truncate(index); err != nil {
+		return err
+	}
+	if this.policy == SyncAlways {
+		return this.sync()
+	}
+	return nil
+}
+
+// truncate cuts the segment index is in short, then removes the later
+// segments, last one first. A crash partway through leaves the log at index
+// followed by a gap and the segments not yet removed, which OpenWAL removes;
+// never a hole in the middle of the log.
+func (this *WAL) truncate(index int) error {
+	position := this.positions[index-this.first]
+
+	// Later segments go entirely, as does this one if index is its first entry
+	keep := len(this.segments)
+	for keep > 0 && this.segments[keep-1].firstIndex >= index {
+		keep--
+	}
+	if position.segment.firstIndex < index {
+		if err := position.segment.file.Truncate(position.offset); err != nil {
+			return err
+		}
+		position.segment.size = position.offset
+		this.dirty = true
+	}
+	this.positions = this.positions[:index-this.first]
+
+	removed := this.segments[keep:]
+	this.segments = this.segments[:keep]
+	for i := len(removed) - 1; i >= 0; i-- {
+		removed[i].file.Close()
+		if err := os.Remove(removed[i].file.Name()); err != nil {
+			for _, segment := range removed[:i] {
+				segment.file.Close()
+			}
+			return err
+		}
+	}
+	if len(removed) > 0 && this.policy != SyncNone {
+		return syncDir(this.dir)
+	}
+	return nil
+}
+
+// Compact drops the entries before index, which a snapshot now covers. Only
+// whole segments are removed, so First may stay below index; if index is past
+// the end of the log, the log is emptied and carries on from index. Segments
+// are removed first to last, so a crash partway leaves a shorter log.
+func (this *WAL) Compact(index int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if index <= this.first {
+		return nil
+	}
+	if len(this.segments) == 0 {
+		this.first = index
+		return nil
+	}
+
+	drop := len(this.segments)
+	if index < this.end() {
+		for drop = 0; drop+1 < len(this.segments) && this.segments[drop+1].firstIndex <= index; drop++ {
+		}
+	}
+	for _, segment := range this.segments[:drop] {
+		segment.file.Close()
+		this.segments = this.segments[1:]
+		if len(this.segments) == 0 {
+			this.first, this.positions = index, nil
+		} else {
+			this.positions = this.positions[this.segments[0].firstIndex-this.first:]
+			this.first = this.segments[0].firstIndex
+		}
+		if err := os.Remove(segment.file.Name()); err != nil {
+			return err
+		}
+	}
+	if drop > 0 && this.policy != SyncNone {
+		return syncDir(this.dir)
+	}
+	return nil
+}
+
+// Sync fsyncs anything written since the last fsync, whatever the policy.
+func (this *WAL) Sync() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.sync()
+}
+
+func (this *WAL) sync() error {
+	if !this.dirty || len(this.segments) == 0 {
+		return nil
+	}
+	// Earlier segments were synced when the last one was started
+	if err := this.segments[len(this.segments)-1].file.Sync(); err != nil {
+		return err
+	}
+	this.dirty = false
+	return nil
+}
+
+func (this *WAL) syncPeriodically() {
+	defer close(this.done)
+	ticker := time.NewTicker(WALBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.mu.Lock()
+			err := this.sync()
+			this.mu.Unlock()
+			if err != nil {
+				log.Fatalf("wal: fsync of %s failed, entries may be lost: %v", this.dir, err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the WAL.
+func (this *WAL) Close() error {
+	close(this.stop)
+	<-this.done
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	err := this.sync()
+	this.closeFiles()
+	return err
+}
+
+func (this *WAL) closeFiles() {
+	for _, segment := range this.segments {
+		segment.file.Close()
+	}
+}
+
+// syncDir fsyncs a directory, making file creations and removals in it durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
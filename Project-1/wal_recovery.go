@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var walLogger = defaultLogging.Logger(LogStorage)
+
+// WALCorruptionError is returned by OpenWAL when a record fails its checksum
+// somewhere other than at the very end of the log. Unlike a torn final write,
+// that can't be fixed by dropping the record: entries after it, which this
+// node may have acknowledged to a leader, would go with it.
+type WALCorruptionError struct {
+	Segment string
+	Offset  int64 // Of the bad record
+	Index   int   // Log index the bad record should have held
+	Err     error
+}
+
+func (this *WALCorruptionError) Error() string {
+	return fmt.Sprintf("wal: corrupt record for index %d in %s at offset %d: %v (inspect with raft-wal verify)", this.Index, this.Segment, this.Offset, this.Err)
+}
+
+func (this *WALCorruptionError) Unwrap() error {
+	return this.Err
+}
+
+// walScan is what scanWALSegment found in a segment.
+type walScan struct {
+	positions []walPosition // Of the valid records, without their segment
+	validSize int64         // Bytes up to the end of the last valid record
+	err       error         // Why the record at validSize is bad, if there is one
+	torn      bool          // Whether nothing valid follows the bad record
+}
+
+// scanWALSegment reads records from data until the first bad one.
+func scanWALSegment(data []byte, firstIndex int) walScan {
+	var scan walScan
+	for scan.validSize < int64(len(data)) {
+		index, length, err := decodeWALRecordHeader(data[scan.validSize:])
+		if err == nil && index != firstIndex+len(scan.positions) {
+			err = fmt.Errorf("found index %d, expected %d", index, firstIndex+len(scan.positions))
+		}
+		if err != nil {
+			scan.err = err
+			scan.torn = !walHasRecordAfter(data, scan.validSize)
+			break
+		}
+		scan.positions = append(scan.positions, walPosition{offset: scan.validSize, length: length})
+		scan.validSize += int64(walHeaderSize + length)
+	}
+	return scan
+}
+
+// walHasRecordAfter reports whether a valid record starts anywhere after
+// offset. A write torn by a crash leaves garbage only at the end of the file,
+// whereas a flipped bit leaves valid records behind the bad one (even when
+// it's the length that got flipped, hiding where the next record starts).
+func walHasRecordAfter(data []byte, offset int64) bool {
+	for i := offset + 1; i+walHeaderSize < int64(len(data)); i++ {
+		if _, _, err := decodeWALRecordHeader(data[i:]); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// WALSegmentReport describes one segment file, as found by VerifyWAL.
+type WALSegmentReport struct {
+	Name       string
+	FirstIndex int
+	Records    int
+	Size       int64
+	ValidSize  int64
+	Err        error // First bad record, if any
+	Torn       bool  // The bad record is a torn final write, which OpenWAL truncates
+	Stale      bool  // Left behind by an interrupted truncation, which OpenWAL removes
+}
+
+// WALReport is the outcome of VerifyWAL.
+type WALReport struct {
+	Segments []WALSegmentReport
+	Entries  int   // Readable entries, up to the first problem
+	Err      error // Nil if the WAL is intact or only has a torn tail
+}
+
+// VerifyWAL checks every record of the WAL in dir without changing anything.
+func VerifyWAL(dir string) (*WALReport, error) {
+	names, err := walSegmentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &WALReport{}
+	stale := false
+	next := 0 // Index the next segment should start at
+	for i, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		segment := WALSegmentReport{Name: name, Size: int64(len(data))}
+		if _, err := fmt.Sscanf(name, "%016d"+walSegmentExt, &segment.FirstIndex); err != nil {
+			segment.Err = fmt.Errorf("bad segment name")
+		} else if stale || i > 0 && segment.FirstIndex > next && report.Err == nil {
+			stale, segment.Stale = true, true
+			report.Segments = append(report.Segments, segment)
+			continue
+		} else if i > 0 && segment.FirstIndex != next && report.Err == nil {
+			segment.Err = fmt.Errorf("should start at index %d", next)
+		} else {
+			scan := scanWALSegment(data, segment.FirstIndex)
+			segment.Records, segment.ValidSize = len(scan.positions), scan.validSize
+			segment.Err, segment.Torn = scan.err, scan.err != nil && scan.torn && i == len(names)-1
+		}
+		report.Segments = append(report.Segments, segment)
+
+		if report.Err != nil {
+			continue // Keep describing segments, but the log ended earlier
+		}
+		report.Entries += segment.Records
+		next = segment.FirstIndex + segment.Records
+		if segment.Err != nil && !segment.Torn {
+			report.Err = &WALCorruptionError{Segment: filepath.Join(dir, name), Offset: segment.ValidSize, Index: next, Err: segment.Err}
+		}
+	}
+	return report, nil
+}
+
+// RepairWAL makes the WAL in dir openable again. A torn tail is truncated, as
+// OpenWAL would do. Corruption in the middle is only repaired if discard is
+// set, by cutting the log at the first bad record; the entries after it are
+// lost, and if they were committed and this node is needed for a majority
+// that has them, they are lost to the cluster too.
+func RepairWAL(dir string, discard bool) (*WALReport, error) {
+	report, err := VerifyWAL(dir)
+	if err != nil {
+		return nil, err
+	}
+	if report.Err != nil && !discard {
+		return report, report.Err
+	}
+
+	// Cut the log at the first problem, dropping any segments after it
+	cut := false
+	for _, segment := range report.Segments {
+		path := filepath.Join(dir, segment.Name)
+		if segment.Stale {
+			walLogger.Warn("removing segment left by an interrupted truncation", "segment", path)
+			if err := os.Remove(path); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if cut {
+			walLogger.Warn("removing segment after corruption", "segment", path)
+			if err := os.Remove(path); err != nil {
+				return report, err
+			}
+			continue
+		}
+		if segment.Err != nil {
+			walLogger.Warn("truncating segment", "segment", path, "offset", segment.ValidSize, "bytes", segment.Size-segment.ValidSize, "err", segment.Err)
+			if segment.ValidSize == 0 {
+				err = os.Remove(path)
+			} else {
+				err = os.Truncate(path, segment.ValidSize)
+			}
+			if err != nil {
+				return report, err
+			}
+			cut = true
+		}
+	}
+	return report, syncDir(dir)
+}
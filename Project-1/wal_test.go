@@ -0,0 +1,381 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func walTestEntries(from, to int, term int) []LogEntry {
+	var entries []LogEntry
+	for i := from; i < to; i++ {
+		entries = append(entries, LogEntry{Command: []byte(fmt.Sprintf("Set X = %d", i)), Term: term})
+	}
+	return entries
+}
+
+func checkWALEntries(t *testing.T, wal *WAL, want []LogEntry) {
+	t.Helper()
+	got, err := wal.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("log is %v, want %v", got, want)
+	}
+}
+
+func TestWALAppendTruncateReopen(t *testing.T) {
+	dir := t.TempDir()
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatched, SyncNone} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := filepath.Join(dir, policy.String())
+			wal, err := OpenWAL(dir, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := walTestEntries(0, 10, 1)
+			if err := wal.Append(0, want); err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Append(20, want); err == nil {
+				t.Fatal("appending past the end should fail")
+			}
+
+			// A conflicting leader overwrites the tail
+			want = append(want[:6], walTestEntries(6, 8, 2)...)
+			if err := wal.Append(6, want[6:]); err != nil {
+				t.Fatal(err)
+			}
+			checkWALEntries(t, wal, want)
+			if entry, err := wal.Entry(7); err != nil || !reflect.DeepEqual(entry, want[7]) {
+				t.Fatalf("Entry(7) = %v, %v; want %v", entry, err, want[7])
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			wal, err = OpenWAL(dir, policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			checkWALEntries(t, wal, want)
+			if err := wal.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			checkWALEntries(t, wal, []LogEntry{})
+		})
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, SyncNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries big enough that a few of them fill a segment
+	big := make([]byte, WALSegmentSize/3)
+	var want []LogEntry
+	for i := 0; i < 10; i++ {
+		want = append(want, LogEntry{Command: []byte(fmt.Sprintf("%d%s", i, big)), Term: 1})
+	}
+	if err := wal.Append(0, want); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(wal.segments))
+	}
+
+	// Truncating into the first segment removes the others
+	want = want[:2]
+	if err := wal.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.segments) != 1 {
+		t.Fatalf("expected 1 segment after truncation, got %d", len(wal.segments))
+	}
+	wal.Close()
+
+	wal, err = OpenWAL(dir, SyncNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	checkWALEntries(t, wal, want)
+}
+
+// A crash partway through a truncation leaves the segment being cut short
+// and only some of the later ones removed; reopening finishes the job.
+func TestWALTruncateInterrupted(t *testing.T) {
+	big := make([]byte, WALSegmentSize/3)
+	var entries []LogEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, LogEntry{Command: []byte(fmt.Sprintf("%d%s", i, big)), Term: 1})
+	}
+
+	tests := []struct {
+		name    string
+		index   int  // Truncate(index) was under way
+		cut     bool // The segment index is in was cut short before the crash
+		removed int  // Later segments removed before the crash, from the last one
+		want    int  // Entries left after reopening
+	}{
+		{"nothing removed yet", 4, true, 0, 4},
+		{"last segment removed", 4, true, 1, 4},
+		{"cut not durable yet", 4, false, 1, 9},
+		{"at a segment boundary", 6, false, 1, 9},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, err := OpenWAL(dir, SyncNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Append(0, entries); err != nil {
+				t.Fatal(err)
+			}
+			position := wal.positions[test.index]
+			var later []string
+			for _, segment := range wal.segments {
+				if segment.firstIndex > position.segment.firstIndex || segment.firstIndex == test.index {
+					later = append(later, segment.file.Name())
+				}
+			}
+			kept := position.segment.file.Name()
+			wal.Close()
+
+			if test.cut {
+				if err := os.Truncate(kept, position.offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range later[len(later)-test.removed:] {
+				if err := os.Remove(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := VerifyWAL(dir)
+			if err != nil || report.Err != nil || report.Entries != test.want {
+				t.Fatalf("VerifyWAL: %+v, %v; want %d entries", report, err, test.want)
+			}
+
+			wal, err = OpenWAL(dir, SyncNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWALEntries(t, wal, entries[:test.want])
+
+			// The log carries on from there, and reopens the same
+			more := walTestEntries(test.want, test.want+2, 2)
+			if err := wal.Append(test.want, more); err != nil {
+				t.Fatal(err)
+			}
+			wal.Close()
+			wal, err = OpenWAL(dir, SyncNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			checkWALEntries(t, wal, append(entries[:test.want:test.want], more...))
+		})
+	}
+}
+
+// Compacting drops whole segments before the index, and the log carries on
+// where it was, over reopens, even once it's been emptied.
+func TestWALCompact(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, SyncNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopen := func() {
+		t.Helper()
+		wal.Close()
+		if wal, err = OpenWAL(dir, SyncNone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := make([]byte, WALSegmentSize/3)
+	var entries []LogEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, LogEntry{Command: []byte(fmt.Sprintf("%d%s", i, big)), Term: 1})
+	}
+	if err := wal.Append(0, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	// Index 4 is partway through a later segment, which is kept whole
+	segments := len(wal.segments)
+	first := wal.positions[4].segment.firstIndex
+	if err := wal.Compact(4); err != nil {
+		t.Fatal(err)
+	}
+	if wal.First() != first || first == 0 || len(wal.segments) >= segments {
+		t.Fatalf("after Compact(4): first %d, %d of %d segments left", wal.First(), len(wal.segments), segments)
+	}
+	reopen()
+	if wal.First() != first || wal.Len() != 10 {
+		t.Fatalf("reopened: first %d, len %d", wal.First(), wal.Len())
+	}
+	checkWALEntries(t, wal, entries[first:])
+	if err := wal.Append(first-1, entries[first-1:]); err == nil {
+		t.Fatal("appending before the first entry should fail")
+	}
+
+	// Past the end, everything goes; appends carry on from there
+	if err := wal.Compact(12); err != nil {
+		t.Fatal(err)
+	}
+	if wal.First() != 12 || wal.Len() != 12 || len(wal.segments) != 0 {
+		t.Fatalf("after Compact(12): first %d, len %d, %d segments", wal.First(), wal.Len(), len(wal.segments))
+	}
+	more := walTestEntries(12, 15, 2)
+	if err := wal.Append(12, more); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	defer wal.Close()
+	if wal.First() != 12 {
+		t.Fatalf("reopened: first %d", wal.First())
+	}
+	checkWALEntries(t, wal, more)
+}
+
+// writeTestWAL writes n entries to a fresh WAL in dir and returns them along
+// with the path of its (only) segment.
+func writeTestWAL(t *testing.T, dir string, n int) ([]LogEntry, string) {
+	t.Helper()
+	wal, err := OpenWAL(dir, SyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := walTestEntries(0, n, 1)
+	if err := wal.Append(0, entries); err != nil {
+		t.Fatal(err)
+	}
+	path := wal.positions[0].segment.file.Name()
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return entries, path
+}
+
+// recordOffset returns where the record for index starts in a test WAL's segment.
+func recordOffset(t *testing.T, path string, index int) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scanWALSegment(data, 0).positions[index].offset
+}
+
+func flipBit(t *testing.T, path string, offset int64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0x10
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		damage func(t *testing.T, path string)
+	}{
+		{"truncated header", func(t *testing.T, path string) {
+			os.Truncate(path, recordOffset(t, path, 9)+3)
+		}},
+		{"truncated payload", func(t *testing.T, path string) {
+			stat, _ := os.Stat(path)
+			os.Truncate(path, stat.Size()-5)
+		}},
+		{"bit flipped in last record", func(t *testing.T, path string) {
+			flipBit(t, path, recordOffset(t, path, 9)+walHeaderSize+10)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries, path := writeTestWAL(t, dir, 10)
+			tc.damage(t, path)
+
+			report, err := VerifyWAL(dir)
+			if err != nil || report.Err != nil || !report.Segments[0].Torn {
+				t.Fatalf("VerifyWAL should report a torn tail, got %+v, %v", report, err)
+			}
+
+			wal, err := OpenWAL(dir, SyncAlways)
+			if err != nil {
+				t.Fatalf("OpenWAL should truncate a torn tail, got %v", err)
+			}
+			defer wal.Close()
+			checkWALEntries(t, wal, entries[:9])
+
+			// And the log carries on from there
+			if err := wal.Append(9, entries[9:]); err != nil {
+				t.Fatal(err)
+			}
+			checkWALEntries(t, wal, entries)
+		})
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		offset func(t *testing.T, path string) int64
+	}{
+		{"bit flipped in payload", func(t *testing.T, path string) int64 {
+			return recordOffset(t, path, 4) + walHeaderSize + 10
+		}},
+		{"bit flipped in checksum", func(t *testing.T, path string) int64 {
+			return recordOffset(t, path, 4) + 5
+		}},
+		{"bit flipped in length", func(t *testing.T, path string) int64 {
+			return recordOffset(t, path, 4) + 2 // Makes the record look much longer than it is
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entries, path := writeTestWAL(t, dir, 10)
+			flipBit(t, path, tc.offset(t, path))
+
+			var corruption *WALCorruptionError
+			if _, err := OpenWAL(dir, SyncAlways); !errors.As(err, &corruption) || corruption.Index != 4 {
+				t.Fatalf("OpenWAL should refuse a corrupt record at index 4, got %v", err)
+			}
+
+			report, err := VerifyWAL(dir)
+			if err != nil || !errors.As(report.Err, &corruption) || report.Entries != 4 {
+				t.Fatalf("VerifyWAL should report corruption after 4 entries, got %+v, %v", report, err)
+			}
+			if _, err := RepairWAL(dir, false); err == nil {
+				t.Fatal("RepairWAL shouldn't discard entries without being told to")
+			}
+			if _, err := OpenWAL(dir, SyncAlways); err == nil {
+				t.Fatal("a refused repair shouldn't change the WAL")
+			}
+
+			if _, err := RepairWAL(dir, true); err != nil {
+				t.Fatal(err)
+			}
+			wal, err := OpenWAL(dir, SyncAlways)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			checkWALEntries(t, wal, entries[:4])
+		})
+	}
+}
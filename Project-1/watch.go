@@ -0,0 +1,170 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of WatchEvent.
+const (
+	WatchPut    = "Put"
+	WatchDelete = "Delete"
+)
+
+// WatchHistoryLimit bounds the events a node keeps for watchers to catch up
+// on: once there are twice as many, the oldest are compacted away down to
+// that many.
+const WatchHistoryLimit = 10000
+
+var ErrCompacted = errors.New("raft: the watch revision has been compacted")
+
+// WatchEvent is a change to a key, made by the log entry at index Revision.
+// Value is the key's value after the change; "" for a Delete.
+type WatchEvent struct {
+	Revision int
+	Type     string
+	Key      string
+	Value    string
+}
+
+// Watchable is implemented by state machines whose changes can be watched:
+// Apply reports every change it makes to hub. Nodes hand their hub to
+// their state machine when it's Watchable.
+type Watchable interface {
+	SetWatchHub(hub *WatchHub)
+}
+
+// WatchHub keeps the changes a node's state machine has made, as reported by
+// it from the apply loop, for watchers to read in revision order. They're
+// kept until the node takes or installs a snapshot covering them, the state
+// machine compacts its own history past them (see KVCompact), or there are
+// more than limit newer ones.
+type WatchHub struct {
+	mu        sync.Mutex
+	changed   chan struct{} // Closed, and replaced, whenever revision moves on
+	events    []WatchEvent  // Those above compacted, oldest first
+	revision  int           // Of the last entry applied
+	compacted int           // Events at or below this revision may be gone
+	limit     int           // WatchHistoryLimit, but for tests
+}
+
+func NewWatchHub() *WatchHub {
+	return &WatchHub{changed: make(chan struct{}), revision: -1, compacted: -1, limit: WatchHistoryLimit}
+}
+
+// publish records event, made by the entry being applied. Called from Apply,
+// so never blocks.
+func (this *WatchHub) publish(event WatchEvent) {
+	if this == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.events = append(this.events, event)
+	if len(this.events) > 2*this.limit {
+		// Not past the entries applied, whose events are all in; an entry
+		// with more events than that keeps them until the next one
+		dropped := len(this.events) - this.limit
+		this.compactLocked(min(this.events[dropped-1].Revision, this.revision))
+	}
+}
+
+// applied makes the events of the entries up to revision visible to watchers.
+func (this *WatchHub) applied(revision int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if revision > this.revision {
+		this.revision = revision
+		close(this.changed)
+		this.changed = make(chan struct{})
+	}
+}
+
+// Compact drops the events at or below revision; watchers asking for them
+// get ErrCompacted.
+func (this *WatchHub) Compact(revision int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.compactLocked(revision)
+}
+
+func (this *WatchHub) compactLocked(revision int) {
+	if revision <= this.compacted {
+		return
+	}
+	this.compacted = revision
+	kept := 0
+	for kept < len(this.events) && this.events[kept].Revision <= revision {
+		kept++
+	}
+	this.events = append([]WatchEvent(nil), this.events[kept:]...)
+}
+
+// Revision returns the revision of the last entry applied, or -1.
+func (this *WatchHub) Revision() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.revision
+}
+
+// Events waits until there are events at or after revision from for key, or
+// for every key starting with it if prefix, and returns them, oldest first,
+// with the revision to ask from next. It returns up to max events, unless max
+// is 0, but never splits up those of one entry. It returns no events if ctx
+// ends first, and ErrCompacted if some from revision from on may have been
+// compacted away. A from of -1 means from the next entry applied.
+func (this *WatchHub) Events(ctx context.Context, key string, prefix bool, from int, max int) ([]WatchEvent, int, error) {
+	this.mu.Lock()
+	if from < 0 {
+		from = this.revision + 1
+	}
+	for {
+		if from <= this.compacted {
+			this.mu.Unlock()
+			return nil, from, ErrCompacted
+		}
+
+		var events []WatchEvent
+		next := this.revision + 1
+		if from > next {
+			next = from
+		}
+		for _, event := range this.events {
+			if event.Revision < from || event.Revision > this.revision {
+				continue
+			}
+			if max > 0 && len(events) >= max && event.Revision > events[len(events)-1].Revision {
+				next = event.Revision // The events of one entry are never split up
+				break
+			}
+			if event.Key == key || prefix && strings.HasPrefix(event.Key, key) {
+				events = append(events, event)
+			}
+		}
+		if len(events) > 0 {
+			this.mu.Unlock()
+			return events, next, nil
+		}
+		from = next // Nothing for this watcher up to here
+
+		changed := this.changed
+		this.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, from, nil
+		}
+		this.mu.Lock()
+	}
+}
+
+// WatchEvents is WatchHub.Events on the node's hub, waiting for no longer
+// than wait.
+func (this *RaftNode) WatchEvents(key string, prefix bool, from int, max int, wait time.Duration) ([]WatchEvent, int, error) {
+	ctx, cancel := context.WithTimeout(this.ctx, wait)
+	defer cancel()
+	return this.watches.Events(ctx, key, prefix, from, max)
+}
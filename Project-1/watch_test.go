@@ -0,0 +1,171 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchHub(t *testing.T) {
+	hub := NewWatchHub()
+	ctx := context.Background()
+	hub.publish(WatchEvent{Revision: 0, Type: WatchPut, Key: "a/1", Value: "x"})
+	hub.publish(WatchEvent{Revision: 0, Type: WatchPut, Key: "a/2", Value: "y"})
+	hub.applied(0)
+	hub.applied(1) // Changed nothing
+	hub.publish(WatchEvent{Revision: 2, Type: WatchPut, Key: "b", Value: "z"})
+	hub.applied(2)
+
+	events, next, err := hub.Events(ctx, "a/", true, 0, 1)
+	if err != nil || next != 2 || len(events) != 2 {
+		t.Fatalf("prefix a/ with max 1: got %v, %d, %v; want revision 0's two events, next 2", events, next, err)
+	}
+	// Nothing for a/ after revision 0 yet; wait for the next change
+	waited := make(chan []WatchEvent)
+	go func() {
+		events, _, _ := hub.Events(ctx, "a/", true, next, 0)
+		waited <- events
+	}()
+	hub.publish(WatchEvent{Revision: 3, Type: WatchDelete, Key: "a/1"})
+	hub.applied(3)
+	if events := <-waited; !reflect.DeepEqual(events, []WatchEvent{{Revision: 3, Type: WatchDelete, Key: "a/1"}}) {
+		t.Fatalf("after waiting: got %v", events)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if events, _, _ := hub.Events(timeout, "a", false, 0, 0); events != nil {
+		t.Fatalf("key a matched %v", events)
+	}
+	if events, next, err := hub.Events(timeout, "b", false, 3, 0); events != nil || next != 4 || err != nil {
+		t.Fatalf("watch that times out: got %v, %d, %v", events, next, err)
+	}
+
+	hub.Compact(2)
+	if _, _, err := hub.Events(ctx, "b", false, 2, 0); err != ErrCompacted {
+		t.Fatalf("watch from a compacted revision: got %v", err)
+	}
+	if events, _, err := hub.Events(ctx, "a/", true, 3, 0); err != nil || len(events) != 1 {
+		t.Fatalf("watch from after the compaction: got %v, %v", events, err)
+	}
+}
+
+// The oldest events are compacted away once there are too many, but never
+// those of an entry that's still being applied.
+func TestWatchHistoryLimit(t *testing.T) {
+	hub := NewWatchHub()
+	hub.limit = 4
+	ctx := context.Background()
+	for revision := 0; revision < 9; revision++ {
+		hub.publish(WatchEvent{Revision: revision, Type: WatchPut, Key: "a", Value: fmt.Sprint(revision)})
+		hub.applied(revision)
+	}
+	// The 9th event made 2*limit+1; all but the last 4 went
+	if _, _, err := hub.Events(ctx, "a", false, 4, 0); err != ErrCompacted {
+		t.Fatalf("watch from a revision past the limit: got %v", err)
+	}
+	if events, next, err := hub.Events(ctx, "a", false, 5, 0); err != nil || len(events) != 4 || next != 9 {
+		t.Fatalf("watch from the oldest revision kept: got %v, %d, %v", events, next, err)
+	}
+
+	// One entry with more events than that keeps them all until it's applied
+	for i := 0; i < 10; i++ {
+		hub.publish(WatchEvent{Revision: 9, Type: WatchPut, Key: fmt.Sprint("b", i)})
+	}
+	hub.applied(9)
+	if events, _, err := hub.Events(ctx, "b", true, 9, 0); err != nil || len(events) != 10 {
+		t.Fatalf("events of a large entry: got %d, %v", len(events), err)
+	}
+}
+
+func TestWatchAcrossNodes(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	var leader int
+	for leader = -1; leader < 0; sleepMs(100) {
+		leader = cluster.GroupLeader(DefaultGroup)
+	}
+	follower := (leader + 1) % 3
+	from := cluster.getServers()[follower].Group(DefaultGroup).watches.Revision() + 1
+
+	for _, cmd := range []KVCommand{
+		{Op: KVPut, Key: "a/1", Value: "x"},
+		{Op: KVPut, Key: "b", Value: "y"},
+		{Op: KVAppend, Key: "a/1", Value: "z"},
+		{Op: KVDelete, Key: "a/1"},
+	} {
+		if _, err := cluster.ExecuteGroupCommand(leader, DefaultGroup, cmd, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every node sees the same changes at the same revisions; a watcher can
+	// move from one to another where it left off
+	var seen [][]WatchEvent
+	for _, id := range []int{follower, leader} {
+		var events []WatchEvent
+		for next := from; len(events) < 3; {
+			more, after, err := cluster.getServers()[id].Group(DefaultGroup).WatchEvents("a/", true, next, 1, 5*time.Second)
+			if err != nil || len(more) == 0 {
+				t.Fatalf("node %d from %d: %v, %v", id, next, more, err)
+			}
+			events, next = append(events, more...), after
+		}
+		seen = append(seen, events)
+	}
+	if !reflect.DeepEqual(seen[0], seen[1]) {
+		t.Fatalf("follower saw %v, leader %v", seen[0], seen[1])
+	}
+	events := seen[0]
+	if events[0].Value != "x" || events[1].Value != "xz" || events[2].Type != WatchDelete || events[0].Revision < from ||
+		!(events[0].Revision < events[1].Revision && events[1].Revision < events[2].Revision) {
+		t.Fatalf("events: %v", events)
+	}
+
+}
+
+// A node's watchers lose the changes a KVCompact drops from the store, and
+// those its snapshot covers, and nothing after them.
+func TestWatchCompacted(t *testing.T) {
+	cluster := NewCluster(t, 3)
+	defer cluster.Shutdown()
+	leader := cluster.getClusterLeader()
+	node := cluster.getServers()[leader].raftLogic
+	var revisions []int
+	for i := 0; i < 4; i++ {
+		if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "a", Value: fmt.Sprint(i)}, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, node.watches.Revision())
+	}
+	checkCompacted := func(compacted int, kept int) {
+		t.Helper()
+		if _, _, err := node.WatchEvents("a", false, compacted, 0, time.Second); err != ErrCompacted {
+			t.Fatalf("watch from revision %d: got %v, want ErrCompacted", compacted, err)
+		}
+		if events, _, err := node.WatchEvents("a", false, kept, 1, time.Second); err != nil || len(events) != 1 || events[0].Revision != kept {
+			t.Fatalf("watch from revision %d: got %v, %v", kept, events, err)
+		}
+	}
+
+	// Nothing is compacted until something says so
+	if events, _, err := node.WatchEvents("a", false, revisions[0], 0, time.Second); err != nil || len(events) != 4 {
+		t.Fatalf("watch from the first put: got %v, %v", events, err)
+	}
+	if _, err := cluster.ExecuteClientCommand(leader, KVCompact{Revision: revisions[1]}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCompacted(revisions[0], revisions[1])
+
+	// Every node snapshots all of it, the compaction entry included
+	snapshot := snapshotAllBut(t, cluster, leader, -1)
+	if _, err := cluster.ExecuteClientCommand(leader, KVCommand{Op: KVPut, Key: "a", Value: "4"}, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCompacted(revisions[3], node.watches.Revision())
+	if _, _, err := node.WatchEvents("a", false, snapshot, 0, time.Second); err != ErrCompacted {
+		t.Fatalf("watch from the snapshot's last entry: got %v", err)
+	}
+}